@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+// accessLists holds the client ranges that skip rate limiting (allow) and
+// the ones refused outright (deny). Deny wins when a client is on both. The
+// lists can be swapped while requests are being served.
+type accessLists struct {
+	lists atomic.Pointer[accessListSet]
+}
+
+type accessListSet struct {
+	Allow []netip.Prefix `json:"allow"`
+	Deny  []netip.Prefix `json:"deny"`
+}
+
+func newAccessLists(allow, deny []netip.Prefix) *accessLists {
+	l := &accessLists{}
+	l.lists.Store(&accessListSet{Allow: allow, Deny: deny})
+	return l
+}
+
+func (l *accessLists) get() accessListSet {
+	return *l.lists.Load()
+}
+
+func (l *accessLists) set(set accessListSet) {
+	l.lists.Store(&set)
+}
+
+// loadFile replaces the lists with the ones in a JSON file of the form
+// {"allow": ["10.0.0.0/8"], "deny": ["2001:db8::/32"]}. Single addresses are
+// accepted in place of ranges.
+func (l *accessLists) loadFile(name string) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	set, err := parseAccessLists(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	l.set(set)
+	return nil
+}
+
+func parseAccessLists(data []byte) (accessListSet, error) {
+	var raw struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return accessListSet{}, err
+	}
+	var set accessListSet
+	for _, list := range []struct {
+		entries []string
+		into    *[]netip.Prefix
+	}{{raw.Allow, &set.Allow}, {raw.Deny, &set.Deny}} {
+		for _, v := range list.entries {
+			prefix, err := parsePrefix(v)
+			if err != nil {
+				return accessListSet{}, fmt.Errorf("invalid range %q: %v", v, err)
+			}
+			*list.into = append(*list.into, prefix)
+		}
+	}
+	return set, nil
+}
+
+// reloadOnHangup reloads the lists from name on every SIGHUP until ctx is
+// done. A file that fails to load leaves the current lists in place.
+func reloadOnHangup(ctx context.Context, lists *accessLists, name string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			if err := lists.loadFile(name); err != nil {
+				fmt.Println("Error reloading rate limit lists :", err)
+				continue
+			}
+			fmt.Println("Reloaded rate limit lists from", name)
+		}
+	}
+}
+
+type rateLimitExemptKey struct{}
+
+// rateLimitExempt reports whether r was let through every rate limiter.
+func rateLimitExempt(r *http.Request) bool {
+	exempt, _ := r.Context().Value(rateLimitExemptKey{}).(bool)
+	return exempt
+}
+
+// exemptFromRateLimit returns r marked as exempt from every rate limiter.
+func exemptFromRateLimit(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), rateLimitExemptKey{}, true))
+}
+
+// accessListMiddleware refuses denied clients with a 403 and marks allowed
+// ones as exempt from rate limiting. It must run after clientIPMiddleware.
+func accessListMiddleware(next http.Handler, lists *accessLists) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := getIP(r)
+		if !ip.IsValid() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		set := lists.get()
+		if inPrefixes(ip, set.Deny) {
+			writeError(w, http.StatusForbidden, apiError{Code: "ip_denied"})
+			return
+		}
+		if inPrefixes(ip, set.Allow) {
+			r = exemptFromRateLimit(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// accessListsHandler serves the current lists on GET and replaces them on
+// PUT, with a body in the format loadFile reads. Lists set this way last
+// until the next restart or reload of the lists file.
+func accessListsHandler(lists *accessLists) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			writeJSON(w, http.StatusOK, lists.get())
+		case http.MethodPut:
+			data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			set, err := parseAccessLists(data)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			lists.set(set)
+			logf(r.Context(), "Rate limit access lists replaced by %s", getIP(r))
+			writeJSON(w, http.StatusOK, set)
+		}
+	}
+}
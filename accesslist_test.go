@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestParseAccessLists(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		wantAllow int
+		wantDeny  int
+		wantErr   bool
+	}{
+		{name: "ranges", data: `{"allow": ["10.0.0.0/8"], "deny": ["2001:db8::/32"]}`, wantAllow: 1, wantDeny: 1},
+		{name: "single addresses", data: `{"allow": ["192.0.2.1", "2001:db8::1"]}`, wantAllow: 2},
+		{name: "empty", data: `{}`},
+		{name: "bad range", data: `{"deny": ["10.0.0.0/99"]}`, wantErr: true},
+		{name: "not JSON", data: `allow 10.0.0.0/8`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			set, err := parseAccessLists([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseAccessLists() error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(set.Allow) != tt.wantAllow || len(set.Deny) != tt.wantDeny {
+				t.Errorf("parseAccessLists() = %d allowed, %d denied, want %d, %d", len(set.Allow), len(set.Deny), tt.wantAllow, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func TestAccessListMiddleware(t *testing.T) {
+	lists := newAccessLists(
+		[]netip.Prefix{netip.MustParsePrefix("192.0.2.0/24"), netip.MustParsePrefix("198.51.100.7/32")},
+		[]netip.Prefix{netip.MustParsePrefix("198.51.100.0/24")},
+	)
+	tests := []struct {
+		name       string
+		remoteAddr string
+		wantStatus int
+		wantExempt bool
+	}{
+		{name: "allowed", remoteAddr: "192.0.2.1:1234", wantStatus: http.StatusOK, wantExempt: true},
+		{name: "denied", remoteAddr: "198.51.100.1:1234", wantStatus: http.StatusForbidden},
+		{name: "on both lists", remoteAddr: "198.51.100.7:1234", wantStatus: http.StatusForbidden},
+		{name: "on neither", remoteAddr: "203.0.113.1:1234", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exempt := false
+			h := clientIPMiddleware(accessListMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				exempt = rateLimitExempt(r)
+			}), lists), nil, defaultIPv6PrefixBits)
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			r.RemoteAddr = tt.remoteAddr
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if exempt != tt.wantExempt {
+				t.Errorf("exempt = %v, want %v", exempt, tt.wantExempt)
+			}
+		})
+	}
+}
+
+func TestAccessListsHandlerPut(t *testing.T) {
+	lists := newAccessLists(nil, nil)
+	h := accessListsHandler(lists)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPut, "/ratelimit/lists", strings.NewReader(`{"deny": ["192.0.2.0/24"]}`)))
+	if rec.Code != http.StatusOK || len(lists.get().Deny) != 1 {
+		t.Fatalf("PUT got %d and left %v", rec.Code, lists.get())
+	}
+	rec = httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPut, "/ratelimit/lists", strings.NewReader(`{"deny": ["nonsense"]}`)))
+	if rec.Code != http.StatusBadRequest || len(lists.get().Deny) != 1 {
+		t.Errorf("invalid PUT got %d and left %v, want 400 and the lists unchanged", rec.Code, lists.get())
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// adminToken returns the admin token r carries, in the X-Admin-Token header
+// or as a bearer token.
+func adminToken(r *http.Request) string {
+	if token := r.Header.Get("X-Admin-Token"); token != "" {
+		return token
+	}
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+// isAdmin reports whether r carries the configured admin token. An empty
+// token never matches.
+func isAdmin(r *http.Request, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(adminToken(r)), []byte(token)) == 1
+}
+
+// adminAuth is how the admin routes authenticate their callers: by the
+// admin token and, with requireCert, also by a client certificate, which
+// the TLS configuration verifies against ADMIN_CLIENT_CA_FILE. An empty
+// token disables the routes.
+type adminAuth struct {
+	token       string
+	requireCert bool
+}
+
+// authenticate returns who made r, or the status and error code r is
+// refused with: 401 without a token, 403 with a wrong one or without a
+// verified client certificate when one is required.
+func (a adminAuth) authenticate(r *http.Request) (who string, status int, code string) {
+	if adminToken(r) == "" {
+		return "", http.StatusUnauthorized, "admin_token_required"
+	}
+	if !isAdmin(r, a.token) {
+		return "", http.StatusForbidden, "admin_token_invalid"
+	}
+	if !a.requireCert {
+		return "token", 0, ""
+	}
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return "", http.StatusForbidden, "admin_certificate_required"
+	}
+	return "cert:" + r.TLS.VerifiedChains[0][0].Subject.CommonName, 0, ""
+}
+
+// adminMiddleware authenticates the requests for next, the admin routes,
+// before they are routed, so that a refused request is answered the same
+// whichever path it names. Every request is written to the audit log, with
+// who made it, what it asked for, when, from where and how it was answered.
+func adminMiddleware(next http.Handler, auth adminAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		who, status, code := auth.authenticate(r)
+		if status != 0 {
+			auditf(r, "-", status)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeError(w, status, apiError{Code: code})
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		auditf(r, who, rec.status)
+	})
+}
+
+// auditf writes the admin request r, made by who and answered with status,
+// to the audit log.
+func auditf(r *http.Request, who string, status int) {
+	client := "unknown"
+	if ip := getIP(r); ip.IsValid() {
+		client = ip.String()
+	}
+	logf(r.Context(), "Audit admin=%s action=%q client=%s status=%d time=%s", who, r.Method+" "+auditedURI(r.URL), client, status, time.Now().UTC().Format(time.RFC3339))
+}
+
+// auditedURI is the request URI of u as the audit log shows it, with the API
+// key that DELETE /admin/apikeys?key=K revokes redacted.
+func auditedURI(u *url.URL) string {
+	q := u.Query()
+	if !q.Has("key") {
+		return u.RequestURI()
+	}
+	q.Set("key", "redacted")
+	redacted := *u
+	redacted.RawQuery = q.Encode()
+	return redacted.RequestURI()
+}
+
+// secretConfigFields are the fields of Config the config dump does not show
+// the values of.
+var secretConfigFields = []string{"AdminToken", "RedisPassword", "APIKeyTiers"}
+
+// configDump returns the fields of cfg by name, for GET /admin/config.
+// Durations and locations are spelled out and secrets are redacted.
+func configDump(cfg Config) map[string]any {
+	v := reflect.ValueOf(cfg)
+	dump := make(map[string]any, v.NumField())
+	for i := range v.NumField() {
+		name, field := v.Type().Field(i).Name, v.Field(i)
+		if slices.Contains(secretConfigFields, name) {
+			dump[name] = ""
+			if !field.IsZero() {
+				dump[name] = "redacted"
+			}
+			continue
+		}
+		switch value := field.Interface().(type) {
+		case time.Duration:
+			dump[name] = value.String()
+		case *time.Location:
+			dump[name] = value.String()
+		case ttlPolicy:
+			ttls := make(map[string]string, len(value))
+			for typ, ttl := range value {
+				ttls[string(typ)] = ttl.String()
+			}
+			dump[name] = ttls
+		default:
+			dump[name] = value
+		}
+	}
+	return dump
+}
+
+// configHandler serves the configuration the server runs with.
+func configHandler(cfg Config) http.HandlerFunc {
+	dump := configDump(cfg)
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, dump)
+	}
+}
+
+// cacheHandler purges cached locations. DELETE /admin/cache?country=X
+// removes a single location, DELETE /admin/cache?pattern=X removes every
+// location matching the Redis glob pattern.
+func cacheHandler(cache *tieredCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		country := r.URL.Query().Get("country")
+		pattern := r.URL.Query().Get("pattern")
+		if (country == "") == (pattern == "") {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "Exactly one of country or pattern is required"})
+			return
+		}
+
+		// Both forms remove every cached variant (units, language, range) of
+		// the matching locations.
+		match := locationPattern(pattern)
+		if country != "" {
+			match = locationPattern(escapeGlob(normalizeKey(country)))
+		}
+		deleted, err := cache.DeleteMatching(r.Context(), match)
+		if err == errPatternDeleteUnsupported {
+			writeError(w, http.StatusNotImplemented, apiError{Code: "not_implemented", Message: "The cache backend cannot delete entries, they expire after their TTL"})
+			return
+		}
+		if err != nil {
+			logf(r.Context(), "Error deleting value from cache : %v", err)
+			writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error deleting value from cache"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]int64{"deleted": deleted})
+	}
+}
+
+// cacheKeyInfo is an entry of the GET /admin/cache/keys listing.
+type cacheKeyInfo struct {
+	Key        string     `json:"key"`
+	Location   string     `json:"location,omitempty"`
+	Units      string     `json:"units,omitempty"`
+	Lang       string     `json:"lang,omitempty"`
+	Range      string     `json:"range,omitempty"`
+	TTLSeconds int64      `json:"ttlSeconds"`
+	SizeBytes  int64      `json:"sizeBytes,omitempty"`
+	FetchedAt  *time.Time `json:"fetchedAt,omitempty"`
+}
+
+// maxKeysPageSize bounds the count parameter of GET /admin/cache/keys.
+const maxKeysPageSize = 1000
+
+// cacheKeysHandler lists cached entries a page at a time. GET
+// /cache/keys?cursor=X&count=N returns about N keys and the cursor of the
+// next page, which is absent on the last one. count is a hint, as with SCAN,
+// so a page can hold more or fewer keys, even none.
+func cacheKeysHandler(cache *tieredCache) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		lister, ok := cache.backend.(keyLister)
+		if !ok {
+			writeError(w, http.StatusNotImplemented, apiError{Code: "not_implemented", Message: errKeyListUnsupported.Error()})
+			return
+		}
+		var cursor uint64
+		if v := r.URL.Query().Get("cursor"); v != "" {
+			var err error
+			if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "cursor must be a cursor returned by a previous page"})
+				return
+			}
+		}
+		count := int64(100)
+		if v := r.URL.Query().Get("count"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n <= 0 || n > maxKeysPageSize {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: fmt.Sprintf("count must be between 1 and %d", maxKeysPageSize)})
+				return
+			}
+			count = n
+		}
+
+		keys, next, err := lister.ListKeys(r.Context(), cacheKeyPrefix+"*", cursor, count)
+		if err == errKeyListUnsupported {
+			writeError(w, http.StatusNotImplemented, apiError{Code: "not_implemented", Message: err.Error()})
+			return
+		}
+		if err != nil {
+			logf(r.Context(), "Error listing cache keys : %v", err)
+			writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error listing cache keys"})
+			return
+		}
+		resp := struct {
+			Keys       []cacheKeyInfo `json:"keys"`
+			NextCursor string         `json:"nextCursor,omitempty"`
+		}{Keys: make([]cacheKeyInfo, 0, len(keys))}
+		for _, key := range keys {
+			info := cacheKeyInfo{Key: key.Key, TTLSeconds: int64(key.TTL / time.Second), SizeBytes: key.Size}
+			if q, ok := parseCacheKey(key.Key); ok {
+				info.Location, info.Units, info.Lang, info.Range = q.Location, q.Units, q.Lang, q.Range
+			}
+			if !key.FetchedAt.IsZero() {
+				info.FetchedAt = &key.FetchedAt
+			}
+			resp.Keys = append(resp.Keys, info)
+		}
+		if next != 0 {
+			resp.NextCursor = strconv.FormatUint(next, 10)
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// adminRoutes is an admin mux with a single route, behind auth, as serve
+// registers it.
+func adminRoutes(auth adminAuth) http.Handler {
+	admin := http.NewServeMux()
+	admin.Handle("/admin/cache/stats", allowMethods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]int{"hits": 1})
+	}), http.MethodGet))
+	admin.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, apiError{Code: "not_found"})
+	})
+	mux := http.NewServeMux()
+	mux.Handle("/admin/", adminMiddleware(admin, auth))
+	return clientIPMiddleware(mux, nil, defaultIPv6PrefixBits)
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	h := adminRoutes(adminAuth{token: "secret"})
+	tests := []struct {
+		name       string
+		target     string
+		header     string
+		value      string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "valid token", target: "/admin/cache/stats", header: "X-Admin-Token", value: "secret", wantStatus: http.StatusOK},
+		{name: "bearer token", target: "/admin/cache/stats", header: "Authorization", value: "Bearer secret", wantStatus: http.StatusOK},
+		{name: "wrong token", target: "/admin/cache/stats", header: "X-Admin-Token", value: "guess", wantStatus: http.StatusForbidden, wantCode: "admin_token_invalid"},
+		{name: "wrong bearer token", target: "/admin/cache/stats", header: "Authorization", value: "Bearer guess", wantStatus: http.StatusForbidden, wantCode: "admin_token_invalid"},
+		{name: "missing token", target: "/admin/cache/stats", wantStatus: http.StatusUnauthorized, wantCode: "admin_token_required"},
+		{name: "other scheme", target: "/admin/cache/stats", header: "Authorization", value: "Basic c2VjcmV0", wantStatus: http.StatusUnauthorized, wantCode: "admin_token_required"},
+		{name: "unknown route without token", target: "/admin/nowhere", wantStatus: http.StatusUnauthorized, wantCode: "admin_token_required"},
+		{name: "unknown route with wrong token", target: "/admin/nowhere", header: "X-Admin-Token", value: "guess", wantStatus: http.StatusForbidden, wantCode: "admin_token_invalid"},
+		{name: "unknown route", target: "/admin/nowhere", header: "X-Admin-Token", value: "secret", wantStatus: http.StatusNotFound, wantCode: "not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body["error"].Code; got != tt.wantCode {
+				t.Errorf("code = %q, want %q", got, tt.wantCode)
+			}
+			if got := rec.Header().Get("WWW-Authenticate"); (got != "") != (tt.wantStatus == http.StatusUnauthorized) {
+				t.Errorf("WWW-Authenticate = %q with status %d", got, rec.Code)
+			}
+		})
+	}
+}
+
+func TestAdminMiddlewareDisabled(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+	r.Header.Set("X-Admin-Token", "anything")
+	rec := httptest.NewRecorder()
+	adminRoutes(adminAuth{}).ServeHTTP(rec, r)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d without an admin token configured, want 403", rec.Code)
+	}
+}
+
+func TestAdminMiddlewareClientCert(t *testing.T) {
+	h := adminRoutes(adminAuth{token: "secret", requireCert: true})
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops"}}
+	tests := []struct {
+		name       string
+		state      *tls.ConnectionState
+		wantStatus int
+		wantAdmin  string
+	}{
+		{name: "plain HTTP", wantStatus: http.StatusForbidden, wantAdmin: "-"},
+		{name: "no certificate", state: &tls.ConnectionState{}, wantStatus: http.StatusForbidden, wantAdmin: "-"},
+		{name: "verified certificate", state: &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, wantStatus: http.StatusOK, wantAdmin: "cert:ops"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/admin/cache/stats", nil)
+			r.Header.Set("X-Admin-Token", "secret")
+			r.TLS = tt.state
+			rec := httptest.NewRecorder()
+			out := captureStdout(t, func() { h.ServeHTTP(rec, r) })
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if want := "admin=" + tt.wantAdmin + " "; !strings.Contains(out, want) {
+				t.Errorf("audit log %q does not name %s", out, want)
+			}
+		})
+	}
+}
+
+func TestAdminAuditLog(t *testing.T) {
+	h := requestIDMiddleware(adminRoutes(adminAuth{token: "secret"}))
+	tests := []struct {
+		name   string
+		method string
+		target string
+		token  string
+		want   []string
+		secret string
+	}{
+		{name: "allowed", method: http.MethodGet, target: "/admin/cache/stats?reset=true", token: "secret", want: []string{"Audit admin=token ", `action="GET /admin/cache/stats?reset=true"`, "client=192.0.2.1 ", "status=200 "}},
+		{name: "refused", method: http.MethodGet, target: "/admin/cache/stats?reset=true", token: "guess", want: []string{"Audit admin=- ", `action="GET /admin/cache/stats?reset=true"`, "client=192.0.2.1 ", "status=403 "}},
+		{name: "revoked key", method: http.MethodDelete, target: "/admin/apikeys?key=0123456789abcdef", token: "secret", want: []string{"Audit admin=token ", `action="DELETE /admin/apikeys?key=redacted"`}, secret: "0123456789abcdef"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, nil)
+			r.Header.Set("X-Admin-Token", tt.token)
+			r.Header.Set("X-Request-ID", "audit-1")
+			before := time.Now().UTC().Truncate(time.Second)
+			out := captureStdout(t, func() { h.ServeHTTP(httptest.NewRecorder(), r) })
+			lines := strings.Split(strings.TrimSpace(out), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("logged %q, want one audit line", out)
+			}
+			line := lines[0]
+			for _, want := range append(tt.want, "request_id=audit-1 ") {
+				if !strings.Contains(line, want) {
+					t.Errorf("audit line %q does not contain %q", line, want)
+				}
+			}
+			_, at, _ := strings.Cut(line, " time=")
+			if when, err := time.Parse(time.RFC3339, at); err != nil || when.Before(before) {
+				t.Errorf("audit time = %q, want the time of the request", at)
+			}
+			if strings.Contains(line, tt.token) {
+				t.Errorf("audit line %q contains the token", line)
+			}
+			if tt.secret != "" && strings.Contains(line, tt.secret) {
+				t.Errorf("audit line %q contains the API key", line)
+			}
+		})
+	}
+}
+
+func TestConfigDump(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.AdminToken = "secret"
+	cfg.RedisPassword = "hunter2"
+	cfg.APIKeyTiers = map[string]string{"key-1": "pro"}
+	cfg.CacheTTL = 5 * time.Minute
+	rec := httptest.NewRecorder()
+	configHandler(cfg)(rec, httptest.NewRequest(http.MethodGet, "/admin/config", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	for _, secret := range []string{"secret", "hunter2", "key-1"} {
+		if strings.Contains(rec.Body.String(), secret) {
+			t.Errorf("config dump shows %q", secret)
+		}
+	}
+	var dump map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &dump); err != nil {
+		t.Fatal(err)
+	}
+	if dump["AdminToken"] != "redacted" || dump["RedisUsername"] != cfg.RedisUsername {
+		t.Errorf("AdminToken = %v and RedisUsername = %v", dump["AdminToken"], dump["RedisUsername"])
+	}
+	if dump["CacheTTL"] != "5m0s" {
+		t.Errorf("CacheTTL = %v, want 5m0s", dump["CacheTTL"])
+	}
+}
+
+// TestAdminCacheInvalidation purges single locations and patterns of them
+// from Redis, and checks the next request for them goes to the provider.
+func TestAdminCacheInvalidation(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	lookup, cache, mr := testLookup(t, cfg)
+	admin := http.NewServeMux()
+	admin.Handle("/admin/cache", allowMethods(cacheHandler(cache), http.MethodDelete))
+	mux := http.NewServeMux()
+	mux.Handle("/weather", lookup)
+	mux.Handle("/admin/", adminMiddleware(admin, adminAuth{token: "secret"}))
+
+	for _, location := range []string{"istanbul", "ankara", "antalya"} {
+		if rec := serveGet(mux, "/weather?country="+location); rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d", location, rec.Code)
+		}
+	}
+	purge := func(query, token string) *httptest.ResponseRecorder {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodDelete, "/admin/cache?"+query, nil)
+		if token != "" {
+			r.Header.Set("X-Admin-Token", token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, r)
+		return rec
+	}
+	cached := func(location string) bool { return mr.Exists(defaultQuery(location).cacheKey()) }
+
+	if rec := purge("country=istanbul", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("purge without a token got %d, want 401", rec.Code)
+	}
+	if rec := purge("country=istanbul", "guess"); rec.Code != http.StatusForbidden {
+		t.Errorf("purge with a wrong token got %d, want 403", rec.Code)
+	}
+	if !cached("istanbul") {
+		t.Fatal("a refused purge deleted the entry")
+	}
+
+	steps := []struct {
+		query       string
+		wantDeleted int64
+		gone, kept  []string
+	}{
+		{query: "country=istanbul", wantDeleted: 1, gone: []string{"istanbul"}, kept: []string{"ankara", "antalya"}},
+		{query: "pattern=an*", wantDeleted: 2, gone: []string{"ankara", "antalya"}},
+	}
+	for _, step := range steps {
+		rec := purge(step.query, "secret")
+		var body map[string]int64
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != http.StatusOK || err != nil || body["deleted"] != step.wantDeleted {
+			t.Fatalf("purge %s: status = %d and body %s, want %d deleted", step.query, rec.Code, rec.Body, step.wantDeleted)
+		}
+		for _, location := range step.kept {
+			if !cached(location) {
+				t.Errorf("purge %s deleted %s", step.query, location)
+			}
+		}
+		for _, location := range step.gone {
+			if cached(location) {
+				t.Errorf("purge %s left %s in Redis", step.query, location)
+			}
+			before := calls.Load()
+			if rec := serveGet(mux, "/weather?country="+location); rec.Header().Get("X-Cache") != "MISS" || calls.Load() != before+1 {
+				t.Errorf("GET %s after purge %s: X-Cache = %q, want a refetch", location, step.query, rec.Header().Get("X-Cache"))
+			}
+		}
+	}
+}
+
+// pagedLister lists its keys count at a time, as SCAN can, which miniredis
+// does not: it returns every key on the first page.
+type pagedLister struct {
+	switchableCache
+	keys []string
+}
+
+func (l *pagedLister) ListKeys(ctx context.Context, pattern string, cursor uint64, count int64) ([]cachedKey, uint64, error) {
+	end := min(cursor+uint64(count), uint64(len(l.keys)))
+	var listed []cachedKey
+	for _, key := range l.keys[cursor:end] {
+		if ok, _ := path.Match(pattern, key); ok {
+			listed = append(listed, cachedKey{Key: key, TTL: time.Hour})
+		}
+	}
+	if end == uint64(len(l.keys)) {
+		end = 0
+	}
+	return listed, end, nil
+}
+
+// TestCacheKeysPagination pages through more keys than fit on a page, and
+// lists an empty keyspace.
+func TestCacheKeysPagination(t *testing.T) {
+	type page struct {
+		Keys       []cacheKeyInfo `json:"keys"`
+		NextCursor *string        `json:"nextCursor"`
+	}
+	list := func(t *testing.T, h http.Handler, target string) page {
+		t.Helper()
+		rec := serveGet(h, target)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("GET %s: status = %d, want 200", target, rec.Code)
+		}
+		var p page
+		if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+			t.Fatalf("GET %s: %v", target, err)
+		}
+		return p
+	}
+
+	t.Run("several pages", func(t *testing.T) {
+		backend := &pagedLister{}
+		want := map[string]bool{}
+		for i := 0; i < 23; i++ {
+			key := defaultQuery(fmt.Sprintf("city%02d", i)).cacheKey()
+			backend.keys = append(backend.keys, key)
+			want[key] = true
+		}
+		// Keys outside the cache's prefix are never listed.
+		backend.keys = append(backend.keys, "other:key")
+		h := cacheKeysHandler(newTieredCache(backend, newCacheHealth(), testConfig(t)))
+
+		seen := map[string]bool{}
+		pages := 0
+		for cursor := ""; ; {
+			pages++
+			target := "/admin/cache/keys?count=5"
+			if cursor != "" {
+				target += "&cursor=" + cursor
+			}
+			p := list(t, h, target)
+			for _, info := range p.Keys {
+				if seen[info.Key] {
+					t.Errorf("%s listed twice", info.Key)
+				}
+				seen[info.Key] = true
+				if info.Location == "" || info.TTLSeconds != 3600 {
+					t.Errorf("%s is listed as %+v", info.Key, info)
+				}
+			}
+			if p.NextCursor == nil {
+				break
+			}
+			if *p.NextCursor == "" || pages > len(backend.keys) {
+				t.Fatalf("page %d: next cursor %q", pages, *p.NextCursor)
+			}
+			cursor = *p.NextCursor
+		}
+		if pages != 5 {
+			t.Errorf("%d keys listed in %d pages of 5, want 5", len(backend.keys), pages)
+		}
+		if len(seen) != len(want) {
+			t.Errorf("listed %d keys, want %d", len(seen), len(want))
+		}
+		for key := range want {
+			if !seen[key] {
+				t.Errorf("%s was never listed", key)
+			}
+		}
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		cache, mr := newTestCache(t, testConfig(t))
+		key := defaultQuery("istanbul").cacheKey()
+		cache.Set(context.Background(), key, testEntry(t, testWeather), time.Hour)
+		mr.Set("other:key", "x")
+		p := list(t, cacheKeysHandler(cache), "/admin/cache/keys")
+		if len(p.Keys) != 1 || p.Keys[0].Key != key || p.NextCursor != nil {
+			t.Fatalf("listed %+v, next cursor %v, want only %s", p.Keys, p.NextCursor, key)
+		}
+		if info := p.Keys[0]; !strings.EqualFold(info.Location, "istanbul") || info.TTLSeconds <= 0 || info.FetchedAt == nil {
+			t.Errorf("%s is listed as %+v", key, info)
+		}
+	})
+
+	t.Run("empty keyspace", func(t *testing.T) {
+		cache, _ := newTestCache(t, testConfig(t))
+		rec := serveGet(cacheKeysHandler(cache), "/admin/cache/keys")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rec.Code)
+		}
+		if got := strings.TrimSpace(rec.Body.String()); got != `{"keys":[]}` {
+			t.Errorf("body = %s, want an empty list and no cursor", got)
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Alert is a government weather alert, sent by the provider when alerts are
+// included.
+type Alert struct {
+	Event       string `json:"event" xml:"event"`
+	Headline    string `json:"headline" xml:"headline"`
+	Severity    string `json:"severity" xml:"severity"`
+	Onset       string `json:"onset" xml:"onset"`
+	Ends        string `json:"ends" xml:"ends"`
+	Description string `json:"description" xml:"description"`
+	Link        string `json:"link" xml:"link"`
+}
+
+// alertsResponse is the body of GET /weather/alerts.
+type alertsResponse struct {
+	Alerts []Alert `json:"alerts" xml:"alert"`
+}
+
+// alertSeverities are the CAP severities, least severe first. Alerts of any
+// other severity rank below them all.
+var alertSeverities = []string{"minor", "moderate", "severe", "extreme"}
+
+// alertSeverity returns the rank of the request's min_severity, or -1 when
+// it has none.
+func alertSeverity(r *http.Request) (int, error) {
+	v := r.URL.Query().Get("min_severity")
+	if v == "" {
+		return -1, nil
+	}
+	rank := slices.Index(alertSeverities, strings.ToLower(v))
+	if rank < 0 {
+		return 0, fmt.Errorf("min_severity must be one of %s", strings.Join(alertSeverities, ", "))
+	}
+	return rank, nil
+}
+
+// minSeverityMiddleware drops the alerts less severe than min_severity from
+// the responses of next.
+func minSeverityMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		min, err := alertSeverity(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		if min < 0 {
+			next(w, r)
+			return
+		}
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			return
+		}
+		var body alertsResponse
+		if buf.status >= 300 || json.Unmarshal(buf.body.Bytes(), &body) != nil {
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		kept := []Alert{}
+		for _, alert := range body.Alerts {
+			if slices.Index(alertSeverities, strings.ToLower(alert.Severity)) >= min {
+				kept = append(kept, alert)
+			}
+		}
+		data, _ := json.Marshal(alertsResponse{Alerts: kept})
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(buf.status)
+		w.Write(data)
+	}
+}
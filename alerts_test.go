@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// alertsFixture is a provider response for include=alerts, with an alert of
+// each CAP severity and one the provider left unrated.
+const alertsFixture = `{
+  "queryCost": 1,
+  "latitude": 41.0091,
+  "longitude": 28.9655,
+  "resolvedAddress": "İstanbul, Türkiye",
+  "address": "istanbul",
+  "timezone": "Europe/Istanbul",
+  "tzoffset": 3.0,
+  "alerts": [
+    {"event": "Fog", "headline": "Patchy fog this morning", "severity": "Minor", "onset": "2024-06-15T04:00:00", "ends": "2024-06-15T09:00:00", "description": "Visibility below 1 km in places.", "link": "https://meteoalarm.org/", "language": "en", "id": "a1"},
+    {"event": "Wind", "headline": "Strong northerly winds", "severity": "Moderate", "onset": "2024-06-15T12:00:00", "ends": "2024-06-16T00:00:00", "description": "Gusts up to 70 km/h.", "link": "https://meteoalarm.org/", "language": "en", "id": "a2"},
+    {"event": "Thunderstorm", "headline": "Severe thunderstorms", "severity": "Severe", "onset": "2024-06-15T15:00:00", "ends": "2024-06-15T21:00:00", "description": "Hail and torrential rain.", "link": "https://meteoalarm.org/", "language": "en", "id": "a3"},
+    {"event": "Flood", "headline": "Flash flooding", "severity": "Extreme", "onset": "2024-06-15T18:00:00", "ends": "2024-06-16T06:00:00", "description": "Rivers bursting their banks.", "link": "https://meteoalarm.org/", "language": "en", "id": "a4"},
+    {"event": "Notice", "headline": "Beach closures", "severity": "Unknown", "onset": "2024-06-15T00:00:00", "ends": "2024-06-16T00:00:00", "description": "Swimming is not allowed.", "link": "https://meteoalarm.org/", "language": "en", "id": "a5"}
+  ]
+}`
+
+// testAlerts returns the /weather/alerts handler over a fresh cache, served
+// from fixture.
+func testAlerts(t *testing.T, fixture string) http.HandlerFunc {
+	t.Helper()
+	fixtureProvider(t, fixture)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	return minSeverityMiddleware(redisMiddleware(fetchHandler(cache, group, budget, cfg), parseAlertsQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg))
+}
+
+func TestAlertSeverityFilter(t *testing.T) {
+	h := testAlerts(t, alertsFixture)
+	tests := []struct {
+		name        string
+		minSeverity string
+		wantEvents  []string
+		wantStatus  int
+	}{
+		{name: "no filter", wantEvents: []string{"Fog", "Wind", "Thunderstorm", "Flood", "Notice"}},
+		{name: "minor", minSeverity: "minor", wantEvents: []string{"Fog", "Wind", "Thunderstorm", "Flood"}},
+		{name: "moderate", minSeverity: "moderate", wantEvents: []string{"Wind", "Thunderstorm", "Flood"}},
+		{name: "severe, any case", minSeverity: "SEVERE", wantEvents: []string{"Thunderstorm", "Flood"}},
+		{name: "extreme", minSeverity: "extreme", wantEvents: []string{"Flood"}},
+		{name: "unknown severity", minSeverity: "apocalyptic", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := "/weather/alerts?country=istanbul"
+			if tt.minSeverity != "" {
+				target += "&min_severity=" + tt.minSeverity
+			}
+			rec := serveGet(h, target)
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			if rec.Code != wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, wantStatus, rec.Body)
+			}
+			if wantStatus != http.StatusOK {
+				return
+			}
+			var body alertsResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			var events []string
+			for _, alert := range body.Alerts {
+				events = append(events, alert.Event)
+			}
+			if !slices.Equal(events, tt.wantEvents) {
+				t.Errorf("events = %v, want %v", events, tt.wantEvents)
+			}
+		})
+	}
+}
+
+// TestNoAlerts checks a location without alerts gets an empty list rather
+// than null, filtered or not.
+func TestNoAlerts(t *testing.T) {
+	h := testAlerts(t, `{"resolvedAddress": "İstanbul, Türkiye", "timezone": "Europe/Istanbul"}`)
+	for _, target := range []string{
+		"/weather/alerts?country=istanbul",
+		"/weather/alerts?country=istanbul&min_severity=severe",
+	} {
+		rec := serveGet(h, target)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", target, rec.Code)
+		}
+		if got := rec.Body.String(); got != `{"alerts":[]}` {
+			t.Errorf("%s: body = %s, want an empty list", target, got)
+		}
+	}
+}
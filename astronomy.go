@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// astronomy is the body of GET /weather/astronomy. On days the sun neither
+// rises nor sets, Polar says whether it stays up or below the horizon. The
+// sun times are those of the location's zone, and are converted to the zone
+// of the tz parameter when it is given.
+type astronomy struct {
+	Date             string `json:"date" xml:"date"`
+	Timezone         string `json:"timezone" xml:"timezone"`
+	Sunrise          string `json:"sunrise,omitempty" xml:"sunrise,omitempty"`
+	Sunset           string `json:"sunset,omitempty" xml:"sunset,omitempty"`
+	DayLength        string `json:"dayLength,omitempty" xml:"dayLength,omitempty"`
+	DayLengthSeconds *int64 `json:"dayLengthSeconds,omitempty" xml:"dayLengthSeconds,omitempty"`
+	Polar            string `json:"polar,omitempty" xml:"polar,omitempty"`
+	TZ               string `json:"tz,omitempty" xml:"tz,omitempty"`
+	SunriseAt        string `json:"sunriseAt,omitempty" xml:"sunriseAt,omitempty"`
+	SunsetAt         string `json:"sunsetAt,omitempty" xml:"sunsetAt,omitempty"`
+	SunriseLocal     string `json:"sunriseLocal,omitempty" xml:"sunriseLocal,omitempty"`
+	SunsetLocal      string `json:"sunsetLocal,omitempty" xml:"sunsetLocal,omitempty"`
+}
+
+// astronomyMiddleware turns the Weather responses of next into the sun
+// times of their first day, in the zone of the tz parameter when it is
+// given.
+func astronomyMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var zone *time.Location
+		if v := r.URL.Query().Get("tz"); v != "" {
+			var err error
+			if zone, err = loadZone(v); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+		}
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			return
+		}
+		var weather Weather
+		if buf.status >= 300 || json.Unmarshal(buf.body.Bytes(), &weather) != nil || len(weather.Days) == 0 {
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		a := dayAstronomy(weather, weather.Days[0])
+		if zone != nil {
+			a.convert(zone)
+		}
+		data, _ := json.Marshal(a)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(buf.status)
+		w.Write(data)
+	}
+}
+
+// dayAstronomy works out the day length of day. A day the sun only rises or
+// only sets on is counted from sunrise to midnight or from midnight to
+// sunset. With neither, the sun is taken to be up in the hemisphere's
+// summer half of the year and down in its winter half.
+func dayAstronomy(weather Weather, day Day) astronomy {
+	a := astronomy{Date: day.Datetime, Timezone: weather.Timezone, Sunrise: day.Sunrise, Sunset: day.Sunset}
+	sunrise, riseErr := time.Parse(time.TimeOnly, day.Sunrise)
+	sunset, setErr := time.Parse(time.TimeOnly, day.Sunset)
+	midnight, _ := time.Parse(time.TimeOnly, "00:00:00")
+	var length time.Duration
+	switch {
+	case riseErr == nil && setErr == nil:
+		length = sunset.Sub(sunrise)
+		if length < 0 {
+			length += 24 * time.Hour
+		}
+	case riseErr == nil:
+		length = midnight.Add(24 * time.Hour).Sub(sunrise)
+	case setErr == nil:
+		length = sunset.Sub(midnight)
+	default:
+		date, err := time.Parse(time.DateOnly, day.Datetime)
+		if err != nil {
+			return a
+		}
+		summer := date.Month() >= time.April && date.Month() <= time.September
+		if summer == (weather.Latitude >= 0) {
+			a.Polar, length = "day", 24*time.Hour
+		} else {
+			a.Polar = "night"
+		}
+	}
+	seconds := int64(length.Seconds())
+	a.DayLength, a.DayLengthSeconds = length.String(), &seconds
+	return a
+}
+
+// loadZone loads the time zone named name, such as Europe/Berlin. The
+// server's own zone, Local, is not one clients can name.
+func loadZone(name string) (*time.Location, error) {
+	zone, err := time.LoadLocation(name)
+	if err != nil || name == "Local" {
+		return nil, fmt.Errorf("tz must be a time zone such as Europe/Berlin, not %q", name)
+	}
+	return zone, nil
+}
+
+// convert sets the sun times of a in zone, as timestamps and as the clock
+// times of that zone. They are read in the location's zone on a's date, so
+// that a day its clocks change on is offset as it was. The sun times of a
+// location whose zone is not known are left unconverted.
+func (a *astronomy) convert(zone *time.Location) {
+	a.TZ = zone.String()
+	from, err := time.LoadLocation(a.Timezone)
+	if err != nil || a.Timezone == "" {
+		return
+	}
+	at := func(clock string) (string, string) {
+		t, err := time.ParseInLocation(time.DateTime, a.Date+" "+clock, from)
+		if err != nil {
+			return "", ""
+		}
+		t = t.In(zone)
+		return t.Format(time.RFC3339), t.Format("15:04")
+	}
+	a.SunriseAt, a.SunriseLocal = at(a.Sunrise)
+	a.SunsetAt, a.SunsetLocal = at(a.Sunset)
+}
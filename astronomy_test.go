@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAstronomyTimezone(t *testing.T) {
+	tests := []struct {
+		name       string
+		timezone   string
+		day        Day
+		tz         string
+		wantStatus int
+		want       astronomy
+	}{
+		{
+			name:     "normal day",
+			timezone: "Europe/Istanbul",
+			day:      Day{Datetime: "2024-01-15", Sunrise: "08:28:00", Sunset: "17:52:30"},
+			tz:       "Europe/Berlin",
+			want: astronomy{
+				SunriseAt: "2024-01-15T06:28:00+01:00", SunriseLocal: "06:28",
+				SunsetAt: "2024-01-15T15:52:30+01:00", SunsetLocal: "15:52",
+			},
+		},
+		{
+			// New York moved its clocks forward on 2024-03-10, Berlin
+			// only on 2024-03-31, so the gap is five hours and not six.
+			name:     "daylight saving time starts",
+			timezone: "America/New_York",
+			day:      Day{Datetime: "2024-03-10", Sunrise: "07:25:00", Sunset: "19:07:00"},
+			tz:       "Europe/Berlin",
+			want: astronomy{
+				SunriseAt: "2024-03-10T12:25:00+01:00", SunriseLocal: "12:25",
+				SunsetAt: "2024-03-11T00:07:00+01:00", SunsetLocal: "00:07",
+			},
+		},
+		{
+			name:     "day before daylight saving time",
+			timezone: "America/New_York",
+			day:      Day{Datetime: "2024-03-09", Sunrise: "06:27:00", Sunset: "18:06:00"},
+			tz:       "Europe/Berlin",
+			want: astronomy{
+				SunriseAt: "2024-03-09T12:27:00+01:00", SunriseLocal: "12:27",
+				SunsetAt: "2024-03-10T00:06:00+01:00", SunsetLocal: "00:06",
+			},
+		},
+		{
+			name:     "polar night",
+			timezone: "Europe/Oslo",
+			day:      Day{Datetime: "2024-12-21"},
+			tz:       "UTC",
+			want:     astronomy{},
+		},
+		{
+			name:       "unknown zone",
+			timezone:   "Europe/Istanbul",
+			day:        Day{Datetime: "2024-01-15", Sunrise: "08:28:00", Sunset: "17:52:30"},
+			tz:         "Europe/Atlantis",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "server zone",
+			timezone:   "Europe/Istanbul",
+			day:        Day{Datetime: "2024-01-15", Sunrise: "08:28:00", Sunset: "17:52:30"},
+			tz:         "Local",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			h := astronomyMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				writeJSON(w, http.StatusOK, Weather{Latitude: 60, Timezone: tt.timezone, Days: []Day{tt.day}})
+			})
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather/astronomy?country=x&tz="+tt.tz, nil))
+			if tt.wantStatus != 0 {
+				if rec.Code != tt.wantStatus || called {
+					t.Errorf("status = %d and called = %v, want %d before the lookup", rec.Code, called, tt.wantStatus)
+				}
+				return
+			}
+			var got astronomy
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.TZ != tt.tz || got.Sunrise != tt.day.Sunrise || got.Sunset != tt.day.Sunset {
+				t.Errorf("tz = %q, sunrise %q and sunset %q, want %q with the location's times", got.TZ, got.Sunrise, got.Sunset, tt.tz)
+			}
+			if got.SunriseAt != tt.want.SunriseAt || got.SunriseLocal != tt.want.SunriseLocal {
+				t.Errorf("sunrise = %s (%s), want %s (%s)", got.SunriseAt, got.SunriseLocal, tt.want.SunriseAt, tt.want.SunriseLocal)
+			}
+			if got.SunsetAt != tt.want.SunsetAt || got.SunsetLocal != tt.want.SunsetLocal {
+				t.Errorf("sunset = %s (%s), want %s (%s)", got.SunsetAt, got.SunsetLocal, tt.want.SunsetAt, tt.want.SunsetLocal)
+			}
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// apiKeysHash is the Redis hash holding the issued API keys, each mapped to
+// its apiKeyInfo.
+const apiKeysHash = "auth:apikeys"
+
+// errMalformedCredentials is returned for an Authorization header that is
+// not a bearer token.
+var errMalformedCredentials = errors.New("the Authorization header must be a bearer token")
+
+// apiKeyInfo describes an issued API key.
+type apiKeyInfo struct {
+	Name      string    `json:"name"`
+	Tier      string    `json:"tier,omitempty"`
+	Enabled   bool      `json:"enabled"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// apiKeyStore keeps the issued API keys in Redis, so that every instance
+// sees keys as soon as they are created or revoked.
+type apiKeyStore struct {
+	redisDB redis.UniversalClient
+}
+
+// get returns the key's info, reporting false for keys never issued.
+func (s *apiKeyStore) get(ctx context.Context, key string) (apiKeyInfo, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	data, err := s.redisDB.HGet(ctx, apiKeysHash, key).Bytes()
+	if err == redis.Nil {
+		return apiKeyInfo{}, false, nil
+	}
+	if err != nil {
+		return apiKeyInfo{}, false, err
+	}
+	var info apiKeyInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return apiKeyInfo{}, false, fmt.Errorf("invalid API key entry: %v", err)
+	}
+	return info, true, nil
+}
+
+func (s *apiKeyStore) put(ctx context.Context, key string, info apiKeyInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return s.redisDB.HSet(ctx, apiKeysHash, key, data).Err()
+}
+
+// list returns every issued key with its info.
+func (s *apiKeyStore) list(ctx context.Context) (map[string]apiKeyInfo, error) {
+	entries, err := s.redisDB.HGetAll(ctx, apiKeysHash).Result()
+	if err != nil {
+		return nil, err
+	}
+	keys := make(map[string]apiKeyInfo, len(entries))
+	for key, data := range entries {
+		var info apiKeyInfo
+		if err := json.Unmarshal([]byte(data), &info); err != nil {
+			continue
+		}
+		keys[key] = info
+	}
+	return keys, nil
+}
+
+// credentials returns the API key r carries in X-API-Key or as an
+// Authorization bearer token, or "" when it carries none.
+func credentials(r *http.Request) (string, error) {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, nil
+	}
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", nil
+	}
+	scheme, token, ok := strings.Cut(auth, " ")
+	token = strings.TrimSpace(token)
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", errMalformedCredentials
+	}
+	return token, nil
+}
+
+// authMiddleware requires an enabled API key on the requests for the mux
+// route patterns in routes. The key's identity is attached to the request
+// as its consumer, for the rate limiter and the logs. Other routes pass
+// through, whatever they carry.
+func authMiddleware(next http.Handler, mux *http.ServeMux, store *apiKeyStore, routes []string) http.Handler {
+	if len(routes) == 0 {
+		return next
+	}
+	required := make(map[string]bool, len(routes))
+	for _, route := range routes {
+		required[route] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); !required[pattern] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key, err := credentials(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, apiError{Code: "invalid_credentials", Message: err.Error()})
+			return
+		}
+		if key == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, apiError{Code: "api_key_required"})
+			return
+		}
+		info, ok, err := store.get(r.Context(), key)
+		if err != nil {
+			logf(r.Context(), "Error looking up API key : %v", err)
+			writeError(w, http.StatusServiceUnavailable, apiError{Code: "auth_unavailable"})
+			return
+		}
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, apiError{Code: "api_key_invalid"})
+			return
+		}
+		if !info.Enabled {
+			writeError(w, http.StatusForbidden, apiError{Code: "api_key_disabled"})
+			return
+		}
+		c := consumer{key: key, tier: info.Tier, name: info.Name}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), consumerKey{}, c)))
+	})
+}
+
+// apiKeysHandler serves the admin routes of the key store. GET
+// /admin/apikeys lists the keys, POST /admin/apikeys issues one from a
+// {"name", "tier"} body and returns it, and DELETE /admin/apikeys?key=K
+// revokes K. Revoked keys are kept, disabled, so that their use is answered
+// with 403 rather than 401.
+func apiKeysHandler(store *apiKeyStore, tiers map[string]rateSpec) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			keys, err := store.list(r.Context())
+			if err != nil {
+				logf(r.Context(), "Error listing API keys : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error listing API keys"})
+				return
+			}
+			writeJSON(w, http.StatusOK, keys)
+		case http.MethodPost:
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			var req struct {
+				Name string `json:"name"`
+				Tier string `json:"tier"`
+			}
+			if err := json.Unmarshal(body, &req); err != nil || req.Name == "" {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: `body must be {"name": "...", "tier": "..."}`})
+				return
+			}
+			if _, ok := tiers[req.Tier]; req.Tier != "" && !ok {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: fmt.Sprintf("unknown tier %q", req.Tier)})
+				return
+			}
+			secret := make([]byte, 24)
+			if _, err := rand.Read(secret); err != nil {
+				logf(r.Context(), "Error generating API key : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error storing API key"})
+				return
+			}
+			key := hex.EncodeToString(secret)
+			info := apiKeyInfo{Name: req.Name, Tier: req.Tier, Enabled: true, CreatedAt: time.Now().UTC()}
+			if err := store.put(r.Context(), key, info); err != nil {
+				logf(r.Context(), "Error storing API key : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error storing API key"})
+				return
+			}
+			writeJSON(w, http.StatusCreated, map[string]interface{}{"key": key, "info": info})
+		case http.MethodDelete:
+			key := r.URL.Query().Get("key")
+			info, ok, err := store.get(r.Context(), key)
+			if err != nil {
+				logf(r.Context(), "Error looking up API key : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error looking up API key"})
+				return
+			}
+			if !ok {
+				writeError(w, http.StatusNotFound, apiError{Code: "not_found", Message: "Unknown API key"})
+				return
+			}
+			info.Enabled = false
+			if err := store.put(r.Context(), key, info); err != nil {
+				logf(r.Context(), "Error revoking API key : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error revoking API key"})
+				return
+			}
+			writeJSON(w, http.StatusOK, info)
+		}
+	}
+}
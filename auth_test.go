@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	store := &apiKeyStore{redisDB: client}
+	ctx := context.Background()
+	store.put(ctx, "good", apiKeyInfo{Name: "app", Tier: "pro", Enabled: true, CreatedAt: time.Now()})
+	store.put(ctx, "revoked", apiKeyInfo{Name: "old", Enabled: false, CreatedAt: time.Now()})
+
+	mux := http.NewServeMux()
+	var seen consumer
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = r.Context().Value(consumerKey{}).(consumer)
+	})
+	mux.Handle("/weather", ok)
+	mux.Handle("/healthz", ok)
+	h := authMiddleware(mux, mux, store, []string{"/weather"})
+
+	tests := []struct {
+		name       string
+		path       string
+		header     string
+		value      string
+		wantStatus int
+		wantCode   string
+		wantTier   string
+	}{
+		{name: "open route", path: "/healthz", wantStatus: http.StatusOK},
+		{name: "no key", path: "/weather", wantStatus: http.StatusUnauthorized, wantCode: "api_key_required"},
+		{name: "X-API-Key", path: "/weather", header: "X-API-Key", value: "good", wantStatus: http.StatusOK, wantTier: "pro"},
+		{name: "bearer token", path: "/weather", header: "Authorization", value: "Bearer good", wantStatus: http.StatusOK, wantTier: "pro"},
+		{name: "basic auth", path: "/weather", header: "Authorization", value: "Basic Z29vZA==", wantStatus: http.StatusUnauthorized, wantCode: "invalid_credentials"},
+		{name: "unknown key", path: "/weather", header: "X-API-Key", value: "made-up", wantStatus: http.StatusUnauthorized, wantCode: "api_key_invalid"},
+		{name: "revoked key", path: "/weather", header: "X-API-Key", value: "revoked", wantStatus: http.StatusForbidden, wantCode: "api_key_disabled"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			seen = consumer{}
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if seen.tier != tt.wantTier {
+				t.Errorf("consumer tier = %q, want %q", seen.tier, tt.wantTier)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body["error"].Code; got != tt.wantCode {
+				t.Errorf("code = %q, want %q", got, tt.wantCode)
+			}
+		})
+	}
+
+	mr.Close()
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+	r.Header.Set("X-API-Key", "good")
+	h.ServeHTTP(rec, r)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("with Redis down got %d, want 503", rec.Code)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// maxBatchLocations caps the locations of one GET /weather/batch.
+	maxBatchLocations = 20
+	// batchFetchWorkers bounds the provider calls one batch makes at once.
+	batchFetchWorkers = 4
+)
+
+// batchHandler serves GET /weather/batch?countries=a,b,c with an object
+// keyed by normalized location. Each value is the location's weather, or
+// {"error": {...}} when it failed, so that one bad location does not fail
+// the others.
+func batchHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, hot *hotKeys, stats *cacheStats, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, err := parseQueryOptions(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		queries := make(map[string]weatherQuery)
+		for _, location := range splitList(r.URL.Query().Get("countries")) {
+			if err := validateLocation("each of countries", location); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			q := base
+			q.Location = location
+			name := normalizeKey(location)
+			if _, ok := queries[name]; !ok {
+				queries[name] = q
+			}
+		}
+		if len(queries) == 0 {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "countries must list at least one location"})
+			return
+		}
+		if len(queries) > maxBatchLocations {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: fmt.Sprintf("countries must list at most %d locations", maxBatchLocations)})
+			return
+		}
+
+		results := fetchMany(r.Context(), cache, group, budget, hot, stats, cfg, queries)
+		if r.Context().Err() != nil {
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// fetchMany looks up each of queries, keyed by name, and returns their
+// results under the same names. Cached ones are read in a single round trip
+// and the rest fetched a few at a time, each cached on its own.
+func fetchMany(ctx context.Context, cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, hot *hotKeys, stats *cacheStats, cfg Config, queries map[string]weatherQuery) map[string]json.RawMessage {
+	results := make(map[string]json.RawMessage, len(queries))
+	var mu sync.Mutex
+	set := func(name string, v json.RawMessage) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[name] = v
+	}
+	keys := make([]string, 0, len(queries))
+	for _, q := range queries {
+		keys = append(keys, q.cacheKey())
+	}
+	found, _ := cache.GetMany(ctx, keys)
+	var misses []string
+	for name, q := range queries {
+		hot.Record(q)
+		val, ok := found[q.cacheKey()]
+		if !ok {
+			stats.misses.Add(1)
+			misses = append(misses, name)
+			continue
+		}
+		stats.hits.Add(1)
+		entry, ok := decodeCacheEntry(val)
+		if !ok {
+			set(name, batchError(apiError{Code: "cache_error", Message: "The cached entry could not be read"}))
+		} else if entry.Status != 0 {
+			stats.negativeHits.Add(1)
+			set(name, batchError(apiError{Code: "location_rejected"}))
+		} else {
+			set(name, entry.Payload)
+		}
+	}
+
+	key := os.Getenv("API_KEY")
+	names := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < min(batchFetchWorkers, len(misses)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				set(name, batchFetch(ctx, cache, group, budget, cfg, queries[name], key))
+			}
+		}()
+	}
+	for _, name := range misses {
+		names <- name
+	}
+	close(names)
+	wg.Wait()
+	return results
+}
+
+// batchFetch fetches q for a batch like fetchHandler does for a single
+// location, returning the payload or the error object to report in its
+// place.
+func batchFetch(ctx context.Context, cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config, q weatherQuery, key string) json.RawMessage {
+	if key == "" {
+		return batchError(apiError{Code: "upstream_unconfigured", RetryAfterSeconds: retryAfterSeconds(unconfiguredRetryAfter)})
+	}
+	ch := group.DoChan(q.cacheKey(), func() (interface{}, error) {
+		return fetchShared(context.WithoutCancel(ctx), cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q))
+	})
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return nil
+	}
+	var upErr *upstreamError
+	switch {
+	case errors.As(res.Err, &upErr) && upErr.rejectsLocation():
+		return batchError(apiError{Code: "location_rejected"})
+	case errors.Is(res.Err, errBudgetExhausted):
+		return batchError(apiError{Code: "upstream_quota_exhausted", Scope: scopeGlobalQuota})
+	case res.Err != nil:
+		logf(ctx, "Error fetching %q for a batch : %v", q.cacheKey(), res.Err)
+		return batchError(apiError{Code: "upstream_error"})
+	}
+	return res.Val.([]byte)
+}
+
+// batchError encodes e as a batch result, in the envelope writeError sends.
+func batchError(e apiError) json.RawMessage {
+	data, _ := json.Marshal(errorBody(e))
+	return data
+}
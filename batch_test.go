@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// TestBatchMixedResults serves a batch with a cached location, one that
+// misses and one the provider rejects, and checks each gets its own result
+// while only the misses reach the provider.
+func TestBatchMixedResults(t *testing.T) {
+	body, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mu sync.Mutex
+	var fetched []string
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		path := strings.ToLower(r.URL.Path)
+		mu.Lock()
+		fetched = append(fetched, path)
+		mu.Unlock()
+		status, data := http.StatusOK, body
+		if strings.Contains(path, "/atlantis") {
+			status, data = http.StatusBadRequest, []byte("Bad API Request:Invalid location parameter value.")
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(data)),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	t.Setenv("API_KEY", "test")
+
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	stats := &cacheStats{}
+	h := batchHandler(cache, new(singleflight.Group), newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), stats, cfg)
+
+	if rec := serveGet(h, "/weather/batch?countries=istanbul"); rec.Code != http.StatusOK {
+		t.Fatalf("warming batch: status = %d, want 200", rec.Code)
+	}
+	mu.Lock()
+	fetched = nil
+	mu.Unlock()
+
+	rec := serveGet(h, "/weather/batch?countries=istanbul,ankara,atlantis")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var results map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &results); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("got %d results, want 3: %s", len(results), rec.Body)
+	}
+	for _, name := range []string{"istanbul", "ankara"} {
+		var w Weather
+		if err := json.Unmarshal(results[name], &w); err != nil || w.ResolvedAddress != testWeather.ResolvedAddress {
+			t.Errorf("%s = %s, want the weather", name, results[name])
+		}
+	}
+	var rejected struct {
+		Error apiError `json:"error"`
+	}
+	if err := json.Unmarshal(results["atlantis"], &rejected); err != nil || rejected.Error.Code != "location_rejected" {
+		t.Errorf("atlantis = %s, want a location_rejected error", results["atlantis"])
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fetched) != 2 {
+		t.Fatalf("provider called for %v, want ankara and atlantis only", fetched)
+	}
+	for _, path := range fetched {
+		if strings.Contains(path, "/istanbul") {
+			t.Errorf("cached istanbul was fetched again")
+		}
+	}
+	if got := stats.hits.Load(); got != 1 {
+		t.Errorf("hits = %d, want 1", got)
+	}
+}
+
+// TestBatchInvalidLocation checks a location that fails validation rejects
+// the whole batch before anything is looked up.
+func TestBatchInvalidLocation(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	h := batchHandler(cache, new(singleflight.Group), newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg)
+
+	rec := serveGet(h, "/weather/batch?countries=istanbul,a%2Fb")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "must not contain /") {
+		t.Errorf("body = %s, want the validation error", rec.Body)
+	}
+	if n := calls.Load(); n != 0 {
+		t.Errorf("provider called %d times, want 0", n)
+	}
+}
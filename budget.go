@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// errBudgetExhausted is returned instead of calling the provider once the
+// day's upstream budget is spent.
+var errBudgetExhausted = errors.New("the daily upstream call budget is exhausted")
+
+// upstreamBudget counts the calls made to the provider each day against the
+// plan's daily quota. Past soft calls stale entries are served as they are
+// rather than refreshed, and once limit calls are made no more are. Days
+// start at midnight in loc, when the provider resets its own count.
+//
+// With redisDB set the count is shared by every instance. Should Redis fail,
+// the instance counts on its own until it is back. A nil budget is
+// unlimited.
+type upstreamBudget struct {
+	limit   int64
+	soft    int64
+	loc     *time.Location
+	redisDB redis.UniversalClient
+	now     func() time.Time
+
+	mu   sync.Mutex
+	day  string
+	used int64
+}
+
+func newUpstreamBudget(limit, soft int, loc *time.Location, redisDB redis.UniversalClient) *upstreamBudget {
+	if limit <= 0 {
+		return nil
+	}
+	return &upstreamBudget{limit: int64(limit), soft: int64(soft), loc: loc, redisDB: redisDB, now: time.Now}
+}
+
+// upstreamBudgetKey is the Redis counter of the calls made on day.
+func upstreamBudgetKey(day string) string {
+	return "upstream:budget:" + day
+}
+
+// take counts a call to the provider, or returns errBudgetExhausted if the
+// day's budget does not allow it.
+func (b *upstreamBudget) take(ctx context.Context) error {
+	if b == nil {
+		return nil
+	}
+	if b.redisDB != nil {
+		day := b.today()
+		rctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+		n, err := b.incr(rctx, day)
+		cancel()
+		if err == nil {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if b.rollover() == day {
+				b.used = max(b.used, min(n, b.limit))
+			}
+			return b.check(ctx, n)
+		}
+		logf(ctx, "Error counting upstream call in Redis : %v", err)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	if b.used >= b.limit {
+		return errBudgetExhausted
+	}
+	b.used++
+	return b.check(ctx, b.used)
+}
+
+// check returns errBudgetExhausted if the call counted as the nth of the day
+// goes over the limit, and logs the crossing of each threshold.
+func (b *upstreamBudget) check(ctx context.Context, n int64) error {
+	if n > b.limit {
+		return errBudgetExhausted
+	}
+	if n == b.soft || n == b.limit {
+		logf(ctx, "Upstream budget : %d of %d calls used today", n, b.limit)
+	}
+	return nil
+}
+
+func (b *upstreamBudget) incr(ctx context.Context, day string) (int64, error) {
+	key := upstreamBudgetKey(day)
+	pipe := b.redisDB.TxPipeline()
+	incr := pipe.Incr(ctx, key)
+	// The counter outlives its day by enough for clocks to disagree.
+	pipe.Expire(ctx, key, 48*time.Hour)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+// today returns the provider's current day.
+func (b *upstreamBudget) today() string {
+	return b.now().In(b.loc).Format(time.DateOnly)
+}
+
+// rollover starts a new count when the day has changed and returns the
+// current day. b.mu must be held.
+func (b *upstreamBudget) rollover() string {
+	day := b.today()
+	if day != b.day {
+		b.day, b.used = day, 0
+	}
+	return day
+}
+
+// saving reports whether the soft threshold has been crossed today, in
+// which case stale entries should be served rather than refreshed.
+func (b *upstreamBudget) saving() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rollover()
+	return b.used >= b.soft
+}
+
+// resetIn returns how long until the provider's next day starts.
+func (b *upstreamBudget) resetIn() time.Duration {
+	if b == nil {
+		return 0
+	}
+	now := b.now().In(b.loc)
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, b.loc).Sub(now)
+}
+
+// dailyLimit returns how many calls a day the budget allows.
+func (b *upstreamBudget) dailyLimit() int {
+	if b == nil {
+		return 0
+	}
+	return int(b.limit)
+}
@@ -0,0 +1,577 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errCacheMiss is returned by Cache.Get when the key is not cached.
+var errCacheMiss = errors.New("cache miss")
+
+// Cache is a storage backend for encoded cache entries.
+type Cache interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+	Ping(ctx context.Context) error
+}
+
+// Backends can implement the following interfaces to do better than the
+// generic fallbacks in tieredCache.
+type (
+	// dayGetter reads an entry limited to the given dates without reading
+	// the other days.
+	dayGetter interface {
+		GetDays(ctx context.Context, key string, dates []string) ([]byte, error)
+	}
+	// batchGetter reads several keys in one round trip, returning the
+	// entries found and the keys that missed.
+	batchGetter interface {
+		GetMany(ctx context.Context, keys []string) (map[string][]byte, []string, error)
+	}
+	// patternDeleter deletes every key matching a glob pattern.
+	patternDeleter interface {
+		DeleteMatching(ctx context.Context, pattern string) (int64, error)
+	}
+	// keyCounter counts the keys matching a glob pattern, stopping at limit.
+	keyCounter interface {
+		CountKeys(ctx context.Context, pattern string, limit int64) (int64, bool, error)
+	}
+	// keyLister pages through the keys matching a glob pattern. A returned
+	// cursor of 0 means the listing is complete.
+	keyLister interface {
+		ListKeys(ctx context.Context, pattern string, cursor uint64, count int64) ([]cachedKey, uint64, error)
+	}
+	// memoryReporter reports the backend's memory usage.
+	memoryReporter interface {
+		MemoryInfo(ctx context.Context) (map[string]string, error)
+	}
+	// locker takes a lock shared by every instance using the backend. Unlock
+	// only releases the lock if it is still held with token.
+	locker interface {
+		Lock(ctx context.Context, key string, ttl time.Duration) (token string, ok bool, err error)
+		Unlock(ctx context.Context, key, token string) error
+	}
+	// invalidator tells the other instances sharing the backend to drop the
+	// local copies of keys matching a glob pattern. Subscribe blocks until
+	// ctx is done, calling evict for each pattern received.
+	invalidator interface {
+		PublishInvalidation(ctx context.Context, pattern string) error
+		SubscribeInvalidations(ctx context.Context, evict func(pattern string))
+	}
+)
+
+// cachedKey describes a key returned by keyLister. FetchedAt is zero when
+// the entry could not be read.
+type cachedKey struct {
+	Key       string
+	TTL       time.Duration
+	Size      int64
+	FetchedAt time.Time
+}
+
+// errKeyListUnsupported is returned by keyLister.ListKeys when the backend's
+// current configuration cannot page through keys.
+var errKeyListUnsupported = errors.New("the cache backend does not support listing keys")
+
+// errPatternDeleteUnsupported is returned by tieredCache.DeleteMatching when
+// the backend cannot match keys.
+var errPatternDeleteUnsupported = errors.New("the cache backend does not support deleting by pattern")
+
+// noopCache caches nothing. It backs CACHE_BACKEND=none.
+type noopCache struct{}
+
+func (noopCache) Get(ctx context.Context, key string) ([]byte, error) { return nil, errCacheMiss }
+func (noopCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return nil
+}
+func (noopCache) Delete(ctx context.Context, key string) error { return nil }
+func (noopCache) Ping(ctx context.Context) error               { return nil }
+
+const (
+	cacheBackendRedis     = "redis"
+	cacheBackendMemcached = "memcached"
+	cacheBackendNone      = "none"
+)
+
+// newCacheBackend builds the configured backend and checks that it is
+// reachable.
+func newCacheBackend(cfg Config) (Cache, error) {
+	switch cfg.CacheBackend {
+	case cacheBackendRedis:
+		redisDB, err := newRedisClient(cfg)
+		if err != nil {
+			return nil, err
+		}
+		return newRedisBackend(redisDB, cacheCodecs[cfg.CacheCodec], cfg.CacheCompression), nil
+	case cacheBackendMemcached:
+		backend := newMemcacheBackend(cfg)
+		if err := backend.Ping(context.Background()); err != nil {
+			return nil, fmt.Errorf("could not reach memcached (%v): %v", cfg.MemcacheAddrs, err)
+		}
+		return backend, nil
+	case cacheBackendNone:
+		return noopCache{}, nil
+	}
+	return nil, fmt.Errorf("unknown CACHE_BACKEND %q", cfg.CacheBackend)
+}
+
+// tieredCache stores cache entries in a backend. While the backend is
+// unreachable it keeps them in an in-process fallback cache instead.
+//
+// Hot entries are also kept in a small local LRU consulted before the
+// backend. Purges and forced refreshes are broadcast to the other instances
+// when the backend supports it; the LRU's short TTL bounds how long a missed
+// broadcast leaves an entry stale.
+type tieredCache struct {
+	backend  Cache
+	fallback *memoryCache
+	local    *lruCache
+	localTTL time.Duration
+	health   *cacheHealth
+	jitter   *ttlJitter
+	// Values longer than maxValueSize bytes are not cached, so that one
+	// huge response cannot evict many useful ones. oversized counts them.
+	maxValueSize int
+	oversized    atomic.Int64
+	// watchers are woken as entries are written here or refreshed by
+	// other instances.
+	watchers *cacheWatchers
+	// writeHooks are called with every entry written here.
+	writeHooks []func(ctx context.Context, key string, value []byte)
+}
+
+func newTieredCache(backend Cache, health *cacheHealth, cfg Config) *tieredCache {
+	return &tieredCache{
+		backend:  backend,
+		fallback: newMemoryCache(),
+		local:    newLRUCache(cfg.LocalCacheSize),
+		localTTL: cfg.LocalCacheTTL,
+		health:   health,
+		jitter:   newTTLJitter(cfg.CacheTTLJitter, cfg.CacheJitterSeed),
+
+		maxValueSize: cfg.CacheMaxValueSize,
+		watchers:     newCacheWatchers(),
+	}
+}
+
+func (c *tieredCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	if val, ok := c.local.Get(key); ok {
+		return val, true
+	}
+	if c.health.Up() {
+		val, err := c.backend.Get(ctx, key)
+		if err == nil {
+			c.local.Set(key, val, c.localTTL)
+			return val, true
+		}
+		if err == errCacheMiss {
+			return nil, false
+		}
+		logf(ctx, "Error getting value from cache : %v", err)
+		c.fail(ctx, err)
+	}
+	return c.fallback.Get(key)
+}
+
+// fail records a backend error, unless it was only caused by the caller
+// giving up on the request.
+func (c *tieredCache) fail(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	c.health.record(err)
+}
+
+// GetDays is like Get but the returned entry only holds the days with the
+// given dates. Backends implementing dayGetter only read those days.
+func (c *tieredCache) GetDays(ctx context.Context, key string, dates []string) ([]byte, bool) {
+	if val, ok := c.local.Get(key); ok {
+		return filterEntryDays(val, dates)
+	}
+	if c.health.Up() {
+		var val []byte
+		var err error
+		if days, ok := c.backend.(dayGetter); ok {
+			val, err = days.GetDays(ctx, key, dates)
+		} else if val, err = c.backend.Get(ctx, key); err == nil {
+			var ok bool
+			if val, ok = filterEntryDays(val, dates); !ok {
+				err = errCacheMiss
+			}
+		}
+		if err == nil {
+			return val, true
+		}
+		if err == errCacheMiss {
+			return nil, false
+		}
+		logf(ctx, "Error getting value from cache : %v", err)
+		c.fail(ctx, err)
+	}
+	if val, ok := c.fallback.Get(key); ok {
+		return filterEntryDays(val, dates)
+	}
+	return nil, false
+}
+
+// GetMany looks up several keys at once, returning the entries found and the
+// keys that missed. Backends implementing batchGetter are queried in a single
+// round trip for all keys not held locally.
+func (c *tieredCache) GetMany(ctx context.Context, keys []string) (map[string][]byte, []string) {
+	found := make(map[string][]byte, len(keys))
+	var remote []string
+	for _, key := range keys {
+		if val, ok := c.local.Get(key); ok {
+			found[key] = val
+		} else {
+			remote = append(remote, key)
+		}
+	}
+	if len(remote) == 0 {
+		return found, nil
+	}
+
+	batch, ok := c.backend.(batchGetter)
+	if !ok {
+		var misses []string
+		for _, key := range remote {
+			if val, ok := c.Get(ctx, key); ok {
+				found[key] = val
+			} else {
+				misses = append(misses, key)
+			}
+		}
+		return found, misses
+	}
+	if c.health.Up() {
+		values, misses, err := batch.GetMany(ctx, remote)
+		if err == nil {
+			for key, val := range values {
+				found[key] = val
+				c.local.Set(key, val, c.localTTL)
+			}
+			return found, misses
+		}
+		logf(ctx, "Error getting values from cache : %v", err)
+		c.fail(ctx, err)
+	}
+	var misses []string
+	for _, key := range remote {
+		if val, ok := c.fallback.Get(key); ok {
+			found[key] = val
+		} else {
+			misses = append(misses, key)
+		}
+	}
+	return found, misses
+}
+
+func (c *tieredCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if c.maxValueSize > 0 && len(value) > c.maxValueSize {
+		logf(ctx, "Not caching %s : %d bytes is over the limit of %d", key, len(value), c.maxValueSize)
+		c.oversized.Add(1)
+		return
+	}
+	c.local.Set(key, value, min(ttl, c.localTTL))
+	defer c.watchers.notify(key)
+	for _, hook := range c.writeHooks {
+		defer hook(ctx, key, value)
+	}
+	if c.health.Up() {
+		err := c.backend.Set(ctx, key, value, ttl)
+		if err == nil {
+			return
+		}
+		logf(ctx, "Error setting value in cache : %v", err)
+		c.fail(ctx, err)
+	}
+	c.fallback.Set(key, value, ttl)
+}
+
+// Lock tries to take the shared lock on key for ttl. It reports true without
+// a lock when the backend cannot lock or is unreachable, so that callers go
+// ahead on their own rather than wait for a lock nobody can take.
+func (c *tieredCache) Lock(ctx context.Context, key string, ttl time.Duration) (string, bool) {
+	l, ok := c.backend.(locker)
+	if !ok || !c.health.Up() {
+		return "", true
+	}
+	token, ok, err := l.Lock(ctx, key, ttl)
+	if err != nil {
+		logf(ctx, "Error taking cache lock : %v", err)
+		return "", true
+	}
+	return token, ok
+}
+
+// Unlock releases a lock taken by Lock.
+func (c *tieredCache) Unlock(ctx context.Context, key, token string) {
+	l, ok := c.backend.(locker)
+	if !ok || token == "" {
+		return
+	}
+	if err := l.Unlock(ctx, key, token); err != nil {
+		logf(ctx, "Error releasing cache lock : %v", err)
+	}
+}
+
+// DeleteMatching removes every key matching the glob pattern from the backend
+// and both in-process tiers. It returns errPatternDeleteUnsupported, after
+// clearing the in-process tiers, if the backend cannot match keys.
+func (c *tieredCache) DeleteMatching(ctx context.Context, pattern string) (int64, error) {
+	c.local.DeleteMatching(pattern)
+	c.fallback.DeleteMatching(pattern)
+	deleter, ok := c.backend.(patternDeleter)
+	if !ok {
+		return 0, errPatternDeleteUnsupported
+	}
+	deleted, err := deleter.DeleteMatching(ctx, pattern)
+	if err != nil {
+		return deleted, err
+	}
+	c.Invalidate(ctx, pattern)
+	return deleted, nil
+}
+
+// Invalidate asks the other instances to evict their local copies of the
+// keys matching pattern, if the backend can reach them.
+func (c *tieredCache) Invalidate(ctx context.Context, pattern string) {
+	inv, ok := c.backend.(invalidator)
+	if !ok {
+		return
+	}
+	if err := inv.PublishInvalidation(ctx, pattern); err != nil {
+		logf(ctx, "Error publishing cache invalidation : %v", err)
+	}
+}
+
+// listenInvalidations evicts local entries as other instances purge or
+// refresh them, and wakes their watchers, until ctx is done.
+func (c *tieredCache) listenInvalidations(ctx context.Context) {
+	inv, ok := c.backend.(invalidator)
+	if !ok {
+		return
+	}
+	inv.SubscribeInvalidations(ctx, func(pattern string) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			fmt.Println("Ignoring invalid cache invalidation pattern :", pattern)
+			return
+		}
+		c.local.DeleteMatching(pattern)
+		c.fallback.DeleteMatching(pattern)
+		c.watchers.notifyMatching(pattern)
+	})
+}
+
+// OnWrite has hook called, once the entry is stored, with every entry
+// written through Set. It must be called before the cache is used, and hook
+// must not block.
+func (c *tieredCache) OnWrite(hook func(ctx context.Context, key string, value []byte)) {
+	c.writeHooks = append(c.writeHooks, hook)
+}
+
+// Watch returns a channel that receives whenever the entry of key is
+// written, and the function that stops watching it. See cacheWatchers.watch.
+func (c *tieredCache) Watch(key string) (<-chan struct{}, func()) {
+	return c.watchers.watch(key)
+}
+
+// memoryCache is a small in-process cache used as a fallback while the cache
+// backend is unreachable.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: make(map[string]memoryEntry)}
+}
+
+func (c *memoryCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.value, true
+}
+
+func (c *memoryCache) Set(key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.After(entry.expiresAt) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = memoryEntry{value: value, expiresAt: now.Add(ttl)}
+}
+
+// DeleteMatching removes every entry whose key matches the glob pattern.
+func (c *memoryCache) DeleteMatching(pattern string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for k := range c.entries {
+		if ok, _ := path.Match(pattern, k); ok {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// entryMetaField is the hash field holding the cache entry envelope together
+// with the top-level weather attributes. Every day is stored in its own
+// dayField so that single days can be read without fetching the rest.
+const entryMetaField = "meta"
+
+func dayField(date string) string {
+	return "day:" + date
+}
+
+// entryMeta is what the entryMetaField holds: the entry, with the days cut
+// out of its payload, and where they were cut out of it.
+type entryMeta struct {
+	cacheEntry
+	// DaysAt is the offset in the payload of the empty days array left in
+	// place of the days, or 0 when the payload had none.
+	DaysAt int `json:"daysAt,omitempty"`
+}
+
+// splitEntry turns an encoded cacheEntry into the hash fields it is stored as
+// in Redis: the entryMetaField plus one dayField per day.
+func splitEntry(value []byte) (map[string][]byte, error) {
+	var meta entryMeta
+	if err := json.Unmarshal(value, &meta.cacheEntry); err != nil {
+		return nil, err
+	}
+	fields := make(map[string][]byte)
+	if start, end, ok := daysSpan(meta.Payload); ok {
+		var days []json.RawMessage
+		if err := json.Unmarshal(meta.Payload[start:end], &days); err != nil {
+			return nil, err
+		}
+		for _, day := range days {
+			var d struct {
+				Datetime string `json:"datetime"`
+			}
+			if err := json.Unmarshal(day, &d); err != nil {
+				return nil, err
+			}
+			fields[dayField(d.Datetime)] = day
+		}
+		payload := make([]byte, 0, len(meta.Payload)-(end-start)+2)
+		payload = append(payload, meta.Payload[:start]...)
+		payload = append(payload, "[]"...)
+		meta.Payload = append(payload, meta.Payload[end:]...)
+		meta.DaysAt = start
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return nil, err
+	}
+	fields[entryMetaField] = data
+	return fields, nil
+}
+
+// daysSpan finds the array under the payload's top-level "days" key,
+// returning where it starts and ends.
+func daysSpan(payload []byte) (int, int, bool) {
+	if len(payload) == 0 {
+		return 0, 0, false
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return 0, 0, false
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return 0, 0, false
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return 0, 0, false
+		}
+		if key == "days" && len(value) > 0 && value[0] == '[' {
+			end := int(dec.InputOffset())
+			return end - len(value), end, true
+		}
+	}
+	return 0, 0, false
+}
+
+// joinEntry rebuilds an encoded cacheEntry from its hash fields, splicing
+// the days present in fields back into the payload in date order. An entry
+// holding all its days comes out as the bytes splitEntry was given.
+func joinEntry(fields map[string]string) ([]byte, error) {
+	var meta entryMeta
+	if err := json.Unmarshal([]byte(fields[entryMetaField]), &meta); err != nil {
+		return nil, err
+	}
+	if meta.DaysAt > 0 {
+		if meta.DaysAt+2 > len(meta.Payload) || string(meta.Payload[meta.DaysAt:meta.DaysAt+2]) != "[]" {
+			return nil, fmt.Errorf("invalid cache entry: no days array at offset %d", meta.DaysAt)
+		}
+		var dates []string
+		for name := range fields {
+			if date, ok := strings.CutPrefix(name, "day:"); ok {
+				dates = append(dates, date)
+			}
+		}
+		sort.Strings(dates)
+		payload := append([]byte(nil), meta.Payload[:meta.DaysAt]...)
+		payload = append(payload, '[')
+		for i, date := range dates {
+			if i > 0 {
+				payload = append(payload, ',')
+			}
+			payload = append(payload, fields[dayField(date)]...)
+		}
+		payload = append(payload, ']')
+		meta.Payload = append(payload, meta.Payload[meta.DaysAt+2:]...)
+	}
+	return json.Marshal(meta.cacheEntry)
+}
+
+// filterEntryDays returns the encoded cacheEntry value with only the days
+// whose dates are given.
+func filterEntryDays(value []byte, dates []string) ([]byte, bool) {
+	fields, err := splitEntry(value)
+	if err != nil {
+		return nil, false
+	}
+	filtered := map[string]string{entryMetaField: string(fields[entryMetaField])}
+	for _, date := range dates {
+		if day, ok := fields[dayField(date)]; ok {
+			filtered[dayField(date)] = string(day)
+		}
+	}
+	joined, err := joinEntry(filtered)
+	if err != nil {
+		return nil, false
+	}
+	return joined, true
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// testEntry encodes payload the way fetchAndCache stores it.
+func testEntry(t testing.TB, payload any) []byte {
+	t.Helper()
+	data, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 10, 0, 0, 123456789, time.UTC)
+	entry, err := json.Marshal(cacheEntry{FetchedAt: now, FreshUntil: now.Add(time.Minute), Provider: weatherProvider, Payload: data, ETag: payloadETag(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+var testWeather = Weather{
+	ResolvedAddress: "Istanbul, Türkiye",
+	Days: []Day{
+		{Datetime: "2024-01-01", Temp: 8.5, Description: "Cloudy <and> cold"},
+		{Datetime: "2024-01-02", Temp: 9, Hours: []Hour{{Datetime: "00:00:00"}}},
+		{Datetime: "2024-01-03", Temp: 7.25},
+	},
+	Meta: &weatherMeta{Units: "metric", weatherUnits: unitGroups["metric"]},
+}
+
+func TestSplitJoinEntryRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    []byte
+		wantDays int
+	}{
+		{name: "weather", value: testEntry(t, testWeather), wantDays: 3},
+		{name: "no days", value: testEntry(t, Weather{ResolvedAddress: "Nowhere", Days: []Day{}}), wantDays: 0},
+		{name: "null days", value: testEntry(t, Weather{ResolvedAddress: "Nowhere"}), wantDays: 0},
+		{name: "current", value: testEntry(t, Current{Datetime: "10:00:00", Temp: 3, Meta: testWeather.Meta}), wantDays: 0},
+		{name: "alerts", value: testEntry(t, alertsResponse{Alerts: []Alert{}}), wantDays: 0},
+		{name: "negative", value: []byte(`{"fetchedAt":"2024-01-01T00:00:00Z","freshUntil":"2024-01-01T00:01:00Z","status":400,"error":"Bad API Request"}`), wantDays: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := splitEntry(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := len(fields) - 1; got != tt.wantDays {
+				t.Errorf("splitEntry() gave %d day fields, want %d", got, tt.wantDays)
+			}
+			hash := make(map[string]string, len(fields))
+			for name, field := range fields {
+				hash[name] = string(field)
+			}
+			joined, err := joinEntry(hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(joined, tt.value) {
+				t.Errorf("joinEntry(splitEntry(v)) =\n%s\nwant\n%s", joined, tt.value)
+			}
+		})
+	}
+}
+
+func TestFilterEntryDays(t *testing.T) {
+	value := testEntry(t, testWeather)
+	tests := []struct {
+		name  string
+		dates []string
+		want  []string
+	}{
+		{name: "one day", dates: []string{"2024-01-02"}, want: []string{"2024-01-02"}},
+		{name: "out of order", dates: []string{"2024-01-03", "2024-01-01"}, want: []string{"2024-01-01", "2024-01-03"}},
+		{name: "unknown day", dates: []string{"2023-12-31"}, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filtered, ok := filterEntryDays(value, tt.dates)
+			if !ok {
+				t.Fatal("filterEntryDays() failed")
+			}
+			entry, _ := decodeCacheEntry(filtered)
+			var weather Weather
+			if err := json.Unmarshal(entry.Payload, &weather); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, d := range weather.Days {
+				got = append(got, d.Datetime)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("days = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("days = %v, want %v", got, tt.want)
+				}
+			}
+			if weather.ResolvedAddress != testWeather.ResolvedAddress {
+				t.Errorf("resolvedAddress = %q, want %q", weather.ResolvedAddress, testWeather.ResolvedAddress)
+			}
+		})
+	}
+}
+
+// TestRedisHitMatchesMiss checks that an entry read back from Redis serves
+// the bytes, and so the ETag, it was stored with.
+func TestRedisHitMatchesMiss(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	tests := []struct {
+		name    string
+		payload any
+	}{
+		{name: "weather", payload: testWeather},
+		{name: "current", payload: Current{Datetime: "10:00:00", Conditions: "Clear", Meta: testWeather.Meta}},
+		{name: "alerts", payload: alertsResponse{Alerts: []Alert{{Event: "Wind"}}}},
+	}
+	for _, codec := range []string{"json", "msgpack"} {
+		backend := newRedisBackend(client, cacheCodecs[codec], true)
+		for _, tt := range tests {
+			t.Run(codec+"/"+tt.name, func(t *testing.T) {
+				value := testEntry(t, tt.payload)
+				stored, _ := decodeCacheEntry(value)
+				key := "test:" + codec + ":" + tt.name
+				if err := backend.Set(context.Background(), key, value, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+				val, err := backend.Get(context.Background(), key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				hit, ok := decodeCacheEntry(val)
+				if !ok {
+					t.Fatal("the entry read back does not decode")
+				}
+				if !bytes.Equal(hit.Payload, stored.Payload) {
+					t.Errorf("hit payload =\n%s\nmiss payload\n%s", hit.Payload, stored.Payload)
+				}
+				if got := payloadETag(hit.Payload); got != stored.ETag {
+					t.Errorf("hit body has ETag %s, stored ETag is %s", got, stored.ETag)
+				}
+			})
+		}
+	}
+}
+
+// TestAstronomyFromCachedForecast serves single dates out of the cached
+// default forecast without a fetch.
+func TestAstronomyFromCachedForecast(t *testing.T) {
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	data, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	value, err := json.Marshal(cacheEntry{FetchedAt: now, FreshUntil: now.Add(time.Hour), Payload: data, ETag: payloadETag(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	forecast := defaultQuery("istanbul")
+	forecast.Range = fmt.Sprintf("next%ddays", defaultForecastDays)
+	cache.Set(context.Background(), forecast.cacheKey(), value, time.Hour)
+
+	tests := []struct {
+		name     string
+		date     string
+		wantMiss bool
+	}{
+		{name: "cached date", date: "2024-01-02"},
+		{name: "other cached date", date: "2024-01-03"},
+		{name: "date outside the forecast", date: "2024-02-01", wantMiss: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			missed := false
+			miss := func(w http.ResponseWriter, r *http.Request) { missed = true }
+			var group singleflight.Group
+			t.Setenv("API_KEY", "test")
+			h := redisMiddleware(miss, parseAstronomyQuery, cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg)
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather/astronomy?country=istanbul&date="+tt.date, nil))
+			if missed != tt.wantMiss {
+				t.Fatalf("missed = %v, want %v", missed, tt.wantMiss)
+			}
+			if tt.wantMiss {
+				return
+			}
+			var weather Weather
+			if err := json.Unmarshal(rec.Body.Bytes(), &weather); err != nil {
+				t.Fatal(err)
+			}
+			if len(weather.Days) != 1 || weather.Days[0].Datetime != tt.date {
+				t.Errorf("served days %+v, want only %s", weather.Days, tt.date)
+			}
+			if got, want := rec.Header().Get("ETag"), payloadETag(rec.Body.Bytes()); got != want {
+				t.Errorf("ETag = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCacheMaxValueSize(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        int
+		wantCached bool
+	}{
+		{name: "under the limit", max: 1 << 20, wantCached: true},
+		{name: "over the limit", max: 10, wantCached: false},
+		{name: "no limit", max: 0, wantCached: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(t)
+			cfg.CacheMaxValueSize = tt.max
+			cache, _ := newTestCache(t, cfg)
+			cache.Set(context.Background(), "test:size", testEntry(t, testWeather), time.Hour)
+			if _, ok := cache.Get(context.Background(), "test:size"); ok != tt.wantCached {
+				t.Errorf("cached = %v, want %v", ok, tt.wantCached)
+			}
+		})
+	}
+}
+
+// TestFallbackWhileRedisDown points the cache at a Redis nothing listens on
+// and checks the lookup keeps serving, caching in the in-process fallback
+// for as long as the entry's TTL.
+func TestFallbackWhileRedisDown(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	mr := miniredis.RunT(t)
+	addr := mr.Addr()
+	mr.Close()
+	client := redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1, DialTimeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	cfg := testConfig(t)
+	// Without the local LRU every hit has to come from the fallback.
+	cfg.LocalCacheSize = 0
+	health := newCacheHealth()
+	cache := newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), health, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+	for i, want := range []string{"MISS", "HIT"} {
+		rec := serveGet(h, "/weather?country=istanbul")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i+1, rec.Code)
+		}
+		if got := rec.Header().Get("X-Cache"); got != want {
+			t.Errorf("request %d: X-Cache = %q, want %s", i+1, got, want)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+	if health.Up() {
+		t.Error("the cache is still reported up")
+	}
+}
+
+// TestCacheCompression stores the same entry with and without compression
+// and checks both read back unchanged, the compressed one in fewer bytes.
+func TestCacheCompression(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	w := Weather{ResolvedAddress: "Istanbul, Türkiye"}
+	for i := 0; i < 15; i++ {
+		w.Days = append(w.Days, Day{Datetime: fmt.Sprintf("2024-01-%02d", i+1), Temp: 8.5, Description: "Partly cloudy throughout the day."})
+	}
+	entry := testEntry(t, w)
+
+	stored := func(key string) int {
+		t.Helper()
+		fields, err := mr.HKeys(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, field := range fields {
+			n += len(mr.HGet(key, field))
+		}
+		return n
+	}
+	sizes := map[bool]int{}
+	for _, compress := range []bool{false, true} {
+		key := fmt.Sprintf("test:compress:%v", compress)
+		b := newRedisBackend(client, cacheCodecs["json"], compress)
+		if err := b.Set(context.Background(), key, entry, time.Hour); err != nil {
+			t.Fatalf("compress=%v: Set: %v", compress, err)
+		}
+		got, err := b.Get(context.Background(), key)
+		if err != nil {
+			t.Fatalf("compress=%v: Get: %v", compress, err)
+		}
+		if !bytes.Equal(got, entry) {
+			t.Errorf("compress=%v: read back\n%s\nwant\n%s", compress, got, entry)
+		}
+		sizes[compress] = stored(key)
+	}
+	if sizes[true] >= sizes[false] {
+		t.Errorf("compressed entry takes %d bytes, plain JSON %d", sizes[true], sizes[false])
+	}
+}
+
+// testCacheContract checks the behaviour every Cache backend must share:
+// misses, round trips, overwrites, deletes and pings.
+func testCacheContract(t *testing.T, c Cache) {
+	t.Helper()
+	ctx := context.Background()
+	key := defaultQuery("istanbul").cacheKey()
+	if _, err := c.Get(ctx, key); err != errCacheMiss {
+		t.Fatalf("Get of a missing key: error = %v, want errCacheMiss", err)
+	}
+	first, second := testEntry(t, testWeather), testEntry(t, Weather{ResolvedAddress: "Ankara, Türkiye"})
+	for i, value := range [][]byte{first, second} {
+		if err := c.Set(ctx, key, value, time.Hour); err != nil {
+			t.Fatalf("Set %d: %v", i+1, err)
+		}
+		got, err := c.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Get after Set %d: %v", i+1, err)
+		}
+		if !bytes.Equal(got, value) {
+			t.Errorf("Get after Set %d = %s, want %s", i+1, got, value)
+		}
+	}
+	if err := c.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Get(ctx, key); err != errCacheMiss {
+		t.Errorf("Get after Delete: error = %v, want errCacheMiss", err)
+	}
+	if err := c.Delete(ctx, key); err != nil {
+		t.Errorf("Delete of a missing key: %v", err)
+	}
+	if err := c.Ping(ctx); err != nil {
+		t.Errorf("Ping: %v", err)
+	}
+}
+
+func TestCacheContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) Cache{
+		"redis": func(t *testing.T) Cache {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return newRedisBackend(client, cacheCodecs["json"], true)
+		},
+		"redis msgpack": func(t *testing.T) Cache {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { client.Close() })
+			return newRedisBackend(client, cacheCodecs["msgpack"], false)
+		},
+		"memcached": func(t *testing.T) Cache {
+			b := newMemcacheBackend(Config{MemcacheAddrs: []string{fakeMemcached(t)}, CacheCodec: "json", CacheCompression: true})
+			t.Cleanup(func() { b.Close() })
+			return b
+		},
+		"in-memory fake": func(t *testing.T) Cache { return &switchableCache{} },
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) { testCacheContract(t, backend(t)) })
+	}
+}
+
+// TestLookupOverFakeBackend serves /weather over the in-memory fake backend
+// instead of Redis.
+func TestLookupOverFakeBackend(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.LocalCacheSize = 0
+	backend := &switchableCache{}
+	cache := newTieredCache(backend, newCacheHealth(), cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+	var bodies []string
+	for i, want := range []string{"MISS", "HIT"} {
+		rec := serveGet(h, "/weather?country=istanbul")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != want {
+			t.Errorf("request %d: status %d, X-Cache %q, want 200 %s", i+1, rec.Code, rec.Header().Get("X-Cache"), want)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("the hit served\n%s\nthe miss\n%s", bodies[1], bodies[0])
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+	if _, err := backend.Get(context.Background(), defaultQuery("istanbul").cacheKey()); err != nil {
+		t.Errorf("the entry is not in the backend: %v", err)
+	}
+}
+
+// TestCacheEntryFetchedAt checks the fetch time survives the cache, that
+// values stored before the envelope still decode, and what each reports.
+func TestCacheEntryFetchedAt(t *testing.T) {
+	stubProvider(t, 0, http.StatusOK)
+	h, cache, mr := testLookup(t, testConfig(t))
+	ctx := context.Background()
+
+	t.Run("round trip", func(t *testing.T) {
+		value := testEntry(t, testWeather)
+		want, _ := decodeCacheEntry(value)
+		if err := cache.backend.Set(ctx, "test:fetched", value, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		got, err := cache.backend.Get(ctx, "test:fetched")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry, ok := decodeCacheEntry(got); !ok || !entry.FetchedAt.Equal(want.FetchedAt) {
+			t.Errorf("fetchedAt = %v after the round trip, want %v", entry.FetchedAt, want.FetchedAt)
+		}
+	})
+
+	t.Run("legacy value", func(t *testing.T) {
+		raw, err := json.Marshal(testWeather)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, ok := decodeCacheEntry(raw)
+		if !ok || !bytes.Equal(entry.Payload, raw) {
+			t.Fatalf("decodeCacheEntry() = %+v, %v, want the value as payload", entry, ok)
+		}
+		if !entry.FetchedAt.IsZero() || !entry.FreshUntil.IsZero() {
+			t.Errorf("a legacy value decoded with times %v, %v, want none", entry.FetchedAt, entry.FreshUntil)
+		}
+
+		mr.Set(defaultQuery("ankara").cacheKey(), string(raw))
+		rec := serveGet(h, "/weather?country=ankara")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("X-Stale") != "true" {
+			t.Errorf("status %d, X-Cache %q, X-Stale %q, want a stale hit", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("X-Stale"))
+		}
+		if got := rec.Header().Get("X-Fetched-At"); got != "" {
+			t.Errorf("X-Fetched-At = %q for a value of unknown age", got)
+		}
+		// The stale hit refreshes the value in the background.
+		for deadline := time.Now().Add(2 * time.Second); ; time.Sleep(5 * time.Millisecond) {
+			val, _ := cache.Get(ctx, defaultQuery("ankara").cacheKey())
+			if entry, _ := decodeCacheEntry(val); !entry.FetchedAt.IsZero() {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the legacy value was never replaced")
+			}
+		}
+	})
+
+	t.Run("header", func(t *testing.T) {
+		freshUntil := time.Now().Add(time.Hour).Truncate(time.Second)
+		cache.Set(ctx, defaultQuery("izmir").cacheKey(), entryFreshUntil(t, freshUntil), time.Hour)
+		rec := serveGet(h, "/weather?country=izmir")
+		if want := freshUntil.Add(-time.Minute).UTC().Format(time.RFC3339); rec.Header().Get("X-Fetched-At") != want {
+			t.Errorf("X-Fetched-At = %q, want %q", rec.Header().Get("X-Fetched-At"), want)
+		}
+	})
+}
+
+// TestOversizedPayloadServed fetches a response over CacheMaxValueSize and
+// checks it reaches the client without being written to Redis.
+func TestOversizedPayloadServed(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.CacheMaxValueSize = 64
+	h, cache, mr := testLookup(t, cfg)
+
+	for i := 1; i <= 2; i++ {
+		var rec *httptest.ResponseRecorder
+		out := captureStdout(t, func() { rec = serveGet(h, "/weather?country=istanbul") })
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want 200", i, rec.Code)
+		}
+		var got Weather
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.ResolvedAddress != testWeather.ResolvedAddress {
+			t.Errorf("request %d: body %s does not hold the forecast", i, rec.Body)
+		}
+		if !strings.Contains(out, "is over the limit of 64") {
+			t.Errorf("request %d: the skipped write was not logged:\n%s", i, out)
+		}
+	}
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("Redis holds %v", keys)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("provider called %d times, want 2 since nothing was cached", got)
+	}
+	if got := cache.oversized.Load(); got != 2 {
+		t.Errorf("%d oversized entries counted, want 2", got)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `Usage:
+  weather-api [serve] [--rate-limit RPS] [--rate-burst N]
+                                       run the HTTP server, overriding
+                                       RATE_LIMIT_RPS and RATE_LIMIT_BURST
+  weather-api fetch [--json] LOCATION  print the provider's weather for LOCATION
+  weather-api flush [--json] [PATTERN] delete the cached locations matching PATTERN, all by default
+`
+
+// runCLI dispatches args to a subcommand and returns the process exit code:
+// 0 on success, 1 when the command fails and 2 on a usage error.
+func runCLI(args []string) int {
+	cmd := "serve"
+	if len(args) > 0 && (!strings.HasPrefix(args[0], "-") || args[0] == "-h" || args[0] == "--help") {
+		cmd, args = args[0], args[1:]
+	}
+	var run func(cfg Config, args []string, stdout io.Writer) error
+	switch cmd {
+	case "serve":
+		run = serveCommand
+	case "fetch":
+		run = fetchCommand
+	case "flush":
+		run = flushCommand
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		return 2
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error loading config :", err)
+		return 1
+	}
+	if err := run(cfg, args, os.Stdout); err != nil {
+		if uerr, ok := err.(usageError); ok {
+			fmt.Fprintf(os.Stderr, "%s\n\n%s", uerr.msg, usage)
+			return 2
+		}
+		fmt.Fprintln(os.Stderr, "Error :", err)
+		return 1
+	}
+	return 0
+}
+
+// usageError reports arguments a command cannot run with.
+type usageError struct {
+	msg string
+}
+
+func (e usageError) Error() string {
+	return e.msg
+}
+
+// parseCommandFlags parses the --json flag every command accepts, returning
+// the remaining positional arguments.
+func parseCommandFlags(name string, args []string) (jsonOutput bool, rest []string, err error) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&jsonOutput, "json", false, "print machine-readable JSON")
+	if err := fs.Parse(args); err != nil {
+		return false, nil, usageError{fmt.Sprintf("%s: %v", name, err)}
+	}
+	return jsonOutput, fs.Args(), nil
+}
+
+// startServer is what serveCommand runs the server with. Tests replace it
+// to check the configuration it gets.
+var startServer = serve
+
+// serveCommand runs the server, with flags overriding the rate limit
+// configuration.
+func serveCommand(cfg Config, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Float64Var(&cfg.RateLimitRPS, "rate-limit", cfg.RateLimitRPS, "requests per second per client, 0 to disable")
+	fs.IntVar(&cfg.RateLimitBurst, "rate-burst", cfg.RateLimitBurst, "requests a client can make at once")
+	if err := fs.Parse(args); err != nil {
+		return usageError{fmt.Sprintf("serve: %v", err)}
+	}
+	if fs.NArg() > 0 {
+		return usageError{"serve takes no arguments"}
+	}
+	if err := validateRateLimit(cfg.RateLimitRPS, cfg.RateLimitBurst); err != nil {
+		return usageError{err.Error()}
+	}
+	return startServer(cfg)
+}
+
+// fetchCommand prints the weather for a location straight from the provider,
+// bypassing the cache. It is indented unless --json asks for one line.
+func fetchCommand(cfg Config, args []string, stdout io.Writer) error {
+	jsonOutput, args, err := parseCommandFlags("fetch", args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return usageError{"fetch takes exactly one location"}
+	}
+	if err := validateLocation("location", args[0]); err != nil {
+		return usageError{err.Error()}
+	}
+	weather, err := getWeatherValue(context.Background(), defaultQuery(args[0]), os.Getenv("API_KEY"), cfg.UpstreamMaxBodySize)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(stdout)
+	if !jsonOutput {
+		enc.SetIndent("", "  ")
+	}
+	return enc.Encode(weather)
+}
+
+// flushCommand deletes the cached variants of every location matching a glob
+// pattern, as DELETE /admin/cache?pattern= does, and prints how many keys went.
+func flushCommand(cfg Config, args []string, stdout io.Writer) error {
+	jsonOutput, args, err := parseCommandFlags("flush", args)
+	if err != nil {
+		return err
+	}
+	if len(args) > 1 {
+		return usageError{"flush takes at most one pattern"}
+	}
+	pattern := "*"
+	if len(args) == 1 {
+		pattern = args[0]
+	}
+	backend, err := newCacheBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to cache: %v", err)
+	}
+	cache := newTieredCache(backend, newCacheHealth(), cfg)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	deleted, err := cache.DeleteMatching(ctx, locationPattern(pattern))
+	if err != nil {
+		return err
+	}
+	if jsonOutput {
+		return json.NewEncoder(stdout).Encode(map[string]int64{"deleted": deleted})
+	}
+	_, err = fmt.Fprintf(stdout, "deleted %d keys\n", deleted)
+	return err
+}
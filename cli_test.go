@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"golang.org/x/time/rate"
+)
+
+func TestFetchCommandValidatesLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+	}{
+		{name: "path traversal", location: "../../admin"},
+		{name: "control character", location: "a\tb"},
+		{name: "only dots", location: "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// No API key, so an unvalidated location would fail on the fetch
+			// rather than as a usage error.
+			t.Setenv("API_KEY", "")
+			var stdout bytes.Buffer
+			err := fetchCommand(testConfig(t), []string{tt.location}, &stdout)
+			var uerr usageError
+			if !errors.As(err, &uerr) {
+				t.Fatalf("fetchCommand() error = %v, want a usage error", err)
+			}
+			if stdout.Len() != 0 {
+				t.Errorf("fetchCommand() printed %q", stdout.String())
+			}
+		})
+	}
+}
+
+func TestRunCLIFetchInvalidLocationExitCode(t *testing.T) {
+	if code := runCLI([]string{"fetch", "a/b"}); code != 2 {
+		t.Errorf("runCLI() = %d, want 2", code)
+	}
+}
+
+// stubServer replaces the server serveCommand starts, recording the
+// configuration of each start instead.
+func stubServer(t *testing.T) *[]Config {
+	t.Helper()
+	var started []Config
+	prev := startServer
+	t.Cleanup(func() { startServer = prev })
+	startServer = func(cfg Config) error {
+		started = append(started, cfg)
+		return nil
+	}
+	return &started
+}
+
+func TestServeCommandRateLimitFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		args      []string
+		wantErr   string
+		wantRPS   float64
+		wantBurst int
+	}{
+		{name: "configured defaults", wantRPS: 2, wantBurst: 10},
+		{name: "both flags", args: []string{"--rate-limit", "0.5", "--rate-burst", "3"}, wantRPS: 0.5, wantBurst: 3},
+		{name: "disabled", args: []string{"--rate-limit", "0", "--rate-burst", "0"}, wantRPS: 0, wantBurst: 0},
+		{name: "negative rate", args: []string{"--rate-limit", "-1"}, wantErr: "invalid rate limit -1: must be a non-negative number of requests per second"},
+		{name: "not a number", args: []string{"--rate-limit", "NaN"}, wantErr: "invalid rate limit NaN"},
+		{name: "unparsable rate", args: []string{"--rate-limit", "fast"}, wantErr: `serve: invalid value "fast" for flag -rate-limit`},
+		{name: "zero burst", args: []string{"--rate-burst", "0"}, wantErr: "invalid rate limit burst 0: must be positive"},
+		{name: "stray argument", args: []string{"now"}, wantErr: "serve takes no arguments"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := stubServer(t)
+			cfg := testConfig(t)
+			cfg.RateLimitRPS, cfg.RateLimitBurst = 2, 10
+			err := serveCommand(cfg, tt.args, io.Discard)
+			if tt.wantErr != "" {
+				var uerr usageError
+				if !errors.As(err, &uerr) || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("serveCommand() error = %v, want a usage error starting %q", err, tt.wantErr)
+				}
+				if len(*started) != 0 {
+					t.Error("the server was started with an invalid rate limit")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("serveCommand() error = %v", err)
+			}
+			if len(*started) != 1 {
+				t.Fatalf("the server was started %d times, want once", len(*started))
+			}
+			if got := (*started)[0]; got.RateLimitRPS != tt.wantRPS || got.RateLimitBurst != tt.wantBurst {
+				t.Errorf("started with %v rps, burst %d, want %v, %d", got.RateLimitRPS, got.RateLimitBurst, tt.wantRPS, tt.wantBurst)
+			}
+		})
+	}
+}
+
+// TestRunCLIInvalidRateLimitEnv checks an invalid RATE_LIMIT_* variable
+// stops the server before it starts.
+func TestRunCLIInvalidRateLimitEnv(t *testing.T) {
+	started := stubServer(t)
+	t.Setenv("RATE_LIMIT_RPS", "-3")
+	if code := runCLI([]string{"serve"}); code != 1 {
+		t.Errorf("runCLI() = %d, want 1", code)
+	}
+	if len(*started) != 0 {
+		t.Error("the server was started")
+	}
+}
+
+// TestRateLimitFlagsDriveLimiter starts the server with rate limit flags
+// and checks a limiter built from the configuration it got, as serve
+// builds the weather limiter, throttles at that burst.
+func TestRateLimitFlagsDriveLimiter(t *testing.T) {
+	starts := stubServer(t)
+	if err := serveCommand(testConfig(t), []string{"--rate-limit", "0.01", "--rate-burst", "3"}, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	started := (*starts)[0]
+	limiter := newIPLimiters(rate.Limit(started.RateLimitRPS), started.RateLimitBurst, started.RateLimitIdleTTL)
+	h := rateLimiterMiddleware(func(w http.ResponseWriter, r *http.Request) {}, limiter)
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		rec := serveGet(h, "/weather")
+		if rec.Code != want {
+			t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+		if got := rec.Header().Get("X-RateLimit-Limit"); got != "3" {
+			t.Errorf("request %d: X-RateLimit-Limit = %q, want 3", i+1, got)
+		}
+	}
+}
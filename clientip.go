@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// unknownIP is the client key of requests without a valid client address.
+// Such requests share a single rate limiter bucket.
+const unknownIP = "unknown"
+
+// defaultIPv6PrefixBits is how much of an IPv6 address identifies a client
+// when the prefix length is not configured. A /64 is the smallest network
+// usually handed to a single subscriber.
+const defaultIPv6PrefixBits = 64
+
+type clientIPKey struct{}
+
+// clientIP is a request's client address and the key it is rate limited by.
+type clientIP struct {
+	addr netip.Addr
+	key  string
+}
+
+// clientIPMiddleware works out each request's client address once for every
+// handler to read with getIP. X-Forwarded-For and X-Real-IP are only
+// believed when the connection comes from one of the trusted proxies;
+// anyone else could set them to pose as any client. IPv6 clients are keyed
+// by their first ipv6Bits bits, since one subscriber can pick any address
+// in its network.
+func clientIPMiddleware(next http.Handler, trusted []netip.Prefix, ipv6Bits int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, trusted)
+		client := clientIP{addr: ip, key: limiterKey(ip, ipv6Bits)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, client)))
+	})
+}
+
+// getIP returns the client address of r, which is invalid when unknown.
+func getIP(r *http.Request) netip.Addr {
+	if client, ok := r.Context().Value(clientIPKey{}).(clientIP); ok {
+		return client.addr
+	}
+	return resolveClientIP(r, nil)
+}
+
+// clientKey returns the key r's client is rate limited by: its IPv4
+// address, its IPv6 network or unknownIP.
+func clientKey(r *http.Request) string {
+	if client, ok := r.Context().Value(clientIPKey{}).(clientIP); ok {
+		return client.key
+	}
+	return limiterKey(resolveClientIP(r, nil), defaultIPv6PrefixBits)
+}
+
+func limiterKey(ip netip.Addr, ipv6Bits int) string {
+	switch {
+	case !ip.IsValid():
+		return unknownIP
+	case ip.Is4():
+		return ip.String()
+	}
+	prefix, err := ip.Prefix(ipv6Bits)
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.String()
+}
+
+func resolveClientIP(r *http.Request, trusted []netip.Prefix) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote, ok := parseIP(host)
+	if !ok {
+		return netip.Addr{}
+	}
+	if !inPrefixes(remote, trusted) {
+		return remote
+	}
+
+	// Each proxy appends the address it received the request from, so the
+	// rightmost entry that is not one of our proxies is the client. Entries
+	// left of it were supplied by the client and cannot be believed.
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		client := remote
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, ok := parseIP(hops[i])
+			if !ok {
+				return netip.Addr{}
+			}
+			client = hop
+			if !inPrefixes(hop, trusted) {
+				break
+			}
+		}
+		return client
+	}
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		ip, _ := parseIP(realIP)
+		return ip
+	}
+	return remote
+}
+
+// parseIP parses an address as found in RemoteAddr or a forwarding header,
+// with or without a port. IPv4-mapped IPv6 addresses are unmapped and zones
+// dropped so that each client has a single spelling.
+func parseIP(s string) (netip.Addr, bool) {
+	s = strings.TrimSpace(s)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	ip, err := netip.ParseAddr(strings.Trim(s, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ip.Unmap().WithZone(""), true
+}
+
+func inPrefixes(ip netip.Addr, prefixes []netip.Prefix) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolveClientIP(t *testing.T) {
+	trusted := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		realIP     string
+		want       string
+	}{
+		{name: "direct", remoteAddr: "192.0.2.1:1234", want: "192.0.2.1"},
+		{name: "untrusted forwarding ignored", remoteAddr: "192.0.2.1:1234", forwarded: []string{"198.51.100.7"}, want: "192.0.2.1"},
+		{name: "trusted proxy", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "spoofed left entries", remoteAddr: "10.0.0.1:1234", forwarded: []string{"203.0.113.9, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "chain of proxies", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7, 10.0.0.2"}, want: "198.51.100.7"},
+		{name: "several headers", remoteAddr: "10.0.0.1:1234", forwarded: []string{"198.51.100.7", "10.0.0.2"}, want: "198.51.100.7"},
+		{name: "garbage hop", remoteAddr: "10.0.0.1:1234", forwarded: []string{"nonsense"}, want: "invalid IP"},
+		{name: "X-Real-IP", remoteAddr: "10.0.0.1:1234", realIP: "198.51.100.7", want: "198.51.100.7"},
+		{name: "IPv4-mapped", remoteAddr: "[::ffff:192.0.2.1]:1234", want: "192.0.2.1"},
+		{name: "IPv6 zone", remoteAddr: "[fe80::1%eth0]:1234", want: "fe80::1"},
+		{name: "no address", remoteAddr: "", want: "invalid IP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			r.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.forwarded {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := resolveClientIP(r, trusted).String(); got != tt.want {
+				t.Errorf("resolveClientIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimiterKey(t *testing.T) {
+	tests := []struct {
+		ip       string
+		ipv6Bits int
+		want     string
+	}{
+		{ip: "192.0.2.1", ipv6Bits: 64, want: "192.0.2.1"},
+		{ip: "2001:db8:1:2:3:4:5:6", ipv6Bits: 64, want: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2:ffff::1", ipv6Bits: 64, want: "2001:db8:1:2::/64"},
+		{ip: "2001:db8:1:2:3:4:5:6", ipv6Bits: 48, want: "2001:db8:1::/48"},
+		{ip: "", ipv6Bits: 64, want: unknownIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			var ip netip.Addr
+			if tt.ip != "" {
+				ip = netip.MustParseAddr(tt.ip)
+			}
+			if got := limiterKey(ip, tt.ipv6Bits); got != tt.want {
+				t.Errorf("limiterKey(%s, %d) = %s, want %s", tt.ip, tt.ipv6Bits, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// cacheCodec converts encoded cache entries, which are JSON in process, to
+// the format they are stored in and back.
+type cacheCodec interface {
+	Encode(value []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// cacheCodecs holds the codecs CACHE_CODEC can select.
+var cacheCodecs = map[string]cacheCodec{
+	"json":    jsonCodec{},
+	"msgpack": msgpackCodec{},
+}
+
+// msgpackMarker starts every msgpack value. It is a byte msgpack never uses
+// and JSON cannot start with, so values of both formats decode correctly
+// while instances with different CACHE_CODEC settings share a cache.
+const msgpackMarker = 0xc1
+
+// jsonCodec stores values as they are. Their leading '{' serves as the
+// format marker, which keeps them readable by builds without codecs.
+type jsonCodec struct{}
+
+func (jsonCodec) Encode(value []byte) ([]byte, error) { return value, nil }
+func (jsonCodec) Decode(data []byte) ([]byte, error)  { return data, nil }
+
+// msgpackCodec transcodes JSON to msgpack and back, keeping the order of
+// object keys and the formatting of numbers, so that a value comes back as
+// the bytes it was stored as.
+type msgpackCodec struct{}
+
+func (msgpackCodec) Encode(value []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(value))
+	dec.UseNumber()
+	v, err := readJSON(dec)
+	if err != nil {
+		return nil, err
+	}
+	// Compact floats store the many whole numbers in a forecast as small
+	// ints instead of 9-byte doubles.
+	buf := bytes.NewBuffer([]byte{msgpackMarker})
+	enc := msgpack.NewEncoder(buf)
+	enc.UseCompactFloats(true)
+	enc.UseCompactInts(true)
+	if err := writeMsgpack(enc, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := readMsgpack(msgpack.NewDecoder(bytes.NewReader(data[1:])), &buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonObject is a JSON object with its keys in order.
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	key   string
+	value any
+}
+
+// readJSON reads the next value from dec, which must use numbers, with
+// objects as jsonObject.
+func readJSON(dec *json.Decoder) (any, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := jsonObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := readJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, jsonMember{key: key.(string), value: value})
+		}
+		_, err := dec.Token()
+		return obj, err
+	case json.Delim('['):
+		arr := []any{}
+		for dec.More() {
+			value, err := readJSON(dec)
+			if err != nil {
+				return nil, err
+			}
+			arr = append(arr, value)
+		}
+		_, err := dec.Token()
+		return arr, err
+	}
+	return tok, nil
+}
+
+func writeMsgpack(enc *msgpack.Encoder, v any) error {
+	switch v := v.(type) {
+	case jsonObject:
+		if err := enc.EncodeMapLen(len(v)); err != nil {
+			return err
+		}
+		for _, m := range v {
+			if err := enc.EncodeString(m.key); err != nil {
+				return err
+			}
+			if err := writeMsgpack(enc, m.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []any:
+		if err := enc.EncodeArrayLen(len(v)); err != nil {
+			return err
+		}
+		for _, value := range v {
+			if err := writeMsgpack(enc, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return enc.EncodeInt(n)
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		return enc.EncodeFloat64(f)
+	}
+	return enc.Encode(v)
+}
+
+// readMsgpack writes the next value of dec to buf as JSON.
+func readMsgpack(dec *msgpack.Decoder, buf *bytes.Buffer) error {
+	code, err := dec.PeekCode()
+	if err != nil {
+		return err
+	}
+	switch {
+	case msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32:
+		n, err := dec.DecodeMapLen()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('{')
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			key, err := dec.DecodeString()
+			if err != nil {
+				return err
+			}
+			if err := writeJSONValue(buf, key); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := readMsgpack(dec, buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+		return nil
+	case msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32:
+		n, err := dec.DecodeArrayLen()
+		if err != nil {
+			return err
+		}
+		buf.WriteByte('[')
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := readMsgpack(dec, buf); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+		return nil
+	}
+	v, err := dec.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	return writeJSONValue(buf, v)
+}
+
+func writeJSONValue(buf *bytes.Buffer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
+
+// decodeValue undoes the compression and codec a stored value was written
+// with, whatever the current settings.
+func decodeValue(val string) (string, error) {
+	val, err := decompressValue(val)
+	if err != nil || len(val) == 0 || val[0] != msgpackMarker {
+		return val, err
+	}
+	data, err := msgpackCodec{}.Decode([]byte(val))
+	return string(data), err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// forecastEntry returns the entry of a 15-day forecast with hourly data,
+// the largest shape the service caches.
+func forecastEntry(t testing.TB) []byte {
+	w := Weather{ResolvedAddress: "Istanbul, Türkiye", Timezone: "Europe/Istanbul", Meta: &weatherMeta{Units: "metric", weatherUnits: unitGroups["metric"]}}
+	for d := 0; d < 15; d++ {
+		day := Day{Datetime: fmt.Sprintf("2024-01-%02d", d+1), Temp: 8.5 + float64(d), FeelsLike: 6, WindSpeed: 14.2, Visibility: 10, UVIndex: 2, Sunrise: "08:27:11", Sunset: "17:51:03", Icon: "partly-cloudy-day", Description: "Partly cloudy throughout the day."}
+		for h := 0; h < 24; h++ {
+			day.Hours = append(day.Hours, Hour{Datetime: fmt.Sprintf("%02d:00:00", h), Temp: 7 + float64(h)/10, WindSpeed: 12, Icon: "cloudy", Conditions: "Overcast"})
+		}
+		w.Days = append(w.Days, day)
+	}
+	return testEntry(t, w)
+}
+
+// TestCacheCodecRoundTrip checks every codec gives back the bytes it was
+// given, for values as encoding/json writes them.
+func TestCacheCodecRoundTrip(t *testing.T) {
+	values := map[string][]byte{
+		"forecast": forecastEntry(t),
+		"negative": []byte(`{"fetchedAt":"2024-01-01T00:00:00Z","status":400,"error":"Bad API Request"}`),
+		"numbers":  []byte(`{"int":3,"neg":-12,"float":0.1,"exp":1e+21,"small":-7.25e-7}`),
+		"nesting":  []byte(`{"a":[1,[2,{"b":null}],true,false],"empty":{},"list":[]}`),
+		"strings":  []byte(`{"s":"Cloudy \u003cand\u003e cold","u":"İstanbul","q":"\"quoted\"\n"}`),
+	}
+	for name, codec := range cacheCodecs {
+		for valueName, value := range values {
+			t.Run(name+"/"+valueName, func(t *testing.T) {
+				data, err := codec.Encode(value)
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				if wantMsgpack := name == "msgpack"; (data[0] == msgpackMarker) != wantMsgpack {
+					t.Errorf("encoded value starts with %#x", data[0])
+				}
+				got, err := codec.Decode(data)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !bytes.Equal(got, value) {
+					t.Errorf("round trip =\n%s\nwant\n%s", got, value)
+				}
+				// Whatever codec wrote it, a stored value decodes the same.
+				if got, err := decodeValue(string(data)); err != nil || got != string(value) {
+					t.Errorf("decodeValue() = %s, %v, want the value back", got, err)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkCacheCodec encodes and decodes a 15-day forecast with each
+// codec, reporting the stored size alongside the time.
+func BenchmarkCacheCodec(b *testing.B) {
+	entry := forecastEntry(b)
+	for _, name := range []string{"json", "msgpack"} {
+		codec := cacheCodecs[name]
+		b.Run(name, func(b *testing.B) {
+			data, err := codec.Encode(entry)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				data, err := codec.Encode(entry)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(data)), "stored-bytes")
+		})
+	}
+}
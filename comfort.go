@@ -0,0 +1,98 @@
+package main
+
+import "math"
+
+// Heat index is only given from heatIndexMinC, where the formula holds, and
+// wind chill up to windChillMaxC and from windChillMinKmh.
+const (
+	heatIndexMinC   = 27
+	windChillMaxC   = 10
+	windChillMinKmh = 4.8
+)
+
+// toCelsius and fromCelsius convert temperatures of a unit group's unit.
+func toCelsius(v float64, units string) float64 {
+	switch unitGroups[units].Temperature {
+	case "°F":
+		return (v - 32) * 5 / 9
+	case "K":
+		return v - 273.15
+	}
+	return v
+}
+
+func fromCelsius(v float64, units string) float64 {
+	switch unitGroups[units].Temperature {
+	case "°F":
+		return v*9/5 + 32
+	case "K":
+		return v + 273.15
+	}
+	return v
+}
+
+// toKmh converts a wind speed of a unit group's unit.
+func toKmh(v float64, units string) float64 {
+	switch unitGroups[units].WindSpeed {
+	case "mph":
+		return v * 1.609344
+	case "m/s":
+		return v * 3.6
+	}
+	return v
+}
+
+// heatIndex is the NWS heat index, the Rothfusz regression with its
+// adjustments for dry and for humid air, of t°C at humidity rh percent.
+func heatIndex(t, rh float64) float64 {
+	f := t*9/5 + 32
+	hi := -42.379 + 2.04901523*f + 10.14333127*rh - 0.22475541*f*rh -
+		0.00683783*f*f - 0.05481717*rh*rh + 0.00122874*f*f*rh +
+		0.00085282*f*rh*rh - 0.00000199*f*f*rh*rh
+	switch {
+	case rh < 13 && f <= 112:
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(f-95))/17)
+	case rh > 85 && f <= 87:
+		hi += (rh - 85) / 10 * (87 - f) / 5
+	}
+	return (hi - 32) * 5 / 9
+}
+
+// windChill is the wind chill index of North America, of t°C in a wind of
+// v km/h.
+func windChill(t, v float64) float64 {
+	p := math.Pow(v, 0.16)
+	return 13.12 + 0.6215*t - 11.37*p + 0.3965*t*p
+}
+
+// dewPoint is the Magnus approximation of the dew point of t°C at humidity
+// rh percent, with the constants of Alduchov and Eskridge.
+func dewPoint(t, rh float64) float64 {
+	const a, b = 17.625, 243.04
+	g := math.Log(rh/100) + a*t/(b+t)
+	return b * g / (a - g)
+}
+
+// deriveComfort sets the heat index, wind chill and dew point of day, in the
+// units of its unit group, from its temperature, wind speed and humidity.
+// Those without the inputs they need, or outside the conditions their
+// formula holds in, are left out.
+func (day *Day) deriveComfort(units string) {
+	day.HeatIndex, day.WindChill, day.DewPoint = nil, nil, nil
+	t := toCelsius(day.Temp, units)
+	derived := func(c float64) *float64 {
+		v := math.Round(fromCelsius(c, units)*10) / 10
+		return &v
+	}
+	if v := toKmh(day.WindSpeed, units); t <= windChillMaxC && v > windChillMinKmh {
+		day.WindChill = derived(windChill(t, v))
+	}
+	if day.Humidity == nil || *day.Humidity <= 0 {
+		return
+	}
+	rh := min(*day.Humidity, 100)
+	if t >= heatIndexMinC {
+		day.HeatIndex = derived(heatIndex(t, rh))
+	}
+	day.DewPoint = derived(dewPoint(t, rh))
+}
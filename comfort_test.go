@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestComfortFormulas checks the formulas against the NWS heat index chart,
+// the wind chill tables of Environment Canada and the NWS, and the dew
+// points the Magnus approximation is known for.
+func TestComfortFormulas(t *testing.T) {
+	tests := []struct {
+		name string
+		got  float64
+		want float64
+		tol  float64
+	}{
+		{name: "heat index 90°F 60%", got: fromCelsius(heatIndex(toCelsius(90, "us"), 60), "us"), want: 100, tol: 0.5},
+		{name: "heat index 100°F 40%", got: fromCelsius(heatIndex(toCelsius(100, "us"), 40), "us"), want: 109, tol: 0.5},
+		{name: "heat index 96°F 65%", got: fromCelsius(heatIndex(toCelsius(96, "us"), 65), "us"), want: 121, tol: 0.5},
+		{name: "heat index 86°F 90%", got: fromCelsius(heatIndex(toCelsius(86, "us"), 90), "us"), want: 105, tol: 0.5},
+		{name: "wind chill -10°C 20 km/h", got: windChill(-10, 20), want: -18, tol: 0.5},
+		{name: "wind chill 5°C 10 km/h", got: windChill(5, 10), want: 3, tol: 0.5},
+		{name: "wind chill -20°C 30 km/h", got: windChill(-20, 30), want: -33, tol: 0.5},
+		{name: "wind chill 0°F 15 mph", got: fromCelsius(windChill(toCelsius(0, "us"), toKmh(15, "us")), "us"), want: -19, tol: 0.5},
+		{name: "dew point 30°C 50%", got: dewPoint(30, 50), want: 18.4, tol: 0.05},
+		{name: "dew point 20°C 60%", got: dewPoint(20, 60), want: 12, tol: 0.05},
+		{name: "dew point saturated", got: dewPoint(25, 100), want: 25, tol: 0.05},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if math.Abs(tt.got-tt.want) > tt.tol {
+				t.Errorf("got %.2f, want %.2f", tt.got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDeriveComfort(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name                              string
+		units                             string
+		day                               Day
+		wantHeat, wantChill, wantDewPoint *float64
+	}{
+		{
+			name:  "hot metric day",
+			units: "metric",
+			day:   Day{Temp: 32.2, WindSpeed: 10, Humidity: ptr(60)},
+			// 90°F at 60% is 100°F on the NWS chart.
+			wantHeat: ptr(37.5), wantDewPoint: ptr(23.5),
+		},
+		{
+			name:     "hot us day",
+			units:    "us",
+			day:      Day{Temp: 90, WindSpeed: 6, Humidity: ptr(60)},
+			wantHeat: ptr(99.7), wantDewPoint: ptr(74.3),
+		},
+		{
+			name:      "cold uk day",
+			units:     "uk",
+			day:       Day{Temp: -10, WindSpeed: 12.4274, Humidity: ptr(80)},
+			wantChill: ptr(-17.9), wantDewPoint: ptr(-12.8),
+		},
+		{
+			name:      "cold base day",
+			units:     "base",
+			day:       Day{Temp: 263.15, WindSpeed: 5.5556},
+			wantChill: ptr(255.3),
+		},
+		{
+			name:         "mild day",
+			units:        "metric",
+			day:          Day{Temp: 18, WindSpeed: 20, Humidity: ptr(50)},
+			wantDewPoint: ptr(7.4),
+		},
+		{
+			name:  "calm cold day without humidity",
+			units: "metric",
+			day:   Day{Temp: 2, WindSpeed: 4},
+		},
+		{
+			name:  "hot day without humidity",
+			units: "metric",
+			day:   Day{Temp: 35, WindSpeed: 10, HeatIndex: ptr(40)},
+		},
+	}
+	show := func(v *float64) any {
+		if v == nil {
+			return nil
+		}
+		return *v
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			day := tt.day
+			day.deriveComfort(tt.units)
+			for _, f := range []struct {
+				name      string
+				got, want *float64
+			}{
+				{"heatIndex", day.HeatIndex, tt.wantHeat},
+				{"windChill", day.WindChill, tt.wantChill},
+				{"dewPoint", day.DewPoint, tt.wantDewPoint},
+			} {
+				if (f.got == nil) != (f.want == nil) || f.got != nil && *f.got != *f.want {
+					t.Errorf("%s = %v, want %v", f.name, show(f.got), show(f.want))
+				}
+			}
+		})
+	}
+}
+
+// TestFetchPayloadComfort checks that the humidity the provider sends is
+// kept and the derived fields are sent, and left out rather than zero when
+// it sends none.
+func TestFetchPayloadComfort(t *testing.T) {
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"timezone":"Europe/Istanbul","days":[` +
+			`{"datetime":"2024-07-01","temp":32.2,"windspeed":10,"humidity":60},` +
+			`{"datetime":"2024-07-02","temp":32.2,"windspeed":10}]}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte(body))), Request: r}, nil
+	})
+	data, err := fetchPayload(context.Background(), newUpstreamBudget(0, 0, time.UTC, nil), defaultQuery("istanbul"), "test", Config{UpstreamMaxBodySize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Days []map[string]any `json:"days"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Days) != 2 {
+		t.Fatalf("got %d days, want 2", len(got.Days))
+	}
+	if got.Days[0]["humidity"] != 60.0 || got.Days[0]["heatIndex"] != 37.5 || got.Days[0]["dewPoint"] != 23.5 {
+		t.Errorf("first day = %v, want humidity, heat index and dew point", got.Days[0])
+	}
+	for _, name := range []string{"humidity", "heatIndex", "windChill", "dewPoint"} {
+		if v, ok := got.Days[1][name]; ok {
+			t.Errorf("%s = %v on a day without humidity, want it left out", name, v)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// compareSide is one location of GET /weather/compare, holding its weather
+// or the error that kept it from being fetched.
+type compareSide struct {
+	Location string          `json:"location"`
+	Weather  json.RawMessage `json:"weather,omitempty"`
+	Error    *apiError       `json:"error,omitempty"`
+}
+
+// weatherDelta is how much warmer, feeling warmer and windier a is than b
+// on their first day.
+type weatherDelta struct {
+	Temp      float64 `json:"temp"`
+	FeelsLike float64 `json:"feelslike"`
+	WindSpeed float64 `json:"windspeed"`
+}
+
+// compareHandler serves GET /weather/compare?a=X&b=Y with today's weather of
+// both locations, fetched together through the cache. The delta is only
+// sent when both sides were fetched.
+func compareHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, hot *hotKeys, stats *cacheStats, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		base, err := parseQueryOptions(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		a, b := strings.TrimSpace(r.URL.Query().Get("a")), strings.TrimSpace(r.URL.Query().Get("b"))
+		if a == "" || b == "" {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "a and b must both name a location"})
+			return
+		}
+		if normalizeKey(a) == normalizeKey(b) {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "a and b must be different locations"})
+			return
+		}
+		for _, side := range [][2]string{{"a", a}, {"b", b}} {
+			if err := validateLocation(side[0], side[1]); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+		}
+		qa, qb := base, base
+		qa.Location, qb.Location = a, b
+		results := fetchMany(r.Context(), cache, group, budget, hot, stats, cfg, map[string]weatherQuery{"a": qa, "b": qb})
+		if r.Context().Err() != nil {
+			return
+		}
+
+		resp := struct {
+			A     compareSide   `json:"a"`
+			B     compareSide   `json:"b"`
+			Delta *weatherDelta `json:"delta,omitempty"`
+		}{A: compareSide{Location: a}, B: compareSide{Location: b}}
+		var days [2]*Day
+		sides := []*compareSide{&resp.A, &resp.B}
+		for i, name := range []string{"a", "b"} {
+			side, result := sides[i], results[name]
+			var failed struct {
+				Error *apiError `json:"error"`
+			}
+			var weather Weather
+			switch {
+			case json.Unmarshal(result, &failed) == nil && failed.Error != nil:
+				side.Error = failed.Error
+			case json.Unmarshal(result, &weather) != nil || len(weather.Days) == 0:
+				side.Error = &apiError{Code: "upstream_error", Message: "The weather provider sent no days"}
+			default:
+				side.Weather, days[i] = result, &weather.Days[0]
+			}
+		}
+		if days[0] != nil && days[1] != nil {
+			resp.Delta = &weatherDelta{
+				Temp:      days[0].Temp - days[1].Temp,
+				FeelsLike: days[0].FeelsLike - days[1].FeelsLike,
+				WindSpeed: days[0].WindSpeed - days[1].WindSpeed,
+			}
+		}
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
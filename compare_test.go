@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// compareProvider answers for istanbul and ankara with a day of weather
+// each, rejects atlantis and fails for anywhere else, counting the calls.
+func compareProvider(t *testing.T) *atomic.Int64 {
+	t.Helper()
+	bodies := map[string]Weather{
+		"istanbul": {ResolvedAddress: "İstanbul, Türkiye", Days: []Day{{Datetime: "2024-06-15", Temp: 24.5, FeelsLike: 25, WindSpeed: 18}}},
+		"ankara":   {ResolvedAddress: "Ankara, Türkiye", Days: []Day{{Datetime: "2024-06-15", Temp: 21, FeelsLike: 20.5, WindSpeed: 12}}},
+	}
+	var calls atomic.Int64
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		location := strings.ToLower(strings.Split(strings.TrimPrefix(r.URL.Path, "/VisualCrossingWebServices/rest/services/timeline/"), "/")[0])
+		status, body := http.StatusInternalServerError, "Internal error"
+		if w, ok := bodies[location]; ok {
+			data, _ := json.Marshal(w)
+			status, body = http.StatusOK, string(data)
+		} else if location == "atlantis" {
+			status, body = http.StatusBadRequest, "Bad API Request:Invalid location parameter value."
+		}
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	t.Setenv("API_KEY", "test")
+	return &calls
+}
+
+type compareBody struct {
+	A     compareSide   `json:"a"`
+	B     compareSide   `json:"b"`
+	Delta *weatherDelta `json:"delta"`
+}
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantCalls  int64
+		check      func(t *testing.T, body compareBody)
+	}{
+		{
+			name:  "both sides",
+			query: "a=istanbul&b=ankara",
+			check: func(t *testing.T, body compareBody) {
+				if body.A.Error != nil || body.B.Error != nil || len(body.A.Weather) == 0 || len(body.B.Weather) == 0 {
+					t.Fatalf("sides = %+v, %+v, want both weathers", body.A, body.B)
+				}
+				if want := (weatherDelta{Temp: 3.5, FeelsLike: 4.5, WindSpeed: 6}); body.Delta == nil || *body.Delta != want {
+					t.Errorf("delta = %+v, want %+v", body.Delta, want)
+				}
+			},
+			wantCalls: 2,
+		},
+		{
+			name:  "rejected side",
+			query: "a=istanbul&b=atlantis",
+			check: func(t *testing.T, body compareBody) {
+				if body.A.Error != nil || len(body.A.Weather) == 0 {
+					t.Errorf("a = %+v, want its weather", body.A)
+				}
+				if body.B.Error == nil || body.B.Error.Code != "location_rejected" || body.B.Weather != nil {
+					t.Errorf("b = %+v, want a location_rejected error", body.B)
+				}
+				if body.Delta != nil {
+					t.Errorf("delta = %+v, want none", body.Delta)
+				}
+			},
+			wantCalls: 2,
+		},
+		{
+			name:  "failing side",
+			query: "a=nowhere&b=ankara",
+			check: func(t *testing.T, body compareBody) {
+				if body.A.Error == nil || body.A.Error.Code != "upstream_error" {
+					t.Errorf("a = %+v, want an upstream_error", body.A)
+				}
+				if body.B.Error != nil || len(body.B.Weather) == 0 {
+					t.Errorf("b = %+v, want its weather", body.B)
+				}
+				if body.Delta != nil {
+					t.Errorf("delta = %+v, want none", body.Delta)
+				}
+			},
+			wantCalls: 2,
+		},
+		{name: "identical locations", query: "a=Istanbul&b=istanbul", wantStatus: http.StatusBadRequest},
+		{name: "missing side", query: "a=istanbul", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := compareProvider(t)
+			cfg := testConfig(t)
+			cache, _ := newTestCache(t, cfg)
+			h := compareHandler(cache, new(singleflight.Group), newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg)
+
+			rec := serveGet(h, "/weather/compare?"+tt.query)
+			wantStatus := tt.wantStatus
+			if wantStatus == 0 {
+				wantStatus = http.StatusOK
+			}
+			if rec.Code != wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, wantStatus, rec.Body)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", n, tt.wantCalls)
+			}
+			if tt.check == nil {
+				return
+			}
+			var body compareBody
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			tt.check(t, body)
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// gzipMinSize is the smallest body worth compressing. Below it the gzip
+// header and checksum outweigh the savings.
+const gzipMinSize = 1024
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether r's Accept-Encoding allows gzip.
+func acceptsGzip(r *http.Request) bool {
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMiddleware compresses the responses of next for clients that accept
+// gzip. Bodies under gzipMinSize, and ones next encoded or that are
+// compressed formats already, are sent as they are. A compressed response's
+// ETag is made weak, since its bytes are no longer those the tag was
+// computed from.
+func gzipMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// gzipResponseWriter holds the start of a body back until it knows whether
+// the body is large enough to compress.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	buf     []byte
+	decided bool
+	zw      *gzip.Writer
+}
+
+func (g *gzipResponseWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+}
+
+func (g *gzipResponseWriter) Write(p []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if !g.decided {
+		g.buf = append(g.buf, p...)
+		if len(g.buf) < gzipMinSize {
+			return len(p), nil
+		}
+		if err := g.decide(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if g.zw != nil {
+		return g.zw.Write(p)
+	}
+	return g.ResponseWriter.Write(p)
+}
+
+// decide starts the response, compressed when its buffered start is large
+// enough and it is worth compressing, and writes out the buffer.
+func (g *gzipResponseWriter) decide() error {
+	g.decided = true
+	h := g.Header()
+	if h.Get("Content-Type") == "" && len(g.buf) > 0 {
+		// Sniffed now, or it would be sniffed from the compressed bytes.
+		h.Set("Content-Type", http.DetectContentType(g.buf))
+	}
+	if len(g.buf) >= gzipMinSize && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		g.zw = gzipWriters.Get().(*gzip.Writer)
+		g.zw.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	buf := g.buf
+	g.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.zw != nil {
+		_, err = g.zw.Write(buf)
+	} else {
+		_, err = g.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// compressible reports whether a body of contentType gains from gzip.
+// Types that are compressed already do not.
+func compressible(contentType string) bool {
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/gzip", "application/zip", "application/x-gzip", "font/woff"} {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what has been written so far, compressing it if it is large
+// enough to be.
+func (g *gzipResponseWriter) Flush() {
+	if !g.decided {
+		if g.status == 0 {
+			g.status = http.StatusOK
+		}
+		g.decide()
+	}
+	if g.zw != nil {
+		g.zw.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+// Hijack hands the connection over, for WebSocket upgrades, leaving nothing
+// for close to write.
+func (g *gzipResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	g.decided = true
+	return http.NewResponseController(g.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (g *gzipResponseWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close finishes the response once the handler returns.
+func (g *gzipResponseWriter) close() {
+	if !g.decided && g.status != 0 {
+		// The Content-Length of a short body is still right.
+		g.decide()
+	}
+	if g.zw != nil {
+		g.zw.Close()
+		gzipWriters.Put(g.zw)
+	}
+}
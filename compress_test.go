@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "br, gzip;q=0.8", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "*", want: true},
+		{header: "deflate", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			r.Header.Set("Accept-Encoding", tt.header)
+			if got := acceptsGzip(r); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	large := strings.Repeat(`{"temp":8.5}`, 200)
+	tests := []struct {
+		name        string
+		method      string
+		accept      string
+		body        string
+		contentType string
+		wantGzip    bool
+	}{
+		{name: "large JSON", method: http.MethodGet, accept: "gzip", body: large, contentType: "application/json", wantGzip: true},
+		{name: "small JSON", method: http.MethodGet, accept: "gzip", body: `{"temp":8.5}`, contentType: "application/json"},
+		{name: "no gzip accepted", method: http.MethodGet, body: large, contentType: "application/json"},
+		{name: "compressed type", method: http.MethodGet, accept: "gzip", body: large, contentType: "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := gzipMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("ETag", `"abc"`)
+				io.WriteString(w, tt.body)
+			}))
+			r := httptest.NewRequest(tt.method, "/weather", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+			if gzipped != tt.wantGzip {
+				t.Fatalf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+			body := rec.Body.Bytes()
+			wantETag := `"abc"`
+			if gzipped {
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+				wantETag = `W/"abc"`
+			}
+			if string(body) != tt.body {
+				t.Errorf("body = %q, want %q", body, tt.body)
+			}
+			if got := rec.Header().Get("ETag"); got != wantETag {
+				t.Errorf("ETag = %s, want %s", got, wantETag)
+			}
+			if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,723 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	// CacheTTL is how long today's forecast stays fresh. TTLPolicy holds it
+	// alongside the TTLs of the other data types.
+	CacheTTL  time.Duration
+	TTLPolicy ttlPolicy
+	// StaleTTL is how long an entry is kept after it stops being fresh so it
+	// can still be served while a refresh runs in the background.
+	StaleTTL time.Duration
+	// NegativeCacheTTL is how long a location rejected by the provider is
+	// remembered.
+	NegativeCacheTTL time.Duration
+	// AdminToken guards the admin routes, under /admin/. They are disabled
+	// when it is empty. It is read from ADMIN_TOKEN or ADMIN_TOKEN_FILE.
+	AdminToken string
+	// AdminClientCAFile, when set, has the admin routes also require a
+	// client certificate issued by one of the CAs it holds. It needs TLS.
+	AdminClientCAFile string
+	// CacheCompression gzips values before they are written to the cache.
+	CacheCompression bool
+	// CacheMaxValueSize is the largest entry, in bytes, that is cached,
+	// zero meaning no limit. Larger responses are still served.
+	// UpstreamMaxBodySize caps what is read from the provider; responses
+	// over it fail instead.
+	CacheMaxValueSize   int
+	UpstreamMaxBodySize int64
+	// UpstreamDailyBudget is how many provider calls a day the plan allows,
+	// zero meaning no limit. Past UpstreamBudgetSoft of them stale entries
+	// are no longer refreshed. Days start at midnight in UpstreamBudgetZone.
+	// UpstreamBudgetShared counts the calls of every instance in Redis.
+	UpstreamDailyBudget  int
+	UpstreamBudgetSoft   int
+	UpstreamBudgetZone   *time.Location
+	UpstreamBudgetShared bool
+	// CacheCodec is the format values are written in, json or msgpack.
+	// Values in either format are always read.
+	CacheCodec string
+	// CacheTTLJitter spreads each entry's TTL by up to this fraction either
+	// way. CacheJitterSeed seeds the jitter source, making it deterministic.
+	CacheTTLJitter  float64
+	CacheJitterSeed int64
+	// LocalCacheSize and LocalCacheTTL bound the in-process LRU kept in front
+	// of Redis. The TTL is also how long a purge can take to reach other
+	// instances.
+	LocalCacheSize int
+	LocalCacheTTL  time.Duration
+	// CacheSweep deletes keys left behind by older cache schema versions at
+	// startup.
+	CacheSweep bool
+
+	// CacheBackend selects where entries are stored: redis, memcached, or
+	// none to disable caching.
+	CacheBackend  string
+	MemcacheAddrs []string
+
+	// RedisMode selects a standalone, sentinel or cluster deployment.
+	RedisMode string
+	// RedisAddrs holds the server address in standalone mode, the sentinel
+	// addresses in sentinel mode and the seed nodes in cluster mode.
+	RedisAddrs      []string
+	RedisMasterName string
+	RedisUsername   string
+	RedisPassword   string
+	RedisDB         int
+	// RedisPoolSize, RedisMinIdleConns and the timeouts fall back to the
+	// go-redis defaults when zero.
+	RedisPoolSize     int
+	RedisMinIdleConns int
+	RedisDialTimeout  time.Duration
+	RedisReadTimeout  time.Duration
+	RedisWriteTimeout time.Duration
+	// RedisTLS enables TLS, verifying the server against RedisTLSCAFile when
+	// set and the system roots otherwise.
+	RedisTLS       bool
+	RedisTLSCAFile string
+	// RedisHealthInterval is how often Redis is pinged while it is up.
+	// RedisHealthMaxBackoff caps the retry delay while it is down.
+	RedisHealthInterval   time.Duration
+	RedisHealthMaxBackoff time.Duration
+
+	// HotRefreshInterval is how often the refresher looks at the
+	// HotRefreshTop most requested locations, re-fetching those whose entries
+	// stop being fresh within HotRefreshAhead, at most HotRefreshMaxCalls per
+	// cycle.
+	HotRefreshInterval time.Duration
+	HotRefreshTop      int
+	HotRefreshAhead    time.Duration
+	HotRefreshMaxCalls int
+
+	// TrustedProxies are the addresses of the reverse proxies whose
+	// X-Forwarded-For and X-Real-IP headers are believed.
+	TrustedProxies []netip.Prefix
+	// RateLimitRPS is how many requests per second each client may make,
+	// in bursts of up to RateLimitBurst. Zero disables rate limiting.
+	RateLimitRPS   float64
+	RateLimitBurst int
+	// RateLimitMissRPS and RateLimitMissBurst are the stricter per-IP limit
+	// of the requests that go to the provider. Zero disables it alone.
+	RateLimitMissRPS   float64
+	RateLimitMissBurst int
+	// RateLimitAllowlist ranges skip rate limiting and RateLimitDenylist
+	// ranges are refused. When RateLimitListsFile is set, the lists in it
+	// replace both at startup and on SIGHUP.
+	RateLimitAllowlist []netip.Prefix
+	RateLimitDenylist  []netip.Prefix
+	RateLimitListsFile string
+	// RateLimitExemptPaths are never rate limited, in addition to the probe
+	// and metrics endpoints.
+	RateLimitExemptPaths []string
+	// RateLimitTiers are the limits of API key consumers by tier name, and
+	// APIKeyTiers the tier of each key. Requests without a known key get
+	// RateLimitRPS per client IP.
+	RateLimitTiers map[string]rateSpec
+	APIKeyTiers    map[string]string
+	// AuthRequiredRoutes are the route patterns that refuse requests
+	// without an enabled API key from the key store.
+	AuthRequiredRoutes []string
+	// RateLimitRoutes are extra limits by route pattern, applied to each
+	// client on top of the default ones.
+	RateLimitRoutes map[string]rateSpec
+	// RateLimitBackend selects where request counts are kept: local, per
+	// instance, or redis, shared by every instance.
+	RateLimitBackend string
+	// RateLimitIPv6Prefix is the prefix length IPv6 clients are grouped by,
+	// so that all the addresses of one network share a limit.
+	RateLimitIPv6Prefix int
+	// RateLimitMode is enforce, rejecting requests over the limits, or
+	// observe, which only counts and logs them.
+	RateLimitMode string
+	// RateLimitAlgorithm is token-bucket, which lets a client spend its whole
+	// burst at once, or sliding-window, which never admits more than the
+	// burst in any burst/RPS seconds.
+	RateLimitAlgorithm string
+	// RateLimitSnapshot saves the state of the local rate limiters to Redis
+	// on shutdown and restores it on start. The Redis backend keeps all its
+	// state in Redis and needs no snapshot.
+	RateLimitSnapshot bool
+	// RateLimitIdleTTL is how long a client's rate limiter is kept after its
+	// last request.
+	RateLimitIdleTTL time.Duration
+
+	// CORSAllowedOrigins are the origins browsers may call the API from,
+	// exactly or, given as https://*.example.com, by subdomain. None
+	// disables CORS. CORSMaxAge is how long, in seconds, browsers may cache
+	// a preflight.
+	CORSAllowedOrigins []string
+	CORSMaxAge         int
+
+	// HealthUpstreamCheck is how /healthz checks the provider: recent, by
+	// whether a fetch succeeded within HealthUpstreamMaxAge, head, by sending
+	// it a HEAD request that costs no quota, or off.
+	HealthUpstreamCheck  string
+	HealthUpstreamMaxAge time.Duration
+
+	// WarmLocations are fetched into the cache at startup, WarmWorkers at a
+	// time.
+	WarmLocations []string
+	WarmWorkers   int
+	// WarmBlocking keeps /readyz failing until the warm up is over.
+	WarmBlocking bool
+	// ShutdownDrainDelay is how long /readyz fails before the server stops
+	// taking requests, giving load balancers time to stop sending them.
+	ShutdownDrainDelay time.Duration
+	// ShutdownTimeout is how long in-flight requests then have to finish.
+	ShutdownTimeout time.Duration
+
+	// ServerReadTimeout bounds reading a request, headers included, and
+	// ServerWriteTimeout writing its response. ServerIdleTimeout is how long
+	// a keep-alive connection waits for the next request, and
+	// ServerMaxHeaderBytes caps the size of request headers.
+	ServerReadTimeout    time.Duration
+	ServerWriteTimeout   time.Duration
+	ServerIdleTimeout    time.Duration
+	ServerMaxHeaderBytes int
+	// WebhookSweepInterval is how often the locations webhooks subscribe to
+	// are fetched when nobody has requested them.
+	WebhookSweepInterval time.Duration
+	// StreamMinInterval is the shortest interval event streams may ask for.
+	// StreamHeartbeat is how often they get a comment in between, so that
+	// proxies do not time them out.
+	StreamMinInterval time.Duration
+	StreamHeartbeat   time.Duration
+
+	// TLSMode is how the server terminates TLS: off, files, serving
+	// TLSCertFile and TLSKeyFile, or autocert, obtaining certificates for
+	// TLSAutocertHosts from Let's Encrypt and keeping them in
+	// TLSAutocertCacheDir. While TLS is on, TLSRedirectAddr serves plain
+	// HTTP redirects to HTTPS, and the ACME challenges in autocert mode.
+	TLSMode             string
+	TLSCertFile         string
+	TLSKeyFile          string
+	TLSAutocertHosts    []string
+	TLSAutocertCacheDir string
+	TLSRedirectAddr     string
+	// GRPCAddr is where the gRPC service listens, empty when it is off.
+	GRPCAddr string
+	// LegacySunset is when the unversioned paths of the API are to stop
+	// being served, announced in their Sunset header.
+	LegacySunset time.Time
+	// IconBaseURL is where the images of the provider's icon codes are
+	// served from, each as <IconBaseURL>/<code>.png.
+	IconBaseURL string
+}
+
+func loadConfig() (Config, error) {
+	cfg := Config{
+		CacheTTL:              5 * time.Minute,
+		StaleTTL:              time.Hour,
+		NegativeCacheTTL:      time.Minute,
+		AdminToken:            os.Getenv("ADMIN_TOKEN"),
+		AdminClientCAFile:     os.Getenv("ADMIN_CLIENT_CA_FILE"),
+		CacheCompression:      true,
+		CacheCodec:            "json",
+		CacheMaxValueSize:     1 << 20,
+		UpstreamMaxBodySize:   8 << 20,
+		CacheTTLJitter:        0.1,
+		CacheJitterSeed:       time.Now().UnixNano(),
+		LocalCacheSize:        1000,
+		LocalCacheTTL:         10 * time.Second,
+		CacheBackend:          cacheBackendRedis,
+		MemcacheAddrs:         []string{"localhost:11211"},
+		RedisMode:             redisModeStandalone,
+		RedisAddrs:            []string{"localhost:6379"},
+		RedisMasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		RedisUsername:         os.Getenv("REDIS_USERNAME"),
+		RedisPassword:         os.Getenv("REDIS_PASSWORD"),
+		RedisTLSCAFile:        os.Getenv("REDIS_TLS_CA_FILE"),
+		RedisHealthInterval:   5 * time.Second,
+		RedisHealthMaxBackoff: time.Minute,
+		HotRefreshInterval:    30 * time.Second,
+		HotRefreshTop:         10,
+		HotRefreshAhead:       time.Minute,
+		HotRefreshMaxCalls:    5,
+		WarmLocations:         splitList(os.Getenv("WARM_LOCATIONS")),
+		WarmWorkers:           3,
+		ShutdownDrainDelay:    2 * time.Second,
+		ShutdownTimeout:       10 * time.Second,
+		ServerReadTimeout:     10 * time.Second,
+		ServerWriteTimeout:    30 * time.Second,
+		ServerIdleTimeout:     120 * time.Second,
+		ServerMaxHeaderBytes:  1 << 20,
+		StreamMinInterval:     30 * time.Second,
+		WebhookSweepInterval:  10 * time.Minute,
+		StreamHeartbeat:       15 * time.Second,
+		HealthUpstreamCheck:   healthUpstreamRecent,
+		CORSAllowedOrigins:    splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		CORSMaxAge:            600,
+		AuthRequiredRoutes:    splitList(os.Getenv("AUTH_REQUIRED_ROUTES")),
+		HealthUpstreamMaxAge:  10 * time.Minute,
+		RateLimitRPS:          2,
+		RateLimitBurst:        10,
+		RateLimitMissRPS:      0.5,
+		RateLimitMissBurst:    5,
+		RateLimitBackend:      rateLimitBackendLocal,
+		RateLimitIPv6Prefix:   defaultIPv6PrefixBits,
+		RateLimitMode:         rateLimitModeEnforce,
+		RateLimitAlgorithm:    rateLimitAlgorithmTokenBucket,
+		RateLimitIdleTTL:      10 * time.Minute,
+		TLSCertFile:           os.Getenv("TLS_CERT_FILE"),
+		TLSKeyFile:            os.Getenv("TLS_KEY_FILE"),
+		TLSAutocertHosts:      splitList(os.Getenv("TLS_AUTOCERT_HOSTS")),
+		TLSAutocertCacheDir:   os.Getenv("TLS_AUTOCERT_CACHE_DIR"),
+		TLSRedirectAddr:       ":80",
+		GRPCAddr:              ":7879",
+		LegacySunset:          legacyDeprecatedAt.AddDate(0, 6, 0),
+		IconBaseURL:           defaultIconBaseURL,
+	}
+
+	var err error
+	if cfg.CacheTTL, err = durationEnv("CACHE_TTL", cfg.CacheTTL); err != nil {
+		return Config{}, err
+	}
+	cfg.TTLPolicy = ttlPolicy{
+		dataCurrent:    2 * time.Minute,
+		dataToday:      cfg.CacheTTL,
+		dataMultiDay:   time.Hour,
+		dataHourly:     15 * time.Minute,
+		dataAlerts:     5 * time.Minute,
+		dataHistorical: 30 * 24 * time.Hour,
+	}
+	if cfg.TTLPolicy[dataCurrent], err = durationEnv("CACHE_TTL_CURRENT", cfg.TTLPolicy[dataCurrent]); err != nil {
+		return Config{}, err
+	}
+	if cfg.TTLPolicy[dataMultiDay], err = durationEnv("CACHE_TTL_MULTI_DAY", cfg.TTLPolicy[dataMultiDay]); err != nil {
+		return Config{}, err
+	}
+	if cfg.TTLPolicy[dataHourly], err = durationEnv("CACHE_TTL_HOURLY", cfg.TTLPolicy[dataHourly]); err != nil {
+		return Config{}, err
+	}
+	if cfg.TTLPolicy[dataAlerts], err = durationEnv("CACHE_TTL_ALERTS", cfg.TTLPolicy[dataAlerts]); err != nil {
+		return Config{}, err
+	}
+	if cfg.TTLPolicy[dataHistorical], err = durationEnv("CACHE_TTL_HISTORICAL", cfg.TTLPolicy[dataHistorical]); err != nil {
+		return Config{}, err
+	}
+	if cfg.StaleTTL, err = durationEnv("CACHE_STALE_TTL", cfg.StaleTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.NegativeCacheTTL, err = durationEnv("NEGATIVE_CACHE_TTL", cfg.NegativeCacheTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheCompression, err = boolEnv("CACHE_COMPRESSION", cfg.CacheCompression); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheMaxValueSize, err = nonNegativeIntEnv("CACHE_MAX_VALUE_SIZE", cfg.CacheMaxValueSize); err != nil {
+		return Config{}, err
+	}
+	maxBody, err := intEnv("UPSTREAM_MAX_BODY_SIZE", int(cfg.UpstreamMaxBodySize))
+	if err != nil {
+		return Config{}, err
+	}
+	cfg.UpstreamMaxBodySize = int64(maxBody)
+	if cfg.UpstreamDailyBudget, err = nonNegativeIntEnv("UPSTREAM_DAILY_BUDGET", 0); err != nil {
+		return Config{}, err
+	}
+	if cfg.UpstreamBudgetSoft, err = intEnv("UPSTREAM_BUDGET_SOFT", max(cfg.UpstreamDailyBudget*8/10, 1)); err != nil {
+		return Config{}, err
+	}
+	if cfg.UpstreamDailyBudget > 0 && cfg.UpstreamBudgetSoft > cfg.UpstreamDailyBudget {
+		return Config{}, fmt.Errorf("invalid UPSTREAM_BUDGET_SOFT %d: must not exceed UPSTREAM_DAILY_BUDGET", cfg.UpstreamBudgetSoft)
+	}
+	zone := os.Getenv("UPSTREAM_BUDGET_TZ")
+	if zone == "" {
+		zone = "UTC"
+	}
+	if cfg.UpstreamBudgetZone, err = time.LoadLocation(zone); err != nil {
+		return Config{}, fmt.Errorf("invalid UPSTREAM_BUDGET_TZ %q: %v", zone, err)
+	}
+	if cfg.UpstreamBudgetShared, err = boolEnv("UPSTREAM_BUDGET_SHARED", cfg.UpstreamBudgetShared); err != nil {
+		return Config{}, err
+	}
+	if v := os.Getenv("CACHE_CODEC"); v != "" {
+		cfg.CacheCodec = strings.ToLower(v)
+		if _, ok := cacheCodecs[cfg.CacheCodec]; !ok {
+			return Config{}, fmt.Errorf("invalid CACHE_CODEC %q: must be json or msgpack", v)
+		}
+	}
+	if v := os.Getenv("CACHE_TTL_JITTER"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || f >= 1 {
+			return Config{}, fmt.Errorf("invalid CACHE_TTL_JITTER %q: must be a fraction in [0, 1)", v)
+		}
+		cfg.CacheTTLJitter = f
+	}
+	if v := os.Getenv("CACHE_JITTER_SEED"); v != "" {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid CACHE_JITTER_SEED %q: %v", v, err)
+		}
+		cfg.CacheJitterSeed = seed
+	}
+	if cfg.LocalCacheSize, err = intEnv("LOCAL_CACHE_SIZE", cfg.LocalCacheSize); err != nil {
+		return Config{}, err
+	}
+	if cfg.LocalCacheTTL, err = durationEnv("LOCAL_CACHE_TTL", cfg.LocalCacheTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.CacheSweep, err = boolEnv("CACHE_SWEEP", cfg.CacheSweep); err != nil {
+		return Config{}, err
+	}
+	if v := os.Getenv("CACHE_BACKEND"); v != "" {
+		cfg.CacheBackend = strings.ToLower(v)
+	}
+	if v := os.Getenv("MEMCACHE_ADDRS"); v != "" {
+		cfg.MemcacheAddrs = splitList(v)
+		if len(cfg.MemcacheAddrs) == 0 {
+			return Config{}, fmt.Errorf("invalid MEMCACHE_ADDRS %q: no addresses", v)
+		}
+	}
+	if v := os.Getenv("REDIS_MODE"); v != "" {
+		cfg.RedisMode = strings.ToLower(v)
+	}
+	if v := os.Getenv("REDIS_ADDRS"); v != "" {
+		cfg.RedisAddrs = splitList(v)
+		if len(cfg.RedisAddrs) == 0 {
+			return Config{}, fmt.Errorf("invalid REDIS_ADDRS %q: no addresses", v)
+		}
+	}
+	if v := os.Getenv("REDIS_DB"); v != "" {
+		db, err := strconv.Atoi(v)
+		if err != nil || db < 0 {
+			return Config{}, fmt.Errorf("invalid REDIS_DB %q: must be a non-negative integer", v)
+		}
+		cfg.RedisDB = db
+	}
+	if cfg.RedisPoolSize, err = intEnv("REDIS_POOL_SIZE", cfg.RedisPoolSize); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisMinIdleConns, err = intEnv("REDIS_MIN_IDLE_CONNS", cfg.RedisMinIdleConns); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisDialTimeout, err = durationEnv("REDIS_DIAL_TIMEOUT", cfg.RedisDialTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisReadTimeout, err = durationEnv("REDIS_READ_TIMEOUT", cfg.RedisReadTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisWriteTimeout, err = durationEnv("REDIS_WRITE_TIMEOUT", cfg.RedisWriteTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisTLS, err = boolEnv("REDIS_TLS", cfg.RedisTLS); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisHealthInterval, err = durationEnv("REDIS_HEALTH_INTERVAL", cfg.RedisHealthInterval); err != nil {
+		return Config{}, err
+	}
+	if cfg.RedisHealthMaxBackoff, err = durationEnv("REDIS_HEALTH_MAX_BACKOFF", cfg.RedisHealthMaxBackoff); err != nil {
+		return Config{}, err
+	}
+	if cfg.HotRefreshInterval, err = durationEnv("HOT_REFRESH_INTERVAL", cfg.HotRefreshInterval); err != nil {
+		return Config{}, err
+	}
+	if cfg.HotRefreshTop, err = intEnv("HOT_REFRESH_TOP", cfg.HotRefreshTop); err != nil {
+		return Config{}, err
+	}
+	if cfg.HotRefreshAhead, err = durationEnv("HOT_REFRESH_AHEAD", cfg.HotRefreshAhead); err != nil {
+		return Config{}, err
+	}
+	if cfg.HotRefreshMaxCalls, err = intEnv("HOT_REFRESH_MAX_CALLS", cfg.HotRefreshMaxCalls); err != nil {
+		return Config{}, err
+	}
+	if cfg.WarmWorkers, err = intEnv("WARM_WORKERS", cfg.WarmWorkers); err != nil {
+		return Config{}, err
+	}
+	if cfg.WarmBlocking, err = boolEnv("WARM_BLOCKING", cfg.WarmBlocking); err != nil {
+		return Config{}, err
+	}
+	if cfg.ShutdownDrainDelay, err = durationEnv("SHUTDOWN_DRAIN_DELAY", cfg.ShutdownDrainDelay); err != nil {
+		return Config{}, err
+	}
+	if cfg.ShutdownTimeout, err = durationEnv("SHUTDOWN_TIMEOUT", cfg.ShutdownTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.ServerReadTimeout, err = durationEnv("SERVER_READ_TIMEOUT", cfg.ServerReadTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.ServerWriteTimeout, err = durationEnv("SERVER_WRITE_TIMEOUT", cfg.ServerWriteTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.ServerIdleTimeout, err = durationEnv("SERVER_IDLE_TIMEOUT", cfg.ServerIdleTimeout); err != nil {
+		return Config{}, err
+	}
+	if cfg.ServerMaxHeaderBytes, err = intEnv("SERVER_MAX_HEADER_BYTES", cfg.ServerMaxHeaderBytes); err != nil {
+		return Config{}, err
+	}
+	if cfg.WebhookSweepInterval, err = durationEnv("WEBHOOK_SWEEP_INTERVAL", cfg.WebhookSweepInterval); err != nil {
+		return Config{}, err
+	}
+	if cfg.StreamMinInterval, err = durationEnv("STREAM_MIN_INTERVAL", cfg.StreamMinInterval); err != nil {
+		return Config{}, err
+	}
+	if cfg.StreamHeartbeat, err = durationEnv("STREAM_HEARTBEAT", cfg.StreamHeartbeat); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitIdleTTL, err = durationEnv("RATE_LIMIT_IDLE_TTL", cfg.RateLimitIdleTTL); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitRPS, cfg.RateLimitBurst, err = rateLimitEnv("RATE_LIMIT", cfg.RateLimitRPS, cfg.RateLimitBurst); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitMissRPS, cfg.RateLimitMissBurst, err = rateLimitEnv("RATE_LIMIT_MISS", cfg.RateLimitMissRPS, cfg.RateLimitMissBurst); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitTiers, err = parseRateTiers(os.Getenv("RATE_LIMIT_TIERS")); err != nil {
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_TIERS: %v", err)
+	}
+	if cfg.RateLimitRoutes, err = parseRateSpecs(os.Getenv("RATE_LIMIT_ROUTES")); err != nil {
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_ROUTES: %v", err)
+	}
+	if cfg.APIKeyTiers, err = parseAPIKeyTiers(os.Getenv("API_KEY_TIERS"), cfg.RateLimitTiers); err != nil {
+		return Config{}, fmt.Errorf("invalid API_KEY_TIERS: %v", err)
+	}
+	if v := os.Getenv("RATE_LIMIT_BACKEND"); v != "" {
+		cfg.RateLimitBackend = strings.ToLower(v)
+		if cfg.RateLimitBackend != rateLimitBackendLocal && cfg.RateLimitBackend != rateLimitBackendRedis {
+			return Config{}, fmt.Errorf("invalid RATE_LIMIT_BACKEND %q: must be local or redis", v)
+		}
+	}
+	if cfg.RateLimitSnapshot, err = boolEnv("RATE_LIMIT_SNAPSHOT", cfg.RateLimitSnapshot); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitIPv6Prefix, err = intEnv("RATE_LIMIT_IPV6_PREFIX", cfg.RateLimitIPv6Prefix); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitIPv6Prefix > 128 {
+		return Config{}, fmt.Errorf("invalid RATE_LIMIT_IPV6_PREFIX %d: must be at most 128", cfg.RateLimitIPv6Prefix)
+	}
+	if v := os.Getenv("RATE_LIMIT_MODE"); v != "" {
+		cfg.RateLimitMode = strings.ToLower(v)
+		if cfg.RateLimitMode != rateLimitModeEnforce && cfg.RateLimitMode != rateLimitModeObserve {
+			return Config{}, fmt.Errorf("invalid RATE_LIMIT_MODE %q: must be enforce or observe", v)
+		}
+	}
+	if cfg.CORSMaxAge, err = intEnv("CORS_MAX_AGE", cfg.CORSMaxAge); err != nil {
+		return Config{}, err
+	}
+	if v := os.Getenv("HEALTH_UPSTREAM_CHECK"); v != "" {
+		cfg.HealthUpstreamCheck = strings.ToLower(v)
+		switch cfg.HealthUpstreamCheck {
+		case healthUpstreamRecent, healthUpstreamHead, healthUpstreamOff:
+		default:
+			return Config{}, fmt.Errorf("invalid HEALTH_UPSTREAM_CHECK %q: must be recent, head or off", v)
+		}
+	}
+	if cfg.HealthUpstreamMaxAge, err = durationEnv("HEALTH_UPSTREAM_MAX_AGE", cfg.HealthUpstreamMaxAge); err != nil {
+		return Config{}, err
+	}
+	if v := os.Getenv("RATE_LIMIT_ALGORITHM"); v != "" {
+		cfg.RateLimitAlgorithm = strings.ToLower(v)
+		if cfg.RateLimitAlgorithm != rateLimitAlgorithmTokenBucket && cfg.RateLimitAlgorithm != rateLimitAlgorithmSlidingWindow {
+			return Config{}, fmt.Errorf("invalid RATE_LIMIT_ALGORITHM %q: must be token-bucket or sliding-window", v)
+		}
+	}
+	if cfg.TrustedProxies, err = prefixListEnv("TRUSTED_PROXIES"); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitAllowlist, err = prefixListEnv("RATE_LIMIT_ALLOWLIST"); err != nil {
+		return Config{}, err
+	}
+	if cfg.RateLimitDenylist, err = prefixListEnv("RATE_LIMIT_DENYLIST"); err != nil {
+		return Config{}, err
+	}
+	cfg.RateLimitListsFile = os.Getenv("RATE_LIMIT_LISTS_FILE")
+	cfg.RateLimitExemptPaths = append(defaultExemptPaths, splitList(os.Getenv("RATE_LIMIT_EXEMPT_PATHS"))...)
+	if cfg.TLSMode, err = tlsModeOf(cfg); err != nil {
+		return Config{}, err
+	}
+	if cfg.AdminClientCAFile != "" && cfg.TLSMode == tlsModeOff {
+		return Config{}, fmt.Errorf("ADMIN_CLIENT_CA_FILE is set but TLS is off")
+	}
+	if path := os.Getenv("ADMIN_TOKEN_FILE"); path != "" {
+		if cfg.AdminToken != "" {
+			return Config{}, fmt.Errorf("ADMIN_TOKEN and ADMIN_TOKEN_FILE cannot both be set")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("could not read ADMIN_TOKEN_FILE: %v", err)
+		}
+		if cfg.AdminToken = strings.TrimSpace(string(data)); cfg.AdminToken == "" {
+			return Config{}, fmt.Errorf("ADMIN_TOKEN_FILE %q is empty", path)
+		}
+	}
+	if v := os.Getenv("TLS_REDIRECT_ADDR"); v != "" {
+		cfg.TLSRedirectAddr = v
+		if strings.EqualFold(v, "off") {
+			cfg.TLSRedirectAddr = ""
+		}
+	}
+	if v := os.Getenv("LEGACY_SUNSET"); v != "" {
+		if cfg.LegacySunset, err = time.Parse(time.DateOnly, v); err != nil {
+			return Config{}, fmt.Errorf("invalid LEGACY_SUNSET %q: must be a date such as 2027-04-14", v)
+		}
+	}
+	if v := os.Getenv("GRPC_ADDR"); v != "" {
+		cfg.GRPCAddr = v
+		if strings.EqualFold(v, "off") {
+			cfg.GRPCAddr = ""
+		}
+	}
+	if v := os.Getenv("ICON_BASE_URL"); v != "" {
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return Config{}, fmt.Errorf("invalid ICON_BASE_URL %q: must be an http or https URL", v)
+		}
+		cfg.IconBaseURL = strings.TrimSuffix(v, "/")
+	}
+
+	return cfg, nil
+}
+
+// rateLimitEnv reads a rate limit from the environment variables
+// prefix_RPS and prefix_BURST, returning rps and burst for the unset ones.
+func rateLimitEnv(prefix string, rps float64, burst int) (float64, int, error) {
+	if v := os.Getenv(prefix + "_RPS"); v != "" {
+		var err error
+		if rps, err = strconv.ParseFloat(v, 64); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s_RPS %q: %v", prefix, v, err)
+		}
+	}
+	if v := os.Getenv(prefix + "_BURST"); v != "" {
+		var err error
+		if burst, err = strconv.Atoi(v); err != nil {
+			return 0, 0, fmt.Errorf("invalid %s_BURST %q: %v", prefix, v, err)
+		}
+	}
+	if err := validateRateLimit(rps, burst); err != nil {
+		return 0, 0, err
+	}
+	return rps, burst, nil
+}
+
+// validateRateLimit checks a requests-per-second limit and burst. A zero
+// limit disables rate limiting, so the burst then does not matter.
+func validateRateLimit(rps float64, burst int) error {
+	if math.IsNaN(rps) || math.IsInf(rps, 0) || rps < 0 {
+		return fmt.Errorf("invalid rate limit %v: must be a non-negative number of requests per second", rps)
+	}
+	if rps > 0 && burst <= 0 {
+		return fmt.Errorf("invalid rate limit burst %d: must be positive", burst)
+	}
+	return nil
+}
+
+// prefixListEnv parses the environment variable name as a comma separated
+// list of CIDRs or addresses.
+func prefixListEnv(name string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, v := range splitList(os.Getenv(name)) {
+		prefix, err := parsePrefix(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", name, v, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses a CIDR, or a single address as a prefix holding only it.
+func parsePrefix(v string) (netip.Prefix, error) {
+	if !strings.Contains(v, "/") {
+		ip, err := netip.ParseAddr(v)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		ip = ip.Unmap()
+		return netip.PrefixFrom(ip, ip.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(v)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// durationEnv parses the environment variable name as a positive duration,
+// returning def when it is unset.
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, v)
+	}
+	return d, nil
+}
+
+// intEnv parses the environment variable name as a positive integer, returning
+// def when it is unset.
+func intEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be positive", name, v)
+	}
+	return n, nil
+}
+
+// nonNegativeIntEnv is intEnv for settings where zero switches a limit off.
+func nonNegativeIntEnv(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: must not be negative", name, v)
+	}
+	return n, nil
+}
+
+// boolEnv parses the environment variable name as a boolean, returning def
+// when it is unset.
+func boolEnv(name string, def bool) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	return b, nil
+}
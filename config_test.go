@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNonNegativeIntEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{name: "unset", value: "", want: 5},
+		{name: "zero", value: "0", want: 0},
+		{name: "positive", value: "1000", want: 1000},
+		{name: "negative", value: "-1", wantErr: true},
+		{name: "not a number", value: "many", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TEST_LIMIT", tt.value)
+			got, err := nonNegativeIntEnv("TEST_LIMIT", 5)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("nonNegativeIntEnv() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("nonNegativeIntEnv() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigUpstreamDailyBudget(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "500", want: 500},
+		{value: "-5", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("UPSTREAM_DAILY_BUDGET="+tt.value, func(t *testing.T) {
+			t.Setenv("UPSTREAM_DAILY_BUDGET", tt.value)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.UpstreamDailyBudget != tt.want {
+				t.Errorf("UpstreamDailyBudget = %d, want %d", cfg.UpstreamDailyBudget, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigAdminToken(t *testing.T) {
+	dir := t.TempDir()
+	file, empty := filepath.Join(dir, "token"), filepath.Join(dir, "empty")
+	if err := os.WriteFile(file, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(empty, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		token   string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "variable", token: "from-env", want: "from-env"},
+		{name: "file", file: file, want: "from-file"},
+		{name: "both", token: "from-env", file: file, wantErr: true},
+		{name: "empty file", file: empty, wantErr: true},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("ADMIN_TOKEN", tt.token)
+			t.Setenv("ADMIN_TOKEN_FILE", tt.file)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.AdminToken != tt.want {
+				t.Errorf("AdminToken = %q, want %q", cfg.AdminToken, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCacheMaxValueSize(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: 1 << 20},
+		{value: "0", want: 0},
+		{value: "4096", want: 4096},
+		{value: "-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("CACHE_MAX_VALUE_SIZE="+tt.value, func(t *testing.T) {
+			t.Setenv("CACHE_MAX_VALUE_SIZE", tt.value)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.CacheMaxValueSize != tt.want {
+				t.Errorf("CacheMaxValueSize = %d, want %d", cfg.CacheMaxValueSize, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigCacheTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "", want: 5 * time.Minute},
+		{value: "90s", want: 90 * time.Second},
+		{value: "1h", want: time.Hour},
+		{value: "0s", wantErr: true},
+		{value: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("CACHE_TTL="+tt.value, func(t *testing.T) {
+			t.Setenv("CACHE_TTL", tt.value)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.CacheTTL != tt.want || cfg.TTLPolicy[dataToday] != tt.want {
+				t.Errorf("CacheTTL = %v and today's TTL = %v, want %v", cfg.CacheTTL, cfg.TTLPolicy[dataToday], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers browsers may send and read on cross-origin requests.
+const (
+	corsAllowMethods  = "GET, HEAD, POST, PUT, DELETE"
+	corsAllowHeaders  = "Authorization, Cache-Control, Content-Type, If-None-Match, X-API-Key, X-Request-ID"
+	corsExposeHeaders = "Age, Deprecation, ETag, Link, Retry-After, Sunset, X-API-Version, X-Cache, X-Cache-TTL, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, X-Request-ID"
+)
+
+// originAllowed reports whether origin is in origins, which hold exact
+// origins such as https://app.example.com and patterns such as
+// https://*.example.com matching any subdomain.
+func originAllowed(origin string, origins []string) bool {
+	for _, allowed := range origins {
+		if prefix, suffix, ok := strings.Cut(allowed, "*."); ok {
+			rest, found := strings.CutPrefix(origin, prefix)
+			sub, isSub := strings.CutSuffix(rest, "."+suffix)
+			if found && isSub && sub != "" && !strings.ContainsAny(sub, "/:") {
+				return true
+			}
+			continue
+		}
+		if origin == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// corsMiddleware lets browsers on origins call next. Preflight requests are
+// answered here, without reaching next. Requests from other origins get no
+// CORS headers, so the browser keeps the response from the page. No origins
+// disables CORS.
+func corsMiddleware(next http.Handler, origins []string, maxAge int) http.Handler {
+	if len(origins) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		allowed := originAllowed(origin, origins)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", strconv.Itoa(maxAge))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	origins := []string{"https://app.example.com", "https://*.example.org"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{origin: "https://app.example.com", want: true},
+		{origin: "http://app.example.com", want: false},
+		{origin: "https://evil.example.com", want: false},
+		{origin: "https://a.example.org", want: true},
+		{origin: "https://a.b.example.org", want: true},
+		{origin: "https://example.org", want: false},
+		{origin: "https://a.example.org:8080", want: false},
+		{origin: "https://evilexample.org", want: false},
+		{origin: "https://a.example.org.evil.com", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.origin, func(t *testing.T) {
+			if got := originAllowed(tt.origin, origins); got != tt.want {
+				t.Errorf("originAllowed(%q) = %v, want %v", tt.origin, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	reached := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true })
+	h := corsMiddleware(next, []string{"https://app.example.com"}, 600)
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		preflight   bool
+		wantStatus  int
+		wantAllow   string
+		wantReached bool
+	}{
+		{name: "no origin", method: http.MethodGet, wantStatus: http.StatusOK, wantReached: true},
+		{name: "allowed origin", method: http.MethodGet, origin: "https://app.example.com", wantStatus: http.StatusOK, wantAllow: "https://app.example.com", wantReached: true},
+		{name: "other origin", method: http.MethodGet, origin: "https://evil.com", wantStatus: http.StatusOK, wantReached: true},
+		{name: "preflight", method: http.MethodOptions, origin: "https://app.example.com", preflight: true, wantStatus: http.StatusNoContent, wantAllow: "https://app.example.com"},
+		{name: "preflight from other origin", method: http.MethodOptions, origin: "https://evil.com", preflight: true, wantStatus: http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reached = false
+			r := httptest.NewRequest(tt.method, "/weather", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantAllow)
+			}
+			if reached != tt.wantReached {
+				t.Errorf("reached next = %v, want %v", reached, tt.wantReached)
+			}
+			if tt.preflight && tt.wantAllow != "" && rec.Header().Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("Access-Control-Max-Age = %q, want 600", rec.Header().Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// dashboardTemplates render GET /dashboard and its errors. Every value is
+// escaped by html/template, provider strings included.
+//
+//go:embed templates
+var dashboardFiles embed.FS
+
+var dashboardTemplates = template.Must(template.ParseFS(dashboardFiles, "templates/*.html"))
+
+// dashboardPage is what dashboard.html shows: today and the days after it.
+type dashboardPage struct {
+	Weather     Weather
+	Today       *Day
+	Coming      []Day
+	Temperature string
+}
+
+// dashboardHandler serves GET /dashboard, the forecast for people rather
+// than programs, read through the cache like GET /weather/forecast, whose
+// parameters it takes. Errors are pages too.
+func dashboardHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseForecastQuery(r)
+		if err != nil {
+			writeDashboardError(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		payload, err := latestPayload(r.Context(), cache, group, budget, cfg, q)
+		if err != nil {
+			status, code, retry := dashboardFailure(err, budget)
+			if retry > 0 {
+				w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(retry), 10))
+			}
+			if code == "upstream_error" {
+				logf(r.Context(), "Error fetching the weather for the dashboard : %v", err)
+			}
+			writeDashboardError(w, r, status, errorMessages[code])
+			return
+		}
+		var weather Weather
+		if err := json.Unmarshal(payload, &weather); err != nil {
+			logf(r.Context(), "Error decoding the weather for the dashboard : %v", err)
+			writeDashboardError(w, r, http.StatusInternalServerError, errorMessages["internal_error"])
+			return
+		}
+		page := dashboardPage{Weather: weather, Temperature: unitGroups[q.Units].Temperature}
+		if len(weather.Days) > 0 {
+			page.Today, page.Coming = &weather.Days[0], weather.Days[1:]
+		}
+		renderDashboard(w, r, http.StatusOK, "dashboard.html", page)
+	}
+}
+
+// dashboardFailure returns the status and error code of a failure of
+// latestPayload, and when to retry if that is known.
+func dashboardFailure(err error, budget *upstreamBudget) (int, string, time.Duration) {
+	var upErr *upstreamError
+	switch {
+	case errors.Is(err, errUnconfigured):
+		return http.StatusServiceUnavailable, "upstream_unconfigured", unconfiguredRetryAfter
+	case errors.As(err, &upErr) && upErr.rejectsLocation():
+		return upErr.StatusCode, "location_rejected", 0
+	case errors.Is(err, errBudgetExhausted):
+		return http.StatusServiceUnavailable, "upstream_quota_exhausted", budget.resetIn()
+	}
+	return http.StatusBadGateway, "upstream_error", 0
+}
+
+func writeDashboardError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	renderDashboard(w, r, status, "error.html", struct{ Message string }{message})
+}
+
+// renderDashboard renders the template name into a buffer, so that a
+// failure can still be answered with a status of its own.
+func renderDashboard(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	var buf bytes.Buffer
+	if err := dashboardTemplates.ExecuteTemplate(&buf, name, data); err != nil {
+		logf(r.Context(), "Error rendering %s : %v", name, err)
+		http.Error(w, errorMessages["internal_error"], http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
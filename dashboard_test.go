@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestDashboard(t *testing.T) {
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	weather := testWeather
+	weather.Days = []Day{
+		{Datetime: "2024-01-01", Temp: 8.5, Icon: "rain", Sunrise: "07:30:12", Sunset: "16:48:03", Description: `<script>alert("hi")</script>`},
+		{Datetime: "2024-01-02", Temp: 9.25},
+	}
+	forecast, _ := parseForecastQuery(httptest.NewRequest(http.MethodGet, "/dashboard?country=Istanbul", nil))
+	cache.Set(context.Background(), forecast.cacheKey(), testEntry(t, weather), time.Hour)
+	var group singleflight.Group
+	h := dashboardHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), cfg)
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/dashboard?country=Istanbul", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Content-Type = %q, want HTML", got)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"Istanbul, Türkiye", "8.5 °C", "rain", "07:30:12", "16:48:03", "2024-01-02", "9.25 °C"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("page does not show %q", want)
+		}
+	}
+	if strings.Contains(body, "<script>alert") {
+		t.Error("the provider's description is not escaped")
+	}
+	if !strings.Contains(body, "&lt;script&gt;alert(&#34;hi&#34;)&lt;/script&gt;") {
+		t.Error("the provider's description is not shown escaped")
+	}
+}
+
+func TestDashboardErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		apiKey     string
+		wantStatus int
+		want       string
+	}{
+		{name: "no location", target: "/dashboard", apiKey: "test", wantStatus: http.StatusBadRequest, want: "give a location"},
+		{name: "no API key", target: "/dashboard?country=Istanbul", wantStatus: http.StatusServiceUnavailable, want: errorMessages["upstream_unconfigured"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("API_KEY", tt.apiKey)
+			cfg := testConfig(t)
+			cache, _ := newTestCache(t, cfg)
+			var group singleflight.Group
+			rec := httptest.NewRecorder()
+			dashboardHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), cfg)(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+				t.Errorf("Content-Type = %q, want an HTML page", got)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, tt.want) || strings.Contains(body, `"error"`) {
+				t.Errorf("page = %s, want it to say %q", body, tt.want)
+			}
+		})
+	}
+}
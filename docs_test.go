@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"testing"
+)
+
+// servedRoutes returns the patterns serve registers on its mux, from the
+// get and mux.Handle calls in main.go, with whether each is an admin route.
+func servedRoutes(t *testing.T) map[string]bool {
+	t.Helper()
+	f, err := parser.ParseFile(token.NewFileSet(), "main.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := make(map[string]bool)
+	ast.Inspect(f, func(n ast.Node) bool {
+		call, ok := n.(*ast.CallExpr)
+		if !ok || len(call.Args) != 2 {
+			return true
+		}
+		switch fun := call.Fun.(type) {
+		case *ast.Ident:
+			if fun.Name != "get" {
+				return true
+			}
+		case *ast.SelectorExpr:
+			if x, ok := fun.X.(*ast.Ident); !ok || x.Name != "mux" || (fun.Sel.Name != "Handle" && fun.Sel.Name != "HandleFunc") {
+				return true
+			}
+		default:
+			return true
+		}
+		pattern := ""
+		switch arg := call.Args[0].(type) {
+		case *ast.BasicLit:
+			pattern, _ = strconv.Unquote(arg.Value)
+		case *ast.Ident:
+			switch arg.Name {
+			case "metricsPath":
+				pattern = metricsPath
+			case "pattern":
+				// The get helper itself.
+				return true
+			}
+		}
+		if pattern == "" {
+			t.Errorf("route registered with a pattern the test cannot read: %#v", call.Args[0])
+			return true
+		}
+		admin := false
+		ast.Inspect(call.Args[1], func(n ast.Node) bool {
+			if id, ok := n.(*ast.Ident); ok && id.Name == "adminMiddleware" {
+				admin = true
+			}
+			return true
+		})
+		routes[pattern] = admin
+		return true
+	})
+	return routes
+}
+
+// TestOpenAPICoversRoutes checks that every public route serve registers is
+// documented, and that the spec documents no route that does not exist.
+func TestOpenAPICoversRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	routes := servedRoutes(t)
+	if len(routes) == 0 {
+		t.Fatal("found no routes in main.go")
+	}
+	public := make(map[string]bool)
+	for pattern, admin := range routes {
+		switch {
+		case admin, pattern == "/":
+			// Admin routes are left out of the spec, / is the 404 catch-all.
+		case pattern == "/{$}":
+			public["/"] = true
+		default:
+			public[pattern] = true
+		}
+	}
+	for pattern := range public {
+		if _, ok := spec.Paths[pattern]; !ok {
+			t.Errorf("route %s is missing from openapi.json", pattern)
+		}
+	}
+	for path := range spec.Paths {
+		if !public[path] {
+			t.Errorf("openapi.json documents %s, which is not a public route", path)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Scopes of a rejection, saying whose allowance ran out.
+const (
+	scopeIP          = "ip"
+	scopeAPIKey      = "api-key"
+	scopeGlobalQuota = "global-quota"
+)
+
+// errorMessages holds the message sent with each error code. Replacing an
+// entry changes the message without touching the handlers that use it.
+var errorMessages = map[string]string{
+	"rate_limited":               "Too many requests, slow down and retry later",
+	"upstream_quota_exhausted":   "The daily quota of calls to the weather provider is exhausted, only cached locations can be served until it resets",
+	"api_key_required":           "An API key is required, in the X-API-Key header or as a bearer token",
+	"api_key_invalid":            "The API key is not valid",
+	"api_key_disabled":           "The API key has been revoked",
+	"auth_unavailable":           "API keys cannot be checked right now, retry later",
+	"admin_token_required":       "An admin token is required, in the X-Admin-Token header or as a bearer token",
+	"admin_token_invalid":        "The admin token is not valid",
+	"admin_certificate_required": "A client certificate issued by the admin CA is required",
+	"ip_denied":                  "Requests from this address are not allowed",
+	"method_not_allowed":         "Method not allowed",
+	"not_acceptable":             "None of the media types the request accepts can be sent, see details for the supported ones",
+	"body_too_large":             "The request body is too large",
+	"not_found":                  "No route matches the path, see / for the routes",
+	"location_rejected":          "The weather provider does not know this location",
+	"upstream_unconfigured":      "The weather provider is not configured, only cached locations can be served",
+	"upstream_error":             "The weather provider could not be reached",
+	"encoding_error":             "The response could not be encoded",
+	"internal_error":             "Something went wrong on our side",
+}
+
+// apiError is the body of an error response, sent as {"error": apiError}.
+// Code is stable for clients to match on, Message is for people. Neither
+// carries the internal cause of a failure, which is logged instead.
+type apiError struct {
+	Code              string  `json:"code" xml:"code,omitempty"`
+	Message           string  `json:"message" xml:"message,omitempty"`
+	RetryAfterSeconds int64   `json:"retry_after_seconds,omitempty" xml:"retry_after_seconds,omitempty"`
+	Limit             int     `json:"limit,omitempty" xml:"limit,omitempty"`
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty" xml:"requests_per_second,omitempty"`
+	Scope             string  `json:"scope,omitempty" xml:"scope,omitempty"`
+	Tier              string  `json:"tier,omitempty" xml:"tier,omitempty"`
+	// Details holds extra facts about the error, keyed by name.
+	Details   map[string]string `json:"details,omitempty" xml:"-"`
+	RequestID string            `json:"requestId,omitempty" xml:"requestId,omitempty"`
+}
+
+// writeError sends e with status, taking its message from errorMessages
+// when it has none and its request ID from the X-Request-ID response
+// header when one was set.
+func writeError(w http.ResponseWriter, status int, e apiError) {
+	if e.RequestID == "" {
+		e.RequestID = w.Header().Get(requestIDHeader)
+	}
+	writeJSON(w, status, errorBody(e))
+}
+
+// errorBody wraps e in the {"error": ...} envelope of error responses.
+func errorBody(e apiError) map[string]apiError {
+	if e.Message == "" {
+		e.Message = errorMessages[e.Code]
+	}
+	return map[string]apiError{"error": e}
+}
+
+// unconfiguredRetryAfter is when clients are told to retry a location that
+// missed the cache while no API key is set. Only a restart with the key
+// fixes that, so they are sent away for a while.
+const unconfiguredRetryAfter = 5 * time.Minute
+
+// writeUnconfigured sends the 503 of a cache miss that cannot be fetched for
+// want of an API key.
+func writeUnconfigured(w http.ResponseWriter) {
+	retry := retryAfterSeconds(unconfiguredRetryAfter)
+	w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+	writeError(w, http.StatusServiceUnavailable, apiError{Code: "upstream_unconfigured", RetryAfterSeconds: retry})
+}
+
+// retryAfterSeconds rounds d up to whole seconds, never under one, as the
+// Retry-After header does.
+func retryAfterSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(max(d, time.Second).Seconds()))
+}
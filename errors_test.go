@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestID   string
+		e           apiError
+		wantMessage string
+	}{
+		{name: "message from the code", e: apiError{Code: "not_found"}, wantMessage: errorMessages["not_found"]},
+		{name: "own message", e: apiError{Code: "invalid_request", Message: "days must be a number"}, wantMessage: "days must be a number"},
+		{name: "request ID", requestID: "abc", e: apiError{Code: "internal_error"}, wantMessage: errorMessages["internal_error"]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			if tt.requestID != "" {
+				rec.Header().Set(requestIDHeader, tt.requestID)
+			}
+			writeError(rec, http.StatusTeapot, tt.e)
+			if rec.Code != http.StatusTeapot {
+				t.Errorf("status = %d, want %d", rec.Code, http.StatusTeapot)
+			}
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			e := body["error"]
+			if e.Code != tt.e.Code || e.Message != tt.wantMessage || e.RequestID != tt.requestID {
+				t.Errorf("error = %+v, want code %q, message %q and request ID %q", e, tt.e.Code, tt.wantMessage, tt.requestID)
+			}
+		})
+	}
+}
+
+func TestRetryAfterSeconds(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want int64
+	}{
+		{d: 0, want: 1},
+		{d: 100 * time.Millisecond, want: 1},
+		{d: time.Second, want: 1},
+		{d: 1500 * time.Millisecond, want: 2},
+		{d: time.Minute, want: 60},
+	}
+	for _, tt := range tests {
+		if got := retryAfterSeconds(tt.d); got != tt.want {
+			t.Errorf("retryAfterSeconds(%s) = %d, want %d", tt.d, got, tt.want)
+		}
+	}
+}
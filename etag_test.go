@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		etag        string
+		want        bool
+	}{
+		{name: "no header", ifNoneMatch: "", etag: `"a"`, want: false},
+		{name: "same tag", ifNoneMatch: `"a"`, etag: `"a"`, want: true},
+		{name: "other tag", ifNoneMatch: `"b"`, etag: `"a"`, want: false},
+		{name: "one of a list", ifNoneMatch: `"b", "a"`, etag: `"a"`, want: true},
+		{name: "wildcard", ifNoneMatch: "*", etag: `"a"`, want: true},
+		{name: "weak header", ifNoneMatch: `W/"a"`, etag: `"a"`, want: true},
+		{name: "weak etag", ifNoneMatch: `"a"`, etag: `W/"a"`, want: true},
+		{name: "prefix only", ifNoneMatch: `"a-xml"`, etag: `"a"`, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMatches(tt.ifNoneMatch, tt.etag); got != tt.want {
+				t.Errorf("etagMatches(%q, %q) = %v, want %v", tt.ifNoneMatch, tt.etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPayloadETagIsStable(t *testing.T) {
+	a, b := payloadETag([]byte(`{"a":1}`)), payloadETag([]byte(`{"a":1}`))
+	if a != b {
+		t.Errorf("payloadETag() gave %s and %s for the same payload", a, b)
+	}
+	if c := payloadETag([]byte(`{"a":2}`)); c == a {
+		t.Errorf("payloadETag() gave %s for different payloads", c)
+	}
+}
+
+// testConfig returns the configuration with every default.
+func testConfig(t *testing.T) Config {
+	t.Helper()
+	cfg, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestCache returns a tiered cache over a Redis backend on miniredis.
+func newTestCache(t *testing.T, cfg Config) (*tieredCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), newCacheHealth(), cfg), mr
+}
+
+// TestCachedResponseETag serves a cached entry twice, the second time with
+// its ETag in If-None-Match.
+func TestCachedResponseETag(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LocalCacheTTL = time.Nanosecond
+	cache, _ := newTestCache(t, cfg)
+	value := testEntry(t, testWeather)
+	stored, _ := decodeCacheEntry(value)
+	q := defaultQuery("istanbul")
+	cache.Set(context.Background(), q.cacheKey(), value, time.Hour)
+
+	var group singleflight.Group
+	miss := func(w http.ResponseWriter, r *http.Request) { t.Error("the cached entry was not served") }
+	h := redisMiddleware(miss, parseWeatherQuery, cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg)
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+		wantBody    string
+	}{
+		{name: "first request", wantStatus: http.StatusOK, wantBody: string(stored.Payload)},
+		{name: "matching If-None-Match", ifNoneMatch: stored.ETag, wantStatus: http.StatusNotModified},
+		{name: "stale If-None-Match", ifNoneMatch: `"0123"`, wantStatus: http.StatusOK, wantBody: string(stored.Payload)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Let the in-process tier expire so the entry comes from Redis.
+			time.Sleep(time.Millisecond)
+			r := httptest.NewRequest(http.MethodGet, "/weather?country=istanbul", nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("ETag"); got != stored.ETag {
+				t.Errorf("ETag = %s, want %s", got, stored.ETag)
+			}
+			if got := rec.Body.String(); got != tt.wantBody {
+				t.Errorf("body =\n%s\nwant\n%s", got, tt.wantBody)
+			}
+			if tt.wantBody != "" && payloadETag(rec.Body.Bytes()) != stored.ETag {
+				t.Error("the body served does not hash to its ETag")
+			}
+		})
+	}
+}
+
+func TestWritePayloadContentType(t *testing.T) {
+	data, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := formatMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		writePayload(w, r, payloadETag(data), data)
+	}, "weather", func() any { return new(Weather) })
+	tests := []struct {
+		name   string
+		query  string
+		accept string
+		want   string
+	}{
+		{name: "default", want: "application/json"},
+		{name: "json", query: "&format=json", want: "application/json"},
+		{name: "xml", query: "&format=xml", want: "application/xml"},
+		{name: "csv", query: "&format=csv", want: "text/csv; charset=utf-8"},
+		{name: "Accept xml", accept: "application/xml", want: "application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather?country=istanbul"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			// gzipMiddleware sniffs a type for responses that set none.
+			rec := httptest.NewRecorder()
+			gzipMiddleware(h).ServeHTTP(rec, r)
+			if got := rec.Header().Get("Content-Type"); got != tt.want {
+				t.Errorf("Content-Type = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
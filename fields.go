@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// fieldTree is a selection of fields parsed from the fields parameter. A
+// field maps to the selection of its own fields, or to nil when it is
+// selected whole.
+type fieldTree map[string]fieldTree
+
+// jsonField is a field of a response type as it is encoded, with the type
+// of its elements when it holds a list.
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields lists the fields of the struct t by their JSON names, in order,
+// with the fields of embedded structs in place.
+func jsonFields(t reflect.Type) []jsonField {
+	var fields []jsonField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			fields = append(fields, jsonFields(f.Type)...)
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		typ := f.Type
+		for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice {
+			typ = typ.Elem()
+		}
+		fields = append(fields, jsonField{name: name, typ: typ})
+	}
+	return fields
+}
+
+// fieldPaths lists every field of t that can be selected, as the dotted
+// paths the fields parameter takes.
+func fieldPaths(t reflect.Type, prefix string) []string {
+	var paths []string
+	for _, f := range jsonFields(t) {
+		paths = append(paths, prefix+f.name)
+		if f.typ.Kind() == reflect.Struct {
+			paths = append(paths, fieldPaths(f.typ, prefix+f.name+".")...)
+		}
+	}
+	return paths
+}
+
+// validFieldPath reports whether path names a field of t.
+func validFieldPath(t reflect.Type, path string) bool {
+	for _, name := range strings.Split(path, ".") {
+		if t.Kind() != reflect.Struct {
+			return false
+		}
+		found := false
+		for _, f := range jsonFields(t) {
+			if f.name == name {
+				t, found = f.typ, true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// parseFields parses the comma-separated field paths of v, such as
+// days.temp, against the response type t.
+func parseFields(v string, t reflect.Type) (fieldTree, error) {
+	tree := fieldTree{}
+	for _, path := range strings.Split(v, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		if !validFieldPath(t, path) {
+			return nil, fmt.Errorf("unknown field %q, fields must be among %s", path, strings.Join(fieldPaths(t, ""), ", "))
+		}
+		node := tree
+		names := strings.Split(path, ".")
+		for i, name := range names {
+			sub, seen := node[name]
+			if seen && sub == nil {
+				// The field is selected whole already.
+				break
+			}
+			if i == len(names)-1 {
+				node[name] = nil
+				break
+			}
+			if sub == nil {
+				sub = fieldTree{}
+				node[name] = sub
+			}
+			node = sub
+		}
+	}
+	if len(tree) == 0 {
+		return nil, fmt.Errorf("fields must name at least one field")
+	}
+	return tree, nil
+}
+
+// project keeps the selected fields of v, a decoded JSON value, selecting
+// from every element of the lists it holds.
+func (tree fieldTree) project(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		kept := make(map[string]any, len(tree))
+		for name, sub := range tree {
+			val, ok := v[name]
+			if !ok {
+				continue
+			}
+			if sub != nil {
+				val = sub.project(val)
+			}
+			kept[name] = val
+		}
+		return kept
+	case []any:
+		for i := range v {
+			v[i] = tree.project(v[i])
+		}
+	}
+	return v
+}
+
+// fieldsMiddleware cuts the JSON responses of next down to the fields the
+// fields parameter selects from the type newBody returns. The cache keeps
+// the whole payload, which is only cut as it is sent.
+func fieldsMiddleware(next http.HandlerFunc, newBody func() any) http.HandlerFunc {
+	t := reflect.TypeOf(newBody()).Elem()
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.Query().Has("fields") {
+			next(w, r)
+			return
+		}
+		tree, err := parseFields(r.URL.Query().Get("fields"), t)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		if format, _ := negotiate(r, formatJSON, formatXML, formatCSV); format != formatJSON {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "fields is only available for JSON"})
+			return
+		}
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			return
+		}
+		// Numbers are kept as they were sent rather than turned into
+		// floats and back.
+		var body any
+		dec := json.NewDecoder(bytes.NewReader(buf.body.Bytes()))
+		dec.UseNumber()
+		if buf.status != http.StatusOK || dec.Decode(&body) != nil {
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		data, _ := json.Marshal(tree.project(body))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(buf.status)
+		w.Write(data)
+	}
+}
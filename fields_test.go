@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestFieldsMiddleware(t *testing.T) {
+	h := fieldsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, testWeather)
+	}, func() any { return new(Weather) })
+	tests := []struct {
+		name       string
+		fields     string
+		format     string
+		wantStatus int
+		want       string
+	}{
+		{name: "top level", fields: "resolvedAddress,timezone", wantStatus: http.StatusOK, want: `{"resolvedAddress":"Istanbul, Türkiye","timezone":""}`},
+		{name: "day fields", fields: "days.temp,days.datetime", wantStatus: http.StatusOK, want: `{"days":[{"datetime":"2024-01-01","temp":8.5},{"datetime":"2024-01-02","temp":9},{"datetime":"2024-01-03","temp":7.25}]}`},
+		{name: "hour fields", fields: "days.hours.datetime", wantStatus: http.StatusOK, want: `{"days":[{},{"hours":[{"datetime":"00:00:00"}]},{}]}`},
+		{name: "embedded fields", fields: "meta.temperature", wantStatus: http.StatusOK, want: `{"meta":{"temperature":"°C"}}`},
+		{name: "whole over part", fields: "meta.units,meta", wantStatus: http.StatusOK, want: `{"meta":{"temperature":"°C","units":"metric","visibility":"km","windSpeed":"km/h"}}`},
+		{name: "unknown field", fields: "resolvedAddress,mood", wantStatus: http.StatusBadRequest, want: `unknown field \"mood\", fields must be among latitude, longitude, resolvedAddress`},
+		{name: "unknown day field", fields: "days.mood", wantStatus: http.StatusBadRequest, want: "days.temp"},
+		{name: "field of a value", fields: "timezone.name", wantStatus: http.StatusBadRequest, want: "unknown field"},
+		{name: "none", fields: ",", wantStatus: http.StatusBadRequest, want: "at least one field"},
+		{name: "not JSON", fields: "days.temp", format: formatXML, wantStatus: http.StatusBadRequest, want: "only available for JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := url.Values{"country": {"istanbul"}, "fields": {tt.fields}}
+			if tt.format != "" {
+				query.Set("format", tt.format)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather?"+query.Encode(), nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !strings.Contains(rec.Body.String(), tt.want) {
+				t.Errorf("body = %s, want it to contain %s", rec.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldsMiddlewareWithoutFields(t *testing.T) {
+	h := fieldsMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, testWeather)
+	}, func() any { return new(Weather) })
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/weather?country=istanbul", nil))
+	var weather Weather
+	if err := json.Unmarshal(rec.Body.Bytes(), &weather); err != nil {
+		t.Fatal(err)
+	}
+	if len(weather.Days) != len(testWeather.Days) || weather.Days[0].Description != testWeather.Days[0].Description {
+		t.Errorf("weather = %+v, want all of %+v", weather, testWeather)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Formats a weather response can be rendered in. The cache always holds
+// JSON, the others are converted from it as the response is sent.
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatCSV  = "csv"
+)
+
+// bufferedResponse holds a response back so that it can be converted
+// before it is sent.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+// formatMiddleware renders the JSON responses of next in the format the
+// client asked for. Successful bodies are decoded into the value newBody
+// returns and encoded under the element root, errors as an error element.
+// CSV lists the days of a Weather, the only body it is offered for, and
+// leaves errors as they are.
+func formatMiddleware(next http.HandlerFunc, root string, newBody func() any) http.HandlerFunc {
+	offered := []string{formatJSON, formatXML}
+	if _, ok := newBody().(*Weather); ok {
+		offered = append(offered, formatCSV)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		format, err := negotiate(r, offered...)
+		if err != nil {
+			writeNegotiationError(w, err, offered)
+			return
+		}
+		if format == formatJSON {
+			next(w, r)
+			return
+		}
+		// The converted response gets a tag of its own, which the cache
+		// lookup knows as the tag of the JSON it was converted from.
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			var tags []string
+			for _, tag := range strings.Split(inm, ",") {
+				if tag, ok := strings.CutSuffix(strings.TrimSpace(tag), "-"+format+`"`); ok {
+					tags = append(tags, tag+`"`)
+				}
+			}
+			r = r.Clone(r.Context())
+			r.Header.Set("If-None-Match", strings.Join(tags, ", "))
+		}
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			// The request went away before anything was written.
+			return
+		}
+		if etag := w.Header().Get("ETag"); etag != "" {
+			w.Header().Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+format+`"`)
+		}
+		if buf.status == http.StatusNotModified {
+			w.WriteHeader(buf.status)
+			return
+		}
+		var out bytes.Buffer
+		contentType := "application/xml"
+		switch {
+		case format == formatCSV && buf.status >= 300:
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		case format == formatCSV:
+			var weather Weather
+			if err = json.Unmarshal(buf.body.Bytes(), &weather); err == nil {
+				err = encodeDaysCSV(&out, weather.Days)
+			}
+			contentType = "text/csv; charset=utf-8"
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": csvFilename(weather)}))
+		case buf.status < 300:
+			body := newBody()
+			if err = json.Unmarshal(buf.body.Bytes(), body); err == nil {
+				err = encodeXML(&out, root, body)
+			}
+		default:
+			err = encodeXML(&out, "error", decodeError(buf.body.Bytes()))
+		}
+		if err != nil {
+			logf(r.Context(), "Error encoding %s response : %v", format, err)
+			w.Header().Del("Content-Disposition")
+			writeError(w, http.StatusInternalServerError, apiError{Code: "encoding_error"})
+			return
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.Itoa(out.Len()))
+		w.WriteHeader(buf.status)
+		w.Write(out.Bytes())
+	}
+}
+
+func encodeXML(buf *bytes.Buffer, root string, v any) error {
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(buf)
+	enc.Indent("", "  ")
+	return enc.EncodeElement(v, xml.StartElement{Name: xml.Name{Local: root}})
+}
+
+// csvColumns heads the columns of a CSV response.
+var csvColumns = []string{"datetime", "temp", "feelslike", "windspeed", "visibility", "uvindex", "sunrise", "sunset", "description"}
+
+func encodeDaysCSV(buf *bytes.Buffer, days []Day) error {
+	cw := csv.NewWriter(buf)
+	cw.Write(csvColumns)
+	num := func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) }
+	for _, d := range days {
+		cw.Write([]string{d.Datetime, num(d.Temp), num(d.FeelsLike), num(d.WindSpeed), num(d.Visibility), num(d.UVIndex), d.Sunrise, d.Sunset, d.Description})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// csvFilename names a CSV download after the location and the days it
+// covers, as in istanbul-turkiye_2024-01-01_2024-01-07.csv.
+func csvFilename(weather Weather) string {
+	var name strings.Builder
+	for _, r := range normalizeKey(weather.ResolvedAddress) {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			name.WriteRune(r)
+		case name.Len() > 0 && !strings.HasSuffix(name.String(), "-"):
+			name.WriteByte('-')
+		}
+	}
+	parts := []string{strings.TrimSuffix(name.String(), "-")}
+	if parts[0] == "" {
+		parts[0] = "weather"
+	}
+	if n := len(weather.Days); n > 0 {
+		parts = append(parts, weather.Days[0].Datetime)
+		if n > 1 {
+			parts = append(parts, weather.Days[n-1].Datetime)
+		}
+	}
+	return strings.Join(parts, "_") + ".csv"
+}
+
+// decodeError recovers the error of an error response, which is either
+// {"error": apiError}, {"error": "message"} or plain text.
+func decodeError(body []byte) apiError {
+	var envelope struct {
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(body, &envelope); err == nil && len(envelope.Error) > 0 {
+		var e apiError
+		if json.Unmarshal(envelope.Error, &e) == nil {
+			return e
+		}
+		var message string
+		if json.Unmarshal(envelope.Error, &message) == nil {
+			return apiError{Message: message}
+		}
+	}
+	return apiError{Message: strings.TrimSpace(string(body))}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// formatted serves body with status through formatMiddleware in format.
+func formatted(t *testing.T, format string, status int, body any, newBody func() any) *httptest.ResponseRecorder {
+	t.Helper()
+	h := formatMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		if e, ok := body.(apiError); ok {
+			writeError(w, status, e)
+			return
+		}
+		writeJSON(w, status, body)
+	}, "weather", newBody)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/weather?country=istanbul&format="+format, nil))
+	return rec
+}
+
+func TestFormatMiddlewareXML(t *testing.T) {
+	newWeather := func() any { return new(Weather) }
+	tests := []struct {
+		name       string
+		status     int
+		body       any
+		wantStatus int
+		want       []string
+	}{
+		{name: "weather", status: http.StatusOK, body: testWeather, wantStatus: http.StatusOK, want: []string{"<weather>", "<resolvedAddress>Istanbul, Türkiye</resolvedAddress>", "Cloudy &lt;and&gt; cold"}},
+		{name: "error", status: http.StatusBadRequest, body: apiError{Code: "invalid_request", Message: "bad"}, wantStatus: http.StatusBadRequest, want: []string{"<error>", "<code>invalid_request</code>", "<message>bad</message>"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := formatted(t, formatXML, tt.status, tt.body, newWeather)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("body does not contain %s:\n%s", want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestFormatMiddlewareCSV(t *testing.T) {
+	rec := formatted(t, formatCSV, http.StatusOK, testWeather, func() any { return new(Weather) })
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	rows, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(testWeather.Days)+1 || strings.Join(rows[0], ",") != strings.Join(csvColumns, ",") {
+		t.Fatalf("rows = %v, want the header and %d days", rows, len(testWeather.Days))
+	}
+	if rows[1][0] != "2024-01-01" || rows[1][1] != "8.5" || rows[1][8] != "Cloudy <and> cold" {
+		t.Errorf("first day = %v", rows[1])
+	}
+	if got, want := rec.Header().Get("Content-Disposition"), `attachment; filename*=utf-8''istanbul-t%C3%BCrkiye_2024-01-01_2024-01-03.csv`; got != want {
+		t.Errorf("Content-Disposition = %q, want %q", got, want)
+	}
+
+	// CSV of anything but days is not acceptable, and errors are left as
+	// JSON.
+	if rec := formatted(t, formatCSV, http.StatusOK, Current{}, func() any { return new(Current) }); rec.Code != http.StatusNotAcceptable {
+		t.Errorf("CSV of current conditions got %d, want 406", rec.Code)
+	}
+	rec = formatted(t, formatCSV, http.StatusBadGateway, apiError{Code: "upstream_error"}, func() any { return new(Weather) })
+	var body map[string]apiError
+	if rec.Code != http.StatusBadGateway || json.Unmarshal(rec.Body.Bytes(), &body) != nil || body["error"].Code != "upstream_error" {
+		t.Errorf("CSV error response = %d %s, want the JSON error", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCSVFilename(t *testing.T) {
+	tests := []struct {
+		name    string
+		weather Weather
+		want    string
+	}{
+		{name: "range", weather: testWeather, want: "istanbul-türkiye_2024-01-01_2024-01-03.csv"},
+		{name: "one day", weather: Weather{ResolvedAddress: "New York, NY", Days: []Day{{Datetime: "2024-01-01"}}}, want: "new-york-ny_2024-01-01.csv"},
+		{name: "no address", weather: Weather{}, want: "weather.csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := csvFilename(tt.weather); got != tt.want {
+				t.Errorf("csvFilename() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/DincerY/weather-api/weatherpb"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpccredentials "google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// grpcForwardedMetadata are the request metadata passed on as the headers
+// of the same name, and grpcReturnedHeaders the response headers sent back
+// as metadata.
+var (
+	grpcForwardedMetadata = []string{"x-api-key", "authorization", requestIDHeader}
+	grpcReturnedHeaders   = []string{"X-Cache", "X-Cache-TTL", "X-Stale", "Age", requestIDHeader}
+)
+
+// weatherServer answers the gRPC service by making the matching HTTP
+// request to handler, the server's own, so that calls are authenticated,
+// rate limited and cached exactly like requests are.
+type weatherServer struct {
+	weatherpb.UnimplementedWeatherServiceServer
+	handler http.Handler
+}
+
+// newGRPCServer returns a server of the weather service, with reflection,
+// that hands calls to handler. TLS is used when tlsConfig is not nil.
+func newGRPCServer(handler http.Handler, tlsConfig *tls.Config) *grpc.Server {
+	var opts []grpc.ServerOption
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(grpccredentials.NewTLS(tlsConfig)))
+	}
+	server := grpc.NewServer(opts...)
+	weatherpb.RegisterWeatherServiceServer(server, &weatherServer{handler: handler})
+	reflection.Register(server)
+	return server
+}
+
+func (s *weatherServer) GetWeather(ctx context.Context, req *weatherpb.WeatherRequest) (*weatherpb.Weather, error) {
+	params := weatherParams(req.GetCountry(), req.Lat, req.Lon, req.GetUnits(), req.GetLang(), req.GetMaxAge())
+	var weather Weather
+	if err := s.call(ctx, apiVersionPrefix+"/weather", params, &weather); err != nil {
+		return nil, err
+	}
+	return weatherProto(weather), nil
+}
+
+func (s *weatherServer) GetForecast(ctx context.Context, req *weatherpb.ForecastRequest) (*weatherpb.Weather, error) {
+	params := weatherParams(req.GetCountry(), req.Lat, req.Lon, req.GetUnits(), req.GetLang(), req.GetMaxAge())
+	if req.GetDays() != 0 {
+		params.Set("days", strconv.Itoa(int(req.GetDays())))
+	}
+	var weather Weather
+	if err := s.call(ctx, apiVersionPrefix+"/weather/forecast", params, &weather); err != nil {
+		return nil, err
+	}
+	return weatherProto(weather), nil
+}
+
+func (s *weatherServer) GetCurrent(ctx context.Context, req *weatherpb.WeatherRequest) (*weatherpb.Current, error) {
+	params := weatherParams(req.GetCountry(), req.Lat, req.Lon, req.GetUnits(), req.GetLang(), req.GetMaxAge())
+	var current Current
+	if err := s.call(ctx, apiVersionPrefix+"/weather/current", params, &current); err != nil {
+		return nil, err
+	}
+	return currentProto(current), nil
+}
+
+// weatherParams are the query parameters of a weather request. Unset
+// fields are left out, so that the defaults and validation of the HTTP
+// endpoints apply.
+func weatherParams(country string, lat, lon *float64, units, lang string, maxAge int64) url.Values {
+	params := url.Values{}
+	if country != "" {
+		params.Set("country", country)
+	}
+	if lat != nil {
+		params.Set("lat", strconv.FormatFloat(*lat, 'f', -1, 64))
+	}
+	if lon != nil {
+		params.Set("lon", strconv.FormatFloat(*lon, 'f', -1, 64))
+	}
+	if units != "" {
+		params.Set("units", units)
+	}
+	if lang != "" {
+		params.Set("lang", lang)
+	}
+	if maxAge != 0 {
+		params.Set("max_age", strconv.FormatInt(maxAge, 10))
+	}
+	return params
+}
+
+// call makes a GET request for path to the HTTP handler on behalf of the
+// gRPC caller and decodes its JSON answer into v, or turns its error into
+// a status.
+func (s *weatherServer) call(ctx context.Context, path string, params url.Values, v any) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, path+"?"+params.Encode(), nil)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		r.RemoteAddr = p.Addr.String()
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, name := range grpcForwardedMetadata {
+		if values := md.Get(name); len(values) > 0 {
+			r.Header.Set(name, values[0])
+		}
+	}
+	r.Header.Set("Accept", "application/json")
+	res := &bufferedResponse{header: http.Header{}}
+	s.handler.ServeHTTP(res, r)
+
+	header := metadata.MD{}
+	for _, name := range grpcReturnedHeaders {
+		if v := res.header.Get(name); v != "" {
+			header.Set(name, v)
+		}
+	}
+	grpc.SetHeader(ctx, header)
+	if res.status != http.StatusOK {
+		return grpcError(res.status, res.header, res.body.Bytes())
+	}
+	if err := json.Unmarshal(res.body.Bytes(), v); err != nil {
+		logf(ctx, "Error decoding the answer to a gRPC call : %v", err)
+		return status.Error(codes.Internal, errorMessages["internal_error"])
+	}
+	return nil
+}
+
+// grpcError turns an HTTP error response into the status of the matching
+// code, telling the caller when to retry if the response did.
+func grpcError(httpStatus int, header http.Header, body []byte) error {
+	var e struct {
+		Error apiError `json:"error"`
+	}
+	json.Unmarshal(body, &e)
+	code := codes.Internal
+	switch {
+	case e.Error.Code == "upstream_quota_exhausted":
+		code = codes.ResourceExhausted
+	case e.Error.Code == "location_rejected":
+		code = codes.NotFound
+	case httpStatus == http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case httpStatus == http.StatusUnauthorized:
+		code = codes.Unauthenticated
+	case httpStatus == http.StatusForbidden:
+		code = codes.PermissionDenied
+	case httpStatus == http.StatusNotFound:
+		code = codes.NotFound
+	case httpStatus == http.StatusTooManyRequests:
+		code = codes.ResourceExhausted
+	case httpStatus == http.StatusBadGateway || httpStatus == http.StatusServiceUnavailable || httpStatus == http.StatusGatewayTimeout:
+		code = codes.Unavailable
+	}
+	message := e.Error.Message
+	if message == "" {
+		message = http.StatusText(httpStatus)
+	}
+	st := status.New(code, message)
+	if seconds, err := strconv.ParseInt(header.Get("Retry-After"), 10, 64); err == nil {
+		retry := &errdetails.RetryInfo{RetryDelay: durationpb.New(time.Duration(seconds) * time.Second)}
+		if withRetry, err := st.WithDetails(retry); err == nil {
+			st = withRetry
+		}
+	}
+	return st.Err()
+}
+
+func weatherProto(w Weather) *weatherpb.Weather {
+	days := make([]*weatherpb.Day, len(w.Days))
+	for i, d := range w.Days {
+		days[i] = &weatherpb.Day{
+			Datetime:    d.Datetime,
+			Temp:        d.Temp,
+			Feelslike:   d.FeelsLike,
+			Windspeed:   d.WindSpeed,
+			Visibility:  d.Visibility,
+			Uvindex:     d.UVIndex,
+			Sunrise:     d.Sunrise,
+			Sunset:      d.Sunset,
+			Icon:        d.Icon,
+			Description: d.Description,
+		}
+	}
+	return &weatherpb.Weather{
+		Latitude:        w.Latitude,
+		Longitude:       w.Longitude,
+		ResolvedAddress: w.ResolvedAddress,
+		Timezone:        w.Timezone,
+		Description:     w.Description,
+		Days:            days,
+		Meta:            metaProto(w.Meta),
+	}
+}
+
+func currentProto(c Current) *weatherpb.Current {
+	return &weatherpb.Current{
+		Datetime:      c.Datetime,
+		DatetimeEpoch: c.DatetimeEpoch,
+		Temp:          c.Temp,
+		Feelslike:     c.FeelsLike,
+		Windspeed:     c.WindSpeed,
+		Icon:          c.Icon,
+		Conditions:    c.Conditions,
+		Meta:          metaProto(c.Meta),
+	}
+}
+
+func metaProto(m *weatherMeta) *weatherpb.Meta {
+	if m == nil {
+		return nil
+	}
+	return &weatherpb.Meta{Units: m.Units, Temperature: m.Temperature, WindSpeed: m.WindSpeed, Visibility: m.Visibility}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/DincerY/weather-api/weatherpb"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient serves the gRPC service in process, in front of the weather
+// routes with a provider answering with providerStatus, and returns a client
+// of it along with the provider's call count.
+func grpcClient(t *testing.T, providerStatus, dailyBudget int) (weatherpb.WeatherServiceClient, func() int64) {
+	t.Helper()
+	calls := stubProvider(t, 0, providerStatus)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	budget := newUpstreamBudget(dailyBudget, 0, time.UTC, nil)
+	var group singleflight.Group
+	fetch := fetchHandler(cache, &group, budget, cfg)
+	mux := http.NewServeMux()
+	for path, parse := range map[string]func(*http.Request) (weatherQuery, error){
+		"/weather":          parseWeatherQuery,
+		"/weather/forecast": parseForecastQuery,
+		"/weather/current":  parseCurrentQuery,
+	} {
+		mux.Handle(path, redisMiddleware(fetch, parse, cache, &group, budget, newHotKeys(), &cacheStats{}, cfg))
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := newGRPCServer(versionMiddleware(clientIPMiddleware(mux, nil, defaultIPv6PrefixBits), mux, time.Now()), nil)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return weatherpb.NewWeatherServiceClient(conn), calls.Load
+}
+
+func TestGRPCGetWeather(t *testing.T) {
+	client, calls := grpcClient(t, http.StatusOK, 0)
+	for _, wantCache := range []string{"MISS", "HIT"} {
+		var header metadata.MD
+		weather, err := client.GetWeather(context.Background(), &weatherpb.WeatherRequest{Country: "Istanbul"}, grpc.Header(&header))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if weather.GetResolvedAddress() != testWeather.ResolvedAddress || len(weather.GetDays()) != len(testWeather.Days) {
+			t.Errorf("weather = %v, want %v", weather, testWeather)
+		}
+		if got := weather.GetDays()[0].GetTemp(); got != testWeather.Days[0].Temp {
+			t.Errorf("temp = %v, want %v", got, testWeather.Days[0].Temp)
+		}
+		if got := weather.GetMeta().GetTemperature(); got != testWeather.Meta.Temperature {
+			t.Errorf("temperature unit = %q, want %q", got, testWeather.Meta.Temperature)
+		}
+		if got := header.Get("x-cache"); len(got) != 1 || got[0] != wantCache {
+			t.Errorf("x-cache = %v, want %s", got, wantCache)
+		}
+	}
+	if got := calls(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+}
+
+func TestGRPCForecastAndCurrent(t *testing.T) {
+	client, calls := grpcClient(t, http.StatusOK, 0)
+	lat, lon := 41.01, 28.97
+	if _, err := client.GetForecast(context.Background(), &weatherpb.ForecastRequest{Lat: &lat, Lon: &lon, Days: 3}); err != nil {
+		t.Errorf("GetForecast() error = %v", err)
+	}
+	// Current conditions are only in the provider's answers to asks for
+	// them.
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		withCurrent := testWeather
+		withCurrent.Current = &Current{Datetime: "12:00:00", Temp: 8}
+		res, err := transport.RoundTrip(r)
+		if err == nil {
+			res.Body.Close()
+			body, _ := json.Marshal(withCurrent)
+			res.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		return res, err
+	})
+	current, err := client.GetCurrent(context.Background(), &weatherpb.WeatherRequest{Country: "Istanbul", Units: "us"})
+	if err != nil {
+		t.Fatalf("GetCurrent() error = %v", err)
+	}
+	if current.GetTemp() != 8 || current.GetDatetime() != "12:00:00" {
+		t.Errorf("current = %v, want 8 degrees at 12:00:00", current)
+	}
+	if got := calls(); got != 2 {
+		t.Errorf("provider called %d times, want 2", got)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	tests := []struct {
+		name           string
+		providerStatus int
+		dailyBudget    int
+		req            *weatherpb.ForecastRequest
+		want           codes.Code
+		wantRetry      bool
+	}{
+		{name: "no location", providerStatus: http.StatusOK, req: &weatherpb.ForecastRequest{}, want: codes.InvalidArgument},
+		{name: "too many days", providerStatus: http.StatusOK, req: &weatherpb.ForecastRequest{Country: "Istanbul", Days: 30}, want: codes.InvalidArgument},
+		{name: "unknown location", providerStatus: http.StatusBadRequest, req: &weatherpb.ForecastRequest{Country: "Atlantis"}, want: codes.NotFound},
+		{name: "provider down", providerStatus: http.StatusInternalServerError, req: &weatherpb.ForecastRequest{Country: "Istanbul"}, want: codes.Unavailable},
+		{name: "budget spent", providerStatus: http.StatusOK, dailyBudget: 1, req: &weatherpb.ForecastRequest{Country: "Istanbul"}, want: codes.ResourceExhausted, wantRetry: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, _ := grpcClient(t, tt.providerStatus, tt.dailyBudget)
+			if tt.dailyBudget > 0 {
+				// Another location spends the budget.
+				if _, err := client.GetForecast(context.Background(), &weatherpb.ForecastRequest{Country: "Ankara"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := client.GetForecast(context.Background(), tt.req)
+			st := status.Convert(err)
+			if st.Code() != tt.want {
+				t.Fatalf("code = %s, want %s: %v", st.Code(), tt.want, err)
+			}
+			retry := false
+			for _, detail := range st.Details() {
+				if _, ok := detail.(*errdetails.RetryInfo); ok {
+					retry = true
+				}
+			}
+			if retry != tt.wantRetry {
+				t.Errorf("retry info = %v, want %v", retry, tt.wantRetry)
+			}
+		})
+	}
+}
+
+func TestGRPCReflection(t *testing.T) {
+	server := newGRPCServer(http.NotFoundHandler(), nil)
+	services := server.GetServiceInfo()
+	for _, name := range []string{"weather.v1.WeatherService", "grpc.reflection.v1.ServerReflection"} {
+		if _, ok := services[name]; !ok {
+			t.Errorf("%s is not served", name)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headMiddleware answers HEAD requests by serving next the GET of the same
+// URL and discarding the body, so that the headers, Content-Length included,
+// are those of the GET.
+func headMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		get := r.Clone(r.Context())
+		get.Method = http.MethodGet
+		hw := &headResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(hw, get)
+		hw.finish()
+	})
+}
+
+// headResponseWriter counts the body it discards, holding the headers back
+// until the handler returns to send its length.
+type headResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+	sent    bool
+}
+
+func (h *headResponseWriter) WriteHeader(status int) {
+	if h.status == 0 {
+		h.status = status
+	}
+}
+
+func (h *headResponseWriter) Write(p []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.written += int64(len(p))
+	return len(p), nil
+}
+
+// Flush sends the headers as they are, for streams that never end.
+func (h *headResponseWriter) Flush() {
+	h.send()
+	http.NewResponseController(h.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (h *headResponseWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+func (h *headResponseWriter) send() {
+	if h.sent {
+		return
+	}
+	h.sent = true
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+	h.ResponseWriter.WriteHeader(h.status)
+}
+
+// finish sends the headers once the handler returns, with the length of the
+// body it wrote unless it gave one.
+func (h *headResponseWriter) finish() {
+	if h.sent {
+		return
+	}
+	noBody := h.status == http.StatusNoContent || h.status == http.StatusNotModified || (h.status >= 100 && h.status < 200)
+	if h.Header().Get("Content-Length") == "" && !noBody {
+		h.Header().Set("Content-Length", strconv.FormatInt(h.written, 10))
+	}
+	h.send()
+}
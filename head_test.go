@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// TestHeadMatchesGet compares the headers of a HEAD and a GET of the same
+// URL, for a small and a compressed body.
+func TestHeadMatchesGet(t *testing.T) {
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	long := testWeather
+	for range 20 {
+		long.Days = append(long.Days, testWeather.Days...)
+	}
+	cache.Set(context.Background(), defaultQuery("ankara").cacheKey(), testEntry(t, long), time.Hour)
+	var group singleflight.Group
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	mux := http.NewServeMux()
+	lookup := redisMiddleware(fetchHandler(cache, &group, budget, cfg), parseWeatherQuery, cache, &group, budget, newHotKeys(), &cacheStats{}, cfg)
+	mux.Handle("/weather", allowMethods(formatMiddleware(lookup, "weather", func() any { return new(Weather) }), http.MethodGet))
+	server := httptest.NewServer(headMiddleware(gzipMiddleware(mux)))
+	defer server.Close()
+
+	// The transport would ask for gzip and decompress the body itself.
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	do := func(method, target, encoding string) *http.Response {
+		t.Helper()
+		r, err := http.NewRequest(method, server.URL+target, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if encoding != "" {
+			r.Header.Set("Accept-Encoding", encoding)
+		}
+		res, err := client.Do(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { res.Body.Close() })
+		return res
+	}
+	tests := []struct {
+		name     string
+		target   string
+		encoding string
+	}{
+		{name: "small", target: "/weather?country=istanbul"},
+		{name: "compressed", target: "/weather?country=ankara", encoding: "gzip"},
+		{name: "error", target: "/weather"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get, head := do(http.MethodGet, tt.target, tt.encoding), do(http.MethodHead, tt.target, tt.encoding)
+			if head.StatusCode != get.StatusCode {
+				t.Errorf("HEAD status = %d, GET %d", head.StatusCode, get.StatusCode)
+			}
+			if got := get.Header.Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("GET Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			body, _ := io.ReadAll(get.Body)
+			if get.ContentLength != int64(len(body)) {
+				t.Fatalf("GET Content-Length = %d for a body of %d bytes", get.ContentLength, len(body))
+			}
+			if head.ContentLength != get.ContentLength {
+				t.Errorf("HEAD Content-Length = %d, GET %d", head.ContentLength, get.ContentLength)
+			}
+			for _, name := range []string{"Content-Type", "Content-Encoding", "ETag", "X-Cache", "X-Cache-TTL", "Age"} {
+				if got, want := head.Header.Get(name), get.Header.Get(name); got != want {
+					t.Errorf("HEAD %s = %q, GET %q", name, got, want)
+				}
+			}
+			if headBody, _ := io.ReadAll(head.Body); len(headBody) != 0 {
+				t.Errorf("HEAD sent a body of %d bytes", len(headBody))
+			}
+		})
+	}
+}
+
+func TestHeadWithoutBody(t *testing.T) {
+	h := headMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			t.Errorf("handler got a %s, want a GET", r.Method)
+		}
+		w.WriteHeader(http.StatusNotModified)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/weather", nil))
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("status = %d, want 304", rec.Code)
+	}
+	if got := rec.Header().Get("Content-Length"); got != "" {
+		t.Errorf("Content-Length = %q on a 304", got)
+	}
+}
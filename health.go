@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheHealth records whether the cache backend is reachable. It is kept up
+// to date by run and consulted by tieredCache so that requests skip the
+// backend entirely while it is down instead of each paying the timeout.
+type cacheHealth struct {
+	mu          sync.RWMutex
+	up          bool
+	lastError   string
+	lastErrorAt time.Time
+	lastSuccess time.Time
+}
+
+type cacheHealthStatus struct {
+	Up          bool       `json:"up"`
+	LastError   string     `json:"lastError,omitempty"`
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+}
+
+// newCacheHealth returns a tracker that starts out up, since main has already
+// pinged the backend by the time it is created.
+func newCacheHealth() *cacheHealth {
+	return &cacheHealth{up: true, lastSuccess: time.Now()}
+}
+
+func (h *cacheHealth) Up() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.up
+}
+
+func (h *cacheHealth) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		h.up = false
+		h.lastError = err.Error()
+		h.lastErrorAt = time.Now()
+		return
+	}
+	h.up = true
+	h.lastSuccess = time.Now()
+}
+
+func (h *cacheHealth) Status() cacheHealthStatus {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	status := cacheHealthStatus{Up: h.up, LastError: h.lastError}
+	if !h.lastErrorAt.IsZero() {
+		t := h.lastErrorAt
+		status.LastErrorAt = &t
+	}
+	if !h.lastSuccess.IsZero() {
+		t := h.lastSuccess
+		status.LastSuccess = &t
+	}
+	return status
+}
+
+// run pings the backend every interval while it is up. Once a ping fails it
+// retries with an exponential backoff, starting at one second and capped at
+// maxBackoff, until the backend answers again.
+func (h *cacheHealth) run(ctx context.Context, backend Cache, interval time.Duration, maxBackoff time.Duration) {
+	backoff := time.Second
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, time.Second)
+		err := backend.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		h.record(err)
+
+		wait := interval
+		if err != nil {
+			wait = backoff
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		} else {
+			backoff = time.Second
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+func statusHandler(health *cacheHealth, backend string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"cache": health.Status(), "backend": backend})
+	}
+}
+
+// Ways /healthz checks the provider.
+const (
+	healthUpstreamRecent = "recent"
+	healthUpstreamHead   = "head"
+	healthUpstreamOff    = "off"
+)
+
+// lastUpstreamSuccess is when, in Unix nanoseconds, the provider last
+// answered a fetch.
+var lastUpstreamSuccess atomic.Int64
+
+// componentHealth is the state of one dependency in /healthz. Only required
+// components being down make the instance unhealthy.
+type componentHealth struct {
+	Status   string `json:"status"`
+	Required bool   `json:"required"`
+	Error    string `json:"error,omitempty"`
+}
+
+// healthzHandler serves GET /healthz: 200 when the cache answers a ping, 503
+// when it does not. The provider is reported too, checked as configured by
+// HealthUpstreamCheck, but does not fail the check since cached locations
+// can still be served without it.
+func healthzHandler(backend Cache, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		components := map[string]componentHealth{
+			"cache":    checkCache(r.Context(), backend, cfg.CacheBackend),
+			"upstream": checkUpstream(r.Context(), cfg),
+		}
+		status, code := "ok", http.StatusOK
+		for _, c := range components {
+			if c.Required && c.Status == "down" {
+				status, code = "unavailable", http.StatusServiceUnavailable
+			}
+		}
+		writeJSON(w, code, map[string]interface{}{"status": status, "components": components})
+	}
+}
+
+func checkCache(ctx context.Context, backend Cache, name string) componentHealth {
+	if name == cacheBackendNone {
+		return componentHealth{Status: "disabled"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	if err := backend.Ping(ctx); err != nil {
+		return componentHealth{Status: "down", Required: true, Error: err.Error()}
+	}
+	return componentHealth{Status: "up", Required: true}
+}
+
+func checkUpstream(ctx context.Context, cfg Config) componentHealth {
+	switch cfg.HealthUpstreamCheck {
+	case healthUpstreamOff:
+		return componentHealth{Status: "disabled"}
+	case healthUpstreamHead:
+		ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, "https://weather.visualcrossing.com/", nil)
+		if err != nil {
+			return componentHealth{Status: "down", Error: err.Error()}
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return componentHealth{Status: "down", Error: err.Error()}
+		}
+		res.Body.Close()
+		if res.StatusCode >= 500 {
+			return componentHealth{Status: "down", Error: res.Status}
+		}
+		return componentHealth{Status: "up"}
+	}
+	last := lastUpstreamSuccess.Load()
+	if last == 0 {
+		return componentHealth{Status: "unknown"}
+	}
+	if time.Since(time.Unix(0, last)) > cfg.HealthUpstreamMaxAge {
+		return componentHealth{Status: "down", Error: "no successful fetch within " + cfg.HealthUpstreamMaxAge.String()}
+	}
+	return componentHealth{Status: "up"}
+}
+
+// probeState is what the probes need to know of the server's lifecycle.
+type probeState struct {
+	warming  atomic.Bool
+	draining atomic.Bool
+	stopping atomic.Bool
+}
+
+// livezHandler serves GET /livez, which fails only once the server is
+// stopping.
+func livezHandler(p *probeState) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if p.stopping.Load() {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "stopping"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}
+}
+
+// readyzHandler serves GET /readyz, which fails while a blocking warm up
+// runs, from the start of a shutdown, and while the cache is down. The
+// configuration was validated at startup, or the server would not be
+// running.
+func readyzHandler(p *probeState, health *cacheHealth, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{"config": "ok", "cache": "ok"}
+		if cfg.CacheBackend == cacheBackendNone {
+			checks["cache"] = "disabled"
+		} else if !health.Up() {
+			checks["cache"] = "down"
+		}
+		status := "ok"
+		switch {
+		case p.draining.Load():
+			status = "draining"
+		case p.warming.Load():
+			status = "warming"
+		case checks["cache"] == "down":
+			status = "unavailable"
+		}
+		code := http.StatusOK
+		if status != "ok" {
+			code = http.StatusServiceUnavailable
+		}
+		writeJSON(w, code, map[string]interface{}{"status": status, "checks": checks})
+	}
+}
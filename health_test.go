@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// switchableCache is an in-memory Cache that can be taken down, failing
+// every call, and counts the reads and writes that reach it.
+type switchableCache struct {
+	down  atomic.Bool
+	calls atomic.Int64
+
+	mu      sync.Mutex
+	entries map[string][]byte
+}
+
+var errSwitchedDown = errors.New("switched down")
+
+func (c *switchableCache) Get(ctx context.Context, key string) ([]byte, error) {
+	c.calls.Add(1)
+	if c.down.Load() {
+		return nil, errSwitchedDown
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.entries[key]
+	if !ok {
+		return nil, errCacheMiss
+	}
+	return val, nil
+}
+
+func (c *switchableCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	c.calls.Add(1)
+	if c.down.Load() {
+		return errSwitchedDown
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string][]byte)
+	}
+	c.entries[key] = value
+	return nil
+}
+
+func (c *switchableCache) Delete(ctx context.Context, key string) error {
+	c.calls.Add(1)
+	if c.down.Load() {
+		return errSwitchedDown
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, key)
+	return nil
+}
+
+func (c *switchableCache) Ping(ctx context.Context) error {
+	if c.down.Load() {
+		return errSwitchedDown
+	}
+	return nil
+}
+
+// TestCacheHealthRecovery takes the backend down and up again under a
+// running health check. While it is down requests must not reach it, and
+// the status endpoint must say so.
+func TestCacheHealthRecovery(t *testing.T) {
+	stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.LocalCacheSize = 0
+	backend := &switchableCache{}
+	health := newCacheHealth()
+	cache := newTieredCache(backend, health, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go health.run(ctx, backend, 10*time.Millisecond, 10*time.Millisecond)
+
+	waitUp := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(3 * time.Second)
+		for health.Up() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("health still reports up = %v", !want)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	status := func() cacheHealthStatus {
+		t.Helper()
+		rec := serveGet(statusHandler(health, "switchable"), "/status")
+		var body struct {
+			Cache cacheHealthStatus `json:"cache"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decoding /status: %v", err)
+		}
+		return body.Cache
+	}
+
+	backend.down.Store(true)
+	waitUp(false)
+	if s := status(); s.Up || s.LastError != errSwitchedDown.Error() {
+		t.Errorf("status while down = %+v, want down with %q", s, errSwitchedDown)
+	}
+	before := backend.calls.Load()
+	for i, want := range []string{"MISS", "HIT"} {
+		rec := serveGet(h, "/weather?country=istanbul")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != want {
+			t.Errorf("request %d while down: status %d, X-Cache %q, want 200 %s", i+1, rec.Code, rec.Header().Get("X-Cache"), want)
+		}
+	}
+	if got := backend.calls.Load() - before; got != 0 {
+		t.Errorf("%d calls reached the backend while it was down, want 0", got)
+	}
+
+	backend.down.Store(false)
+	waitUp(true)
+	if s := status(); !s.Up {
+		t.Errorf("status after recovery = %+v, want up", s)
+	}
+	before = backend.calls.Load()
+	serveGet(h, "/weather?country=ankara")
+	if backend.calls.Load() == before {
+		t.Error("requests still skip the backend after it recovered")
+	}
+}
+
+// TestProbesWithRedisDown stops Redis under the health and readiness
+// probes, which must then fail with 503 and say the cache is what is down.
+func TestProbesWithRedisDown(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.HealthUpstreamCheck = healthUpstreamOff
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	backend := newRedisBackend(client, cacheCodecs["json"], true)
+	health := newCacheHealth()
+	healthz := healthzHandler(backend, cfg)
+	readyz := readyzHandler(&probeState{}, health, cfg)
+
+	type healthzBody struct {
+		Status     string                     `json:"status"`
+		Components map[string]componentHealth `json:"components"`
+	}
+	type readyzBody struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	probe := func(h http.Handler, path string, wantCode int, body any) {
+		t.Helper()
+		rec := serveGet(h, path)
+		if rec.Code != wantCode {
+			t.Fatalf("%s: status = %d, want %d: %s", path, rec.Code, wantCode, rec.Body)
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), body); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+	}
+
+	var hz healthzBody
+	probe(healthz, "/healthz", http.StatusOK, &hz)
+	if hz.Status != "ok" || hz.Components["cache"] != (componentHealth{Status: "up", Required: true}) {
+		t.Errorf("healthz with Redis up = %+v", hz)
+	}
+	var rz readyzBody
+	probe(readyz, "/readyz", http.StatusOK, &rz)
+	if rz.Status != "ok" || rz.Checks["cache"] != "ok" || rz.Checks["config"] != "ok" {
+		t.Errorf("readyz with Redis up = %+v", rz)
+	}
+
+	mr.Close()
+	health.record(backend.Ping(context.Background()))
+
+	hz = healthzBody{}
+	probe(healthz, "/healthz", http.StatusServiceUnavailable, &hz)
+	cache := hz.Components["cache"]
+	if hz.Status != "unavailable" || cache.Status != "down" || !cache.Required || cache.Error == "" {
+		t.Errorf("healthz with Redis down = %+v", hz)
+	}
+	if upstream := hz.Components["upstream"]; upstream.Status != "disabled" || upstream.Required {
+		t.Errorf("upstream = %+v, want it reported as disabled and not required", upstream)
+	}
+	rz = readyzBody{}
+	probe(readyz, "/readyz", http.StatusServiceUnavailable, &rz)
+	if rz.Status != "unavailable" || rz.Checks["cache"] != "down" || rz.Checks["config"] != "ok" {
+		t.Errorf("readyz with Redis down = %+v", rz)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// defaultIconBaseURL serves the provider's own icon set, one PNG per code.
+const defaultIconBaseURL = "https://raw.githubusercontent.com/visualcrossing/WeatherIcons/main/PNG/2nd%20Set%20-%20Color"
+
+// iconFields describe an icon code of the provider for clients, as the URL
+// of its image, an emoji and a short label.
+type iconFields struct {
+	IconURL   string `json:"iconUrl,omitempty" xml:"iconUrl,omitempty"`
+	IconEmoji string `json:"iconEmoji,omitempty" xml:"iconEmoji,omitempty"`
+	IconLabel string `json:"iconLabel,omitempty" xml:"iconLabel,omitempty"`
+}
+
+// weatherIcon is how an icon code is described. Code names its image, which
+// is the code itself except for the default.
+type weatherIcon struct {
+	code  string
+	emoji string
+	label string
+}
+
+// weatherIcons are the icon codes the provider documents, across its icon
+// sets.
+var weatherIcons = map[string]weatherIcon{
+	"clear-day":               {code: "clear-day", emoji: "☀️", label: "Clear"},
+	"clear-night":             {code: "clear-night", emoji: "🌙", label: "Clear"},
+	"partly-cloudy-day":       {code: "partly-cloudy-day", emoji: "⛅", label: "Partly cloudy"},
+	"partly-cloudy-night":     {code: "partly-cloudy-night", emoji: "☁️", label: "Partly cloudy"},
+	"cloudy":                  {code: "cloudy", emoji: "☁️", label: "Cloudy"},
+	"fog":                     {code: "fog", emoji: "🌫️", label: "Fog"},
+	"wind":                    {code: "wind", emoji: "💨", label: "Windy"},
+	"rain":                    {code: "rain", emoji: "🌧️", label: "Rain"},
+	"showers-day":             {code: "showers-day", emoji: "🌦️", label: "Showers"},
+	"showers-night":           {code: "showers-night", emoji: "🌧️", label: "Showers"},
+	"snow":                    {code: "snow", emoji: "❄️", label: "Snow"},
+	"snow-showers-day":        {code: "snow-showers-day", emoji: "🌨️", label: "Snow showers"},
+	"snow-showers-night":      {code: "snow-showers-night", emoji: "🌨️", label: "Snow showers"},
+	"rain-snow":               {code: "rain-snow", emoji: "🌨️", label: "Rain and snow"},
+	"rain-snow-showers-day":   {code: "rain-snow-showers-day", emoji: "🌨️", label: "Rain and snow showers"},
+	"rain-snow-showers-night": {code: "rain-snow-showers-night", emoji: "🌨️", label: "Rain and snow showers"},
+	"sleet":                   {code: "sleet", emoji: "🌨️", label: "Sleet"},
+	"hail":                    {code: "hail", emoji: "🧊", label: "Hail"},
+	"thunder":                 {code: "thunder", emoji: "🌩️", label: "Thunder"},
+	"thunder-rain":            {code: "thunder-rain", emoji: "⛈️", label: "Thunderstorms"},
+	"thunder-showers-day":     {code: "thunder-showers-day", emoji: "⛈️", label: "Thundershowers"},
+	"thunder-showers-night":   {code: "thunder-showers-night", emoji: "⛈️", label: "Thundershowers"},
+}
+
+// defaultWeatherIcon describes the codes the provider does not document,
+// with the image of cloudy since the set has none for unknown weather.
+var defaultWeatherIcon = weatherIcon{code: "cloudy", emoji: "🌡️", label: "Unknown"}
+
+// describeIcon describes the icon code code, with its image under baseURL.
+func describeIcon(code, baseURL string) iconFields {
+	icon, ok := weatherIcons[code]
+	if !ok {
+		icon = defaultWeatherIcon
+	}
+	return iconFields{IconURL: baseURL + "/" + icon.code + ".png", IconEmoji: icon.emoji, IconLabel: icon.label}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// providerIcons are the icon codes the provider documents, those of its
+// first set and those its later sets add.
+var providerIcons = []string{
+	"snow", "rain", "fog", "wind", "cloudy", "partly-cloudy-day", "partly-cloudy-night", "clear-day", "clear-night",
+	"snow-showers-day", "snow-showers-night", "thunder-rain", "thunder-showers-day", "thunder-showers-night", "showers-day", "showers-night",
+	"rain-snow-showers-day", "rain-snow-showers-night", "rain-snow", "sleet", "hail", "thunder",
+}
+
+func TestDescribeIcon(t *testing.T) {
+	const base = "https://icons.example.com/set"
+	for _, code := range providerIcons {
+		t.Run(code, func(t *testing.T) {
+			if _, ok := weatherIcons[code]; !ok {
+				t.Fatalf("%s is not mapped", code)
+			}
+			got := describeIcon(code, base)
+			if want := base + "/" + code + ".png"; got.IconURL != want {
+				t.Errorf("iconUrl = %q, want %q", got.IconURL, want)
+			}
+			if got.IconEmoji == "" || got.IconLabel == "" || got.IconLabel == defaultWeatherIcon.label {
+				t.Errorf("emoji = %q and label = %q, want its own", got.IconEmoji, got.IconLabel)
+			}
+		})
+	}
+	if len(weatherIcons) != len(providerIcons) {
+		t.Errorf("%d codes are mapped, the provider documents %d", len(weatherIcons), len(providerIcons))
+	}
+	for _, code := range []string{"tornado", ""} {
+		got := describeIcon(code, base)
+		want := iconFields{IconURL: base + "/cloudy.png", IconEmoji: defaultWeatherIcon.emoji, IconLabel: defaultWeatherIcon.label}
+		if got != want {
+			t.Errorf("describeIcon(%q) = %+v, want the default %+v", code, got, want)
+		}
+	}
+}
+
+func TestLoadConfigIconBaseURL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "", want: defaultIconBaseURL},
+		{value: "https://cdn.example.com/icons/", want: "https://cdn.example.com/icons"},
+		{value: "http://localhost:8080/icons", want: "http://localhost:8080/icons"},
+		{value: "/icons", wantErr: true},
+		{value: "ftp://cdn.example.com/icons", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("ICON_BASE_URL="+tt.value, func(t *testing.T) {
+			t.Setenv("ICON_BASE_URL", tt.value)
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.IconBaseURL != tt.want {
+				t.Errorf("IconBaseURL = %q, want %q", cfg.IconBaseURL, tt.want)
+			}
+		})
+	}
+}
+
+// TestFetchPayloadIcons checks that the days and the current conditions
+// fetched have their icons described.
+func TestFetchPayloadIcons(t *testing.T) {
+	transport := http.DefaultTransport
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body := `{"days":[{"datetime":"2024-07-01","icon":"rain"},{"datetime":"2024-07-02","icon":"meteors"}],` +
+			`"currentConditions":{"datetime":"12:00:00","icon":"clear-night"}}`
+		return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(bytes.NewReader([]byte(body))), Request: r}, nil
+	})
+	cfg := Config{UpstreamMaxBodySize: 1 << 20, IconBaseURL: "https://icons.example.com"}
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+
+	data, err := fetchPayload(context.Background(), budget, defaultQuery("istanbul"), "test", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var weather Weather
+	if err := json.Unmarshal(data, &weather); err != nil {
+		t.Fatal(err)
+	}
+	want := []iconFields{
+		{IconURL: "https://icons.example.com/rain.png", IconEmoji: "🌧️", IconLabel: "Rain"},
+		{IconURL: "https://icons.example.com/cloudy.png", IconEmoji: defaultWeatherIcon.emoji, IconLabel: defaultWeatherIcon.label},
+	}
+	for i, day := range weather.Days {
+		if day.iconFields != want[i] {
+			t.Errorf("day %d icon = %+v, want %+v", i, day.iconFields, want[i])
+		}
+	}
+
+	q := defaultQuery("istanbul")
+	q.Range, q.Include = "current", "current"
+	if data, err = fetchPayload(context.Background(), budget, q, "test", cfg); err != nil {
+		t.Fatal(err)
+	}
+	var current Current
+	if err := json.Unmarshal(data, &current); err != nil {
+		t.Fatal(err)
+	}
+	if want := (iconFields{IconURL: "https://icons.example.com/clear-night.png", IconEmoji: "🌙", IconLabel: "Clear"}); current.iconFields != want {
+		t.Errorf("current icon = %+v, want %+v", current.iconFields, want)
+	}
+}
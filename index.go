@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// serviceIndex is the document served at /, listing the routes of
+// openapi.json so that clients can find their way without reading it.
+type serviceIndex struct {
+	Name        string            `json:"name"`
+	Version     string            `json:"version"`
+	Description string            `json:"description,omitempty"`
+	Endpoints   []indexEndpoint   `json:"endpoints"`
+	Links       map[string]string `json:"links"`
+}
+
+type indexEndpoint struct {
+	Method     string   `json:"method"`
+	Path       string   `json:"path"`
+	Summary    string   `json:"summary,omitempty"`
+	Parameters []string `json:"parameters,omitempty"`
+}
+
+// newServiceIndex builds the index from an OpenAPI document, resolving the
+// parameters it references from its components.
+func newServiceIndex(spec []byte) (serviceIndex, error) {
+	type parameter struct {
+		Ref  string `json:"$ref"`
+		Name string `json:"name"`
+	}
+	type operation struct {
+		Summary    string      `json:"summary"`
+		Parameters []parameter `json:"parameters"`
+	}
+	var doc struct {
+		Info struct {
+			Title       string `json:"title"`
+			Version     string `json:"version"`
+			Description string `json:"description"`
+		} `json:"info"`
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Parameters map[string]parameter `json:"parameters"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return serviceIndex{}, err
+	}
+	index := serviceIndex{
+		Name:        doc.Info.Title,
+		Version:     doc.Info.Version,
+		Description: doc.Info.Description,
+		Links:       map[string]string{"openapi": "/openapi.json", "docs": "/docs", "health": "/healthz"},
+	}
+	for p, ops := range doc.Paths {
+		route := p
+		if versionedRoute(p) {
+			route = apiVersionPrefix + p
+		}
+		for method, raw := range ops {
+			// A path may list the servers it is on next to its operations.
+			if method == "servers" {
+				continue
+			}
+			var op operation
+			if err := json.Unmarshal(raw, &op); err != nil {
+				return serviceIndex{}, err
+			}
+			e := indexEndpoint{Method: strings.ToUpper(method), Path: route, Summary: op.Summary}
+			for _, param := range op.Parameters {
+				if param.Ref != "" {
+					param = doc.Components.Parameters[path.Base(param.Ref)]
+				}
+				if param.Name != "" {
+					e.Parameters = append(e.Parameters, param.Name)
+				}
+			}
+			index.Endpoints = append(index.Endpoints, e)
+		}
+	}
+	sort.Slice(index.Endpoints, func(i, j int) bool {
+		a, b := index.Endpoints[i], index.Endpoints[j]
+		return a.Path < b.Path || a.Path == b.Path && a.Method < b.Method
+	})
+	return index, nil
+}
+
+// indexHandler serves the service index at /.
+func indexHandler(index serviceIndex) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, index)
+	}
+}
+
+// notFoundHandler answers the paths no route matches, hinting at the route
+// of the index the client most likely meant, under the version prefix the
+// path was under.
+func notFoundHandler(index serviceIndex) http.HandlerFunc {
+	var routes []string
+	for _, e := range index.Endpoints {
+		route := strings.TrimPrefix(e.Path, apiVersionPrefix)
+		if !slices.Contains(routes, route) {
+			routes = append(routes, route)
+		}
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		e := apiError{Code: "not_found"}
+		if route := closestRoute(r.URL.Path, routes); route != "" {
+			if versionedRoute(route) {
+				route = apiPrefix(r) + route
+			}
+			e.Details = map[string]string{"hint": route}
+		}
+		writeError(w, http.StatusNotFound, e)
+	}
+}
+
+// closestRoute returns the route p is a misspelling of, the one a few edits
+// away, or else the longest route p is below, or "" when p is like none.
+func closestRoute(p string, routes []string) string {
+	p = strings.ToLower(strings.TrimSuffix(p, "/"))
+	best, bestDistance := "", -1
+	for _, route := range routes {
+		d := editDistance(p, strings.ToLower(route))
+		if d <= max(2, len(route)/5) && (bestDistance < 0 || d < bestDistance) {
+			best, bestDistance = route, d
+		}
+	}
+	if best != "" {
+		return best
+	}
+	for _, route := range routes {
+		if route != "/" && strings.HasPrefix(p, strings.ToLower(route)+"/") && len(route) > len(best) {
+			best = route
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b, in bytes.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceIndex(t *testing.T) {
+	index, err := newServiceIndex(openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Name == "" || index.Version == "" {
+		t.Errorf("index has name %q and version %q", index.Name, index.Version)
+	}
+	tests := []struct {
+		path       string
+		wantParams []string
+	}{
+		{path: "/v1/weather", wantParams: []string{"country", "lat", "lon", "units", "lang"}},
+		{path: "/v1/weather/forecast", wantParams: []string{"country", "days"}},
+		{path: "/v1/weather/astronomy", wantParams: []string{"country", "units", "lang", "date"}},
+		{path: "/v1/weather/batch", wantParams: []string{"countries", "units"}},
+		{path: "/healthz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			i := slices.IndexFunc(index.Endpoints, func(e indexEndpoint) bool { return e.Path == tt.path })
+			if i < 0 {
+				t.Fatalf("%s is not in the index", tt.path)
+			}
+			e := index.Endpoints[i]
+			if e.Method != http.MethodGet {
+				t.Errorf("method = %s, want GET", e.Method)
+			}
+			for _, param := range tt.wantParams {
+				if !slices.Contains(e.Parameters, param) {
+					t.Errorf("parameters %v do not include %s", e.Parameters, param)
+				}
+			}
+		})
+	}
+	if !slices.IsSortedFunc(index.Endpoints, func(a, b indexEndpoint) int { return strings.Compare(a.Path, b.Path) }) {
+		t.Error("endpoints are not sorted by path")
+	}
+}
+
+func TestIndexAndNotFoundRoutes(t *testing.T) {
+	index, err := newServiceIndex(openAPISpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/{$}", allowMethods(indexHandler(index), http.MethodGet))
+	mux.Handle("/", notFoundHandler(index))
+	tests := []struct {
+		path     string
+		want     int
+		wantCode string
+		wantHint string
+	}{
+		{path: "/", want: http.StatusOK},
+		{path: "/nowhere", want: http.StatusNotFound, wantCode: "not_found"},
+		{path: "/weathr", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/weather"},
+		{path: "/v1/weathr", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/v1/weather"},
+		{path: "/v1/helthz", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/healthz"},
+		{path: "/Weather/Forcast/", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/weather/forecast"},
+		{path: "/weather/nowhere", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/weather"},
+		{path: "/webhooks/abc/deliveries", want: http.StatusNotFound, wantCode: "not_found", wantHint: "/webhooks"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			requestIDMiddleware(versionMiddleware(mux, mux, time.Now())).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if tt.wantCode == "" {
+				var got serviceIndex
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || len(got.Endpoints) != len(index.Endpoints) {
+					t.Errorf("served an index of %d endpoints (%v), want %d", len(got.Endpoints), err, len(index.Endpoints))
+				}
+				return
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body["error"].Code; got != tt.wantCode {
+				t.Errorf("code = %q, want %q", got, tt.wantCode)
+			}
+			if got := body["error"].Details["hint"]; got != tt.wantHint {
+				t.Errorf("hint = %q, want %q", got, tt.wantHint)
+			}
+			if body["error"].RequestID == "" {
+				t.Error("no request ID")
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ttlJitter spreads TTLs by up to ±fraction so that keys written together,
+// such as by the startup warmer, do not all expire in the same second.
+type ttlJitter struct {
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	fraction float64
+}
+
+// newTTLJitter returns a jitter driven by a source seeded with seed, so the
+// sequence of TTLs it produces is reproducible.
+func newTTLJitter(fraction float64, seed int64) *ttlJitter {
+	return &ttlJitter{rnd: rand.New(rand.NewSource(seed)), fraction: fraction}
+}
+
+func (j *ttlJitter) apply(ttl time.Duration) time.Duration {
+	if j.fraction == 0 {
+		return ttl
+	}
+	j.mu.Lock()
+	offset := (j.rnd.Float64()*2 - 1) * j.fraction
+	j.mu.Unlock()
+	return ttl + time.Duration(float64(ttl)*offset)
+}
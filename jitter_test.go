@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTTLJitter(t *testing.T) {
+	tests := []struct {
+		name     string
+		fraction float64
+	}{
+		{name: "off", fraction: 0},
+		{name: "ten percent", fraction: 0.1},
+		{name: "half", fraction: 0.5},
+	}
+	const ttl = 10 * time.Minute
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := newTTLJitter(tt.fraction, 1)
+			spread := time.Duration(float64(ttl) * tt.fraction)
+			seen := make(map[time.Duration]bool)
+			for range 1000 {
+				got := j.apply(ttl)
+				if got < ttl-spread || got > ttl+spread {
+					t.Fatalf("apply(%s) = %s, outside ±%s", ttl, got, spread)
+				}
+				seen[got] = true
+			}
+			if tt.fraction > 0 && len(seen) < 100 {
+				t.Errorf("apply() gave %d distinct TTLs in 1000 calls", len(seen))
+			}
+		})
+	}
+}
+
+func TestTTLJitterIsReproducible(t *testing.T) {
+	a, b := newTTLJitter(0.2, 42), newTTLJitter(0.2, 42)
+	for i := range 10 {
+		if x, y := a.apply(time.Minute), b.apply(time.Minute); x != y {
+			t.Fatalf("call %d: %s and %s from the same seed", i, x, y)
+		}
+	}
+}
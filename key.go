@@ -0,0 +1,365 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// cacheSchemaVersion must be bumped whenever the cached shape (Weather, Day or
+// cacheEntry) changes. Keys carry the version, so entries written by an older
+// build are never read and simply expire, or are removed by sweepOldCacheVersions.
+const cacheSchemaVersion = 4
+
+// cacheKeyPrefix namespaces every key this service writes.
+var cacheKeyPrefix = versionPrefix(cacheSchemaVersion)
+
+func versionPrefix(version int) string {
+	return fmt.Sprintf("weather:v%d:", version)
+}
+
+// maxLocationLength bounds the characters of a location name.
+const maxLocationLength = 100
+
+// unitGroups maps each unit group the provider knows to the units its
+// measurements are in.
+var unitGroups = map[string]weatherUnits{
+	"metric": {Temperature: "°C", WindSpeed: "km/h", Visibility: "km"},
+	"us":     {Temperature: "°F", WindSpeed: "mph", Visibility: "mi"},
+	"uk":     {Temperature: "°C", WindSpeed: "mph", Visibility: "mi"},
+	"base":   {Temperature: "K", WindSpeed: "m/s", Visibility: "km"},
+}
+
+// languages are the codes the provider translates descriptions into.
+var languages = []string{
+	"ar", "bg", "cs", "da", "de", "el", "en", "es", "fa", "fi", "fr", "he", "hu", "it",
+	"ja", "ko", "nl", "pl", "pt", "ru", "sk", "sr", "sv", "tr", "uk", "vi", "zh",
+}
+
+// weatherQuery describes a single provider request. Every field that changes
+// the upstream response is part of the cache key so that variants never
+// collide.
+type weatherQuery struct {
+	Location string
+	Units    string
+	Lang     string
+	Range    string
+	// Include is what the provider breaks the range down into, days or
+	// hours, or current or alerts for the latest observation or the alerts
+	// in force alone.
+	Include string
+}
+
+func defaultQuery(location string) weatherQuery {
+	return weatherQuery{Location: location, Units: "metric", Lang: "en", Range: "today", Include: "days"}
+}
+
+// validateLocation rejects location names, given in the parameter param,
+// that are too long or hold control characters or path separators. Such
+// names cannot be places and would change the path of the provider URL.
+func validateLocation(param, location string) error {
+	if !utf8.ValidString(location) {
+		return fmt.Errorf("%s must be valid UTF-8", param)
+	}
+	if utf8.RuneCountInString(location) > maxLocationLength {
+		return fmt.Errorf("%s must be at most %d characters", param, maxLocationLength)
+	}
+	if strings.Trim(location, ". ") == "" {
+		return fmt.Errorf("%s must name a place", param)
+	}
+	for _, c := range location {
+		if unicode.IsControl(c) {
+			return fmt.Errorf("%s must not contain control characters", param)
+		}
+		if c == '/' || c == '\\' {
+			return fmt.Errorf("%s must not contain / or \\", param)
+		}
+	}
+	return nil
+}
+
+func parseWeatherQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseQueryOptions(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	country := r.URL.Query().Get("country")
+	switch {
+	case r.URL.Query().Has("lat") || r.URL.Query().Has("lon"):
+		if country != "" {
+			return weatherQuery{}, fmt.Errorf("give either country or lat and lon, not both")
+		}
+		if q.Location, err = parseCoordinates(r.URL.Query().Get("lat"), r.URL.Query().Get("lon")); err != nil {
+			return weatherQuery{}, err
+		}
+	case strings.TrimSpace(country) != "":
+		if err := validateLocation("country", country); err != nil {
+			return weatherQuery{}, err
+		}
+		q.Location = country
+	default:
+		return weatherQuery{}, fmt.Errorf("give a location, either country or lat and lon")
+	}
+	return q, nil
+}
+
+// parseQueryOptions parses the units and lang parameters every weather
+// endpoint takes, leaving the location to the caller. Endpoints that name
+// their locations in other parameters, such as /weather/batch, start from
+// it.
+func parseQueryOptions(r *http.Request) (weatherQuery, error) {
+	q := defaultQuery("")
+	// units replaces unitGroup, which is still accepted.
+	v := r.URL.Query().Get("units")
+	if v == "" {
+		v = r.URL.Query().Get("unitGroup")
+	}
+	if v != "" {
+		if _, ok := unitGroups[v]; !ok {
+			return weatherQuery{}, fmt.Errorf("units must be one of metric, us, uk or base")
+		}
+		q.Units = v
+	}
+	if v := r.URL.Query().Get("lang"); v != "" {
+		if !slices.Contains(languages, v) {
+			return weatherQuery{}, fmt.Errorf("lang must be one of %s", strings.Join(languages, ", "))
+		}
+		q.Lang = v
+	}
+	return q, nil
+}
+
+// parseCoordinates validates a latitude and longitude and returns them as
+// the location "lat,lon", rounded to two decimals (about a kilometre) so
+// that nearby clients share cache entries.
+func parseCoordinates(latValue, lonValue string) (string, error) {
+	lat, err := strconv.ParseFloat(latValue, 64)
+	if err != nil || !(lat >= -90 && lat <= 90) {
+		return "", fmt.Errorf("lat must be a number between -90 and 90")
+	}
+	lon, err := strconv.ParseFloat(lonValue, 64)
+	if err != nil || !(lon >= -180 && lon <= 180) {
+		return "", fmt.Errorf("lon must be a number between -180 and 180")
+	}
+	// Adding zero turns a -0.00 into 0.00.
+	return fmt.Sprintf("%.2f,%.2f", math.Round(lat*100)/100+0, math.Round(lon*100)/100+0), nil
+}
+
+const (
+	minForecastDays     = 1
+	maxForecastDays     = 15
+	defaultForecastDays = 7
+)
+
+// parseForecastQuery parses GET /weather/forecast, whose days parameter asks
+// for the coming 1 to 15 days.
+func parseForecastQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	days := defaultForecastDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		days, err = strconv.Atoi(v)
+		if err != nil || days < minForecastDays || days > maxForecastDays {
+			return weatherQuery{}, fmt.Errorf("days must be a number between %d and %d", minForecastDays, maxForecastDays)
+		}
+	}
+	q.Range = fmt.Sprintf("next%ddays", days)
+	return q, nil
+}
+
+// parseCurrentQuery parses GET /weather/current, which asks for the latest
+// observation only.
+func parseCurrentQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	q.Range, q.Include = "current", "current"
+	return q, nil
+}
+
+// parseAlertsQuery parses GET /weather/alerts, which asks for the weather
+// alerts in force at a location.
+func parseAlertsQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	if _, err := alertSeverity(r); err != nil {
+		return weatherQuery{}, err
+	}
+	q.Include = "alerts"
+	return q, nil
+}
+
+// parseHourlyQuery parses GET /weather/hourly, whose date parameter picks
+// the day to break down by hour, today by default.
+func parseHourlyQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	if q.Range, err = dateRange(r); err != nil {
+		return weatherQuery{}, err
+	}
+	q.Include = "hours"
+	return q, nil
+}
+
+// parseAstronomyQuery parses GET /weather/astronomy, whose date parameter
+// picks the day, today by default. It asks for the same data as /weather so
+// that both share cache entries.
+func parseAstronomyQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	if q.Range, err = dateRange(r); err != nil {
+		return weatherQuery{}, err
+	}
+	return q, nil
+}
+
+// dateRange returns the range of the day in the date parameter, today when
+// there is none.
+func dateRange(r *http.Request) (string, error) {
+	v := r.URL.Query().Get("date")
+	if v == "" {
+		return "today", nil
+	}
+	date, err := time.Parse(time.DateOnly, v)
+	if err != nil {
+		return "", fmt.Errorf("date must be a date such as 2024-01-31")
+	}
+	return date.Format(time.DateOnly), nil
+}
+
+// maxHistoryDays caps the ranges GET /weather/history and /weather/summary
+// serve, since the provider bills each day of them.
+const maxHistoryDays = 92
+
+// parseHistoryQuery parses GET /weather/history, whose start and end
+// parameters give the first and last day of a past range.
+func parseHistoryQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	start, end, err := dayRange(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	// Today has begun somewhere once it has in UTC+14.
+	today := time.Now().UTC().Add(14 * time.Hour).Format(time.DateOnly)
+	if end.Format(time.DateOnly) > today {
+		return weatherQuery{}, fmt.Errorf("end must not be in the future, use /weather/forecast for coming days")
+	}
+	q.Range = start.Format(time.DateOnly) + "/" + end.Format(time.DateOnly)
+	return q, nil
+}
+
+// parseSummaryQuery parses GET /weather/summary, whose start and end
+// parameters give a range of days that may be past, coming or both. It asks
+// for the same data as /weather/history so that both share cache entries.
+func parseSummaryQuery(r *http.Request) (weatherQuery, error) {
+	q, err := parseWeatherQuery(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	start, end, err := dayRange(r)
+	if err != nil {
+		return weatherQuery{}, err
+	}
+	q.Range = start.Format(time.DateOnly) + "/" + end.Format(time.DateOnly)
+	return q, nil
+}
+
+// dayRange parses the start and end parameters, the first and last day of
+// a range of at most maxHistoryDays.
+func dayRange(r *http.Request) (start, end time.Time, err error) {
+	dates := make([]time.Time, 2)
+	for i, name := range []string{"start", "end"} {
+		v := r.URL.Query().Get(name)
+		if v == "" {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s is required, as a date such as 2024-01-31", name)
+		}
+		if dates[i], err = time.Parse(time.DateOnly, v); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%s must be a date such as 2024-01-31", name)
+		}
+	}
+	start, end = dates[0], dates[1]
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("start must not be after end")
+	}
+	if days := int(end.Sub(start).Hours()/24) + 1; days > maxHistoryDays {
+		return time.Time{}, time.Time{}, fmt.Errorf("the range must be at most %d days, not %d", maxHistoryDays, days)
+	}
+	return start, end, nil
+}
+
+// cacheKey builds the key q is cached under:
+// weather:v4:{location}:{units}:{lang}:{range}:{include}.
+func (q weatherQuery) cacheKey() string {
+	return cacheKeyPrefix + strings.Join([]string{normalizeKey(q.Location), q.Units, q.Lang, q.Range, q.Include}, ":")
+}
+
+// parseCacheKey splits a key built by cacheKey back into its query, with the
+// location in display form. It reports false for keys of any other shape.
+func parseCacheKey(key string) (weatherQuery, bool) {
+	rest, ok := strings.CutPrefix(key, cacheKeyPrefix)
+	if !ok {
+		return weatherQuery{}, false
+	}
+	// Locations may contain colons, the other parts never do.
+	parts := strings.Split(rest, ":")
+	if len(parts) < 5 {
+		return weatherQuery{}, false
+	}
+	n := len(parts)
+	return weatherQuery{
+		Location: displayLocation(strings.Join(parts[:n-4], ":")),
+		Units:    parts[n-4],
+		Lang:     parts[n-3],
+		Range:    parts[n-2],
+		Include:  parts[n-1],
+	}, true
+}
+
+// displayLocation capitalizes each word of a normalized location, turning
+// "new york" back into "New York".
+func displayLocation(location string) string {
+	words := strings.Fields(location)
+	for i, word := range words {
+		r, size := utf8.DecodeRuneInString(word)
+		words[i] = string(unicode.ToUpper(r)) + word[size:]
+	}
+	return strings.Join(words, " ")
+}
+
+// locationPattern returns a glob matching every cached variant of the
+// locations matched by pattern, which is itself a glob over normalized
+// location names.
+func locationPattern(pattern string) string {
+	return cacheKeyPrefix + normalizeKey(pattern) + ":*"
+}
+
+// escapeGlob escapes the characters Redis treats specially in a MATCH pattern.
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`).Replace(s)
+}
+
+// normalizeKey turns a location into its cache key form so that different
+// spellings of the same place ("Istanbul", "istanbul", "İSTANBUL ") share one entry.
+func normalizeKey(key string) string {
+	key = strings.NewReplacer("İ", "i", "ı", "i").Replace(key)
+	key = strings.ToLower(key)
+	return strings.Join(strings.Fields(key), " ")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestParseWeatherQuery(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		wantLocation string
+		wantUnits    string
+		wantErr      bool
+	}{
+		{name: "country", query: "country=istanbul", wantLocation: "istanbul", wantUnits: "metric"},
+		{name: "coordinates", query: "lat=41.0082&lon=28.9784", wantLocation: "41.01,28.98", wantUnits: "metric"},
+		{name: "units", query: "country=istanbul&units=us", wantLocation: "istanbul", wantUnits: "us"},
+		{name: "unitGroup", query: "country=istanbul&unitGroup=uk", wantLocation: "istanbul", wantUnits: "uk"},
+		{name: "no location", query: "", wantErr: true},
+		{name: "blank country", query: "country=%20%20", wantErr: true},
+		{name: "only units", query: "units=metric", wantErr: true},
+		{name: "country and coordinates", query: "country=istanbul&lat=41&lon=29", wantErr: true},
+		{name: "lat without lon", query: "lat=41", wantErr: true},
+		{name: "unknown units", query: "country=istanbul&units=kelvin", wantErr: true},
+		{name: "unknown lang", query: "country=istanbul&lang=xx", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := parseWeatherQuery(httptest.NewRequest(http.MethodGet, "/weather?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseWeatherQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if q.Location != tt.wantLocation || q.Units != tt.wantUnits {
+				t.Errorf("parseWeatherQuery() = location %q units %q, want %q %q", q.Location, q.Units, tt.wantLocation, tt.wantUnits)
+			}
+		})
+	}
+}
+
+func TestParseQueryOptions(t *testing.T) {
+	q, err := parseQueryOptions(httptest.NewRequest(http.MethodGet, "/weather/batch?countries=a,b&units=us&lang=de", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.Location != "" || q.Units != "us" || q.Lang != "de" {
+		t.Errorf("parseQueryOptions() = %+v, want no location, us units and de", q)
+	}
+}
+
+func TestValidateLocation(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		wantErr  bool
+	}{
+		{name: "place", location: "istanbul"},
+		{name: "with spaces and comma", location: "New York, NY"},
+		{name: "non-ASCII", location: "İzmir"},
+		{name: "at the length limit", location: strings.Repeat("ş", maxLocationLength)},
+		{name: "over the length limit", location: strings.Repeat("a", maxLocationLength+1), wantErr: true},
+		{name: "invalid UTF-8", location: "ist\xffanbul", wantErr: true},
+		{name: "dots", location: "..", wantErr: true},
+		{name: "dots and spaces", location: ". .", wantErr: true},
+		{name: "slash", location: "a/b", wantErr: true},
+		{name: "path traversal", location: "../../admin", wantErr: true},
+		{name: "backslash", location: `a\b`, wantErr: true},
+		{name: "newline", location: "a\nb", wantErr: true},
+		{name: "NUL", location: "a\x00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validateLocation("country", tt.location); (err != nil) != tt.wantErr {
+				t.Errorf("validateLocation(%q) error = %v, want error %v", tt.location, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNormalizeKey(t *testing.T) {
+	tests := []struct {
+		location string
+		want     string
+	}{
+		{location: "Istanbul", want: "istanbul"},
+		{location: "İSTANBUL ", want: "istanbul"},
+		{location: "ıstanbul", want: "istanbul"},
+		{location: "  New   York ", want: "new york"},
+		{location: "new\tyork", want: "new york"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.location, func(t *testing.T) {
+			if got := normalizeKey(tt.location); got != tt.want {
+				t.Errorf("normalizeKey(%q) = %q, want %q", tt.location, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheKeyRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		q    weatherQuery
+		want weatherQuery
+	}{
+		{name: "default", q: defaultQuery("Istanbul"), want: defaultQuery("Istanbul")},
+		{name: "spaces", q: weatherQuery{Location: "new  york", Units: "us", Lang: "de", Range: "next7days", Include: "days"}, want: weatherQuery{Location: "New York", Units: "us", Lang: "de", Range: "next7days", Include: "days"}},
+		{name: "coordinates", q: weatherQuery{Location: "41.01,28.98", Units: "metric", Lang: "en", Range: "2024-01-01/2024-01-07", Include: "days"}, want: weatherQuery{Location: "41.01,28.98", Units: "metric", Lang: "en", Range: "2024-01-01/2024-01-07", Include: "days"}},
+		{name: "colon in location", q: weatherQuery{Location: "a:b", Units: "metric", Lang: "en", Range: "today", Include: "hours"}, want: weatherQuery{Location: "A:b", Units: "metric", Lang: "en", Range: "today", Include: "hours"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseCacheKey(tt.q.cacheKey())
+			if !ok {
+				t.Fatalf("parseCacheKey(%q) failed", tt.q.cacheKey())
+			}
+			if got != tt.want {
+				t.Errorf("parseCacheKey(cacheKey()) = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+	variants := []weatherQuery{defaultQuery("istanbul"), {Location: "istanbul", Units: "us", Lang: "en", Range: "today", Include: "days"}, {Location: "istanbul", Units: "metric", Lang: "tr", Range: "today", Include: "days"}, {Location: "istanbul", Units: "metric", Lang: "en", Range: "next7days", Include: "days"}, {Location: "istanbul", Units: "metric", Lang: "en", Range: "today", Include: "hours"}}
+	seen := make(map[string]bool)
+	for _, q := range variants {
+		if seen[q.cacheKey()] {
+			t.Errorf("%+v shares the key %s with another variant", q, q.cacheKey())
+		}
+		seen[q.cacheKey()] = true
+	}
+	if _, ok := parseCacheKey("other:istanbul"); ok {
+		t.Error("parseCacheKey() accepted a key without the prefix")
+	}
+}
+
+// TestCacheSchemaVersionBump writes an entry under an older schema version
+// and checks the lookup ignores it and fetches again, and that the sweep
+// removes it.
+func TestCacheSchemaVersionBump(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	h, cache, mr := testLookup(t, testConfig(t))
+
+	current := cacheKeyPrefix
+	cacheKeyPrefix = versionPrefix(cacheSchemaVersion - 1)
+	oldKey := defaultQuery("istanbul").cacheKey()
+	cache.Set(context.Background(), oldKey, entryFreshUntil(t, time.Now().Add(time.Hour)), time.Hour)
+	cacheKeyPrefix = current
+
+	rec := serveGet(h, "/weather?country=istanbul")
+	if got := rec.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("X-Cache = %q, want MISS for an entry of the previous version", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+	if !mr.Exists(defaultQuery("istanbul").cacheKey()) {
+		t.Error("the refetched entry is not cached under the current version")
+	}
+
+	captureStdout(t, func() { sweepOldCacheVersions(context.Background(), cache) })
+	if mr.Exists(oldKey) {
+		t.Errorf("%s survived the sweep", oldKey)
+	}
+	if !mr.Exists(defaultQuery("istanbul").cacheKey()) {
+		t.Error("the sweep removed the current entry")
+	}
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		query     string
+		wantRange string
+		wantErr   string
+	}{
+		{name: "valid range", query: "start=2024-01-01&end=2024-01-31", wantRange: "2024-01-01/2024-01-31"},
+		{name: "single day", query: "start=2024-02-29&end=2024-02-29", wantRange: "2024-02-29/2024-02-29"},
+		{name: "longest range", query: "start=2024-01-01&end=2024-04-01", wantRange: "2024-01-01/2024-04-01"},
+		{name: "inverted", query: "start=2024-01-31&end=2024-01-01", wantErr: "start must not be after end"},
+		{name: "over the cap", query: "start=2024-01-01&end=2024-04-02", wantErr: "the range must be at most 92 days, not 93"},
+		{name: "missing start", query: "end=2024-01-31", wantErr: "start is required, as a date such as 2024-01-31"},
+		{name: "malformed start", query: "start=01/02/2024&end=2024-01-31", wantErr: "start must be a date such as 2024-01-31"},
+		{name: "impossible end", query: "start=2024-01-01&end=2024-02-30", wantErr: "end must be a date such as 2024-01-31"},
+		{name: "future end", query: "start=2024-01-01&end=2999-01-01", wantErr: "the range must be at most 92 days"},
+		{name: "future range", query: "start=2999-01-01&end=2999-01-02", wantErr: "end must not be in the future"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather/history?country=istanbul&"+tt.query, nil)
+			q, err := parseHistoryQuery(r)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("parseHistoryQuery() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHistoryQuery() error = %v", err)
+			}
+			if q.Range != tt.wantRange {
+				t.Errorf("Range = %q, want %q", q.Range, tt.wantRange)
+			}
+		})
+	}
+}
+
+// TestHistoryLookup serves a history range and checks the provider is asked
+// for exactly those days, and that invalid ranges never reach it.
+func TestHistoryLookup(t *testing.T) {
+	urls := recordProvider(t)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseHistoryQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+	if rec := serveGet(h, "/weather/history?country=istanbul&start=2024-01-01&end=2024-01-31"); rec.Code != http.StatusOK {
+		t.Fatalf("valid range: status = %d, want 200", rec.Code)
+	}
+	if rec := serveGet(h, "/weather/history?country=istanbul&start=2024-01-31&end=2024-01-01"); rec.Code != http.StatusBadRequest {
+		t.Errorf("inverted range: status = %d, want 400", rec.Code)
+	}
+	got := urls()
+	if len(got) != 1 {
+		t.Fatalf("provider called %d times, want 1", len(got))
+	}
+	if !strings.HasSuffix(got[0].Path, "/istanbul/2024-01-01/2024-01-31") {
+		t.Errorf("provider asked for %s", got[0].Path)
+	}
+}
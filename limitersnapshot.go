@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// limiterSnapshot is the state of an in-memory limiter written to Redis on
+// shutdown, so that a restart does not hand every client a fresh burst.
+// Tokens holds the token buckets' levels, Requests the sliding window logs.
+type limiterSnapshot struct {
+	SavedAt  time.Time              `json:"savedAt"`
+	Tokens   map[string]float64     `json:"tokens,omitempty"`
+	Requests map[string][]time.Time `json:"requests,omitempty"`
+}
+
+// persistentLimiter is implemented by the in-memory limiters.
+type persistentLimiter interface {
+	rateLimiter
+	snapshot() limiterSnapshot
+	restore(s limiterSnapshot)
+	windowLength() time.Duration
+}
+
+func limiterSnapshotKey(name string) string {
+	return "ratelimit:snapshot:" + name
+}
+
+// saveLimiterSnapshot writes l's state under name. The snapshot expires
+// once a full window has passed, by which time every client has its whole
+// allowance back anyway.
+func saveLimiterSnapshot(ctx context.Context, redisDB redis.UniversalClient, name string, l persistentLimiter) error {
+	data, err := json.Marshal(l.snapshot())
+	if err != nil {
+		return err
+	}
+	return redisDB.Set(ctx, limiterSnapshotKey(name), data, l.windowLength()).Err()
+}
+
+// loadLimiterSnapshot restores the state saved under name into l. Missing
+// snapshots and ones older than a window are ignored.
+func loadLimiterSnapshot(ctx context.Context, redisDB redis.UniversalClient, name string, l persistentLimiter) error {
+	data, err := redisDB.Get(ctx, limiterSnapshotKey(name)).Bytes()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var s limiterSnapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid rate limiter snapshot %s: %v", name, err)
+	}
+	if time.Since(s.SavedAt) >= l.windowLength() {
+		return nil
+	}
+	l.restore(s)
+	return nil
+}
+
+// windowLength is how long an empty bucket takes to fill up.
+func (l *ipLimiters) windowLength() time.Duration {
+	return tokenWait(float64(l.burst), l.limit)
+}
+
+// snapshot records the level of every bucket that is not full.
+func (l *ipLimiters) snapshot() limiterSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	s := limiterSnapshot{SavedAt: now, Tokens: make(map[string]float64)}
+	for key, entry := range l.limiters {
+		if tokens := entry.limiter.TokensAt(now); tokens < float64(l.burst) {
+			s.Tokens[key] = tokens
+		}
+	}
+	return s
+}
+
+// restore refills each saved bucket for the time since the snapshot and
+// takes the difference from a fresh one, rounding the partial tokens away.
+func (l *ipLimiters) restore(s limiterSnapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	refill := now.Sub(s.SavedAt).Seconds() * float64(l.limit)
+	for key, tokens := range s.Tokens {
+		spent := int(math.Ceil(float64(l.burst) - (tokens + refill)))
+		if spent <= 0 {
+			continue
+		}
+		limiter := rate.NewLimiter(l.limit, l.burst)
+		limiter.AllowN(now, spent)
+		l.limiters[key] = &ipLimiter{limiter: limiter, lastSeen: now}
+	}
+}
+
+func (l *slidingWindowLimiters) windowLength() time.Duration {
+	return l.window
+}
+
+func (l *slidingWindowLimiters) snapshot() limiterSnapshot {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	s := limiterSnapshot{SavedAt: now, Requests: make(map[string][]time.Time)}
+	for key, log := range l.logs {
+		log.prune(now.Add(-l.window))
+		times := make([]time.Time, 0, log.n)
+		for i := 0; i < log.n; i++ {
+			times = append(times, log.times[(log.start+i)%l.burst])
+		}
+		if len(times) > 0 {
+			s.Requests[key] = times
+		}
+	}
+	return s
+}
+
+// restore brings back the saved requests still in the window, at most a
+// burst of them per client, oldest first.
+func (l *slidingWindowLimiters) restore(s limiterSnapshot) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	since := l.now().Add(-l.window)
+	for key, times := range s.Requests {
+		log := &requestLog{times: make([]time.Time, l.burst)}
+		for _, t := range times {
+			if t.After(since) && log.n < l.burst {
+				log.times[log.n] = t
+				log.n++
+			}
+		}
+		if log.n > 0 {
+			l.logs[key] = log
+		}
+	}
+}
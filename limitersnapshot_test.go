@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// TestLimiterRestart throttles a client, then replaces the limiter and its
+// middleware with new ones sharing only the Redis, as a restart does, and
+// checks the client is still throttled.
+func TestLimiterRestart(t *testing.T) {
+	const burst = 3
+	limit := rate.Every(time.Minute)
+	tests := []struct {
+		name string
+		// start returns the limiter of an instance starting on rdb, and what
+		// the instance does on shutdown.
+		start         func(rdb redis.UniversalClient) (rateLimiter, func())
+		wantThrottled bool
+	}{
+		{
+			name: "redis fixed window",
+			start: func(rdb redis.UniversalClient) (rateLimiter, func()) {
+				return newRedisLimiter(rdb, "weather", limit, burst, false, rejectAll{}), func() {}
+			},
+			wantThrottled: true,
+		},
+		{
+			name: "redis sliding window",
+			start: func(rdb redis.UniversalClient) (rateLimiter, func()) {
+				return newRedisLimiter(rdb, "weather", limit, burst, true, rejectAll{}), func() {}
+			},
+			wantThrottled: true,
+		},
+		{
+			name:          "token bucket with a snapshot",
+			start:         snapshotted(t, func() persistentLimiter { return newIPLimiters(limit, burst, time.Minute) }),
+			wantThrottled: true,
+		},
+		{
+			name:          "sliding window with a snapshot",
+			start:         snapshotted(t, func() persistentLimiter { return newSlidingWindowLimiters(limit, burst, time.Minute) }),
+			wantThrottled: true,
+		},
+		{
+			name: "token bucket without a snapshot",
+			start: func(rdb redis.UniversalClient) (rateLimiter, func()) {
+				return newIPLimiters(limit, burst, time.Minute), func() {}
+			},
+			wantThrottled: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			instance := func() (http.HandlerFunc, func()) {
+				rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				t.Cleanup(func() { rdb.Close() })
+				limiter, shutdown := tt.start(rdb)
+				return rateLimiterMiddleware(func(w http.ResponseWriter, r *http.Request) {}, limiter), shutdown
+			}
+
+			h, shutdown := instance()
+			for i := 0; i < burst; i++ {
+				serveGet(h, "/weather")
+			}
+			if rec := serveGet(h, "/weather"); rec.Code != http.StatusTooManyRequests {
+				t.Fatalf("before the restart: status = %d, want 429", rec.Code)
+			}
+			shutdown()
+
+			h, _ = instance()
+			rec := serveGet(h, "/weather")
+			if throttled := rec.Code == http.StatusTooManyRequests; throttled != tt.wantThrottled {
+				t.Errorf("after the restart: status = %d, throttled = %v, want %v", rec.Code, throttled, tt.wantThrottled)
+			}
+		})
+	}
+}
+
+// snapshotted starts local limiters built by newLimiter the way serve does
+// with RATE_LIMIT_SNAPSHOT: restoring the snapshot on start and saving one
+// on shutdown.
+func snapshotted(t *testing.T, newLimiter func() persistentLimiter) func(rdb redis.UniversalClient) (rateLimiter, func()) {
+	return func(rdb redis.UniversalClient) (rateLimiter, func()) {
+		l := newLimiter()
+		if err := loadLimiterSnapshot(context.Background(), rdb, "weather", l); err != nil {
+			t.Fatalf("loadLimiterSnapshot: %v", err)
+		}
+		return l, func() {
+			if err := saveLimiterSnapshot(context.Background(), rdb, "weather", l); err != nil {
+				t.Fatalf("saveLimiterSnapshot: %v", err)
+			}
+		}
+	}
+}
+
+// TestStaleLimiterSnapshot checks a snapshot older than the window is not
+// restored.
+func TestStaleLimiterSnapshot(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	l := newIPLimiters(rate.Every(time.Minute), 3, time.Minute)
+	data, err := json.Marshal(limiterSnapshot{SavedAt: time.Now().Add(-2 * l.windowLength()), Tokens: map[string]float64{"192.0.2.1": 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mr.Set(limiterSnapshotKey("weather"), string(data))
+
+	if err := loadLimiterSnapshot(context.Background(), rdb, "weather", l); err != nil {
+		t.Fatalf("loadLimiterSnapshot: %v", err)
+	}
+	if d := l.allow(context.Background(), "192.0.2.1"); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("after a stale snapshot: %+v, want a full burst", d)
+	}
+}
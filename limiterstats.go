@@ -0,0 +1,221 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// topRejectedCap bounds how many client IPs the rejection sample tracks.
+const topRejectedCap = 100
+
+// limiterStats counts the decisions of rateLimiterMiddleware. The rejected
+// IPs are a space-saving sample: once it is full, a new IP takes the place
+// of the least rejected one and inherits its count, so counts can overstate
+// but the heaviest clients always stay in.
+type limiterStats struct {
+	allowed  atomic.Int64
+	rejected atomic.Int64
+	exempt   atomic.Int64
+
+	mu          sync.Mutex
+	rejectedIPs map[string]int64
+	limiters    []rateLimiter
+}
+
+func newLimiterStats() *limiterStats {
+	return &limiterStats{rejectedIPs: make(map[string]int64)}
+}
+
+// track adds limiter to the ones whose clients are counted in snapshots. A
+// limiter shared by several routes is only tracked once.
+func (s *limiterStats) track(limiter rateLimiter) {
+	if s == nil || limiter == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, tracked := range s.limiters {
+		if tracked == limiter {
+			return
+		}
+	}
+	s.limiters = append(s.limiters, limiter)
+}
+
+type limitVerdictKey struct{}
+
+// limitVerdict is the decision the nested limiters of one request came to
+// together: the first rejection, or the last limit that allowed it. Only
+// the outermost limiter records it, so that each request counts once.
+type limitVerdict struct {
+	key      string
+	d        rateDecision
+	rejected bool
+}
+
+func (v *limitVerdict) note(key string, d rateDecision) {
+	if v.rejected {
+		return
+	}
+	v.key, v.d, v.rejected = key, d, !d.Allowed
+}
+
+func (s *limiterStats) record(ip string, d rateDecision) {
+	if s == nil {
+		return
+	}
+	if d.Allowed {
+		s.allowed.Add(1)
+		return
+	}
+	s.rejected.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n, ok := s.rejectedIPs[ip]; ok || len(s.rejectedIPs) < topRejectedCap {
+		s.rejectedIPs[ip] = n + 1
+		return
+	}
+	minIP, minN := "", int64(0)
+	for other, n := range s.rejectedIPs {
+		if minIP == "" || n < minN {
+			minIP, minN = other, n
+		}
+	}
+	delete(s.rejectedIPs, minIP)
+	s.rejectedIPs[ip] = minN + 1
+}
+
+func (s *limiterStats) recordExempt() {
+	if s != nil {
+		s.exempt.Add(1)
+	}
+}
+
+// trackedClients is implemented by limiters that keep state per client.
+type trackedClients interface {
+	tracked() int
+}
+
+func (l *ipLimiters) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.limiters)
+}
+
+func (l *slidingWindowLimiters) tracked() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.logs)
+}
+
+// tracked is the number of clients the local fallback knows of, the ones in
+// Redis are not counted.
+func (l *redisLimiter) tracked() int {
+	return trackedBy(l.local)
+}
+
+func (l *tieredLimiter) tracked() int {
+	n := trackedBy(l.anonymous)
+	for _, limiter := range l.tiers {
+		n += trackedBy(limiter)
+	}
+	return n
+}
+
+// trackedBy returns how many clients limiter keeps state for, if it does.
+func trackedBy(limiter rateLimiter) int {
+	if t, ok := limiter.(trackedClients); ok {
+		return t.tracked()
+	}
+	return 0
+}
+
+type rejectedIP struct {
+	IP       string `json:"ip"`
+	Rejected int64  `json:"rejected"`
+}
+
+type limiterStatsSnapshot struct {
+	Allowed     int64        `json:"allowed"`
+	Rejected    int64        `json:"rejected"`
+	Exempt      int64        `json:"exempt"`
+	Tracked     int          `json:"trackedClients"`
+	TopRejected []rejectedIP `json:"topRejected"`
+}
+
+// snapshot returns the counters and the n most rejected IPs.
+func (s *limiterStats) snapshot(n int) limiterStatsSnapshot {
+	snap := limiterStatsSnapshot{
+		Allowed:  s.allowed.Load(),
+		Rejected: s.rejected.Load(),
+		Exempt:   s.exempt.Load(),
+	}
+	s.mu.Lock()
+	limiters := s.limiters
+	snap.TopRejected = make([]rejectedIP, 0, len(s.rejectedIPs))
+	for ip, count := range s.rejectedIPs {
+		snap.TopRejected = append(snap.TopRejected, rejectedIP{IP: ip, Rejected: count})
+	}
+	s.mu.Unlock()
+	sort.Slice(snap.TopRejected, func(i, j int) bool {
+		if snap.TopRejected[i].Rejected != snap.TopRejected[j].Rejected {
+			return snap.TopRejected[i].Rejected > snap.TopRejected[j].Rejected
+		}
+		return snap.TopRejected[i].IP < snap.TopRejected[j].IP
+	})
+	if len(snap.TopRejected) > n {
+		snap.TopRejected = snap.TopRejected[:n]
+	}
+	for _, limiter := range limiters {
+		snap.Tracked += trackedBy(limiter)
+	}
+	return snap
+}
+
+func (s *limiterStats) reset() {
+	s.allowed.Store(0)
+	s.rejected.Store(0)
+	s.exempt.Store(0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.rejectedIPs)
+}
+
+var (
+	limiterDecisionsDesc = prometheus.NewDesc("weather_ratelimit_decisions_total",
+		"Rate limiter decisions, by decision: allowed, rejected or exempt.", []string{"decision"}, nil)
+	limiterTrackedDesc = prometheus.NewDesc("weather_ratelimit_tracked_clients",
+		"Clients the local rate limiters keep state for.", nil, nil)
+)
+
+// Describe and Collect export the counters to Prometheus. A reset through
+// /admin/limits/stats shows there as a counter reset.
+func (s *limiterStats) Describe(ch chan<- *prometheus.Desc) {
+	ch <- limiterDecisionsDesc
+	ch <- limiterTrackedDesc
+}
+
+func (s *limiterStats) Collect(ch chan<- prometheus.Metric) {
+	snap := s.snapshot(0)
+	ch <- prometheus.MustNewConstMetric(limiterDecisionsDesc, prometheus.CounterValue, float64(snap.Allowed), "allowed")
+	ch <- prometheus.MustNewConstMetric(limiterDecisionsDesc, prometheus.CounterValue, float64(snap.Rejected), "rejected")
+	ch <- prometheus.MustNewConstMetric(limiterDecisionsDesc, prometheus.CounterValue, float64(snap.Exempt), "exempt")
+	ch <- prometheus.MustNewConstMetric(limiterTrackedDesc, prometheus.GaugeValue, float64(snap.Tracked))
+}
+
+// limiterStatsHandler serves GET /admin/limits/stats with the ten most
+// rejected IPs. With ?reset=true the counters are reset after the snapshot
+// is taken.
+func limiterStatsHandler(stats *limiterStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap := stats.snapshot(10)
+		if r.URL.Query().Get("reset") == "true" {
+			stats.reset()
+		}
+		writeJSON(w, http.StatusOK, snap)
+	}
+}
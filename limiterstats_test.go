@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestLimiterStatsMetrics(t *testing.T) {
+	stats := newLimiterStats()
+	stats.record("192.0.2.1", rateDecision{Allowed: true})
+	stats.record("192.0.2.1", rateDecision{Allowed: true})
+	stats.record("192.0.2.2", rateDecision{})
+	stats.recordExempt()
+	want := `
+# HELP weather_ratelimit_decisions_total Rate limiter decisions, by decision: allowed, rejected or exempt.
+# TYPE weather_ratelimit_decisions_total counter
+weather_ratelimit_decisions_total{decision="allowed"} 2
+weather_ratelimit_decisions_total{decision="exempt"} 1
+weather_ratelimit_decisions_total{decision="rejected"} 1
+`
+	if err := testutil.CollectAndCompare(stats, strings.NewReader(want), "weather_ratelimit_decisions_total"); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"time"
+)
+
+// limitsStatus is the body of GET /limits, the rate limit the caller is
+// under and what is left of it. Limited is false when rate limiting is off,
+// leaving the other fields but Scope empty.
+type limitsStatus struct {
+	Scope             string     `json:"scope"`
+	Tier              string     `json:"tier,omitempty"`
+	Limited           bool       `json:"limited"`
+	RequestsPerSecond float64    `json:"requestsPerSecond"`
+	Burst             int        `json:"burst"`
+	Remaining         int        `json:"remaining"`
+	ResetSeconds      int64      `json:"resetSeconds"`
+	ResetAt           *time.Time `json:"resetAt,omitempty"`
+}
+
+// limitsHandler serves GET /limits from the state of limiter, the limiter of
+// the weather routes, for the caller's API key or IP. It only peeks at the
+// state, so checking the budget does not spend it.
+func limitsHandler(limiter rateLimiter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		if limiter == nil {
+			writeJSON(w, http.StatusOK, limitsStatus{Scope: scopeIP})
+			return
+		}
+		d := limiter.peek(r.Context(), IPKey(r))
+		// Both are rounded up, so that clients never count on the reset
+		// early.
+		reset := int64(math.Ceil(d.Reset.Seconds()))
+		resetAt := time.Now().UTC().Add(d.Reset + time.Second - 1).Truncate(time.Second)
+		writeJSON(w, http.StatusOK, limitsStatus{
+			Scope:             limitScope(d),
+			Tier:              d.Tier,
+			Limited:           true,
+			RequestsPerSecond: float64(d.Rate),
+			Burst:             d.Limit,
+			Remaining:         d.Remaining,
+			ResetSeconds:      reset,
+			ResetAt:           &resetAt,
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// TestLimits spends a few tokens through RateLimit and checks that /limits
+// reports what is left, twice, without spending any itself.
+func TestLimits(t *testing.T) {
+	redisLimiter := func(sliding bool) func(t *testing.T) rateLimiter {
+		return func(t *testing.T) rateLimiter {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { rdb.Close() })
+			return newRedisLimiter(rdb, "weather", rate.Every(time.Minute), 10, sliding, rejectAll{})
+		}
+	}
+	tests := []struct {
+		name       string
+		limiter    func(t *testing.T) rateLimiter
+		apiKey     string
+		wantScope  string
+		wantTier   string
+		wantBurst  int
+		spend      int
+		wantRemain int
+	}{
+		{
+			name:      "token bucket",
+			limiter:   func(t *testing.T) rateLimiter { return newIPLimiters(rate.Every(time.Minute), 10, time.Minute) },
+			wantScope: scopeIP, wantBurst: 10, spend: 3, wantRemain: 7,
+		},
+		{
+			name: "sliding window",
+			limiter: func(t *testing.T) rateLimiter {
+				return newSlidingWindowLimiters(rate.Every(time.Minute), 10, time.Minute)
+			},
+			wantScope: scopeIP, wantBurst: 10, spend: 3, wantRemain: 7,
+		},
+		{name: "redis fixed window", limiter: redisLimiter(false), wantScope: scopeIP, wantBurst: 10, spend: 3, wantRemain: 7},
+		{name: "redis sliding window", limiter: redisLimiter(true), wantScope: scopeIP, wantBurst: 10, spend: 3, wantRemain: 7},
+		{name: "untouched", limiter: redisLimiter(false), wantScope: scopeIP, wantBurst: 10, wantRemain: 10},
+		{name: "exhausted", limiter: redisLimiter(true), wantScope: scopeIP, wantBurst: 10, spend: 12, wantRemain: 0},
+		{
+			name: "api key",
+			limiter: func(t *testing.T) rateLimiter {
+				return newTieredLimiter(testLimiter("weather", 1, 1), map[string]rateSpec{"pro": {RPS: 0.1, Burst: 5}}, testLimiter)
+			},
+			apiKey: "k1", wantScope: scopeAPIKey, wantTier: "pro", wantBurst: 5, spend: 2, wantRemain: 3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := tt.limiter(t)
+			keys := &apiKeyTiers{keys: map[string]string{"k1": "pro"}}
+			spend := consumerMiddleware(rateLimiterMiddleware(func(w http.ResponseWriter, r *http.Request) {}, limiter), keys)
+			limits := consumerMiddleware(limitsHandler(limiter), keys)
+			request := func(target string) *http.Request {
+				r := httptest.NewRequest(http.MethodGet, target, nil)
+				if tt.apiKey != "" {
+					r.Header.Set("X-API-Key", tt.apiKey)
+				}
+				return r
+			}
+			for range tt.spend {
+				spend(httptest.NewRecorder(), request("/weather"))
+			}
+			for i := range 2 {
+				rec := httptest.NewRecorder()
+				limits(rec, request("/limits"))
+				if rec.Code != http.StatusOK {
+					t.Fatalf("status = %d, want 200", rec.Code)
+				}
+				var got limitsStatus
+				if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+					t.Fatal(err)
+				}
+				if !got.Limited || got.Scope != tt.wantScope || got.Tier != tt.wantTier || got.Burst != tt.wantBurst {
+					t.Errorf("limits = %+v, want scope %s, tier %q and burst %d", got, tt.wantScope, tt.wantTier, tt.wantBurst)
+				}
+				if got.Remaining != tt.wantRemain {
+					t.Errorf("call %d: remaining = %d, want %d", i+1, got.Remaining, tt.wantRemain)
+				}
+				if tt.spend > 0 && (got.ResetSeconds <= 0 || got.ResetAt == nil || !got.ResetAt.After(time.Now())) {
+					t.Errorf("reset in %ds at %v, want a reset to come", got.ResetSeconds, got.ResetAt)
+				}
+			}
+		})
+	}
+}
+
+func TestLimitsUnlimited(t *testing.T) {
+	rec := httptest.NewRecorder()
+	limitsHandler(nil)(rec, httptest.NewRequest(http.MethodGet, "/limits", nil))
+	var got limitsStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Limited || got.Scope != scopeIP {
+		t.Errorf("limits = %+v with rate limiting off, want unlimited", got)
+	}
+}
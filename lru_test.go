@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLRUCacheExpiry(t *testing.T) {
+	c := newLRUCache(10)
+	c.Set("fresh", []byte("1"), time.Minute)
+	c.Set("expired", []byte("2"), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if got, ok := c.Get("fresh"); !ok || string(got) != "1" {
+		t.Errorf("Get(fresh) = %q, %v, want 1, true", got, ok)
+	}
+	if _, ok := c.Get("expired"); ok {
+		t.Error("an expired entry was served")
+	}
+	c.Set("fresh", []byte("3"), time.Minute)
+	if got, _ := c.Get("fresh"); string(got) != "3" {
+		t.Errorf("Get(fresh) = %q after it was replaced, want 3", got)
+	}
+}
+
+func TestLRUCacheKeepsRecentlyUsed(t *testing.T) {
+	c := newLRUCache(2)
+	c.Set("a", []byte("1"), time.Minute)
+	c.Set("b", []byte("2"), time.Minute)
+	c.Get("a")
+	c.Set("c", []byte("3"), time.Minute)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("the recently used entry was evicted")
+	}
+	if _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+}
+
+func TestLRUCacheDeleteMatching(t *testing.T) {
+	c := newLRUCache(10)
+	for _, key := range []string{"weather:v4:istanbul:metric", "weather:v4:istanbul:us", "weather:v4:ankara:metric"} {
+		c.Set(key, []byte("x"), time.Minute)
+	}
+	if n := c.DeleteMatching("weather:v4:istanbul:*"); n != 2 {
+		t.Errorf("DeleteMatching() = %d, want 2", n)
+	}
+	if _, ok := c.Get("weather:v4:ankara:metric"); !ok {
+		t.Error("DeleteMatching() removed a key that does not match")
+	}
+}
+
+// TestTieredCacheLocalEviction fills the local cache of a tiered cache past
+// its size and checks the least recently used entry is the one read back
+// from Redis.
+func TestTieredCacheLocalEviction(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.LocalCacheSize = 2
+	cfg.LocalCacheTTL = time.Minute
+	cache, mr := newTestCache(t, cfg)
+	ctx := context.Background()
+	cache.Set(ctx, "test:a", testEntry(t, testWeather), time.Hour)
+	cache.Set(ctx, "test:b", testEntry(t, testWeather), time.Hour)
+	cache.Get(ctx, "test:a")
+	cache.Set(ctx, "test:c", testEntry(t, testWeather), time.Hour)
+
+	for _, tt := range []struct {
+		key       string
+		wantRedis bool
+	}{
+		{key: "test:a", wantRedis: false},
+		{key: "test:c", wantRedis: false},
+		{key: "test:b", wantRedis: true},
+	} {
+		before := mr.CommandCount()
+		if _, ok := cache.Get(ctx, tt.key); !ok {
+			t.Fatalf("Get(%s) missed", tt.key)
+		}
+		if gotRedis := mr.CommandCount() != before; gotRedis != tt.wantRedis {
+			t.Errorf("Get(%s) reached Redis = %v, want %v", tt.key, gotRedis, tt.wantRedis)
+		}
+	}
+}
+
+// BenchmarkTieredCacheLocalHit reads an entry held in the local cache and
+// fails if any read reaches Redis.
+func BenchmarkTieredCacheLocalHit(b *testing.B) {
+	mr := miniredis.RunT(b)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	b.Cleanup(func() { client.Close() })
+	cfg := Config{LocalCacheSize: 100, LocalCacheTTL: time.Hour}
+	cache := newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), newCacheHealth(), cfg)
+	ctx := context.Background()
+	cache.Set(ctx, "test:hit", testEntry(b, testWeather), time.Hour)
+	before := mr.CommandCount()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := cache.Get(ctx, "test:hit"); !ok {
+			b.Fatal("Get missed")
+		}
+	}
+	b.StopTimer()
+	if n := mr.CommandCount() - before; n != 0 {
+		b.Fatalf("%d local hits reached Redis", n)
+	}
+}
@@ -1,138 +1,946 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
 	"golang.org/x/time/rate"
+	"google.golang.org/grpc"
 )
 
 // bu uyuglamayı docker üzerinden çalıştırmayı dene bunun için dockerfile oluştur.
 // bu uyuglamayı redis ile beraber yönetmek için docker-compose oluştur.
 type Weather struct {
-	Latitude        float64 `json:"latitude"`
-	Longitude       float64 `json:"longitude"`
-	ResolvedAddress string  `json:"resolvedAddress"`
-	Timezone        string  `json:"timezone"`
-	Description     string  `json:"description"`
-	Days            []Day   `json:"days"`
+	Latitude        float64  `json:"latitude" xml:"latitude"`
+	Longitude       float64  `json:"longitude" xml:"longitude"`
+	ResolvedAddress string   `json:"resolvedAddress" xml:"resolvedAddress"`
+	Timezone        string   `json:"timezone" xml:"timezone"`
+	Description     string   `json:"description" xml:"description"`
+	Days            []Day    `json:"days" xml:"days>day"`
+	Current         *Current `json:"currentConditions,omitempty" xml:"currentConditions,omitempty"`
+	Alerts          []Alert  `json:"alerts,omitempty" xml:"alert,omitempty"`
+	// Meta describes the response rather than the weather.
+	Meta *weatherMeta `json:"meta,omitempty" xml:"meta,omitempty"`
+}
+
+// weatherMeta tells clients how to read a response.
+type weatherMeta struct {
+	Units string `json:"units" xml:"units"`
+	weatherUnits
+	// Page is set when the days were asked for a page at a time.
+	Page *pageMeta `json:"page,omitempty" xml:"page,omitempty"`
+}
+
+// weatherUnits are the units of a unit group's measurements.
+type weatherUnits struct {
+	Temperature string `json:"temperature" xml:"temperature"`
+	WindSpeed   string `json:"windSpeed" xml:"windSpeed"`
+	Visibility  string `json:"visibility" xml:"visibility"`
 }
 
 type Day struct {
-	Datetime    string  `json:"datetime"`
-	Temp        float64 `json:"temp"`
-	FeelsLike   float64 `json:"feelslike"`
-	WindSpeed   float64 `json:"windspeed"`
-	Visibility  float64 `json:"visibility"`
-	UVIndex     float64 `json:"uvindex"`
-	Sunrise     string  `json:"sunrise"`
-	Sunset      string  `json:"sunset"`
-	Icon        string  `json:"icon"`
-	Description string  `json:"description"`
+	Datetime    string   `json:"datetime" xml:"datetime"`
+	Temp        float64  `json:"temp" xml:"temp"`
+	FeelsLike   float64  `json:"feelslike" xml:"feelslike"`
+	WindSpeed   float64  `json:"windspeed" xml:"windspeed"`
+	Visibility  float64  `json:"visibility" xml:"visibility"`
+	UVIndex     float64  `json:"uvindex" xml:"uvindex"`
+	Humidity    *float64 `json:"humidity,omitempty" xml:"humidity,omitempty"`
+	Sunrise     string   `json:"sunrise" xml:"sunrise"`
+	Sunset      string   `json:"sunset" xml:"sunset"`
+	Icon        string   `json:"icon" xml:"icon"`
+	Description string   `json:"description" xml:"description"`
+	Hours       []Hour   `json:"hours,omitempty" xml:"hour,omitempty"`
+	// HeatIndex, WindChill and DewPoint are worked out from the fields the
+	// provider sends, by deriveComfort.
+	HeatIndex *float64 `json:"heatIndex,omitempty" xml:"heatIndex,omitempty"`
+	WindChill *float64 `json:"windChill,omitempty" xml:"windChill,omitempty"`
+	DewPoint  *float64 `json:"dewPoint,omitempty" xml:"dewPoint,omitempty"`
+	// iconFields describe Icon, for clients that would otherwise map it
+	// themselves.
+	iconFields
 }
 
-func getIP(r *http.Request) string {
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		fmt.Println("Error parsing IP : %v", err)
-		return ""
-	}
-	return host
+// Current is the latest observation, sent by the provider when current
+// conditions are included.
+type Current struct {
+	Datetime      string       `json:"datetime" xml:"datetime"`
+	DatetimeEpoch int64        `json:"datetimeEpoch" xml:"datetimeEpoch"`
+	Temp          float64      `json:"temp" xml:"temp"`
+	FeelsLike     float64      `json:"feelslike" xml:"feelslike"`
+	WindSpeed     float64      `json:"windspeed" xml:"windspeed"`
+	Icon          string       `json:"icon" xml:"icon"`
+	Conditions    string       `json:"conditions" xml:"conditions"`
+	Meta          *weatherMeta `json:"meta,omitempty" xml:"meta,omitempty"`
+	// iconFields describe Icon, as those of a Day do.
+	iconFields
 }
 
-func rateLimiterMiddleware(next http.HandlerFunc, limit rate.Limit, burst int) http.HandlerFunc {
-	ipLimiterMap := make(map[string]*rate.Limiter)
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := getIP(r)
+// Hour is one hour of a Day, sent by the provider when hours are included.
+type Hour struct {
+	Datetime   string  `json:"datetime" xml:"datetime"`
+	Temp       float64 `json:"temp" xml:"temp"`
+	FeelsLike  float64 `json:"feelslike" xml:"feelslike"`
+	PrecipProb float64 `json:"precipprob" xml:"precipprob"`
+	WindSpeed  float64 `json:"windspeed" xml:"windspeed"`
+	Icon       string  `json:"icon" xml:"icon"`
+	Conditions string  `json:"conditions" xml:"conditions"`
+}
 
-		limiter, exists := ipLimiterMap[ip]
-		if !exists {
-			limiter = rate.NewLimiter(limit, burst)
-			ipLimiterMap[ip] = limiter
-		}
-		if !limiter.Allow() {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusTooManyRequests)
-			json.NewEncoder(w).Encode(map[string]string{"error": "To many requests"})
-			return
+// cacheControl reports whether the request's Cache-Control header carries
+// the no-cache and no-store directives.
+func cacheControl(r *http.Request) (noCache, noStore bool) {
+	for _, directive := range strings.Split(r.Header.Get("Cache-Control"), ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch strings.ToLower(name) {
+		case "no-cache":
+			noCache = true
+		case "no-store":
+			noStore = true
 		}
-		next.ServeHTTP(w, r)
-	})
+	}
+	return noCache, noStore
+}
+
+// requestTTL returns the cache TTL for a request. The max_age query parameter
+// (in seconds) can only shorten the configured TTL, never lengthen it, so
+// values too large to parse are clamped to it like any other long one.
+func requestTTL(r *http.Request, ttl time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get("max_age")
+	if v == "" {
+		return ttl, nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if errors.Is(err, strconv.ErrRange) && seconds > 0 {
+		return ttl, nil
+	}
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("max_age must be a positive number of seconds")
+	}
+	if seconds >= int64(ttl/time.Second) {
+		return ttl, nil
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
 
+// cacheEntry is the value stored in the cache for a location. Entries are kept
+// past FreshUntil so that a stale copy can be served while a refresh runs.
+// Negative entries, recording that the provider rejected the location, carry
+// the upstream Status and Error instead of a Payload.
+type cacheEntry struct {
+	FetchedAt  time.Time       `json:"fetchedAt"`
+	FreshUntil time.Time       `json:"freshUntil"`
+	Provider   string          `json:"provider,omitempty"`
+	Payload    json.RawMessage `json:"payload,omitempty"`
+	// ETag is the payload's entity tag, computed once when it is stored.
+	ETag   string `json:"etag,omitempty"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
 }
 
-func redisMiddleware(redisDB *redis.Client) http.HandlerFunc {
+// weatherProvider names the provider recorded in every cacheEntry.
+const weatherProvider = "visualcrossing"
+
+// decodeCacheEntry decodes a cached value. Values written before entries had
+// an envelope are a bare Weather; they decode as an entry of unknown age that
+// is already stale, so they are served once while a refresh replaces them.
+func decodeCacheEntry(data []byte) (cacheEntry, bool) {
+	var entry cacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return cacheEntry{}, false
+	}
+	if len(entry.Payload) > 0 || entry.Status != 0 {
+		return entry, true
+	}
+	var weather Weather
+	if err := json.Unmarshal(data, &weather); err != nil || (weather.ResolvedAddress == "" && len(weather.Days) == 0) {
+		return cacheEntry{}, false
+	}
+	return cacheEntry{Payload: data}, true
+}
+
+// weatherMiss is what redisMiddleware found out about a request it could
+// not answer from the cache, for fetchHandler to go on with.
+type weatherMiss struct {
+	q           weatherQuery
+	ttl         time.Duration
+	key         string
+	bypass      bool
+	noStore     bool
+	cacheStatus string
+}
+
+type weatherMissKey struct{}
+
+// redisMiddleware answers weather requests, as parsed by parse, from the
+// cache and hands the ones that need the provider to next, so that those
+// can be limited apart from the cheap hits.
+func redisMiddleware(next http.HandlerFunc, parse func(*http.Request) (weatherQuery, error), cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, hot *hotKeys, stats *cacheStats, cfg Config) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		country := r.URL.Query().Get("country")
-		val, err := getRedisValue(redisDB, country)
+		q, err := parse(r)
 		if err != nil {
-			key := os.Getenv("API_KEY")
-			if key == "" {
-				http.Error(w, "Api key could not found", http.StatusInternalServerError)
-				return
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		ttl, err := requestTTL(r, cfg.TTLPolicy.ttl(q))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		hot.Record(q)
+		cacheKey := q.cacheKey()
+		key := os.Getenv("API_KEY")
+
+		// refresh=true skips the cache and overwrites the entry. Without a
+		// valid admin token the parameter is ignored so it cannot be used to
+		// bust the cache.
+		refresh := r.URL.Query().Get("refresh") == "true" && isAdmin(r, cfg.AdminToken)
+		// Cache-Control: no-cache refetches and rewrites the entry like
+		// refresh=true, no-store refetches without touching the cache.
+		noCache, noStore := cacheControl(r)
+		bypass := refresh || noCache || noStore
+		var val []byte
+		var ok bool
+		if refresh {
+			logf(r.Context(), "Forced refresh of %s requested by %s", cacheKey, getIP(r))
+		}
+		if !bypass {
+			val, ok = cache.Get(r.Context(), cacheKey)
+			if !ok {
+				val, ok = cachedForecastDay(r.Context(), cache, q)
 			}
-			weather, err := getWeatherValue(country, key)
-			if err != nil {
-				http.Error(w, "getWeatherValue Error : "+err.Error(), http.StatusInternalServerError)
+		}
+		if ok {
+			logf(r.Context(), "Yes redis")
+			if entry, ok := decodeCacheEntry(val); ok && entry.Status != 0 {
+				stats.hits.Add(1)
+				stats.negativeHits.Add(1)
+				w.Header().Set("X-Cache", "HIT")
+				writeError(w, entry.Status, apiError{Code: "location_rejected"})
 				return
-			}
-			data, err := json.Marshal(weather)
-			if err != nil {
-				http.Error(w, "Error marshalling JSON", http.StatusInternalServerError)
+			} else if ok {
+				stats.hits.Add(1)
+				if time.Now().After(entry.FreshUntil) {
+					w.Header().Set("X-Stale", "true")
+					// Short on budget, the stale entry is served as it is
+					// until it expires.
+					if key != "" && !budget.saving() {
+						go func() {
+							_, err, _ := group.Do(cacheKey, func() (interface{}, error) {
+								return fetchAndCache(context.WithoutCancel(r.Context()), cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q))
+							})
+							if err != nil {
+								logf(r.Context(), "Error refreshing stale value : %v", err)
+							}
+						}()
+					}
+				}
+				w.Header().Set("X-Cache", "HIT")
+				if !entry.FetchedAt.IsZero() {
+					age := int(time.Since(entry.FetchedAt).Seconds())
+					if age < 0 {
+						age = 0
+					}
+					w.Header().Set("Age", strconv.Itoa(age))
+					w.Header().Set("X-Fetched-At", entry.FetchedAt.UTC().Format(time.RFC3339))
+				}
+				// The freshness window is stored in the entry itself, so this
+				// needs no extra TTL round trip. Stale entries report 0.
+				remaining := int(time.Until(entry.FreshUntil).Seconds())
+				if remaining < 0 {
+					remaining = 0
+				}
+				w.Header().Set("X-Cache-TTL", strconv.Itoa(remaining))
+				etag := entry.ETag
+				if etag == "" {
+					etag = payloadETag(entry.Payload)
+				}
+				writePayload(w, r, etag, entry.Payload)
 				return
 			}
-			err = setRedisValue(redisDB, country, data, 5*time.Minute)
-			if err != nil {
-				http.Error(w, "Error setting value in Redis", http.StatusInternalServerError)
+		}
+
+		cacheStatus := "MISS"
+		if bypass {
+			cacheStatus = "BYPASS"
+		} else {
+			stats.misses.Add(1)
+		}
+		if key == "" {
+			logf(r.Context(), "Error fetching weather : API_KEY is not set")
+			writeUnconfigured(w)
+			return
+		}
+		miss := weatherMiss{q: q, ttl: ttl, key: key, bypass: bypass, noStore: noStore, cacheStatus: cacheStatus}
+		next(w, r.WithContext(context.WithValue(r.Context(), weatherMissKey{}, miss)))
+	}
+}
+
+// cachedForecastDay serves a query for a single date, such as
+// /weather/astronomy?date=, from the fresh default forecast entry of the same
+// location when it holds that date, reading only that day of it. The entry
+// served is only the day, so its ETag is left to be computed from it.
+func cachedForecastDay(ctx context.Context, cache *tieredCache, q weatherQuery) ([]byte, bool) {
+	if q.Include != "days" {
+		return nil, false
+	}
+	if _, err := time.Parse(time.DateOnly, q.Range); err != nil {
+		return nil, false
+	}
+	forecast := q
+	forecast.Range = fmt.Sprintf("next%ddays", defaultForecastDays)
+	val, ok := cache.GetDays(ctx, forecast.cacheKey(), []string{q.Range})
+	if !ok {
+		return nil, false
+	}
+	entry, ok := decodeCacheEntry(val)
+	if !ok || entry.Status != 0 || time.Now().After(entry.FreshUntil) {
+		return nil, false
+	}
+	var days struct {
+		Days []json.RawMessage `json:"days"`
+	}
+	if json.Unmarshal(entry.Payload, &days) != nil || len(days.Days) != 1 {
+		return nil, false
+	}
+	entry.ETag = ""
+	val, err := json.Marshal(entry)
+	if err != nil {
+		return nil, false
+	}
+	return val, true
+}
+
+// fetchHandler fetches the weather for the requests redisMiddleware missed
+// and caches it. It must run behind redisMiddleware.
+func fetchHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		miss, ok := r.Context().Value(weatherMissKey{}).(weatherMiss)
+		if !ok {
+			logf(r.Context(), "Error fetching weather : no cache lookup preceded the fetch")
+			writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error"})
+			return
+		}
+		q, key, ttl, cacheKey := miss.q, miss.key, miss.ttl, miss.q.cacheKey()
+		// A bypass must not join an in-flight fetch, which may have started
+		// before whatever the caller wants to confirm.
+		var v interface{}
+		var err error
+		if miss.noStore {
+			v, err = fetchPayload(r.Context(), budget, q, key, cfg)
+		} else if miss.bypass {
+			v, err = fetchAndCache(r.Context(), cache, budget, cfg, q, key, ttl)
+			cache.Invalidate(r.Context(), escapeGlob(cacheKey))
+		} else {
+			// A shared fetch keeps going if the request that started it goes
+			// away, since others may be waiting on it and its result is
+			// cached either way. It keeps the request's values but not its
+			// cancellation, while each request stops waiting when it is
+			// cancelled.
+			ch := group.DoChan(cacheKey, func() (interface{}, error) {
+				return fetchShared(context.WithoutCancel(r.Context()), cache, budget, cfg, q, key, ttl)
+			})
+			select {
+			case res := <-ch:
+				v, err = res.Val, res.Err
+			case <-r.Context().Done():
 				return
 			}
-			fmt.Println("No redis")
-			w.Write(data)
-		} else {
-			fmt.Println("Yes redis")
-			w.Write([]byte(val))
 		}
+		if r.Context().Err() != nil {
+			return
+		}
+		var upErr *upstreamError
+		if errors.As(err, &upErr) && upErr.rejectsLocation() {
+			w.Header().Set("X-Cache", miss.cacheStatus)
+			logf(r.Context(), "Location %q rejected by the provider : %s", q.Location, upErr.Message)
+			writeError(w, upErr.StatusCode, apiError{Code: "location_rejected"})
+			return
+		}
+		if errors.Is(err, errBudgetExhausted) {
+			w.Header().Set("X-Cache", miss.cacheStatus)
+			retry := retryAfterSeconds(budget.resetIn())
+			w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+			writeError(w, http.StatusServiceUnavailable, apiError{Code: "upstream_quota_exhausted", RetryAfterSeconds: retry, Limit: budget.dailyLimit(), Scope: scopeGlobalQuota})
+			return
+		}
+		if err != nil {
+			logf(r.Context(), "Error fetching %q : %v", cacheKey, err)
+			w.Header().Set("X-Cache", miss.cacheStatus)
+			writeError(w, http.StatusBadGateway, apiError{Code: "upstream_error"})
+			return
+		}
+		data := v.([]byte)
+		logf(r.Context(), "No redis")
+		w.Header().Set("X-Cache", miss.cacheStatus)
+		if !miss.noStore {
+			w.Header().Set("X-Cache-TTL", strconv.Itoa(int(ttl.Seconds())))
+		}
+		writePayload(w, r, payloadETag(data), data)
+	}
+}
+
+const (
+	// fetchLockTTL outlives the upstream timeout so the lock is not lost
+	// mid-fetch, yet expires quickly if its holder dies.
+	fetchLockTTL = 3 * time.Second
+	// fetchLockWait bounds how long a request waits for another instance's
+	// fetch before making its own.
+	fetchLockWait = time.Second
+	fetchLockPoll = 50 * time.Millisecond
+)
+
+// fetchShared is fetchAndCache guarded by a lock shared with the other
+// instances, so that replicas missing the same key at once make a single
+// upstream call. Instances that lose the race poll the cache for the
+// winner's entry and fetch it themselves if it does not show up in time.
+func fetchShared(ctx context.Context, cache *tieredCache, budget *upstreamBudget, cfg Config, q weatherQuery, key string, ttl time.Duration) ([]byte, error) {
+	cacheKey := q.cacheKey()
+	token, ok := cache.Lock(ctx, cacheKey, fetchLockTTL)
+	if ok {
+		defer cache.Unlock(context.Background(), cacheKey, token)
+		return fetchAndCache(ctx, cache, budget, cfg, q, key, ttl)
+	}
+	deadline := time.Now().Add(fetchLockWait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(fetchLockPoll):
+		}
+		val, ok := cache.Get(ctx, cacheKey)
+		if !ok {
+			continue
+		}
+		if entry, ok := decodeCacheEntry(val); ok && entry.Status != 0 {
+			return nil, &upstreamError{StatusCode: entry.Status, Message: entry.Error}
+		} else if ok {
+			return entry.Payload, nil
+		}
+	}
+	return fetchAndCache(ctx, cache, budget, cfg, q, key, ttl)
+}
+
+// fetchAndCache fetches the weather for q from the provider, within budget,
+// and stores it in the cache. The entry is fresh for ttl and kept for a
+// further cfg.StaleTTL. When the provider rejects the location a negative
+// entry is cached for cfg.NegativeCacheTTL instead.
+func fetchAndCache(ctx context.Context, cache *tieredCache, budget *upstreamBudget, cfg Config, q weatherQuery, key string, ttl time.Duration) ([]byte, error) {
+	data, err := fetchPayload(ctx, budget, q, key, cfg)
+	var upErr *upstreamError
+	if errors.As(err, &upErr) && upErr.rejectsLocation() {
+		now := time.Now()
+		entry, merr := json.Marshal(cacheEntry{FetchedAt: now, FreshUntil: now.Add(cfg.NegativeCacheTTL), Provider: weatherProvider, Status: upErr.StatusCode, Error: upErr.Message})
+		if merr == nil {
+			cache.Set(ctx, q.cacheKey(), entry, cfg.NegativeCacheTTL)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// Jitter is applied after requestTTL has clamped ttl, so an entry can end
+	// up slightly fresher than max_age asked for, but never by more than the
+	// jitter fraction.
+	ttl = cache.jitter.apply(ttl)
+	now := time.Now()
+	entry, err := json.Marshal(cacheEntry{FetchedAt: now, FreshUntil: now.Add(ttl), Provider: weatherProvider, Payload: data, ETag: payloadETag(data)})
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling JSON")
+	}
+	cache.Set(ctx, q.cacheKey(), entry, ttl+cfg.StaleTTL)
+	return data, nil
+}
+
+// fetchPayload fetches the weather for q from the provider and encodes it
+// for the response, without caching it. It fails with errBudgetExhausted
+// rather than go over budget.
+func fetchPayload(ctx context.Context, budget *upstreamBudget, q weatherQuery, key string, cfg Config) ([]byte, error) {
+	if err := budget.take(ctx); err != nil {
+		return nil, err
+	}
+	weather, err := getWeatherValue(ctx, q, key, cfg.UpstreamMaxBodySize)
+	if err != nil {
+		return nil, fmt.Errorf("getWeatherValue Error : %w", err)
+	}
+	meta := &weatherMeta{Units: q.Units, weatherUnits: unitGroups[q.Units]}
+	var v any = weather
+	// Current conditions and alerts are served on their own.
+	switch q.Include {
+	case "current":
+		if weather.Current == nil {
+			return nil, fmt.Errorf("the provider sent no current conditions")
+		}
+		weather.Current.Meta = meta
+		weather.Current.iconFields = describeIcon(weather.Current.Icon, cfg.IconBaseURL)
+		v = weather.Current
+	case "alerts":
+		v = alertsResponse{Alerts: append([]Alert{}, weather.Alerts...)}
+	default:
+		for i := range weather.Days {
+			weather.Days[i].deriveComfort(q.Units)
+			weather.Days[i].iconFields = describeIcon(weather.Days[i].Icon, cfg.IconBaseURL)
+		}
+		weather.Meta = meta
 	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling JSON")
+	}
+	return data, nil
 }
 
 func main() {
-	var redisDB = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
+	os.Exit(runCLI(os.Args[1:]))
+}
+
+// newHTTPServer returns the server for handler on :7878, with the timeouts
+// and header limit of cfg.
+func newHTTPServer(cfg Config, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":7878",
+		Handler:           handler,
+		ReadTimeout:       cfg.ServerReadTimeout,
+		ReadHeaderTimeout: cfg.ServerReadTimeout,
+		WriteTimeout:      cfg.ServerWriteTimeout,
+		IdleTimeout:       cfg.ServerIdleTimeout,
+		MaxHeaderBytes:    cfg.ServerMaxHeaderBytes,
+	}
+}
+
+// serve runs the HTTP server until it receives SIGINT or SIGTERM.
+func serve(cfg Config) error {
+	backend, err := newCacheBackend(cfg)
+	if err != nil {
+		return fmt.Errorf("could not connect to cache: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	index, err := newServiceIndex(openAPISpec)
+	if err != nil {
+		return fmt.Errorf("could not read openapi.json: %v", err)
+	}
+	mux.Handle("/{$}", allowMethods(indexHandler(index), http.MethodGet))
+	mux.Handle("/", notFoundHandler(index))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// Background work outlives the signal until the requests have drained,
+	// since they may still depend on it.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var workers sync.WaitGroup
+	spawn := func(work func(ctx context.Context)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			work(background)
+		}()
+	}
+
+	health := newCacheHealth()
+	spawn(func(ctx context.Context) {
+		health.run(ctx, backend, cfg.RedisHealthInterval, cfg.RedisHealthMaxBackoff)
 	})
+	cache := newTieredCache(backend, health, cfg)
+	spawn(cache.listenInvalidations)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, "/weather", http.StatusOK)
+	// The rate limiter and upstream budget share the cache's Redis client
+	// when the cache is Redis, and otherwise a client of their own.
+	var sharedDB redis.UniversalClient
+	if rb, ok := backend.(*redisBackend); ok {
+		sharedDB = rb.redisDB
+	}
+	snapshots := cfg.RateLimitSnapshot && cfg.RateLimitBackend == rateLimitBackendLocal
+	needsRedis := cfg.RateLimitBackend == rateLimitBackendRedis || snapshots || (cfg.UpstreamBudgetShared && cfg.UpstreamDailyBudget > 0) || len(cfg.AuthRequiredRoutes) > 0
+	if sharedDB == nil && needsRedis {
+		if sharedDB, err = newRedisClient(cfg); err != nil {
+			return fmt.Errorf("could not connect to Redis: %v", err)
+		}
+	}
+	var budgetDB redis.UniversalClient
+	if cfg.UpstreamBudgetShared {
+		budgetDB = sharedDB
+	}
+	budget := newUpstreamBudget(cfg.UpstreamDailyBudget, cfg.UpstreamBudgetSoft, cfg.UpstreamBudgetZone, budgetDB)
+
+	// Webhooks are evaluated on every entry this instance fetches. They are
+	// kept in Redis like the API keys, and unavailable without it.
+	var webhooks *webhookStore
+	if sharedDB != nil {
+		webhooks = &webhookStore{redisDB: sharedDB}
+		dispatcher := newWebhookDispatcher(webhooks, time.Second)
+		cache.OnWrite(dispatcher.observe)
+		spawn(dispatcher.run)
+		spawn(func(ctx context.Context) { runWebhookSweep(ctx, cache, budget, webhooks, cfg) })
+	}
+
+	hot := newHotKeys()
+	spawn(func(ctx context.Context) { runRefresher(ctx, cache, budget, hot, cfg) })
+	stats := &cacheStats{}
+
+	var limiterDB redis.UniversalClient
+	if cfg.RateLimitBackend == rateLimitBackendRedis {
+		limiterDB = sharedDB
+	}
+	// persisted are the local limiters to snapshot on shutdown.
+	persisted := make(map[string]persistentLimiter)
+	newLimiter := func(name string, limit rate.Limit, burst int) rateLimiter {
+		if cfg.RateLimitRPS == 0 {
+			return nil
+		}
+		sliding := cfg.RateLimitAlgorithm == rateLimitAlgorithmSlidingWindow
+		var local persistentLimiter = newIPLimiters(limit, burst, cfg.RateLimitIdleTTL)
+		if sliding {
+			local = newSlidingWindowLimiters(limit, burst, cfg.RateLimitIdleTTL)
+		}
+		if limiterDB != nil {
+			return newRedisLimiter(limiterDB, name, limit, burst, sliding, local)
+		}
+		if snapshots {
+			if err := loadLimiterSnapshot(ctx, sharedDB, name, local); err != nil {
+				fmt.Println("Error restoring rate limiter snapshot :", err)
+			}
+			persisted[name] = local
+		}
+		return local
+	}
+
+	// Cache hits only count against the outer limit. Requests that go to
+	// the provider also pass the miss limit, and cache bypasses the even
+	// stricter bypass limit. group collapses concurrent misses and
+	// background refreshes for the same location into a single fetch.
+	var group singleflight.Group
+	limiterStats := newLimiterStats()
+	limitOpts := []Option{WithStats(limiterStats), WithObserve(cfg.RateLimitMode == rateLimitModeObserve)}
+	fetch := bypassLimiterMiddleware(fetchHandler(cache, &group, budget, cfg), newLimiter("bypass", rate.Every(10*time.Second), 3), limitOpts...)
+	var missLimiter rateLimiter
+	if cfg.RateLimitMissRPS > 0 {
+		missLimiter = newLimiter("miss", rate.Limit(cfg.RateLimitMissRPS), cfg.RateLimitMissBurst)
+	}
+	fetch = rateLimiterMiddleware(fetch, missLimiter, limitOpts...)
+	// Keys issued through Redis are looked up there when it keeps the counts.
+	keys := &apiKeyTiers{keys: cfg.APIKeyTiers, redisDB: limiterDB}
+	limiter := newTieredLimiter(newLimiter("weather", rate.Limit(cfg.RateLimitRPS), cfg.RateLimitBurst), cfg.RateLimitTiers, newLimiter)
+	lookup := func(parse func(*http.Request) (weatherQuery, error)) http.HandlerFunc {
+		h := redisMiddleware(fetch, parse, cache, &group, budget, hot, stats, cfg)
+		return consumerMiddleware(rateLimiterMiddleware(h, limiter, limitOpts...), keys)
+	}
+	weather := func(parse func(*http.Request) (weatherQuery, error), root string, newBody func() any) http.HandlerFunc {
+		h := lookup(parse)
+		if _, ok := newBody().(*Weather); ok {
+			h = pageMiddleware(h)
+		}
+		return formatMiddleware(fieldsMiddleware(h, newBody), root, newBody)
+	}
+	newWeather := func() any { return new(Weather) }
+	get := func(pattern string, h http.Handler) {
+		mux.Handle(pattern, allowMethods(h, http.MethodGet))
+	}
+	get("/weather", weather(parseWeatherQuery, "weather", newWeather))
+	get("/weather/forecast", weather(parseForecastQuery, "weather", newWeather))
+	get("/weather/history", weather(parseHistoryQuery, "weather", newWeather))
+	get("/weather/hourly", weather(parseHourlyQuery, "weather", newWeather))
+	get("/weather/current", weather(parseCurrentQuery, "current", func() any { return new(Current) }))
+	get("/weather/astronomy", formatMiddleware(astronomyMiddleware(lookup(parseAstronomyQuery)), "astronomy", func() any { return new(astronomy) }))
+	get("/weather/summary", formatMiddleware(summaryMiddleware(lookup(parseSummaryQuery)), "summary", func() any { return new(weatherSummary) }))
+	// Alerts are filtered by severity as they are served, so that every
+	// filter shares one cache entry.
+	get("/weather/alerts", formatMiddleware(minSeverityMiddleware(lookup(parseAlertsQuery)), "alerts", func() any { return new(alertsResponse) }))
+	batch := negotiateMiddleware(batchHandler(cache, &group, budget, hot, stats, cfg), formatJSON)
+	get("/weather/batch", consumerMiddleware(rateLimiterMiddleware(batch, limiter, limitOpts...), keys))
+	compare := negotiateMiddleware(compareHandler(cache, &group, budget, hot, stats, cfg), formatJSON)
+	get("/weather/compare", consumerMiddleware(rateLimiterMiddleware(compare, limiter, limitOpts...), keys))
+	query := negotiateMiddleware(queryHandler(cache, &group, budget, hot, stats, cfg), formatJSON)
+	mux.Handle("/weather/query", allowMethods(consumerMiddleware(rateLimiterMiddleware(query, limiter, limitOpts...), keys), http.MethodPost))
+	// A stream only counts against the outer limit as it opens.
+	streams := newOpenStreams()
+	socket := weatherSocketHandler(cache, &group, budget, cfg, streams)
+	get("/weather/ws", consumerMiddleware(rateLimiterMiddleware(socket, limiter, limitOpts...), keys))
+	stream := weatherStreamHandler(cache, &group, budget, cfg, streams)
+	get("/weather/stream", consumerMiddleware(rateLimiterMiddleware(stream, limiter, limitOpts...), keys))
+	// Callers check their budget without spending it.
+	get("/limits", consumerMiddleware(limitsHandler(limiter), keys))
+	dashboard := dashboardHandler(cache, &group, budget, cfg)
+	get("/dashboard", consumerMiddleware(rateLimiterMiddleware(dashboard, limiter, limitOpts...), keys))
+	get("/status", statusHandler(health, cfg.CacheBackend))
+	get("/healthz", healthzHandler(backend, cfg))
+	probes := &probeState{}
+	metrics := newHTTPMetrics()
+	metrics.registry.MustRegister(limiterStats)
+	get(metricsPath, metrics.handler())
+	get("/openapi.json", http.HandlerFunc(openAPIHandler))
+	get("/docs", http.HandlerFunc(docsHandler))
+	get("/livez", livezHandler(probes))
+	get("/readyz", readyzHandler(probes, health, cfg))
+
+	lists := newAccessLists(cfg.RateLimitAllowlist, cfg.RateLimitDenylist)
+	if cfg.RateLimitListsFile != "" {
+		if err := lists.loadFile(cfg.RateLimitListsFile); err != nil {
+			return fmt.Errorf("could not load rate limit lists: %v", err)
+		}
+		spawn(func(ctx context.Context) { reloadOnHangup(ctx, lists, cfg.RateLimitListsFile) })
+	}
+	var keyStore *apiKeyStore
+	authRoutes := cfg.AuthRequiredRoutes
+	if sharedDB != nil {
+		keyStore = &apiKeyStore{redisDB: sharedDB}
+		// Webhooks belong to the consumer whose key made them.
+		mux.Handle("/webhooks", allowMethods(webhooksHandler(webhooks), http.MethodGet, http.MethodPost))
+		mux.Handle("/webhooks/{id}", allowMethods(webhooksHandler(webhooks), http.MethodDelete))
+		authRoutes = append(slices.Clip(authRoutes), "/webhooks", "/webhooks/{id}")
+	}
+
+	// The admin routes are authenticated before they are routed, so that a
+	// refused request cannot tell which of them exist.
+	admin := http.NewServeMux()
+	admin.Handle("/admin/config", allowMethods(configHandler(cfg), http.MethodGet))
+	admin.Handle("/admin/cache", allowMethods(cacheHandler(cache), http.MethodDelete))
+	admin.Handle("/admin/cache/stats", allowMethods(cacheStatsHandler(cache, stats), http.MethodGet))
+	admin.Handle("/admin/cache/keys", allowMethods(cacheKeysHandler(cache), http.MethodGet))
+	admin.Handle("/admin/limits/stats", allowMethods(limiterStatsHandler(limiterStats), http.MethodGet))
+	admin.Handle("/admin/ratelimit/lists", allowMethods(accessListsHandler(lists), http.MethodGet, http.MethodPut))
+	if keyStore != nil {
+		admin.Handle("/admin/apikeys", allowMethods(apiKeysHandler(keyStore, cfg.RateLimitTiers), http.MethodGet, http.MethodPost, http.MethodDelete))
+	}
+	admin.HandleFunc("/admin/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, apiError{Code: "not_found"})
 	})
-	http.HandleFunc("/weather", rateLimiterMiddleware(redisMiddleware(redisDB), rate.Limit(2), 10))
+	mux.Handle("/admin/", adminMiddleware(admin, adminAuth{token: cfg.AdminToken, requireCert: cfg.AdminClientCAFile != ""}))
+
+	if cfg.CacheSweep {
+		spawn(func(ctx context.Context) { sweepOldCacheVersions(ctx, cache) })
+	}
+	probes.warming.Store(cfg.WarmBlocking)
+	spawn(func(ctx context.Context) {
+		warmCache(ctx, cache, budget, cfg)
+		probes.warming.Store(false)
+	})
+
+	routeLimiters := make(map[string]rateLimiter)
+	for pattern, spec := range cfg.RateLimitRoutes {
+		if limiter := newLimiter("route:"+pattern, rate.Limit(spec.RPS), spec.Burst); limiter != nil {
+			routeLimiters[pattern] = limiter
+		}
+	}
+	handler := routeLimitMiddleware(mux, mux, routeLimiters, limitOpts...)
+	handler = authMiddleware(handler, mux, keyStore, authRoutes)
+	handler = exemptPathsMiddleware(handler, cfg.RateLimitExemptPaths, limiterStats)
+	handler = clientIPMiddleware(accessListMiddleware(handler, lists), cfg.TrustedProxies, cfg.RateLimitIPv6Prefix)
+	handler = corsMiddleware(handler, cfg.CORSAllowedOrigins, cfg.CORSMaxAge)
+	handler = prettyMiddleware(handler)
+	handler = gzipMiddleware(handler)
+	handler = headMiddleware(handler)
+	handler = metricsMiddleware(handler, mux, metrics)
+	handler = versionMiddleware(handler, mux, cfg.LegacySunset)
+	handler = requestIDMiddleware(handler)
+	server := newHTTPServer(cfg, handler)
+	tlsConfig, redirect, err := serverTLSConfig(cfg, server.Addr)
+	if err != nil {
+		return err
+	}
+	server.TLSConfig = tlsConfig
+	// Streams are told to end as Shutdown starts, or it would wait for the
+	// event streams to time out. It does not wait for hijacked WebSockets,
+	// so they are waited for once requests have drained.
+	server.RegisterOnShutdown(streams.close)
+	var redirectServer *http.Server
+	if tlsConfig != nil && cfg.TLSRedirectAddr != "" {
+		redirectServer = &http.Server{
+			Addr:              cfg.TLSRedirectAddr,
+			Handler:           redirect,
+			ReadHeaderTimeout: cfg.ServerReadTimeout,
+			IdleTimeout:       cfg.ServerIdleTimeout,
+			MaxHeaderBytes:    cfg.ServerMaxHeaderBytes,
+		}
+		go func() {
+			fmt.Println("Redirecting to HTTPS on", redirectServer.Addr)
+			if err := redirectServer.ListenAndServe(); err != http.ErrServerClosed {
+				fmt.Printf("Error serving redirects on %s : %v\n", redirectServer.Addr, err)
+			}
+		}()
+	}
+	// The gRPC service makes its calls to the HTTP handler, so that they go
+	// through the same middleware and cache.
+	var grpcServer *grpc.Server
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			return fmt.Errorf("could not listen on %s: %v", cfg.GRPCAddr, err)
+		}
+		grpcServer = newGRPCServer(handler, tlsConfig)
+		go func() {
+			fmt.Println("Serving gRPC on", cfg.GRPCAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				fmt.Printf("Error serving gRPC on %s : %v\n", cfg.GRPCAddr, err)
+			}
+		}()
+	}
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		// A second signal kills the process.
+		stop()
+		grpcStopped := make(chan struct{})
+		go func() {
+			defer close(grpcStopped)
+			if grpcServer != nil {
+				stopGRPC(grpcServer, cfg.ShutdownDrainDelay+cfg.ShutdownTimeout)
+			}
+		}()
+		drainErr := drain(server, probes, cfg)
+		streams.wait()
+		<-grpcStopped
+		if redirectServer != nil {
+			redirectServer.Close()
+		}
+		fmt.Println("Shutting down : stopping background work")
+		stopBackground()
+		workers.Wait()
+		// Requests have drained, so the snapshots hold their final counts.
+		saveCtx, cancelSave := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelSave()
+		for name, l := range persisted {
+			if err := saveLimiterSnapshot(saveCtx, sharedDB, name, l); err != nil {
+				fmt.Println("Error saving rate limiter snapshot :", err)
+			}
+		}
+		fmt.Println("Shutting down : closing connections")
+		if closer, ok := backend.(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				fmt.Println("Error closing cache :", err)
+			}
+		}
+		if rb, ok := backend.(*redisBackend); sharedDB != nil && (!ok || rb.redisDB != sharedDB) {
+			if err := sharedDB.Close(); err != nil {
+				fmt.Println("Error closing Redis :", err)
+			}
+		}
+		if drainErr != nil {
+			done <- drainErr
+			return
+		}
+		fmt.Println("Shut down")
+		done <- nil
+	}()
+	fmt.Println("Listening on", server.Addr, "with TLS", cfg.TLSMode)
+	if tlsConfig != nil {
+		// The certificates are already in the TLS configuration.
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		return fmt.Errorf("could not serve on %s: %v", server.Addr, err)
+	}
+	return <-done
+}
 
-	http.ListenAndServe(":7878", nil)
+// drain stops server taking requests and waits up to cfg.ShutdownTimeout
+// for the ones in flight to finish. Readiness fails first so load balancers
+// drain the instance while it still serves, liveness only once it stops.
+func drain(server *http.Server, probes *probeState, cfg Config) error {
+	fmt.Println("Shutting down : failing readiness for", cfg.ShutdownDrainDelay)
+	probes.draining.Store(true)
+	time.Sleep(cfg.ShutdownDrainDelay)
+	probes.stopping.Store(true)
+	fmt.Println("Shutting down : draining requests for up to", cfg.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("Error draining requests :", err)
+		return fmt.Errorf("requests were still in flight after %s", cfg.ShutdownTimeout)
+	}
+	return nil
+}
 
+// stopGRPC lets the calls in flight on server finish, cutting them off after
+// timeout.
+func stopGRPC(server *grpc.Server, timeout time.Duration) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(timeout):
+		fmt.Println("Error stopping gRPC : calls were still in flight after", timeout)
+		server.Stop()
+	}
 }
 
-func getWeatherValue(country string, key string) (Weather, error) {
+// upstreamError is returned by getWeatherValue when the provider answers with
+// a status other than 200.
+type upstreamError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("status code : %d , message : %s", e.StatusCode, e.Message)
+}
+
+// rejectsLocation reports whether the provider refused the request because of
+// the location itself. Auth and quota errors are also 4xx but say nothing
+// about the location, and 5xx errors are transient.
+func (e *upstreamError) rejectsLocation() bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests:
+		return false
+	}
+	return e.StatusCode >= 400 && e.StatusCode < 500
+}
+
+// getWeatherValue fetches the weather for q, failing if the provider's
+// response body is larger than maxBody bytes.
+func getWeatherValue(ctx context.Context, q weatherQuery, key string, maxBody int64) (Weather, error) {
 
 	if key == "" {
 		return Weather{}, fmt.Errorf("API key cannot be empty")
 	}
-	if country == "" {
-		country = "maltepe"
-	}
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 2*time.Second)
 	defer cancel()
-	url := "https://weather.visualcrossing.com/VisualCrossingWebServices/rest/services/timeline/" + country + "/today?unitGroup=metric&include=days&key=" + key + "&contentType=json"
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	// The location is a single path segment, escaped as the URL is
+	// encoded, while the range may be two dates separated by a slash.
+	u := url.URL{
+		Scheme: "https",
+		Host:   "weather.visualcrossing.com",
+		Path:   "/VisualCrossingWebServices/rest/services/timeline/" + q.Location,
+		RawQuery: url.Values{
+			"unitGroup":   {q.Units},
+			"lang":        {q.Lang},
+			"include":     {q.Include},
+			"key":         {key},
+			"contentType": {"json"},
+		}.Encode(),
+	}
+	if q.Range != "current" {
+		u.Path += "/" + q.Range
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
 	if err != nil {
 		return Weather{}, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
+	if id := requestID(ctx); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
 
 	client := &http.Client{}
 	res, err := client.Do(req)
@@ -142,13 +950,16 @@ func getWeatherValue(country string, key string) (Weather, error) {
 	}
 	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxBody+1))
 	if err != nil {
 		return Weather{}, fmt.Errorf("failed to read response body: %v", err)
 	}
+	if int64(len(body)) > maxBody {
+		return Weather{}, fmt.Errorf("response body is larger than %d bytes", maxBody)
+	}
 
 	if res.StatusCode != http.StatusOK {
-		return Weather{}, fmt.Errorf("status code : %d , message : %s", res.StatusCode, body)
+		return Weather{}, &upstreamError{StatusCode: res.StatusCode, Message: strings.TrimSpace(string(body))}
 	}
 
 	var weather Weather
@@ -156,12 +967,51 @@ func getWeatherValue(country string, key string) (Weather, error) {
 	if err != nil {
 		return Weather{}, err
 	}
+	lastUpstreamSuccess.Store(time.Now().UnixNano())
 	return weather, nil
 }
 
-func setRedisValue(redisDB *redis.Client, key string, value interface{}, expiration time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+// gzipMagic is the header every gzip stream starts with. Plain JSON entries
+// written before compression was enabled never start with it.
+const gzipMagic = "\x1f\x8b"
+
+func compressValue(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(value); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decompressValue undoes compressValue, passing uncompressed values through.
+func decompressValue(val string) (string, error) {
+	if !strings.HasPrefix(val, gzipMagic) {
+		return val, nil
+	}
+	zr, err := gzip.NewReader(strings.NewReader(val))
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(zr)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func setRedisValue(ctx context.Context, redisDB redis.UniversalClient, key string, value []byte, expiration time.Duration, compress bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
+	if compress {
+		var err error
+		if value, err = compressValue(value); err != nil {
+			return err
+		}
+	}
 	err := redisDB.Set(ctx, key, value, expiration).Err()
 	if err != nil {
 		return err
@@ -169,12 +1019,233 @@ func setRedisValue(redisDB *redis.Client, key string, value interface{}, expirat
 	return nil
 }
 
-func getRedisValue(redisDB *redis.Client, key string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+func getRedisValue(ctx context.Context, redisDB redis.UniversalClient, key string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	val, err := redisDB.Get(ctx, key).Result()
 	if err != nil {
 		return "", err
 	}
-	return val, nil
+	return decodeValue(val)
+}
+
+// setRedisHash replaces the hash at key with fields and sets its expiration,
+// all in one transaction.
+func setRedisHash(ctx context.Context, redisDB redis.UniversalClient, key string, fields map[string][]byte, expiration time.Duration, compress bool) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	values := make([]interface{}, 0, 2*len(fields))
+	for name, value := range fields {
+		if compress {
+			var err error
+			if value, err = compressValue(value); err != nil {
+				return err
+			}
+		}
+		values = append(values, name, value)
+	}
+	_, err := redisDB.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, key)
+		pipe.HSet(ctx, key, values...)
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	return err
+}
+
+// getRedisHash reads the given fields of the hash at key, or all of them when
+// none are given. Missing fields are left out of the result and a missing key
+// returns redis.Nil.
+func getRedisHash(ctx context.Context, redisDB redis.UniversalClient, key string, fields ...string) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	result := make(map[string]string)
+	if len(fields) == 0 {
+		all, err := redisDB.HGetAll(ctx, key).Result()
+		if err != nil {
+			return nil, err
+		}
+		result = all
+	} else {
+		vals, err := redisDB.HMGet(ctx, key, fields...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range vals {
+			if v, ok := v.(string); ok {
+				result[fields[i]] = v
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, redis.Nil
+	}
+	for name, val := range result {
+		val, err := decodeValue(val)
+		if err != nil {
+			return nil, err
+		}
+		result[name] = val
+	}
+	return result, nil
+}
+
+// redisBatchSize bounds how many keys go into a single MGET or pipeline.
+const redisBatchSize = 100
+
+// getRedisValues reads several string keys, returning the values found and the
+// keys that were missing. Keys are read with one MGET per redisBatchSize keys;
+// in cluster mode MGET cannot span hash slots, so a pipeline of GETs is used
+// instead and go-redis routes each GET to its node.
+func getRedisValues(ctx context.Context, redisDB redis.UniversalClient, keys []string) (map[string]string, []string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	values := make(map[string]string, len(keys))
+	var misses []string
+	_, cluster := redisDB.(*redis.ClusterClient)
+	for start := 0; start < len(keys); start += redisBatchSize {
+		chunk := keys[start:min(start+redisBatchSize, len(keys))]
+		var vals []interface{}
+		if cluster {
+			cmds := make([]*redis.StringCmd, len(chunk))
+			_, err := redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+				for i, key := range chunk {
+					cmds[i] = pipe.Get(ctx, key)
+				}
+				return nil
+			})
+			if err != nil && err != redis.Nil {
+				return nil, nil, err
+			}
+			for _, cmd := range cmds {
+				if val, err := cmd.Result(); err == nil {
+					vals = append(vals, val)
+				} else {
+					vals = append(vals, nil)
+				}
+			}
+		} else {
+			var err error
+			if vals, err = redisDB.MGet(ctx, chunk...).Result(); err != nil {
+				return nil, nil, err
+			}
+		}
+		for i, v := range vals {
+			val, ok := v.(string)
+			if !ok {
+				misses = append(misses, chunk[i])
+				continue
+			}
+			val, err := decodeValue(val)
+			if err != nil {
+				return nil, nil, err
+			}
+			values[chunk[i]] = val
+		}
+	}
+	return values, misses, nil
+}
+
+// getRedisHashes reads every field of several hashes in one pipeline per
+// redisBatchSize keys. Missing keys are returned in misses and keys still
+// holding a plain string value in legacy.
+func getRedisHashes(ctx context.Context, redisDB redis.UniversalClient, keys []string) (hashes map[string]map[string]string, misses []string, legacy []string, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	hashes = make(map[string]map[string]string, len(keys))
+	for start := 0; start < len(keys); start += redisBatchSize {
+		chunk := keys[start:min(start+redisBatchSize, len(keys))]
+		cmds := make([]*redis.MapStringStringCmd, len(chunk))
+		redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range chunk {
+				cmds[i] = pipe.HGetAll(ctx, key)
+			}
+			return nil
+		})
+		for i, cmd := range cmds {
+			fields, err := cmd.Result()
+			switch {
+			case err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE"):
+				legacy = append(legacy, chunk[i])
+				continue
+			case err != nil:
+				return nil, nil, nil, err
+			case len(fields) == 0:
+				misses = append(misses, chunk[i])
+				continue
+			}
+			for name, val := range fields {
+				if fields[name], err = decodeValue(val); err != nil {
+					return nil, nil, nil, err
+				}
+			}
+			hashes[chunk[i]] = fields
+		}
+	}
+	return hashes, misses, legacy, nil
+}
+
+// deleteRedisPattern removes every key matching pattern using SCAN so that a
+// large keyspace does not block Redis the way KEYS would.
+func deleteRedisPattern(ctx context.Context, redisDB redis.UniversalClient, pattern string) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if cluster, ok := redisDB.(*redis.ClusterClient); ok {
+		var deleted int64
+		var mu sync.Mutex
+		err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			n, err := deleteRedisPatternNode(ctx, node, pattern, true)
+			mu.Lock()
+			deleted += n
+			mu.Unlock()
+			return err
+		})
+		return deleted, err
+	}
+	return deleteRedisPatternNode(ctx, redisDB, pattern, false)
+}
+
+// deleteRedisPatternNode runs the SCAN+DEL loop against a single node. In
+// cluster mode SCAN only covers the node it is sent to.
+func deleteRedisPatternNode(ctx context.Context, redisDB redis.Cmdable, pattern string, cluster bool) (int64, error) {
+	var deleted int64
+	var cursor uint64
+	for {
+		keys, next, err := redisDB.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			return deleted, err
+		}
+		if len(keys) > 0 {
+			n, err := deleteRedisKeys(ctx, redisDB, keys, cluster)
+			if err != nil {
+				return deleted, err
+			}
+			deleted += n
+		}
+		cursor = next
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// deleteRedisKeys deletes keys with a single DEL. A cluster node rejects a
+// DEL spanning several hash slots, so in cluster mode each key gets its own
+// DEL within one pipeline.
+func deleteRedisKeys(ctx context.Context, redisDB redis.Cmdable, keys []string, cluster bool) (int64, error) {
+	if !cluster {
+		return redisDB.Del(ctx, keys...).Result()
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			cmds[i] = pipe.Del(ctx, key)
+		}
+		return nil
+	})
+	var deleted int64
+	for _, cmd := range cmds {
+		deleted += cmd.Val()
+	}
+	return deleted, err
 }
@@ -0,0 +1,1024 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
+)
+
+func TestDrain(t *testing.T) {
+	tests := []struct {
+		name    string
+		work    time.Duration
+		timeout time.Duration
+		wantErr bool
+	}{
+		{name: "in-flight request finishes", work: 200 * time.Millisecond, timeout: 2 * time.Second},
+		{name: "timeout exceeded", work: time.Second, timeout: 100 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			started := make(chan struct{})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(tt.work)
+				w.Write([]byte("done"))
+			})}
+			go server.Serve(ln)
+			url := "http://" + ln.Addr().String()
+
+			status := make(chan int, 1)
+			go func() {
+				res, err := http.Get(url)
+				if err != nil {
+					status <- 0
+					return
+				}
+				res.Body.Close()
+				status <- res.StatusCode
+			}()
+			<-started
+
+			probes := &probeState{}
+			err = drain(server, probes, Config{ShutdownTimeout: tt.timeout})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("drain() error = %v, want error %v", err, tt.wantErr)
+			}
+			if !probes.draining.Load() || !probes.stopping.Load() {
+				t.Error("drain() left the probes passing")
+			}
+			if !tt.wantErr {
+				if got := <-status; got != http.StatusOK {
+					t.Errorf("in-flight request got status %d, want 200", got)
+				}
+			}
+			if _, err := net.DialTimeout("tcp", ln.Addr().String(), time.Second); err == nil {
+				t.Error("new connections are still accepted after drain()")
+			}
+		})
+	}
+}
+
+func TestMissWithoutAPIKey(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	var group singleflight.Group
+	next := func(w http.ResponseWriter, r *http.Request) { t.Error("a miss without API_KEY went to the provider") }
+	h := redisMiddleware(next, parseWeatherQuery, cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg)
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodGet, "/weather?country=istanbul", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status = %d, want 503", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "300" {
+		t.Errorf("Retry-After = %q, want 300", got)
+	}
+	var body map[string]apiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if e := body["error"]; e.Code != "upstream_unconfigured" || e.RetryAfterSeconds != 300 {
+		t.Errorf("error = %+v, want upstream_unconfigured retrying after 300s", e)
+	}
+}
+
+// stubProvider replaces the provider with one that answers every request
+// after delay, with testWeather or an error when status is not 200, and
+// returns the number of calls it got.
+func stubProvider(t *testing.T, delay time.Duration, status int) *atomic.Int64 {
+	t.Helper()
+	body, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		body = []byte("Internal error")
+	}
+	var calls atomic.Int64
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		time.Sleep(delay)
+		return &http.Response{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(bytes.NewReader(body)),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	t.Setenv("API_KEY", "test")
+	return &calls
+}
+
+// recordProvider is stubProvider answering every call with testWeather,
+// returning the URLs the provider was called with.
+func recordProvider(t *testing.T) func() []*url.URL {
+	t.Helper()
+	body, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fixtureProvider(t, string(body))
+}
+
+// fixtureProvider is recordProvider answering every call with fixture, a
+// response body as the provider sends it.
+func fixtureProvider(t *testing.T, fixture string) func() []*url.URL {
+	t.Helper()
+	var mu sync.Mutex
+	var urls []*url.URL
+	transport := http.DefaultTransport
+	http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		urls = append(urls, r.URL)
+		mu.Unlock()
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"application/json"}},
+			Body:       io.NopCloser(strings.NewReader(fixture)),
+			Request:    r,
+		}, nil
+	})
+	t.Cleanup(func() { http.DefaultTransport = transport })
+	t.Setenv("API_KEY", "test")
+	return func() []*url.URL {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]*url.URL(nil), urls...)
+	}
+}
+
+// testLookup returns the /weather lookup, the cache and the fetch behind it,
+// over a cache on miniredis.
+func testLookup(t *testing.T, cfg Config) (http.HandlerFunc, *tieredCache, *miniredis.Miniredis) {
+	t.Helper()
+	cache, mr := newTestCache(t, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	return redisMiddleware(fetchHandler(cache, group, budget, cfg), parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg), cache, mr
+}
+
+// serveGet sends h a GET of target, with the headers of header in pairs.
+func serveGet(h http.Handler, target string, header ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, target, nil)
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// TestConcurrentMissesFetchOnce sends many requests for a location that is
+// not cached at once, and checks that they share a single provider call and
+// its result, be it an error.
+func TestConcurrentMissesFetchOnce(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		wantStatus int
+	}{
+		{name: "success", status: http.StatusOK, wantStatus: http.StatusOK},
+		{name: "provider error", status: http.StatusInternalServerError, wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubProvider(t, 100*time.Millisecond, tt.status)
+			cfg := testConfig(t)
+			cache, _ := newTestCache(t, cfg)
+			var group singleflight.Group
+			budget := newUpstreamBudget(0, 0, time.UTC, nil)
+			h := redisMiddleware(fetchHandler(cache, &group, budget, cfg), parseWeatherQuery, cache, &group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+			const requests = 50
+			var wg sync.WaitGroup
+			bodies := make([]string, requests)
+			codes := make([]int, requests)
+			for i := range requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rec := httptest.NewRecorder()
+					h(rec, httptest.NewRequest(http.MethodGet, "/weather?country=Istanbul", nil))
+					codes[i], bodies[i] = rec.Code, rec.Body.String()
+				}()
+			}
+			wg.Wait()
+			if got := calls.Load(); got != 1 {
+				t.Errorf("provider called %d times, want 1", got)
+			}
+			for i := range requests {
+				if codes[i] != tt.wantStatus {
+					t.Fatalf("request %d got status %d, want %d", i, codes[i], tt.wantStatus)
+				}
+				if tt.wantStatus == http.StatusOK && bodies[i] != bodies[0] {
+					t.Fatalf("request %d got a different body", i)
+				}
+			}
+			_, cached := cache.Get(context.Background(), defaultQuery("Istanbul").cacheKey())
+			if cached != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("cached = %v after a %d", cached, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequestTTL(t *testing.T) {
+	const ttl = 5 * time.Minute
+	tests := []struct {
+		maxAge  string
+		want    time.Duration
+		wantErr bool
+	}{
+		{maxAge: "", want: ttl},
+		{maxAge: "30", want: 30 * time.Second},
+		{maxAge: "300", want: ttl},
+		{maxAge: "86400", want: ttl},
+		{maxAge: "99999999999999999999999", want: ttl},
+		{maxAge: "0", wantErr: true},
+		{maxAge: "-30", wantErr: true},
+		{maxAge: "-99999999999999999999999", wantErr: true},
+		{maxAge: "1.5", wantErr: true},
+		{maxAge: "soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run("max_age="+tt.maxAge, func(t *testing.T) {
+			got, err := requestTTL(httptest.NewRequest(http.MethodGet, "/weather?max_age="+tt.maxAge, nil), ttl)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("requestTTL() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("requestTTL() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMaxAgeOverride checks the TTL a miss is cached for, from CACHE_TTL and
+// the max_age parameter.
+func TestMaxAgeOverride(t *testing.T) {
+	tests := []struct {
+		name       string
+		cacheTTL   string
+		maxAge     string
+		wantStatus int
+		wantTTL    string
+	}{
+		{name: "configured", cacheTTL: "2m", wantStatus: http.StatusOK, wantTTL: "120"},
+		{name: "shortened", cacheTTL: "2m", maxAge: "45", wantStatus: http.StatusOK, wantTTL: "45"},
+		{name: "clamped", cacheTTL: "2m", maxAge: "3600", wantStatus: http.StatusOK, wantTTL: "120"},
+		{name: "clamped from out of range", cacheTTL: "2m", maxAge: "99999999999999999999999", wantStatus: http.StatusOK, wantTTL: "120"},
+		{name: "invalid", cacheTTL: "2m", maxAge: "-1", wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubProvider(t, 0, http.StatusOK)
+			t.Setenv("CACHE_TTL", tt.cacheTTL)
+			h, cache, _ := testLookup(t, testConfig(t))
+			target := "/weather?country=istanbul"
+			if tt.maxAge != "" {
+				target += "&max_age=" + tt.maxAge
+			}
+			rec := serveGet(h, target)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("X-Cache-TTL"); got != tt.wantTTL {
+				t.Errorf("X-Cache-TTL = %q, want %q", got, tt.wantTTL)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			val, _ := cache.Get(context.Background(), defaultQuery("istanbul").cacheKey())
+			entry, _ := decodeCacheEntry(val)
+			want, _ := time.ParseDuration(tt.wantTTL + "s")
+			// The entry's TTL is jittered by up to a tenth either way.
+			if fresh := entry.FreshUntil.Sub(entry.FetchedAt); fresh < want*9/10 || fresh > want*11/10 {
+				t.Errorf("entry is fresh for %v, want about %v", fresh, want)
+			}
+		})
+	}
+}
+
+// entryFreshUntil encodes testWeather as an entry fetched a minute before
+// freshUntil.
+func entryFreshUntil(t *testing.T, freshUntil time.Time) []byte {
+	t.Helper()
+	data, _ := json.Marshal(testWeather)
+	entry, err := json.Marshal(cacheEntry{FetchedAt: freshUntil.Add(-time.Minute), FreshUntil: freshUntil, Provider: weatherProvider, Payload: data, ETag: payloadETag(data)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entry
+}
+
+// TestStaleWhileRevalidate serves a fresh entry as it is, a stale one while
+// a single refresh runs in the background, and fetches an expired one.
+func TestStaleWhileRevalidate(t *testing.T) {
+	key := defaultQuery("istanbul").cacheKey()
+	t.Run("fresh hit", func(t *testing.T) {
+		calls := stubProvider(t, 0, http.StatusOK)
+		h, cache, _ := testLookup(t, testConfig(t))
+		cache.Set(context.Background(), key, entryFreshUntil(t, time.Now().Add(time.Minute)), time.Hour)
+		rec := serveGet(h, "/weather?country=istanbul")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("X-Stale") != "" {
+			t.Errorf("status = %d, X-Cache = %q and X-Stale = %q, want a fresh 200 hit", rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("X-Stale"))
+		}
+		time.Sleep(50 * time.Millisecond)
+		if got := calls.Load(); got != 0 {
+			t.Errorf("provider called %d times, want 0", got)
+		}
+	})
+	t.Run("stale hit", func(t *testing.T) {
+		calls := stubProvider(t, 100*time.Millisecond, http.StatusOK)
+		h, cache, _ := testLookup(t, testConfig(t))
+		stale := entryFreshUntil(t, time.Now().Add(-time.Minute))
+		cache.Set(context.Background(), key, stale, time.Hour)
+		for i := range 5 {
+			rec := serveGet(h, "/weather?country=istanbul")
+			if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" || rec.Header().Get("X-Stale") != "true" {
+				t.Fatalf("request %d: status = %d, X-Cache = %q and X-Stale = %q, want a stale 200 hit", i+1, rec.Code, rec.Header().Get("X-Cache"), rec.Header().Get("X-Stale"))
+			}
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			val, _ := cache.Get(context.Background(), key)
+			if entry, ok := decodeCacheEntry(val); ok && time.Now().Before(entry.FreshUntil) {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("the stale entry was not refreshed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("provider called %d times, want a single refresh", got)
+		}
+		if rec := serveGet(h, "/weather?country=istanbul"); rec.Header().Get("X-Stale") != "" {
+			t.Error("the refreshed entry is still served stale")
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		calls := stubProvider(t, 0, http.StatusOK)
+		cfg := testConfig(t)
+		cfg.LocalCacheSize = 0
+		h, cache, mr := testLookup(t, cfg)
+		cache.Set(context.Background(), key, entryFreshUntil(t, time.Now().Add(-time.Minute)), time.Minute)
+		mr.FastForward(2 * time.Minute)
+		rec := serveGet(h, "/weather?country=istanbul")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "MISS" {
+			t.Errorf("status = %d and X-Cache = %q, want a 200 miss", rec.Code, rec.Header().Get("X-Cache"))
+		}
+		if got := calls.Load(); got != 1 {
+			t.Errorf("provider called %d times, want 1", got)
+		}
+	})
+}
+
+// TestCacheHeaders checks the X-Cache and Age headers of a miss and of the
+// hits that follow it.
+func TestCacheHeaders(t *testing.T) {
+	stubProvider(t, 0, http.StatusOK)
+	h, cache, _ := testLookup(t, testConfig(t))
+
+	miss := serveGet(h, "/weather?country=istanbul")
+	if got := miss.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("miss: X-Cache = %q, want MISS", got)
+	}
+	if got := miss.Header().Get("Age"); got != "" {
+		t.Errorf("miss: Age = %q, want none", got)
+	}
+	hit := serveGet(h, "/weather?country=istanbul")
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("hit: X-Cache = %q, want HIT", got)
+	}
+	if got := hit.Header().Get("Age"); got != "0" {
+		t.Errorf("hit right after the miss: Age = %q, want 0", got)
+	}
+
+	// An entry fetched 40 seconds ago.
+	cache.Set(context.Background(), defaultQuery("ankara").cacheKey(), entryFreshUntil(t, time.Now().Add(20*time.Second)), time.Hour)
+	hit = serveGet(h, "/weather?country=ankara")
+	if got := hit.Header().Get("X-Cache"); got != "HIT" {
+		t.Errorf("older hit: X-Cache = %q, want HIT", got)
+	}
+	if age, err := strconv.Atoi(hit.Header().Get("Age")); err != nil || age < 39 || age > 41 {
+		t.Errorf("older hit: Age = %q, want about 40", hit.Header().Get("Age"))
+	}
+}
+
+// TestNegativeCache checks a location the provider rejects is not asked
+// for again until its negative entry expires.
+func TestNegativeCache(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusBadRequest)
+	cfg := testConfig(t)
+	cfg.NegativeCacheTTL = time.Minute
+	cfg.LocalCacheSize = 0
+	h, _, mr := testLookup(t, cfg)
+
+	for i := 1; i <= 2; i++ {
+		if rec := serveGet(h, "/weather?country=nowhere"); rec.Code != http.StatusBadRequest {
+			t.Fatalf("request %d: status = %d, want 400", i, rec.Code)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times within the negative TTL, want 1", got)
+	}
+	mr.FastForward(cfg.NegativeCacheTTL + time.Second)
+	if rec := serveGet(h, "/weather?country=nowhere"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("after expiry: status = %d, want 400", rec.Code)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("provider called %d times after the negative entry expired, want 2", got)
+	}
+}
+
+// TestCacheTTLCountsDown checks X-Cache-TTL reports the time left, not the
+// TTL the entry was stored with.
+func TestCacheTTLCountsDown(t *testing.T) {
+	stubProvider(t, 0, http.StatusOK)
+	h, _, _ := testLookup(t, testConfig(t))
+	serveGet(h, "/weather?country=istanbul")
+
+	remaining := func() int {
+		t.Helper()
+		rec := serveGet(h, "/weather?country=istanbul")
+		if got := rec.Header().Get("X-Cache"); got != "HIT" {
+			t.Fatalf("X-Cache = %q, want HIT", got)
+		}
+		n, err := strconv.Atoi(rec.Header().Get("X-Cache-TTL"))
+		if err != nil {
+			t.Fatalf("X-Cache-TTL = %q: %v", rec.Header().Get("X-Cache-TTL"), err)
+		}
+		return n
+	}
+	first := remaining()
+	time.Sleep(1100 * time.Millisecond)
+	if second := remaining(); second >= first {
+		t.Errorf("X-Cache-TTL went from %d to %d over a second, want it to decrease", first, second)
+	}
+}
+
+// TestForcedRefresh checks refresh=true is ignored without the admin token,
+// and with it refetches and replaces the cached entry.
+func TestForcedRefresh(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.AdminToken = "secret"
+	h, cache, _ := testLookup(t, cfg)
+	key := defaultQuery("istanbul").cacheKey()
+	seeded := entryFreshUntil(t, time.Now().Add(time.Hour))
+	cache.Set(context.Background(), key, seeded, time.Hour)
+
+	tests := []struct {
+		name      string
+		header    []string
+		wantCache string
+		wantCalls int64
+	}{
+		{name: "no token", wantCache: "HIT", wantCalls: 0},
+		{name: "wrong token", header: []string{"X-Admin-Token", "guess"}, wantCache: "HIT", wantCalls: 0},
+		{name: "admin token", header: []string{"X-Admin-Token", "secret"}, wantCache: "BYPASS", wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveGet(h, "/weather?country=istanbul&refresh=true", tt.header...)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("X-Cache = %q, want %s", got, tt.wantCache)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+
+	val, err := cache.backend.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("reading the refreshed entry: %v", err)
+	}
+	old, _ := decodeCacheEntry(seeded)
+	if entry, _ := decodeCacheEntry(val); entry.FetchedAt.Equal(old.FetchedAt) {
+		t.Errorf("the entry fetched at %v was not replaced", entry.FetchedAt)
+	}
+}
+
+// TestCacheControlBypass checks each Cache-Control directive a client can
+// send to skip the cache, and that bypasses pass the stricter bypass limit.
+func TestCacheControlBypass(t *testing.T) {
+	key := defaultQuery("istanbul").cacheKey()
+	tests := []struct {
+		name         string
+		cacheControl string
+		wantCache    string
+		wantCalls    int64
+		wantReplaced bool
+	}{
+		{name: "none", wantCache: "HIT"},
+		{name: "max-age only", cacheControl: "max-age=0", wantCache: "HIT"},
+		{name: "no-cache", cacheControl: "no-cache", wantCache: "BYPASS", wantCalls: 1, wantReplaced: true},
+		{name: "no-cache among others", cacheControl: "max-age=0, No-Cache", wantCache: "BYPASS", wantCalls: 1, wantReplaced: true},
+		{name: "no-store", cacheControl: "no-store", wantCache: "BYPASS", wantCalls: 1},
+		{name: "both", cacheControl: "no-cache, no-store", wantCache: "BYPASS", wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := stubProvider(t, 0, http.StatusOK)
+			h, cache, _ := testLookup(t, testConfig(t))
+			seeded := entryFreshUntil(t, time.Now().Add(time.Hour))
+			cache.Set(context.Background(), key, seeded, time.Hour)
+
+			rec := serveGet(h, "/weather?country=istanbul", "Cache-Control", tt.cacheControl)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rec.Code)
+			}
+			if got := rec.Header().Get("X-Cache"); got != tt.wantCache {
+				t.Errorf("X-Cache = %q, want %s", got, tt.wantCache)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("provider called %d times, want %d", got, tt.wantCalls)
+			}
+			val, err := cache.backend.Get(context.Background(), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if replaced := !bytes.Equal(val, seeded); replaced != tt.wantReplaced {
+				t.Errorf("entry replaced = %v, want %v", replaced, tt.wantReplaced)
+			}
+		})
+	}
+
+	t.Run("bypass limit", func(t *testing.T) {
+		stubProvider(t, 0, http.StatusOK)
+		cfg := testConfig(t)
+		cache, _ := newTestCache(t, cfg)
+		cache.Set(context.Background(), key, entryFreshUntil(t, time.Now().Add(time.Hour)), time.Hour)
+		group := new(singleflight.Group)
+		budget := newUpstreamBudget(0, 0, time.UTC, nil)
+		fetch := bypassLimiterMiddleware(fetchHandler(cache, group, budget, cfg), testLimiter("bypass", rate.Every(time.Hour), 1))
+		h := redisMiddleware(fetch, parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+		for i, tt := range []struct {
+			cacheControl string
+			wantStatus   int
+		}{
+			{cacheControl: "no-cache", wantStatus: http.StatusOK},
+			{cacheControl: "no-store", wantStatus: http.StatusTooManyRequests},
+			{cacheControl: "", wantStatus: http.StatusOK},
+		} {
+			if rec := serveGet(h, "/weather?country=istanbul", "Cache-Control", tt.cacheControl); rec.Code != tt.wantStatus {
+				t.Errorf("request %d (%q): status = %d, want %d", i+1, tt.cacheControl, rec.Code, tt.wantStatus)
+			}
+		}
+	})
+}
+
+// TestCancelledRequest cancels requests while the provider is answering.
+// A bypass fetches on the request's context, so the provider sees it
+// cancelled. A shared fetch carries on for the others waiting on it, but
+// the cancelled request stops waiting. Either way the handler returns at
+// once.
+func TestCancelledRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		cacheControl  string
+		wantCancelled bool
+	}{
+		{name: "bypass", cacheControl: "no-store", wantCancelled: true},
+		{name: "shared fetch", wantCancelled: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			upstreamErr := make(chan error, 1)
+			transport := http.DefaultTransport
+			http.DefaultTransport = roundTripFunc(func(r *http.Request) (*http.Response, error) {
+				close(started)
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+				upstreamErr <- r.Context().Err()
+				return nil, errors.New("provider unavailable")
+			})
+			t.Cleanup(func() { http.DefaultTransport = transport })
+			t.Setenv("API_KEY", "test")
+			h, _, _ := testLookup(t, testConfig(t))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			r := httptest.NewRequest(http.MethodGet, "/weather?country=istanbul", nil).WithContext(ctx)
+			if tt.cacheControl != "" {
+				r.Header.Set("Cache-Control", tt.cacheControl)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				h.ServeHTTP(httptest.NewRecorder(), r)
+			}()
+			<-started
+			cancel()
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Fatal("the handler did not return after the request was cancelled")
+			}
+
+			close(release)
+			select {
+			case err := <-upstreamErr:
+				if cancelled := err != nil; cancelled != tt.wantCancelled {
+					t.Errorf("provider saw its context cancelled = %v, want %v", cancelled, tt.wantCancelled)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("the provider call never finished")
+			}
+		})
+	}
+}
+
+// TestMissLimiter nests the limiters as serve does: a client can read a
+// cached location as fast as the outer limit allows, but is throttled once
+// it forces misses on many locations, and can still read cached ones.
+func TestMissLimiter(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), entryFreshUntil(t, time.Now().Add(time.Hour)), time.Hour)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	fetch := rateLimiterMiddleware(fetchHandler(cache, group, budget, cfg), testLimiter("miss", 0.5, 2))
+	h := rateLimiterMiddleware(redisMiddleware(fetch, parseWeatherQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg), testLimiter("weather", 100, 100))
+
+	for i := 0; i < 20; i++ {
+		if rec := serveGet(h, "/weather?country=istanbul"); rec.Code != http.StatusOK || rec.Header().Get("X-Cache") != "HIT" {
+			t.Fatalf("cached read %d: status %d, X-Cache %q", i+1, rec.Code, rec.Header().Get("X-Cache"))
+		}
+	}
+	throttled := 0
+	for i := 0; i < 10; i++ {
+		rec := serveGet(h, fmt.Sprintf("/weather?country=city%02d", i))
+		switch {
+		case rec.Code == http.StatusTooManyRequests:
+			throttled++
+		case i >= 2:
+			t.Errorf("miss %d: status = %d, want 429 past the miss burst", i+1, rec.Code)
+		}
+	}
+	if throttled != 8 {
+		t.Errorf("%d of 10 misses throttled, want 8", throttled)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("provider called %d times, want 2", got)
+	}
+	if rec := serveGet(h, "/weather?country=istanbul"); rec.Code != http.StatusOK {
+		t.Errorf("cached read after the misses: status = %d, want 200", rec.Code)
+	}
+}
+
+// TestUnitsLookup checks the requested units reach the provider as unitGroup
+// and that each unit group is cached on its own.
+func TestUnitsLookup(t *testing.T) {
+	urls := recordProvider(t)
+	h, cache, _ := testLookup(t, testConfig(t))
+
+	for _, target := range []string{
+		"/weather?country=istanbul&units=metric",
+		"/weather?country=istanbul&units=us",
+		"/weather?country=istanbul&units=metric",
+		"/weather?country=istanbul&unitGroup=us",
+	} {
+		if rec := serveGet(h, target); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", target, rec.Code)
+		}
+	}
+	var groups []string
+	for _, u := range urls() {
+		groups = append(groups, u.Query().Get("unitGroup"))
+	}
+	if want := []string{"metric", "us"}; !slices.Equal(groups, want) {
+		t.Errorf("provider asked for unit groups %v, want %v", groups, want)
+	}
+
+	metric, us := defaultQuery("istanbul"), defaultQuery("istanbul")
+	metric.Units, us.Units = "metric", "us"
+	if metric.cacheKey() == us.cacheKey() {
+		t.Fatalf("metric and us share the cache key %q", metric.cacheKey())
+	}
+	for _, q := range []weatherQuery{metric, us} {
+		if _, ok := cache.Get(context.Background(), q.cacheKey()); !ok {
+			t.Errorf("%s not cached", q.cacheKey())
+		}
+	}
+}
+
+// TestLangLookup checks the requested language reaches the provider and
+// that each language is cached on its own.
+func TestLangLookup(t *testing.T) {
+	urls := recordProvider(t)
+	h, cache, _ := testLookup(t, testConfig(t))
+
+	for _, target := range []string{
+		"/weather?country=istanbul&lang=tr",
+		"/weather?country=istanbul&lang=de",
+		"/weather?country=istanbul&lang=tr",
+	} {
+		if rec := serveGet(h, target); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", target, rec.Code)
+		}
+	}
+	if rec := serveGet(h, "/weather?country=istanbul&lang=xx"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown lang: status = %d, want 400", rec.Code)
+	}
+	var langs []string
+	for _, u := range urls() {
+		langs = append(langs, u.Query().Get("lang"))
+	}
+	if want := []string{"tr", "de"}; !slices.Equal(langs, want) {
+		t.Errorf("provider asked for languages %v, want %v", langs, want)
+	}
+
+	tr, de := defaultQuery("istanbul"), defaultQuery("istanbul")
+	tr.Lang, de.Lang = "tr", "de"
+	if tr.cacheKey() == de.cacheKey() {
+		t.Fatalf("tr and de share the cache key %q", tr.cacheKey())
+	}
+	for _, q := range []weatherQuery{tr, de} {
+		if _, ok := cache.Get(context.Background(), q.cacheKey()); !ok {
+			t.Errorf("%s not cached", q.cacheKey())
+		}
+	}
+}
+
+// hourlyFixture is a provider response for include=hours, trimmed to three
+// hours of one day.
+const hourlyFixture = `{
+  "queryCost": 1,
+  "latitude": 41.0091,
+  "longitude": 28.9655,
+  "resolvedAddress": "İstanbul, Türkiye",
+  "address": "istanbul",
+  "timezone": "Europe/Istanbul",
+  "tzoffset": 3.0,
+  "description": "Similar temperatures continuing with no rain expected.",
+  "days": [
+    {
+      "datetime": "2024-06-15",
+      "datetimeEpoch": 1718398800,
+      "tempmax": 27.4,
+      "tempmin": 19.1,
+      "temp": 23.2,
+      "feelslike": 23.2,
+      "humidity": 61.3,
+      "windspeed": 24.1,
+      "visibility": 13.8,
+      "uvindex": 9.0,
+      "sunrise": "05:31:02",
+      "sunset": "20:38:47",
+      "conditions": "Partially cloudy",
+      "description": "Partly cloudy throughout the day.",
+      "icon": "partly-cloudy-day",
+      "hours": [
+        {"datetime": "00:00:00", "datetimeEpoch": 1718398800, "temp": 20.1, "feelslike": 20.1, "humidity": 73.5, "precip": 0.0, "precipprob": 0.0, "windspeed": 14.8, "conditions": "Clear", "icon": "clear-night"},
+        {"datetime": "01:00:00", "datetimeEpoch": 1718402400, "temp": 19.8, "feelslike": 19.8, "humidity": 75.2, "precip": 0.0, "precipprob": 3.2, "windspeed": 13.3, "conditions": "Partially cloudy", "icon": "partly-cloudy-night"},
+        {"datetime": "02:00:00", "datetimeEpoch": 1718406000, "temp": 19.5, "feelslike": 19.5, "humidity": 76.9, "precip": 0.1, "precipprob": 19.4, "windspeed": 11.9, "conditions": "Rain, Partially cloudy", "icon": "rain"}
+      ]
+    }
+  ],
+  "stations": {}
+}`
+
+func TestHourlyFixture(t *testing.T) {
+	var w Weather
+	if err := json.Unmarshal([]byte(hourlyFixture), &w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Days) != 1 {
+		t.Fatalf("got %d days, want 1", len(w.Days))
+	}
+	day := w.Days[0]
+	if day.Datetime != "2024-06-15" || day.Temp != 23.2 || day.Sunrise != "05:31:02" {
+		t.Errorf("day = %+v", day)
+	}
+	want := []Hour{
+		{Datetime: "00:00:00", Temp: 20.1, FeelsLike: 20.1, PrecipProb: 0, WindSpeed: 14.8, Icon: "clear-night", Conditions: "Clear"},
+		{Datetime: "01:00:00", Temp: 19.8, FeelsLike: 19.8, PrecipProb: 3.2, WindSpeed: 13.3, Icon: "partly-cloudy-night", Conditions: "Partially cloudy"},
+		{Datetime: "02:00:00", Temp: 19.5, FeelsLike: 19.5, PrecipProb: 19.4, WindSpeed: 11.9, Icon: "rain", Conditions: "Rain, Partially cloudy"},
+	}
+	if !slices.Equal(day.Hours, want) {
+		t.Errorf("hours = %+v, want %+v", day.Hours, want)
+	}
+}
+
+// TestHourlyLookup serves /weather/hourly from the fixture and checks the
+// provider is asked for hours and the hours come back.
+func TestHourlyLookup(t *testing.T) {
+	urls := fixtureProvider(t, hourlyFixture)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseHourlyQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+	rec := serveGet(h, "/weather/hourly?country=istanbul&date=2024-06-15")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	got := urls()
+	if len(got) != 1 {
+		t.Fatalf("provider called %d times, want 1", len(got))
+	}
+	if include := got[0].Query().Get("include"); include != "hours" {
+		t.Errorf("provider asked for include=%s, want hours", include)
+	}
+	if !strings.HasSuffix(got[0].Path, "/2024-06-15") {
+		t.Errorf("provider asked for %s", got[0].Path)
+	}
+	var w Weather
+	if err := json.Unmarshal(rec.Body.Bytes(), &w); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.Days) != 1 || len(w.Days[0].Hours) != 3 || w.Days[0].Hours[2].PrecipProb != 19.4 {
+		t.Errorf("response days = %+v, want the fixture's three hours", w.Days)
+	}
+}
+
+// currentFixture is a provider response for include=current.
+const currentFixture = `{
+  "queryCost": 1,
+  "latitude": 41.0091,
+  "longitude": 28.9655,
+  "resolvedAddress": "İstanbul, Türkiye",
+  "address": "istanbul",
+  "timezone": "Europe/Istanbul",
+  "tzoffset": 3.0,
+  "currentConditions": {
+    "datetime": "14:45:00",
+    "datetimeEpoch": 1718451900,
+    "temp": 26.3,
+    "feelslike": 26.3,
+    "humidity": 52.4,
+    "dew": 15.8,
+    "precip": 0.0,
+    "windspeed": 18.7,
+    "winddir": 40.0,
+    "pressure": 1012.0,
+    "visibility": 10.0,
+    "cloudcover": 38.0,
+    "uvindex": 7.0,
+    "conditions": "Partially cloudy",
+    "icon": "partly-cloudy-day",
+    "stations": ["LTBA"],
+    "source": "obs",
+    "sunrise": "05:31:02",
+    "sunset": "20:38:47"
+  }
+}`
+
+// TestCurrentFixture serves /weather/current from the fixture and checks
+// the conditions are parsed and cached for the current-conditions TTL,
+// which is shorter than a day's.
+func TestCurrentFixture(t *testing.T) {
+	urls := fixtureProvider(t, currentFixture)
+	cfg := testConfig(t)
+	cfg.CacheTTLJitter = 0
+	cache, _ := newTestCache(t, cfg)
+	group := new(singleflight.Group)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	h := redisMiddleware(fetchHandler(cache, group, budget, cfg), parseCurrentQuery, cache, group, budget, newHotKeys(), &cacheStats{}, cfg)
+
+	rec := serveGet(h, "/weather/current?country=istanbul")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := urls(); len(got) != 1 || got[0].Query().Get("include") != "current" || strings.HasSuffix(got[0].Path, "/current") {
+		t.Errorf("provider asked for %v, want include=current and no range", got)
+	}
+	var c Current
+	if err := json.Unmarshal(rec.Body.Bytes(), &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Datetime != "14:45:00" || c.DatetimeEpoch != 1718451900 || c.Temp != 26.3 || c.WindSpeed != 18.7 || c.Conditions != "Partially cloudy" || c.Icon != "partly-cloudy-day" {
+		t.Errorf("current = %+v", c)
+	}
+
+	ttl := cfg.TTLPolicy[dataCurrent]
+	if ttl >= cfg.TTLPolicy[dataToday] {
+		t.Fatalf("current TTL %s is not shorter than today's %s", ttl, cfg.TTLPolicy[dataToday])
+	}
+	if got := rec.Header().Get("X-Cache-TTL"); got != strconv.Itoa(int(ttl.Seconds())) {
+		t.Errorf("X-Cache-TTL = %s, want %d", got, int(ttl.Seconds()))
+	}
+	q := defaultQuery("istanbul")
+	q.Range, q.Include = "current", "current"
+	val, ok := cache.Get(context.Background(), q.cacheKey())
+	if !ok {
+		t.Fatalf("%s not cached", q.cacheKey())
+	}
+	entry, ok := decodeCacheEntry(val)
+	if !ok {
+		t.Fatal("cached entry could not be decoded")
+	}
+	if fresh := entry.FreshUntil.Sub(entry.FetchedAt); fresh != ttl {
+		t.Errorf("entry fresh for %s, want %s", fresh, ttl)
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	t.Setenv("SERVER_READ_TIMEOUT", "3s")
+	t.Setenv("SERVER_WRITE_TIMEOUT", "7s")
+	t.Setenv("SERVER_IDLE_TIMEOUT", "45s")
+	t.Setenv("SERVER_MAX_HEADER_BYTES", "4096")
+	server := newHTTPServer(testConfig(t), http.NotFoundHandler())
+	if server.ReadTimeout != 3*time.Second || server.ReadHeaderTimeout != 3*time.Second {
+		t.Errorf("read timeouts = %s, %s, want 3s", server.ReadTimeout, server.ReadHeaderTimeout)
+	}
+	if server.WriteTimeout != 7*time.Second {
+		t.Errorf("WriteTimeout = %s, want 7s", server.WriteTimeout)
+	}
+	if server.IdleTimeout != 45*time.Second {
+		t.Errorf("IdleTimeout = %s, want 45s", server.IdleTimeout)
+	}
+	if server.MaxHeaderBytes != 4096 {
+		t.Errorf("MaxHeaderBytes = %d, want 4096", server.MaxHeaderBytes)
+	}
+}
+
+// TestSlowClientTimedOut connects a client that sends its request too
+// slowly and checks the server's read timeout closes the connection.
+func TestSlowClientTimedOut(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.ServerReadTimeout = 200 * time.Millisecond
+	var served atomic.Int64
+	server := newHTTPServer(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			return
+		}
+		served.Add(1)
+	}))
+	ts := httptest.NewUnstartedServer(server.Handler)
+	ts.Config = server
+	ts.Start()
+	t.Cleanup(ts.Close)
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{name: "slow headers", request: "GET /weather HTTP/1.1\r\nHost: localhost\r\n"},
+		{name: "slow body", request: "POST /weather HTTP/1.1\r\nHost: localhost\r\nContent-Length: 10\r\n\r\nabc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadAll(conn); err != nil {
+				t.Fatalf("connection not closed by the server: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("connection closed after %s, want about %s", elapsed, cfg.ServerReadTimeout)
+			}
+		})
+	}
+	if n := served.Load(); n != 0 {
+		t.Errorf("%d requests served, want 0", n)
+	}
+}
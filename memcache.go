@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// memcacheMaxRelativeTTL is the longest expiration memcached accepts as a
+// number of seconds. Longer ones must be given as a unix timestamp.
+const memcacheMaxRelativeTTL = 30 * 24 * time.Hour
+
+// memcacheBackend stores cache entries in memcached. Memcached cannot match
+// keys, so the cache purge endpoint and key counts are unavailable with it.
+type memcacheBackend struct {
+	client   *memcache.Client
+	codec    cacheCodec
+	compress bool
+}
+
+func (b *memcacheBackend) Close() error {
+	return b.client.Close()
+}
+
+func newMemcacheBackend(cfg Config) *memcacheBackend {
+	client := memcache.New(cfg.MemcacheAddrs...)
+	client.Timeout = 3 * time.Second
+	return &memcacheBackend{client: client, codec: cacheCodecs[cfg.CacheCodec], compress: cfg.CacheCompression}
+}
+
+// memcacheKey maps key to a valid memcached key. Keys longer than 250 bytes
+// or containing spaces or control characters are replaced by their hash.
+func memcacheKey(key string) string {
+	valid := len(key) <= 250
+	for i := 0; valid && i < len(key); i++ {
+		valid = key[i] > ' ' && key[i] != 0x7f
+	}
+	if valid {
+		return key
+	}
+	sum := sha256.Sum256([]byte(key))
+	return cacheKeyPrefix + "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func (b *memcacheBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	item, err := b.client.Get(memcacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	val, err := decodeValue(string(item.Value))
+	if err != nil {
+		return nil, err
+	}
+	return []byte(val), nil
+}
+
+func (b *memcacheBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	value, err := b.codec.Encode(value)
+	if err != nil {
+		return err
+	}
+	if b.compress {
+		if value, err = compressValue(value); err != nil {
+			return err
+		}
+	}
+	expiration := int32(ttl / time.Second)
+	if ttl > memcacheMaxRelativeTTL {
+		expiration = int32(time.Now().Add(ttl).Unix())
+	}
+	return b.client.Set(&memcache.Item{Key: memcacheKey(key), Value: value, Expiration: expiration})
+}
+
+func (b *memcacheBackend) Delete(ctx context.Context, key string) error {
+	err := b.client.Delete(memcacheKey(key))
+	if err == memcache.ErrCacheMiss {
+		return nil
+	}
+	return err
+}
+
+func (b *memcacheBackend) Ping(ctx context.Context) error {
+	return b.client.Ping()
+}
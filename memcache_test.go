@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeMemcached serves the get, set, delete and version commands of the
+// memcached text protocol from memory, ignoring expiration, and returns
+// its address.
+func fakeMemcached(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	var mu sync.Mutex
+	items := map[string]string{}
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				return
+			}
+			mu.Lock()
+			switch args[0] {
+			case "get", "gets":
+				for _, key := range args[1:] {
+					if val, ok := items[key]; ok {
+						fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", key, len(val), val)
+					}
+				}
+				rw.WriteString("END\r\n")
+			case "set":
+				size, _ := strconv.Atoi(args[4])
+				data := make([]byte, size+2)
+				if _, err := io.ReadFull(rw, data); err != nil {
+					mu.Unlock()
+					return
+				}
+				items[args[1]] = string(data[:size])
+				rw.WriteString("STORED\r\n")
+			case "delete":
+				if _, ok := items[args[1]]; ok {
+					delete(items, args[1])
+					rw.WriteString("DELETED\r\n")
+				} else {
+					rw.WriteString("NOT_FOUND\r\n")
+				}
+			case "version":
+				rw.WriteString("VERSION 1.6.0-fake\r\n")
+			default:
+				rw.WriteString("ERROR\r\n")
+			}
+			mu.Unlock()
+			if rw.Flush() != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func TestMemcacheKey(t *testing.T) {
+	long := cacheKeyPrefix + strings.Repeat("x", 300)
+	tests := []struct {
+		name   string
+		key    string
+		hashed bool
+	}{
+		{name: "plain", key: defaultQuery("istanbul").cacheKey(), hashed: false},
+		{name: "space", key: cacheKeyPrefix + "new york:metric", hashed: true},
+		{name: "too long", key: long, hashed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := memcacheKey(tt.key)
+			if hashed := got != tt.key; hashed != tt.hashed {
+				t.Errorf("memcacheKey(%q) = %q, hashed = %v, want %v", tt.key, got, hashed, tt.hashed)
+			}
+			if len(got) > 250 || strings.ContainsAny(got, " \r\n") {
+				t.Errorf("memcacheKey(%q) = %q is not a valid memcached key", tt.key, got)
+			}
+		})
+	}
+}
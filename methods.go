@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// allowMethods serves the requests for methods with next and answers the
+// others with a 405 and the Allow header. GET allows HEAD as well, and a
+// plain OPTIONS, which is not a CORS preflight, is answered with Allow alone.
+func allowMethods(next http.Handler, methods ...string) http.HandlerFunc {
+	if slices.Contains(methods, http.MethodGet) && !slices.Contains(methods, http.MethodHead) {
+		methods = append(methods, http.MethodHead)
+	}
+	allow := strings.Join(append(methods, http.MethodOptions), ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if slices.Contains(methods, r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Allow", allow)
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		writeError(w, http.StatusMethodNotAllowed, apiError{Code: "method_not_allowed", Details: map[string]string{"allow": allow}})
+	}
+}
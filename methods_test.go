@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAllowMethods(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+	tests := []struct {
+		name      string
+		methods   []string
+		method    string
+		want      int
+		wantAllow string
+	}{
+		{name: "GET", methods: []string{http.MethodGet}, method: http.MethodGet, want: http.StatusOK},
+		{name: "HEAD with GET", methods: []string{http.MethodGet}, method: http.MethodHead, want: http.StatusOK},
+		{name: "POST to GET", methods: []string{http.MethodGet}, method: http.MethodPost, want: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD, OPTIONS"},
+		{name: "OPTIONS", methods: []string{http.MethodGet}, method: http.MethodOptions, want: http.StatusNoContent, wantAllow: "GET, HEAD, OPTIONS"},
+		{name: "DELETE only", methods: []string{http.MethodDelete}, method: http.MethodDelete, want: http.StatusOK},
+		{name: "GET to DELETE only", methods: []string{http.MethodDelete}, method: http.MethodGet, want: http.StatusMethodNotAllowed, wantAllow: "DELETE, OPTIONS"},
+		{name: "HEAD to DELETE only", methods: []string{http.MethodDelete}, method: http.MethodHead, want: http.StatusMethodNotAllowed, wantAllow: "DELETE, OPTIONS"},
+		{name: "PUT of several", methods: []string{http.MethodGet, http.MethodPut}, method: http.MethodPut, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			allowMethods(ok, tt.methods...)(rec, httptest.NewRequest(tt.method, "/cache", nil))
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if got := rec.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if tt.want != http.StatusMethodNotAllowed {
+				return
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if e := body["error"]; e.Code != "method_not_allowed" || e.Details["allow"] != tt.wantAllow {
+				t.Errorf("error = %+v, want method_not_allowed allowing %s", e, tt.wantAllow)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// TestMetricsScrape serves a few requests through metricsMiddleware and
+// scrapes /metrics, checking the request families carry the route, method
+// and status labels, and that scrapes are not counted.
+func TestMetricsScrape(t *testing.T) {
+	m := newHTTPMetrics()
+	m.registry.MustRegister(newLimiterStats())
+	mux := http.NewServeMux()
+	mux.Handle("/weather", allowMethods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("country") == "" {
+			http.Error(w, "country is required", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}), http.MethodGet))
+	mux.Handle(metricsPath, m.handler())
+	mux.Handle("/", http.NotFoundHandler())
+	h := metricsMiddleware(mux, mux, m)
+
+	for _, target := range []string{
+		"/weather?country=istanbul",
+		"/weather?country=ankara",
+		"/weather",
+		"/weather/nowhere?x=1",
+		metricsPath,
+	} {
+		serveGet(h, target)
+	}
+	rec := serveGet(h, metricsPath)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: status = %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE weather_http_requests_total counter",
+		"# TYPE weather_http_request_duration_seconds histogram",
+		"# TYPE weather_http_requests_in_flight gauge",
+		"# TYPE weather_ratelimit_decisions_total counter",
+		"# TYPE go_goroutines gauge",
+		"# TYPE go_build_info gauge",
+		`weather_http_requests_total{method="GET",route="/weather",status="200"} 2`,
+		`weather_http_requests_total{method="GET",route="/weather",status="400"} 1`,
+		`weather_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`weather_http_request_duration_seconds_count{method="GET",route="/weather"} 3`,
+		"weather_http_requests_in_flight 0",
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("scrape is missing %q", want)
+		}
+	}
+	if strings.Contains(body, `route="`+metricsPath+`"`) {
+		t.Errorf("scrapes are counted:\n%s", body)
+	}
+	if strings.Contains(body, "country=") || strings.Contains(body, "/weather/nowhere") {
+		t.Errorf("query strings or unknown paths leaked into the labels")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// renderers are the media types of each format responses can be rendered
+// in, the first being the one sent.
+var renderers = map[string][]string{
+	formatJSON: {"application/json"},
+	formatXML:  {"application/xml", "text/xml"},
+	formatCSV:  {"text/csv"},
+}
+
+// errNotAcceptable is returned by negotiate when no format offered is one
+// the request accepts.
+var errNotAcceptable = errors.New("no acceptable format")
+
+// acceptRange is a media range of an Accept header with its quality.
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header into its media ranges, in the order
+// they are listed. Ranges that do not parse are left out.
+func parseAccept(header string) []acceptRange {
+	var ranges []acceptRange
+	for _, accept := range strings.Split(header, ",") {
+		if strings.TrimSpace(accept) == "" {
+			continue
+		}
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality r's Accept ranges give mediaType, from
+// the most specific range that matches it, how specific that is and where
+// it is listed. The quality is 0 when no range matches.
+func acceptQuality(ranges []acceptRange, mediaType string) (q float64, specificity, position int) {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	specificity = -1
+	for i, ar := range ranges {
+		s := -1
+		switch {
+		case ar.mediaType == mediaType:
+			s = 2
+		case ar.mediaType == typ+"/*":
+			s = 1
+		case ar.mediaType == "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity, position = ar.q, s, i
+		}
+	}
+	return q, specificity, position
+}
+
+// negotiate picks the format of r's response among offered, which are in
+// the order the server prefers them. The format parameter, when given, wins
+// over Accept. Otherwise the type Accept gives the highest quality is
+// picked, ties going to the more specific range, then to the one listed
+// first. Without Accept the first format offered is picked.
+func negotiate(r *http.Request, offered ...string) (string, error) {
+	if v := r.URL.Query().Get("format"); v != "" {
+		if _, ok := renderers[v]; !ok {
+			return "", fmt.Errorf("format must be one of json, xml or csv")
+		}
+		if !slices.Contains(offered, v) {
+			return "", errNotAcceptable
+		}
+		return v, nil
+	}
+	ranges := parseAccept(r.Header.Get("Accept"))
+	if len(ranges) == 0 {
+		return offered[0], nil
+	}
+	best, bestQ, bestSpecificity, bestPosition := "", 0.0, -1, 0
+	for _, format := range offered {
+		for _, mediaType := range renderers[format] {
+			q, specificity, position := acceptQuality(ranges, mediaType)
+			if q <= 0 {
+				continue
+			}
+			better := q > bestQ ||
+				q == bestQ && specificity > bestSpecificity ||
+				q == bestQ && specificity == bestSpecificity && position < bestPosition
+			if best == "" || better {
+				best, bestQ, bestSpecificity, bestPosition = format, q, specificity, position
+			}
+		}
+	}
+	if best == "" {
+		return "", errNotAcceptable
+	}
+	return best, nil
+}
+
+// writeNegotiationError answers a request negotiate failed for, with a 406
+// listing the media types of offered when none was acceptable.
+func writeNegotiationError(w http.ResponseWriter, err error, offered []string) {
+	if !errors.Is(err, errNotAcceptable) {
+		writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+		return
+	}
+	var types []string
+	for _, format := range offered {
+		types = append(types, renderers[format]...)
+	}
+	writeError(w, http.StatusNotAcceptable, apiError{Code: "not_acceptable", Details: map[string]string{"supported": strings.Join(types, ", ")}})
+}
+
+// negotiateMiddleware refuses the requests for next that accept none of the
+// formats offered, which next renders itself.
+func negotiateMiddleware(next http.HandlerFunc, offered ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if _, err := negotiate(r, offered...); err != nil {
+			writeNegotiationError(w, err, offered)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	all := []string{formatJSON, formatXML, formatCSV}
+	tests := []struct {
+		name    string
+		query   string
+		accept  string
+		offered []string
+		want    string
+		wantErr bool
+		// wantNotAcceptable is set for the errors a 406 answers.
+		wantNotAcceptable bool
+	}{
+		{name: "default", want: formatJSON},
+		{name: "format parameter", query: "format=xml", want: formatXML},
+		{name: "parameter over Accept", query: "format=csv", accept: "application/xml", want: formatCSV},
+		{name: "parameter over unacceptable Accept", query: "format=json", accept: "image/png", want: formatJSON},
+		{name: "Accept", accept: "text/csv", want: formatCSV},
+		{name: "text/xml", accept: "text/xml", want: formatXML},
+		{name: "highest quality", accept: "application/json;q=0.5, text/csv;q=0.8, application/xml;q=0.2", want: formatCSV},
+		{name: "quality over order", accept: "text/html, application/xml;q=0.9, application/json", want: formatJSON},
+		{name: "order on equal quality", accept: "application/xml, application/json", want: formatXML},
+		{name: "wildcard", accept: "*/*", want: formatJSON},
+		{name: "type wildcard", accept: "text/*", want: formatXML},
+		{name: "specific over wildcard", accept: "*/*;q=0.9, text/csv;q=0.9", want: formatCSV},
+		{name: "excluded by q=0", accept: "application/json;q=0, */*", want: formatXML},
+		{name: "wildcard excluding one", accept: "*/*, application/json;q=0, application/xml;q=0, text/xml;q=0", want: formatCSV},
+		{name: "not offered", accept: "text/csv", offered: []string{formatJSON, formatXML}, wantErr: true, wantNotAcceptable: true},
+		{name: "parameter not offered", query: "format=csv", offered: []string{formatJSON}, wantErr: true, wantNotAcceptable: true},
+		{name: "unsupported Accept", accept: "text/html", wantErr: true, wantNotAcceptable: true},
+		{name: "unknown format", query: "format=yaml", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/weather?"+tt.query, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			offered := tt.offered
+			if offered == nil {
+				offered = all
+			}
+			got, err := negotiate(r, offered...)
+			if (err != nil) != tt.wantErr || errors.Is(err, errNotAcceptable) != tt.wantNotAcceptable {
+				t.Fatalf("negotiate() error = %v, want error %v, not acceptable %v", err, tt.wantErr, tt.wantNotAcceptable)
+			}
+			if got != tt.want {
+				t.Errorf("negotiate() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegotiateMiddleware(t *testing.T) {
+	h := negotiateMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}, formatJSON, formatXML)
+	tests := []struct {
+		name   string
+		target string
+		accept string
+		want   int
+	}{
+		{name: "acceptable", target: "/weather/batch", accept: "application/*", want: http.StatusOK},
+		{name: "not acceptable", target: "/weather/batch", accept: "text/csv, text/html", want: http.StatusNotAcceptable},
+		{name: "format not offered", target: "/weather/batch?format=csv", want: http.StatusNotAcceptable},
+		{name: "unknown format", target: "/weather/batch?format=yaml", want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.Header.Set("Accept", tt.accept)
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.want {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.want)
+			}
+			if rec.Code != http.StatusNotAcceptable {
+				return
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if got := body["error"].Details["supported"]; got != "application/json, application/xml, text/xml" {
+				t.Errorf("supported = %q, want the media types of JSON and XML", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxPageLimit is the most days a page may hold.
+const maxPageLimit = 100
+
+// pageMeta describes the page of days a response holds.
+type pageMeta struct {
+	TotalDays int  `json:"totalDays" xml:"totalDays"`
+	Offset    int  `json:"offset" xml:"offset"`
+	Limit     int  `json:"limit" xml:"limit"`
+	HasMore   bool `json:"hasMore" xml:"hasMore"`
+}
+
+// pageParams reads the offset and limit parameters of r. ok is false when
+// neither is given. Without a limit the page runs to the last day.
+func pageParams(r *http.Request) (offset, limit int, ok bool, err error) {
+	query := r.URL.Query()
+	if !query.Has("offset") && !query.Has("limit") {
+		return 0, 0, false, nil
+	}
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, false, fmt.Errorf("offset must be a number of days, 0 or more")
+		}
+	}
+	limit = -1
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxPageLimit {
+			return 0, 0, false, fmt.Errorf("limit must be a number between 1 and %d", maxPageLimit)
+		}
+	}
+	return offset, limit, true, nil
+}
+
+// pageMiddleware cuts the days of the Weather responses of next down to the
+// page the offset and limit parameters ask for, reporting it in the meta
+// block and linking the pages before and after it. The cache keeps every
+// day, which are only cut as they are sent.
+func pageMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		offset, limit, ok, err := pageParams(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		if !ok {
+			next(w, r)
+			return
+		}
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			return
+		}
+		var weather Weather
+		if buf.status != http.StatusOK || json.Unmarshal(buf.body.Bytes(), &weather) != nil {
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		total := len(weather.Days)
+		if limit < 0 {
+			limit = max(total-offset, 1)
+		}
+		start, end := min(offset, total), min(offset+limit, total)
+		weather.Days = weather.Days[start:end]
+		if weather.Days == nil {
+			weather.Days = []Day{}
+		}
+		if weather.Meta == nil {
+			weather.Meta = &weatherMeta{}
+		}
+		weather.Meta.Page = &pageMeta{TotalDays: total, Offset: offset, Limit: limit, HasMore: end < total}
+
+		var links []string
+		if end < total {
+			links = append(links, pageLink(r, end, limit, "next"))
+		}
+		if offset > 0 {
+			links = append(links, pageLink(r, max(min(offset, total)-limit, 0), limit, "prev"))
+		}
+		if len(links) > 0 {
+			w.Header().Add("Link", strings.Join(links, ", "))
+		}
+		data, _ := json.Marshal(weather)
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(buf.status)
+		w.Write(data)
+	}
+}
+
+// pageLink is the Link header value of the page of r at offset, as rel,
+// under the version prefix r was made under.
+func pageLink(r *http.Request, offset, limit int, rel string) string {
+	query := r.URL.Query()
+	query.Set("offset", strconv.Itoa(offset))
+	query.Set("limit", strconv.Itoa(limit))
+	return fmt.Sprintf(`<%s%s?%s>; rel="%s"`, apiPrefix(r), r.URL.EscapedPath(), query.Encode(), rel)
+}
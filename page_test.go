@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestPageMiddleware(t *testing.T) {
+	var days []Day
+	for i := 1; i <= 10; i++ {
+		days = append(days, Day{Datetime: fmt.Sprintf("2024-01-%02d", i)})
+	}
+	h := pageMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, Weather{ResolvedAddress: "Istanbul, Türkiye", Days: days})
+	})
+	tests := []struct {
+		name      string
+		query     string
+		wantDays  []string
+		wantPage  pageMeta
+		wantLinks string
+	}{
+		{
+			name:      "first page",
+			query:     "limit=4",
+			wantDays:  []string{"2024-01-01", "2024-01-02", "2024-01-03", "2024-01-04"},
+			wantPage:  pageMeta{TotalDays: 10, Offset: 0, Limit: 4, HasMore: true},
+			wantLinks: `</weather/history?country=istanbul&limit=4&offset=4>; rel="next"`,
+		},
+		{
+			name:      "middle page",
+			query:     "offset=4&limit=3",
+			wantDays:  []string{"2024-01-05", "2024-01-06", "2024-01-07"},
+			wantPage:  pageMeta{TotalDays: 10, Offset: 4, Limit: 3, HasMore: true},
+			wantLinks: `</weather/history?country=istanbul&limit=3&offset=7>; rel="next", </weather/history?country=istanbul&limit=3&offset=1>; rel="prev"`,
+		},
+		{
+			name:      "last partial page",
+			query:     "offset=8&limit=4",
+			wantDays:  []string{"2024-01-09", "2024-01-10"},
+			wantPage:  pageMeta{TotalDays: 10, Offset: 8, Limit: 4, HasMore: false},
+			wantLinks: `</weather/history?country=istanbul&limit=4&offset=4>; rel="prev"`,
+		},
+		{
+			name:      "rest of the days",
+			query:     "offset=7",
+			wantDays:  []string{"2024-01-08", "2024-01-09", "2024-01-10"},
+			wantPage:  pageMeta{TotalDays: 10, Offset: 7, Limit: 3, HasMore: false},
+			wantLinks: `</weather/history?country=istanbul&limit=3&offset=4>; rel="prev"`,
+		},
+		{
+			name:      "past the last day",
+			query:     "offset=20&limit=5",
+			wantDays:  []string{},
+			wantPage:  pageMeta{TotalDays: 10, Offset: 20, Limit: 5, HasMore: false},
+			wantLinks: `</weather/history?country=istanbul&limit=5&offset=5>; rel="prev"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather/history?country=istanbul&"+tt.query, nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			var weather Weather
+			if err := json.Unmarshal(rec.Body.Bytes(), &weather); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for _, day := range weather.Days {
+				got = append(got, day.Datetime)
+			}
+			if !slices.Equal(got, tt.wantDays) {
+				t.Errorf("days = %v, want %v", got, tt.wantDays)
+			}
+			if weather.Meta == nil || weather.Meta.Page == nil || *weather.Meta.Page != tt.wantPage {
+				t.Errorf("meta = %+v, want page %+v", weather.Meta, tt.wantPage)
+			}
+			if got := rec.Header().Get("Link"); got != tt.wantLinks {
+				t.Errorf("Link = %s, want %s", got, tt.wantLinks)
+			}
+		})
+	}
+}
+
+func TestPageParams(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantOK  bool
+		wantErr bool
+	}{
+		{query: ""},
+		{query: "limit=1", wantOK: true},
+		{query: "limit=100", wantOK: true},
+		{query: "offset=0", wantOK: true},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=101", wantErr: true},
+		{query: "limit=few", wantErr: true},
+		{query: "offset=-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			_, _, ok, err := pageParams(httptest.NewRequest(http.MethodGet, "/weather?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("pageParams() error = %v, want error %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("pageParams() ok = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// prettyIndent is what each level of pretty-printed JSON is indented by.
+const prettyIndent = "  "
+
+// prettyMiddleware indents the JSON responses of next, every handler's, when
+// the request asks with pretty=true. Responses are compact otherwise, and
+// ones of other types are sent as they are.
+func prettyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := r.URL.Query().Get("pretty")
+		if v == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pretty, err := strconv.ParseBool(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "pretty must be true or false"})
+			return
+		}
+		if !pretty {
+			next.ServeHTTP(w, r)
+			return
+		}
+		pw := &prettyResponseWriter{ResponseWriter: w}
+		defer pw.close()
+		next.ServeHTTP(pw, r)
+	})
+}
+
+// prettyResponseWriter holds a JSON body back to indent it once the handler
+// returns. Other bodies go straight through.
+type prettyResponseWriter struct {
+	http.ResponseWriter
+	status    int
+	buffering bool
+	buf       bytes.Buffer
+}
+
+func (p *prettyResponseWriter) WriteHeader(status int) {
+	if p.status != 0 {
+		return
+	}
+	p.status = status
+	mediaType, _, _ := mime.ParseMediaType(p.Header().Get("Content-Type"))
+	if mediaType == "application/json" && status != http.StatusNoContent && status != http.StatusNotModified {
+		p.buffering = true
+		return
+	}
+	p.ResponseWriter.WriteHeader(status)
+}
+
+func (p *prettyResponseWriter) Write(b []byte) (int, error) {
+	if p.status == 0 {
+		p.WriteHeader(http.StatusOK)
+	}
+	if p.buffering {
+		return p.buf.Write(b)
+	}
+	return p.ResponseWriter.Write(b)
+}
+
+// Flush sends what has been written so far, unless it is JSON waiting to be
+// indented.
+func (p *prettyResponseWriter) Flush() {
+	if !p.buffering {
+		http.NewResponseController(p.ResponseWriter).Flush()
+	}
+}
+
+// Hijack hands the connection over, for WebSocket upgrades.
+func (p *prettyResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(p.ResponseWriter).Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (p *prettyResponseWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
+
+// close indents the held back body and sends it. A body that is not valid
+// JSON after all is sent as it is. The indented body's ETag is made weak,
+// since its bytes are no longer those the tag was computed from.
+func (p *prettyResponseWriter) close() {
+	if !p.buffering {
+		return
+	}
+	body := p.buf.Bytes()
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", prettyIndent); err == nil {
+		body = append(bytes.TrimRight(indented.Bytes(), "\n"), '\n')
+		h := p.Header()
+		h.Set("Content-Length", strconv.Itoa(len(body)))
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+	}
+	p.ResponseWriter.WriteHeader(p.status)
+	p.ResponseWriter.Write(body)
+}
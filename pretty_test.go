@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestPrettyWeather(t *testing.T) {
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	var group singleflight.Group
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	lookup := redisMiddleware(fetchHandler(cache, &group, budget, cfg), parseWeatherQuery, cache, &group, budget, newHotKeys(), &cacheStats{}, cfg)
+	h := prettyMiddleware(gzipMiddleware(formatMiddleware(lookup, "weather", func() any { return new(Weather) })))
+
+	compact, err := json.Marshal(testWeather)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indented bytes.Buffer
+	json.Indent(&indented, compact, "", "  ")
+	tests := []struct {
+		name      string
+		query     string
+		want      string
+		wantEtag  string
+		wantError bool
+	}{
+		{name: "default", query: "", want: string(compact), wantEtag: `"`},
+		{name: "compact", query: "&pretty=false", want: string(compact), wantEtag: `"`},
+		{name: "pretty", query: "&pretty=true", want: indented.String() + "\n", wantEtag: `W/"`},
+		{name: "invalid", query: "&pretty=very", wantError: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?country=istanbul"+tt.query, nil))
+			if got := rec.Header().Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got)
+			}
+			if tt.wantError {
+				if rec.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", rec.Code)
+				}
+				return
+			}
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+			}
+			if got := rec.Body.String(); got != tt.want {
+				t.Errorf("body = %s, want %s", got, tt.want)
+			}
+			if got := rec.Header().Get("ETag"); !strings.HasPrefix(got, tt.wantEtag) {
+				t.Errorf("ETag = %q, want it to start with %s", got, tt.wantEtag)
+			}
+		})
+	}
+}
+
+func TestPrettyLeavesOtherTypes(t *testing.T) {
+	h := prettyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Write([]byte("date,temp\n2024-01-01,8.5\n"))
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/weather?pretty=true", nil))
+	if got := rec.Body.String(); got != "date,temp\n2024-01-01,8.5\n" {
+		t.Errorf("body = %q, want the CSV as it was", got)
+	}
+}
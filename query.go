@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// maxQueryBodyBytes caps the body of POST /weather/query.
+const maxQueryBodyBytes = 64 << 10
+
+// queryRequest is the body of POST /weather/query. Start and End give a
+// range of days together, today's weather is served without them.
+type queryRequest struct {
+	Locations []string `json:"locations"`
+	Start     string   `json:"start"`
+	End       string   `json:"end"`
+	Units     string   `json:"units"`
+	Lang      string   `json:"lang"`
+	Fields    []string `json:"fields"`
+}
+
+// decodeQueryRequest decodes body field by field, so that every field of the
+// wrong type is reported and not only the first, along with the fields it
+// does not know. The problems are keyed by field.
+func decodeQueryRequest(body []byte) (queryRequest, map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(body, &raw); err != nil || raw == nil {
+		return queryRequest{}, nil, fmt.Errorf("body must be a JSON object")
+	}
+	var req queryRequest
+	problems := make(map[string]string)
+	decode := func(name string, v any, want string) {
+		data, ok := raw[name]
+		if !ok {
+			return
+		}
+		delete(raw, name)
+		if json.Unmarshal(data, v) != nil {
+			problems[name] = name + " must be " + want
+		}
+	}
+	decode("locations", &req.Locations, "a list of locations")
+	decode("start", &req.Start, "a date such as 2024-01-31")
+	decode("end", &req.End, "a date such as 2024-01-31")
+	decode("units", &req.Units, "a string")
+	decode("lang", &req.Lang, "a string")
+	decode("fields", &req.Fields, "a list of field paths")
+	for name := range raw {
+		problems[name] = "unknown field " + name
+	}
+	return req, problems, nil
+}
+
+// queries validates req, adding what is wrong with it to problems, and
+// returns the query of each of its locations keyed by normalized location,
+// with the selection of its fields.
+func (req queryRequest) queries(problems map[string]string) (map[string]weatherQuery, fieldTree) {
+	base := defaultQuery("")
+	if req.Units != "" {
+		if _, ok := unitGroups[req.Units]; !ok {
+			problems["units"] = "units must be one of metric, us, uk or base"
+		}
+		base.Units = req.Units
+	}
+	if req.Lang != "" {
+		if !slices.Contains(languages, req.Lang) {
+			problems["lang"] = "lang must be one of " + strings.Join(languages, ", ")
+		}
+		base.Lang = req.Lang
+	}
+	if r, ok := req.dateRange(problems); ok {
+		base.Range = r
+	}
+
+	queries := make(map[string]weatherQuery)
+	for i, location := range req.Locations {
+		name := fmt.Sprintf("locations[%d]", i)
+		if err := validateLocation(name, location); err != nil {
+			problems[name] = err.Error()
+			continue
+		}
+		q := base
+		q.Location = location
+		if _, ok := queries[normalizeKey(location)]; !ok {
+			queries[normalizeKey(location)] = q
+		}
+	}
+	switch {
+	case len(req.Locations) == 0 && problems["locations"] == "":
+		problems["locations"] = "locations must list at least one location"
+	case len(queries) > maxBatchLocations:
+		problems["locations"] = fmt.Sprintf("locations must list at most %d locations", maxBatchLocations)
+	}
+
+	var tree fieldTree
+	t := reflect.TypeFor[Weather]()
+	for i, path := range req.Fields {
+		if !validFieldPath(t, path) {
+			problems[fmt.Sprintf("fields[%d]", i)] = fmt.Sprintf("unknown field %q, fields must be among %s", path, strings.Join(fieldPaths(t, ""), ", "))
+		}
+	}
+	if len(req.Fields) > 0 {
+		tree, _ = parseFields(strings.Join(req.Fields, ","), t)
+	}
+	return queries, tree
+}
+
+// dateRange returns the range of days from Start to End, adding what is
+// wrong with them to problems. It reports false when there is none.
+func (req queryRequest) dateRange(problems map[string]string) (string, bool) {
+	switch {
+	case req.Start == "" && req.End == "":
+		return "", false
+	case req.Start == "":
+		problems["start"] = "start is required with end, as a date such as 2024-01-31"
+		return "", false
+	case req.End == "":
+		problems["end"] = "end is required with start, as a date such as 2024-01-31"
+		return "", false
+	}
+	start, err := time.Parse(time.DateOnly, req.Start)
+	if err != nil {
+		problems["start"] = "start must be a date such as 2024-01-31"
+	}
+	end, err := time.Parse(time.DateOnly, req.End)
+	if err != nil {
+		problems["end"] = "end must be a date such as 2024-01-31"
+	}
+	switch {
+	case problems["start"] != "" || problems["end"] != "":
+		return "", false
+	case end.Before(start):
+		problems["end"] = "end must not be before start"
+		return "", false
+	}
+	if days := int(end.Sub(start).Hours()/24) + 1; days > maxHistoryDays {
+		problems["end"] = fmt.Sprintf("the range must be at most %d days, not %d", maxHistoryDays, days)
+		return "", false
+	}
+	return start.Format(time.DateOnly) + "/" + end.Format(time.DateOnly), true
+}
+
+// queryHandler serves POST /weather/query, whose JSON body names several
+// locations, a range of days, units and the fields to keep. The response is
+// keyed by normalized location like that of /weather/batch, which it shares
+// the cache and the provider calls with. Every problem with the body is
+// reported at once, in the details of a single 400.
+func queryHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, hot *hotKeys, stats *cacheStats, cfg Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxQueryBodyBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, apiError{Code: "body_too_large", Message: fmt.Sprintf("The request body must be at most %d bytes", tooLarge.Limit)})
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		req, problems, err := decodeQueryRequest(body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		queries, tree := req.queries(problems)
+		if len(problems) > 0 {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: "The request body is not valid, see details for each field", Details: problems})
+			return
+		}
+
+		results := fetchMany(r.Context(), cache, group, budget, hot, stats, cfg, queries)
+		if r.Context().Err() != nil {
+			return
+		}
+		if tree != nil {
+			for name, result := range results {
+				results[name] = projectResult(tree, result)
+			}
+		}
+		writeJSON(w, http.StatusOK, results)
+	}
+}
+
+// projectResult cuts result, a payload or an error envelope of fetchMany,
+// down to the fields of tree. Errors are left whole.
+func projectResult(tree fieldTree, result json.RawMessage) json.RawMessage {
+	var v map[string]any
+	dec := json.NewDecoder(bytes.NewReader(result))
+	dec.UseNumber()
+	if dec.Decode(&v) != nil || v["error"] != nil {
+		return result
+	}
+	data, err := json.Marshal(tree.project(v))
+	if err != nil {
+		return result
+	}
+	return data
+}
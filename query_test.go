@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// testQueryHandler serves POST /weather/query over a fresh cache.
+func testQueryHandler(t *testing.T) (http.HandlerFunc, *tieredCache) {
+	t.Helper()
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	var group singleflight.Group
+	return queryHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), &cacheStats{}, cfg), cache
+}
+
+func TestQueryHandler(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	h, cache := testQueryHandler(t)
+	body := `{"locations": ["istanbul", "ankara", "Istanbul"], "start": "2024-01-01", "end": "2024-01-03", "units": "us", "lang": "tr", "fields": ["resolvedAddress", "days.temp"]}`
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/weather/query", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var got map[string]map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["istanbul"] == nil || got["ankara"] == nil {
+		t.Fatalf("results for %v, want istanbul and ankara", got)
+	}
+	for name, weather := range got {
+		if len(weather) != 2 || weather["resolvedAddress"] != testWeather.ResolvedAddress {
+			t.Errorf("%s = %v, want resolvedAddress and days only", name, weather)
+		}
+		days, _ := weather["days"].([]any)
+		if len(days) != len(testWeather.Days) {
+			t.Fatalf("%s has %d days, want %d", name, len(days), len(testWeather.Days))
+		}
+		if day, _ := days[0].(map[string]any); len(day) != 1 || day["temp"] != testWeather.Days[0].Temp {
+			t.Errorf("%s first day = %v, want its temp only", name, day)
+		}
+	}
+	if n := calls.Load(); n != 2 {
+		t.Errorf("provider called %d times, want once per location", n)
+	}
+	// The locations are cached as the GET endpoints would ask for them.
+	for _, location := range []string{"istanbul", "ankara"} {
+		q := weatherQuery{Location: location, Units: "us", Lang: "tr", Range: "2024-01-01/2024-01-03", Include: "days"}
+		if _, ok := cache.Get(context.Background(), q.cacheKey()); !ok {
+			t.Errorf("%s is not cached", q.cacheKey())
+		}
+	}
+}
+
+func TestQueryHandlerValidation(t *testing.T) {
+	var many []string
+	for i := range maxBatchLocations + 1 {
+		many = append(many, fmt.Sprintf("city %d", i))
+	}
+	tooMany, _ := json.Marshal(map[string][]string{"locations": many})
+	tests := []struct {
+		name       string
+		body       string
+		wantFields []string
+	}{
+		{name: "no locations", body: `{}`, wantFields: []string{"locations"}},
+		{name: "wrong types", body: `{"locations": "istanbul", "units": 3, "fields": "days"}`, wantFields: []string{"locations", "units", "fields"}},
+		{name: "unknown field", body: `{"locations": ["istanbul"], "country": "istanbul"}`, wantFields: []string{"country"}},
+		{
+			name:       "invalid values",
+			body:       `{"locations": ["istanbul", "a/b", ""], "units": "imperial", "lang": "xx", "fields": ["days.temp", "days.colour"]}`,
+			wantFields: []string{"locations[1]", "locations[2]", "units", "lang", "fields[1]"},
+		},
+		{name: "start without end", body: `{"locations": ["istanbul"], "start": "2024-01-01"}`, wantFields: []string{"end"}},
+		{name: "bad dates", body: `{"locations": ["istanbul"], "start": "yesterday", "end": "2024-13-01"}`, wantFields: []string{"start", "end"}},
+		{name: "end before start", body: `{"locations": ["istanbul"], "start": "2024-01-03", "end": "2024-01-01"}`, wantFields: []string{"end"}},
+		{name: "long range", body: `{"locations": ["istanbul"], "start": "2024-01-01", "end": "2024-12-31"}`, wantFields: []string{"end"}},
+		{name: "too many locations", body: string(tooMany), wantFields: []string{"locations"}},
+	}
+	h, _ := testQueryHandler(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodPost, "/weather/query", strings.NewReader(tt.body)))
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want 400", rec.Code)
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			details := body["error"].Details
+			if body["error"].Code != "invalid_request" || len(details) != len(tt.wantFields) {
+				t.Fatalf("error = %+v, want the fields %v", body["error"], tt.wantFields)
+			}
+			for _, field := range tt.wantFields {
+				if details[field] == "" {
+					t.Errorf("details %v do not name %s", details, field)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryHandlerBody(t *testing.T) {
+	h, _ := testQueryHandler(t)
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "oversized", body: `{"locations": ["` + strings.Repeat("a", maxQueryBodyBytes) + `"]}`, wantStatus: http.StatusRequestEntityTooLarge, wantCode: "body_too_large"},
+		{name: "not JSON", body: `locations=istanbul`, wantStatus: http.StatusBadRequest, wantCode: "invalid_request"},
+		{name: "not an object", body: `["istanbul"]`, wantStatus: http.StatusBadRequest, wantCode: "invalid_request"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodPost, "/weather/query", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"].Code != tt.wantCode {
+				t.Errorf("body = %s, want code %s", rec.Body, tt.wantCode)
+			}
+		})
+	}
+}
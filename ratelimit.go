@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitBackendLocal = "local"
+	rateLimitBackendRedis = "redis"
+)
+
+// Rate limit modes. In observe mode requests over the limit are counted and
+// logged but still served.
+const (
+	rateLimitModeEnforce = "enforce"
+	rateLimitModeObserve = "observe"
+)
+
+// rateLimiter decides whether a client, identified by key, may make another
+// request. peek reports the decision allow would make now without counting
+// a request, for clients checking their budget.
+type rateLimiter interface {
+	allow(ctx context.Context, key string) rateDecision
+	peek(ctx context.Context, key string) rateDecision
+}
+
+// rateDecision is a rateLimiter's verdict on one request. Limit is how many
+// requests the client can make at once, Rate how many per second it regains
+// and Remaining how many it has left. Reset is when the client will be back
+// to Limit, RetryAfter when a rejected client may try again. Tier is the
+// consumer tier whose limit applied, if the limiter has tiers.
+type rateDecision struct {
+	Allowed    bool
+	Tier       string
+	Limit      int
+	Rate       rate.Limit
+	Remaining  int
+	Reset      time.Duration
+	RetryAfter time.Duration
+}
+
+// rateSpec is a request rate in requests per second, with bursts of up to
+// Burst requests.
+type rateSpec struct {
+	RPS   float64
+	Burst int
+}
+
+// parseRateSpecs parses a comma separated list of name=rps:burst rates, as
+// in "free=2:10,pro=20:40".
+func parseRateSpecs(v string) (map[string]rateSpec, error) {
+	specs := make(map[string]rateSpec)
+	for _, entry := range splitList(v) {
+		name, limit, ok := strings.Cut(entry, "=")
+		rps, burst, ok2 := strings.Cut(limit, ":")
+		if !ok || !ok2 || name == "" {
+			return nil, fmt.Errorf("%q must be name=rps:burst", entry)
+		}
+		var spec rateSpec
+		var err error
+		if spec.RPS, err = strconv.ParseFloat(rps, 64); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		if spec.Burst, err = strconv.Atoi(burst); err != nil {
+			return nil, fmt.Errorf("%q: %v", entry, err)
+		}
+		if err := validateRateLimit(spec.RPS, spec.Burst); err != nil || spec.RPS == 0 {
+			return nil, fmt.Errorf("%q: must have a positive rate and burst", entry)
+		}
+		specs[name] = spec
+	}
+	return specs, nil
+}
+
+// ipLimiters hands out one token bucket per client IP. Buckets unused for
+// idle are dropped, so the map does not grow with every address ever seen.
+type ipLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	idle      time.Duration
+	now       func() time.Time
+	lastSweep time.Time
+	limiters  map[string]*ipLimiter
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newIPLimiters(limit rate.Limit, burst int, idle time.Duration) *ipLimiters {
+	return &ipLimiters{
+		limit:     limit,
+		burst:     burst,
+		idle:      idle,
+		now:       time.Now,
+		lastSweep: time.Now(),
+		limiters:  make(map[string]*ipLimiter),
+	}
+}
+
+// allow reports whether a request from ip may go ahead, taking a token from
+// its bucket. Idle buckets are swept at most once per idle period.
+func (l *ipLimiters) allow(ctx context.Context, ip string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.idle {
+		l.sweep(now)
+	}
+	entry, ok := l.limiters[ip]
+	if !ok {
+		entry = &ipLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[ip] = entry
+	}
+	entry.lastSeen = now
+	d := rateDecision{Allowed: entry.limiter.AllowN(now, 1), Limit: l.burst, Rate: l.limit}
+	tokens := entry.limiter.TokensAt(now)
+	d.Remaining = max(int(tokens), 0)
+	d.Reset = tokenWait(float64(l.burst)-tokens, l.limit)
+	if !d.Allowed {
+		d.RetryAfter = tokenWait(1-tokens, l.limit)
+	}
+	return d
+}
+
+// peek reports how many tokens ip's bucket holds, leaving it as it is. A
+// client without a bucket has the whole burst.
+func (l *ipLimiters) peek(ctx context.Context, ip string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	d := rateDecision{Allowed: true, Limit: l.burst, Rate: l.limit, Remaining: l.burst}
+	entry, ok := l.limiters[ip]
+	if !ok {
+		return d
+	}
+	tokens := entry.limiter.TokensAt(l.now())
+	d.Allowed = tokens >= 1
+	d.Remaining = max(int(tokens), 0)
+	d.Reset = tokenWait(float64(l.burst)-tokens, l.limit)
+	if !d.Allowed {
+		d.RetryAfter = tokenWait(1-tokens, l.limit)
+	}
+	return d
+}
+
+// tokenWait returns how long a bucket refilling at limit takes to gain n
+// tokens.
+func tokenWait(n float64, limit rate.Limit) time.Duration {
+	if n <= 0 || limit <= 0 {
+		return 0
+	}
+	return time.Duration(n / float64(limit) * float64(time.Second))
+}
+
+// sweep drops the buckets not used since now minus idle. A dropped bucket
+// has had time to refill, so recreating it later changes nothing for the
+// client. l.mu must be held.
+func (l *ipLimiters) sweep(now time.Time) {
+	for ip, entry := range l.limiters {
+		if now.Sub(entry.lastSeen) >= l.idle {
+			delete(l.limiters, ip)
+		}
+	}
+	l.lastSweep = now
+}
+
+// redisLimitScript counts a request in the current window of KEYS[1],
+// starting a window of ARGV[1] milliseconds on the first one, and returns
+// the count with the milliseconds left in the window, in a single round trip.
+var redisLimitScript = redis.NewScript(`
+local n = redis.call("INCR", KEYS[1])
+if n == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {n, redis.call("PTTL", KEYS[1])}`)
+
+// redisLimiter shares a fixed window counter per client IP between every
+// instance, or with sliding set a log of request times as the sliding window
+// limiter keeps. A window lasts burst/limit seconds and admits burst
+// requests, which matches the long-run rate of the local token bucket. While
+// Redis is unreachable the local limiter decides instead, so each instance
+// enforces the limit on its own rather than letting everything through.
+type redisLimiter struct {
+	redisDB   redis.UniversalClient
+	prefix    string
+	window    time.Duration
+	limit     rate.Limit
+	burst     int64
+	sliding   bool
+	local     rateLimiter
+	fallbacks atomic.Int64
+	degraded  atomic.Bool
+}
+
+func newRedisLimiter(redisDB redis.UniversalClient, name string, limit rate.Limit, burst int, sliding bool, local rateLimiter) *redisLimiter {
+	// The algorithms keep different types at their keys.
+	prefix := "ratelimit:" + name + ":"
+	if sliding {
+		prefix = "ratelimit:sliding:" + name + ":"
+	}
+	return &redisLimiter{
+		redisDB: redisDB,
+		prefix:  prefix,
+		window:  time.Duration(float64(burst) / float64(limit) * float64(time.Second)),
+		limit:   limit,
+		burst:   int64(burst),
+		sliding: sliding,
+		local:   local,
+	}
+}
+
+func (l *redisLimiter) allow(ctx context.Context, ip string) rateDecision {
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	allow := l.fixedWindowAllow
+	if l.sliding {
+		allow = l.slidingWindowAllow
+	}
+	d, err := allow(ctx, ip)
+	if err != nil {
+		l.fallbacks.Add(1)
+		if !l.degraded.Swap(true) {
+			logf(ctx, "Rate limiting locally, Redis is unavailable : %v", err)
+		}
+		return l.local.allow(ctx, ip)
+	}
+	if l.degraded.Swap(false) {
+		logf(ctx, "Rate limiting through Redis again")
+	}
+	return d
+}
+
+// peek inspects key's window in Redis, or the local limiter while Redis is
+// unreachable.
+func (l *redisLimiter) peek(ctx context.Context, ip string) rateDecision {
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	peek := l.fixedWindowPeek
+	if l.sliding {
+		peek = l.slidingWindowPeek
+	}
+	d, err := peek(ctx, ip)
+	if err != nil {
+		logf(ctx, "Error inspecting rate limit in Redis : %v", err)
+		return l.local.peek(ctx, ip)
+	}
+	return d
+}
+
+// redisPeekScript returns the count of the current window of KEYS[1] with
+// the milliseconds left in it, without counting a request.
+var redisPeekScript = redis.NewScript(`
+local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+return {n, redis.call("PTTL", KEYS[1])}`)
+
+// fixedWindowPeek runs redisPeekScript for key.
+func (l *redisLimiter) fixedWindowPeek(ctx context.Context, key string) (rateDecision, error) {
+	res, err := redisPeekScript.Run(ctx, l.redisDB, []string{l.prefix + key}).Int64Slice()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	if err != nil {
+		return rateDecision{}, err
+	}
+	n, reset := res[0], time.Duration(max(res[1], 0))*time.Millisecond
+	d := rateDecision{Allowed: n < l.burst, Limit: int(l.burst), Rate: l.limit, Remaining: int(max(l.burst-n, 0)), Reset: reset}
+	if !d.Allowed {
+		d.RetryAfter = reset
+	}
+	return d, nil
+}
+
+// fixedWindowAllow runs redisLimitScript for key.
+func (l *redisLimiter) fixedWindowAllow(ctx context.Context, key string) (rateDecision, error) {
+	res, err := redisLimitScript.Run(ctx, l.redisDB, []string{l.prefix + key}, l.window.Milliseconds()).Int64Slice()
+	if err == nil && len(res) != 2 {
+		err = fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	if err != nil {
+		return rateDecision{}, err
+	}
+	n, reset := res[0], time.Duration(max(res[1], 0))*time.Millisecond
+	d := rateDecision{Allowed: n <= l.burst, Limit: int(l.burst), Rate: l.limit, Remaining: int(max(l.burst-n, 0)), Reset: reset}
+	if !d.Allowed {
+		d.RetryAfter = reset
+	}
+	return d, nil
+}
+
+// setRateLimitHeaders describes d in the X-RateLimit-* headers, and in
+// Retry-After when the request was rejected. Durations are whole seconds,
+// rounded up so that clients never retry early.
+func setRateLimitHeaders(w http.ResponseWriter, d rateDecision) {
+	seconds := func(d time.Duration) string {
+		return strconv.FormatInt(int64(math.Ceil(d.Seconds())), 10)
+	}
+	w.Header().Set("X-RateLimit-Limit", strconv.Itoa(d.Limit))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(d.Remaining))
+	w.Header().Set("X-RateLimit-Reset", seconds(d.Reset))
+	if !d.Allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds(d.RetryAfter), 10))
+	}
+}
+
+// KeyFunc returns the key a request is rate limited by. Requests with the
+// same key share a budget.
+type KeyFunc func(r *http.Request) string
+
+// IPKey keys requests on their client IP, or IPv6 network.
+func IPKey(r *http.Request) string {
+	return clientKey(r)
+}
+
+// APIKeyKey keys requests on their consumer API key, and those without one
+// on their client IP.
+func APIKeyKey(r *http.Request) string {
+	if key := apiKey(r); key != "" {
+		return "key:" + key
+	}
+	return IPKey(r)
+}
+
+// PathIPKey keys requests on their path and client IP, giving each client a
+// separate budget per endpoint.
+func PathIPKey(r *http.Request) string {
+	return r.URL.Path + " " + IPKey(r)
+}
+
+// rateLimitOptions are the settings of RateLimit.
+type rateLimitOptions struct {
+	limit   rate.Limit
+	burst   int
+	idle    time.Duration
+	limiter rateLimiter
+	key     KeyFunc
+	stats   *limiterStats
+	observe bool
+}
+
+// Option configures RateLimit.
+type Option func(*rateLimitOptions)
+
+// WithLimit sets how many requests per second each key may make.
+func WithLimit(limit rate.Limit) Option {
+	return func(o *rateLimitOptions) { o.limit = limit }
+}
+
+// WithBurst sets how many requests each key may make at once.
+func WithBurst(burst int) Option {
+	return func(o *rateLimitOptions) { o.burst = burst }
+}
+
+// WithLimiter makes RateLimit use limiter rather than token buckets built
+// from WithLimit and WithBurst.
+func WithLimiter(limiter rateLimiter) Option {
+	return func(o *rateLimitOptions) { o.limiter = limiter }
+}
+
+// WithKeyFunc sets how requests are keyed. The default is IPKey.
+func WithKeyFunc(key KeyFunc) Option {
+	return func(o *rateLimitOptions) { o.key = key }
+}
+
+// WithStats counts RateLimit's decisions in stats.
+func WithStats(stats *limiterStats) Option {
+	return func(o *rateLimitOptions) { o.stats = stats }
+}
+
+// WithObserve makes RateLimit serve the requests it would reject, marking
+// them with an X-RateLimit-Would-Reject header instead.
+func WithObserve(observe bool) Option {
+	return func(o *rateLimitOptions) { o.observe = observe }
+}
+
+// RateLimit rejects the requests its limiter does not allow for their key,
+// by default the client IP at 2 requests per second in bursts of 10. The
+// 429 body names the tier and the limit that was hit. Requests marked
+// exempt are let through without being counted, exemptPathsMiddleware
+// counts them. Nested limiters record a single decision per request.
+func RateLimit(next http.Handler, opts ...Option) http.Handler {
+	o := rateLimitOptions{limit: 2, burst: 10, idle: 10 * time.Minute, key: IPKey}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	limiter := o.limiter
+	if limiter == nil {
+		limiter = newIPLimiters(o.limit, o.burst, o.idle)
+	}
+	stats := o.stats
+	stats.track(limiter)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		verdict, nested := r.Context().Value(limitVerdictKey{}).(*limitVerdict)
+		if !nested {
+			verdict = &limitVerdict{}
+			r = r.WithContext(context.WithValue(r.Context(), limitVerdictKey{}, verdict))
+			defer func() { stats.record(verdict.key, verdict.d) }()
+		}
+		key := o.key(r)
+		d := limiter.allow(r.Context(), key)
+		verdict.note(key, d)
+		setRateLimitHeaders(w, d)
+		if !d.Allowed && o.observe {
+			logf(r.Context(), "Rate limit exceeded key=%s tier=%s would_reject=true", key, d.Tier)
+			w.Header().Set("X-RateLimit-Would-Reject", "true")
+		} else if !d.Allowed {
+			writeError(w, http.StatusTooManyRequests, rateLimitedError(d))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimiterMiddleware is RateLimit with limiter and opts. A nil limiter
+// lets every request through.
+func rateLimiterMiddleware(next http.HandlerFunc, limiter rateLimiter, opts ...Option) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	return RateLimit(next, append([]Option{WithLimiter(limiter)}, opts...)...).ServeHTTP
+}
+
+// defaultExemptPaths are never rate limited, so that probes and scrapes,
+// which come from few IPs at a steady rate, cannot be throttled.
+var defaultExemptPaths = []string{"/healthz", "/livez", "/readyz", "/metrics"}
+
+// exemptPathsMiddleware marks the requests for paths as exempt from rate
+// limiting. They are still counted in stats, as exempt, so that abuse of
+// them shows, and so are the ones accessListMiddleware already exempted.
+// This is the only place exempt requests are counted.
+func exemptPathsMiddleware(next http.Handler, paths []string, stats *limiterStats) http.Handler {
+	exempt := make(map[string]bool, len(paths))
+	for _, path := range paths {
+		exempt[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exempt[r.URL.Path] || rateLimitExempt(r) {
+			stats.recordExempt()
+			r = exemptFromRateLimit(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitScope returns what the limit of d applies to. Requests with an API
+// key are limited per key, the others per IP.
+func limitScope(d rateDecision) string {
+	if d.Tier != "" && d.Tier != anonymousTier {
+		return scopeAPIKey
+	}
+	return scopeIP
+}
+
+// rateLimitedError describes the limit d rejected a request for.
+func rateLimitedError(d rateDecision) apiError {
+	return apiError{
+		Code:              "rate_limited",
+		RetryAfterSeconds: retryAfterSeconds(d.RetryAfter),
+		Limit:             d.Limit,
+		RequestsPerSecond: float64(d.Rate),
+		Scope:             limitScope(d),
+		Tier:              d.Tier,
+	}
+}
+
+// bypassLimiterMiddleware applies a separate, stricter per-IP limit to
+// requests that skip the cache with Cache-Control, so that they cannot be
+// used to hammer the provider.
+func bypassLimiterMiddleware(next http.HandlerFunc, limiter rateLimiter, opts ...Option) http.HandlerFunc {
+	if limiter == nil {
+		return next
+	}
+	limited := rateLimiterMiddleware(next, limiter, opts...)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if noCache, noStore := cacheControl(r); noCache || noStore {
+			limited(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
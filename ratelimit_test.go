@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// testLimiter builds local token buckets, as serve does without Redis.
+func testLimiter(name string, limit rate.Limit, burst int) rateLimiter {
+	return newIPLimiters(limit, burst, time.Minute)
+}
+
+func TestTieredLimiter(t *testing.T) {
+	tiers := map[string]rateSpec{"free": {RPS: 1, Burst: 2}, "pro": {RPS: 1, Burst: 5}}
+	tests := []struct {
+		name     string
+		consumer *consumer
+		wantTier string
+		allowed  int
+	}{
+		{name: "anonymous", wantTier: anonymousTier, allowed: 1},
+		{name: "free key", consumer: &consumer{key: "k1", tier: "free"}, wantTier: "free", allowed: 2},
+		{name: "pro key", consumer: &consumer{key: "k2", tier: "pro"}, wantTier: "pro", allowed: 5},
+		{name: "unknown tier", consumer: &consumer{key: "k3", tier: "gold"}, wantTier: anonymousTier, allowed: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newTieredLimiter(testLimiter("weather", 1, 1), tiers, testLimiter)
+			ctx := context.Background()
+			if tt.consumer != nil {
+				ctx = context.WithValue(ctx, consumerKey{}, *tt.consumer)
+			}
+			for i := 0; i < tt.allowed; i++ {
+				d := limiter.allow(ctx, "192.0.2.1")
+				if !d.Allowed {
+					t.Fatalf("request %d was rejected, want %d allowed", i+1, tt.allowed)
+				}
+				if d.Tier != tt.wantTier {
+					t.Errorf("tier = %q, want %q", d.Tier, tt.wantTier)
+				}
+			}
+			if d := limiter.allow(ctx, "192.0.2.1"); d.Allowed {
+				t.Errorf("request %d was allowed past the %s limit", tt.allowed+1, tt.wantTier)
+			}
+		})
+	}
+}
+
+func TestTieredLimiterKeysApart(t *testing.T) {
+	limiter := newTieredLimiter(testLimiter("weather", 1, 1), map[string]rateSpec{"free": {RPS: 1, Burst: 1}}, testLimiter)
+	a := context.WithValue(context.Background(), consumerKey{}, consumer{key: "a", tier: "free"})
+	b := context.WithValue(context.Background(), consumerKey{}, consumer{key: "b", tier: "free"})
+	if !limiter.allow(a, "192.0.2.1").Allowed || !limiter.allow(b, "192.0.2.1").Allowed {
+		t.Fatal("two keys of a tier share a budget")
+	}
+	if !limiter.allow(context.Background(), "192.0.2.1").Allowed {
+		t.Error("keyed requests used up the anonymous budget of their IP")
+	}
+}
+
+func TestLimiterStatsTracksOnce(t *testing.T) {
+	stats := newLimiterStats()
+	limiter := newIPLimiters(1, 1, time.Minute)
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	// serve wraps every weather route in the same limiter.
+	for range 9 {
+		rateLimiterMiddleware(ok, limiter, WithStats(stats))
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2"} {
+		limiter.allow(context.Background(), ip)
+	}
+	if got := stats.snapshot(10).Tracked; got != 2 {
+		t.Errorf("trackedClients = %d, want 2", got)
+	}
+}
+
+// TestNestedLimitersRecordOnce passes requests through the route, weather
+// and miss limiters as serve nests them.
+func TestNestedLimitersRecordOnce(t *testing.T) {
+	tests := []struct {
+		name         string
+		route        int
+		weather      int
+		miss         int
+		wantStatus   int
+		wantAllowed  int64
+		wantRejected int64
+	}{
+		{name: "allowed by all", route: 5, weather: 5, miss: 5, wantStatus: http.StatusOK, wantAllowed: 1},
+		{name: "rejected by the route", route: 0, weather: 5, miss: 5, wantStatus: http.StatusTooManyRequests, wantRejected: 1},
+		{name: "rejected inside", route: 5, weather: 5, miss: 0, wantStatus: http.StatusTooManyRequests, wantRejected: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newLimiterStats()
+			limiter := func(burst int) rateLimiter {
+				if burst == 0 {
+					return rejectAll{}
+				}
+				return newIPLimiters(1, burst, time.Minute)
+			}
+			ok := func(w http.ResponseWriter, r *http.Request) {}
+			h := rateLimiterMiddleware(ok, limiter(tt.miss), WithStats(stats))
+			h = rateLimiterMiddleware(h, limiter(tt.weather), WithStats(stats))
+			h = rateLimiterMiddleware(h, limiter(tt.route), WithStats(stats))
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			snap := stats.snapshot(10)
+			if snap.Allowed != tt.wantAllowed || snap.Rejected != tt.wantRejected {
+				t.Errorf("allowed, rejected = %d, %d, want %d, %d", snap.Allowed, snap.Rejected, tt.wantAllowed, tt.wantRejected)
+			}
+		})
+	}
+}
+
+// rejectAll is a limiter that allows nothing.
+type rejectAll struct{}
+
+func (rejectAll) allow(ctx context.Context, key string) rateDecision {
+	return rateDecision{RetryAfter: time.Second}
+}
+
+func (rejectAll) peek(ctx context.Context, key string) rateDecision {
+	return rateDecision{RetryAfter: time.Second}
+}
+
+func TestExemptRequestsCountOnce(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		allowlisted bool
+		wantExempt  int64
+	}{
+		{name: "exempt path", path: "/healthz", wantExempt: 1},
+		{name: "allowlisted client", path: "/weather", allowlisted: true, wantExempt: 1},
+		{name: "limited path", path: "/weather"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats := newLimiterStats()
+			ok := func(w http.ResponseWriter, r *http.Request) {}
+			// Nested limiters, as the weather routes have, must not count
+			// an exempt request again.
+			h := rateLimiterMiddleware(ok, newIPLimiters(1, 1, time.Minute), WithStats(stats))
+			h = rateLimiterMiddleware(h, rejectAll{}, WithStats(stats))
+			var allow []netip.Prefix
+			if tt.allowlisted {
+				allow = []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")}
+			}
+			handler := exemptPathsMiddleware(h, defaultExemptPaths, stats)
+			handler = clientIPMiddleware(accessListMiddleware(handler, newAccessLists(allow, nil)), nil, defaultIPv6PrefixBits)
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, r)
+			snap := stats.snapshot(10)
+			if snap.Exempt != tt.wantExempt {
+				t.Errorf("exempt = %d, want %d", snap.Exempt, tt.wantExempt)
+			}
+			if tt.wantExempt > 0 && (rec.Code != http.StatusOK || snap.Allowed+snap.Rejected != 0) {
+				t.Errorf("exempt request got %d and counted %d allowed, %d rejected", rec.Code, snap.Allowed, snap.Rejected)
+			}
+		})
+	}
+}
+
+// TestIPLimitersConcurrent fires requests from many IPs at once. Run it with
+// -race.
+func TestIPLimitersConcurrent(t *testing.T) {
+	limiter := newIPLimiters(1, 5, time.Minute)
+	const ips, perIP = 50, 10
+	allowed := make([]atomic.Int64, ips)
+	var wg sync.WaitGroup
+	for i := range ips {
+		for range perIP {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if limiter.allow(context.Background(), fmt.Sprintf("192.0.2.%d", i)).Allowed {
+					allowed[i].Add(1)
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	for i := range ips {
+		// A token or so may come back while the requests run.
+		if n := allowed[i].Load(); n < 5 || n > 6 {
+			t.Errorf("IP %d had %d requests allowed, want the burst of 5", i, n)
+		}
+	}
+	if got := limiter.tracked(); got != ips {
+		t.Errorf("tracked() = %d, want %d", got, ips)
+	}
+}
+
+// trackingLimiter is a local limiter that keeps state per client.
+type trackingLimiter interface {
+	rateLimiter
+	trackedClients
+}
+
+func TestLimitersEvictIdle(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Each limiter is given a clock reading now.
+	var now time.Time
+	clock := func() time.Time { return now }
+	limiters := map[string]func() trackingLimiter{
+		"token bucket": func() trackingLimiter {
+			l := newIPLimiters(1, 1, time.Minute)
+			l.now, l.lastSweep = clock, start
+			return l
+		},
+		"sliding window": func() trackingLimiter {
+			l := newSlidingWindowLimiters(1, 1, time.Minute)
+			l.now, l.lastSweep = clock, start
+			return l
+		},
+	}
+	steps := []struct {
+		name    string
+		advance time.Duration
+		ip      string
+		want    int
+	}{
+		{name: "first client", ip: "192.0.2.1", want: 1},
+		{name: "second client", advance: 30 * time.Second, ip: "192.0.2.2", want: 2},
+		{name: "before the idle window", advance: 20 * time.Second, ip: "192.0.2.2", want: 2},
+		{name: "first client idle", advance: 15 * time.Second, ip: "192.0.2.3", want: 2},
+		{name: "every client idle", advance: 2 * time.Minute, ip: "192.0.2.4", want: 1},
+	}
+	for name, newLimiter := range limiters {
+		t.Run(name, func(t *testing.T) {
+			now = start
+			limiter := newLimiter()
+			for _, step := range steps {
+				now = now.Add(step.advance)
+				limiter.allow(context.Background(), step.ip)
+				if got := limiter.tracked(); got != step.want {
+					t.Errorf("%s: tracked() = %d, want %d", step.name, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitRejection(t *testing.T) {
+	tests := []struct {
+		name      string
+		limiter   rateLimiter
+		observe   bool
+		wantCodes []int
+		wantRetry string
+	}{
+		{name: "burst then reject", limiter: newIPLimiters(0.5, 2, time.Minute), wantCodes: []int{200, 200, 429}, wantRetry: "2"},
+		{name: "observe mode", limiter: newIPLimiters(0.5, 1, time.Minute), observe: true, wantCodes: []int{200, 200}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok := func(w http.ResponseWriter, r *http.Request) {}
+			h := rateLimiterMiddleware(ok, tt.limiter, WithObserve(tt.observe))
+			var rec *httptest.ResponseRecorder
+			for i, want := range tt.wantCodes {
+				rec = httptest.NewRecorder()
+				h(rec, httptest.NewRequest(http.MethodGet, "/weather", nil))
+				if rec.Code != want {
+					t.Fatalf("request %d got %d, want %d", i+1, rec.Code, want)
+				}
+				if rec.Header().Get("X-RateLimit-Limit") == "" || rec.Header().Get("X-RateLimit-Remaining") == "" {
+					t.Errorf("request %d has no X-RateLimit headers", i+1)
+				}
+			}
+			if tt.observe {
+				if rec.Header().Get("X-RateLimit-Would-Reject") != "true" {
+					t.Error("observed rejection is not marked X-RateLimit-Would-Reject")
+				}
+				return
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.wantRetry {
+				t.Errorf("Retry-After = %q, want %q", got, tt.wantRetry)
+			}
+			var body map[string]apiError
+			if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			e := body["error"]
+			if e.Code != "rate_limited" || e.Limit != 2 || e.RequestsPerSecond != 0.5 || e.Scope != scopeIP || e.RetryAfterSeconds != 2 {
+				t.Errorf("error = %+v", e)
+			}
+		})
+	}
+}
+
+func TestRateLimitedErrorScope(t *testing.T) {
+	tests := []struct {
+		tier string
+		want string
+	}{
+		{tier: "", want: scopeIP},
+		{tier: anonymousTier, want: scopeIP},
+		{tier: "pro", want: scopeAPIKey},
+	}
+	for _, tt := range tests {
+		if got := rateLimitedError(rateDecision{Tier: tt.tier}).Scope; got != tt.want {
+			t.Errorf("scope of tier %q = %q, want %q", tt.tier, got, tt.want)
+		}
+	}
+}
+
+// TestRedisLimiterWindow checks both Redis algorithms allow a full burst
+// again once the window has passed, and never allow more than the burst to
+// concurrent requests.
+func TestRedisLimiterWindow(t *testing.T) {
+	const burst = 10
+	for _, sliding := range []bool{false, true} {
+		name := "fixed window"
+		if sliding {
+			name = "sliding window"
+		}
+		t.Run(name+"/reset", func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { rdb.Close() })
+			l := newRedisLimiter(rdb, "weather", rate.Every(6*time.Second), burst, sliding, rejectAll{})
+			start := time.Now()
+			mr.SetTime(start)
+			for round := 0; round < 2; round++ {
+				for i := 0; i < burst; i++ {
+					if !l.allow(context.Background(), "1.2.3.4").Allowed {
+						t.Fatalf("round %d: request %d rejected within the burst", round+1, i+1)
+					}
+				}
+				if d := l.allow(context.Background(), "1.2.3.4"); d.Allowed || d.RetryAfter <= 0 {
+					t.Fatalf("round %d: request over the burst = %+v, want rejected with a retry", round+1, d)
+				}
+				mr.SetTime(start.Add(l.window + time.Second))
+				mr.FastForward(l.window + time.Second)
+			}
+			if got := l.fallbacks.Load(); got != 0 {
+				t.Errorf("%d decisions fell back to the local limiter", got)
+			}
+		})
+		t.Run(name+"/concurrent", func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+			t.Cleanup(func() { rdb.Close() })
+			l := newRedisLimiter(rdb, "weather", rate.Every(time.Minute), burst, sliding, rejectAll{})
+			var allowed atomic.Int64
+			var wg sync.WaitGroup
+			for i := 0; i < 5*burst; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if l.allow(context.Background(), "1.2.3.4").Allowed {
+						allowed.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if got := allowed.Load(); got != burst {
+				t.Errorf("%d concurrent requests allowed, want %d", got, burst)
+			}
+			if got := l.fallbacks.Load(); got != 0 {
+				t.Errorf("%d decisions fell back to the local limiter", got)
+			}
+		})
+	}
+}
+
+// TestRateLimitHeaders checks the headers of allowed and rejected requests
+// with each limiter. A token bucket can be retried once a token is back, a
+// fixed window once the window is over.
+func TestRateLimitHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		limiter   func(t *testing.T) rateLimiter
+		wantRetry string
+	}{
+		{
+			name:      "token bucket",
+			limiter:   func(t *testing.T) rateLimiter { return newIPLimiters(rate.Every(10*time.Second), 3, time.Minute) },
+			wantRetry: "10",
+		},
+		{
+			name: "redis fixed window",
+			limiter: func(t *testing.T) rateLimiter {
+				mr := miniredis.RunT(t)
+				rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+				t.Cleanup(func() { rdb.Close() })
+				return newRedisLimiter(rdb, "weather", rate.Every(10*time.Second), 3, false, rejectAll{})
+			},
+			wantRetry: "30",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := rateLimiterMiddleware(func(w http.ResponseWriter, r *http.Request) {}, tt.limiter(t))
+			for i, want := range []struct {
+				status    int
+				remaining string
+				retry     string
+			}{
+				{status: http.StatusOK, remaining: "2"},
+				{status: http.StatusOK, remaining: "1"},
+				{status: http.StatusOK, remaining: "0"},
+				{status: http.StatusTooManyRequests, remaining: "0", retry: tt.wantRetry},
+			} {
+				rec := serveGet(h, "/weather")
+				if rec.Code != want.status {
+					t.Fatalf("request %d: status = %d, want %d", i+1, rec.Code, want.status)
+				}
+				if got := rec.Header().Get("X-RateLimit-Limit"); got != "3" {
+					t.Errorf("request %d: X-RateLimit-Limit = %q, want 3", i+1, got)
+				}
+				if got := rec.Header().Get("X-RateLimit-Remaining"); got != want.remaining {
+					t.Errorf("request %d: X-RateLimit-Remaining = %q, want %s", i+1, got, want.remaining)
+				}
+				if reset, err := strconv.Atoi(rec.Header().Get("X-RateLimit-Reset")); err != nil || reset <= 0 || reset > 30 {
+					t.Errorf("request %d: X-RateLimit-Reset = %q, want 1 to 30 seconds", i+1, rec.Header().Get("X-RateLimit-Reset"))
+				}
+				if got := rec.Header().Get("Retry-After"); got != want.retry {
+					t.Errorf("request %d: Retry-After = %q, want %q", i+1, got, want.retry)
+				}
+			}
+		})
+	}
+}
+
+// TestBoundaryBurst sends a full burst, then another half a window later.
+// The token bucket has refilled half its tokens by then and lets through
+// one and a half bursts within a window, the sliding window never more
+// than one.
+func TestBoundaryBurst(t *testing.T) {
+	start := time.Now()
+	now := start
+	clock := func() time.Time { return now }
+	bucket := newIPLimiters(1, 10, time.Minute)
+	bucket.now = clock
+	window := newSlidingWindowLimiters(1, 10, time.Minute)
+	window.now = clock
+
+	tests := []struct {
+		at         time.Duration
+		wantBucket int
+		wantWindow int
+	}{
+		{at: 0, wantBucket: 10, wantWindow: 10},
+		{at: 5 * time.Second, wantBucket: 5, wantWindow: 0},
+		{at: 10*time.Second + time.Millisecond, wantBucket: 5, wantWindow: 10},
+	}
+	for _, tt := range tests {
+		now = start.Add(tt.at)
+		allowed := func(l rateLimiter) int {
+			n := 0
+			for i := 0; i < 10; i++ {
+				if l.allow(context.Background(), "1.2.3.4").Allowed {
+					n++
+				}
+			}
+			return n
+		}
+		if got := allowed(bucket); got != tt.wantBucket {
+			t.Errorf("at %v: token bucket allowed %d of 10, want %d", tt.at, got, tt.wantBucket)
+		}
+		if got := allowed(window); got != tt.wantWindow {
+			t.Errorf("at %v: sliding window allowed %d of 10, want %d", tt.at, got, tt.wantWindow)
+		}
+	}
+}
+
+// TestCustomKeyFunc keys requests on a tenant header: two tenants behind
+// one IP have a bucket each, and one tenant behind two IPs shares its own.
+func TestCustomKeyFunc(t *testing.T) {
+	tenant := func(r *http.Request) string { return r.Header.Get("X-Tenant") }
+	h := RateLimit(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), WithLimit(rate.Every(time.Minute)), WithBurst(2), WithKeyFunc(tenant))
+	request := func(tenant, ip string) int {
+		r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+		r.Header.Set("X-Tenant", tenant)
+		r.RemoteAddr = ip + ":1234"
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec.Code
+	}
+	for i, tt := range []struct {
+		tenant, ip string
+		want       int
+	}{
+		{tenant: "a", ip: "192.0.2.1", want: http.StatusOK},
+		{tenant: "a", ip: "192.0.2.1", want: http.StatusOK},
+		{tenant: "a", ip: "192.0.2.1", want: http.StatusTooManyRequests},
+		{tenant: "b", ip: "192.0.2.1", want: http.StatusOK},
+		{tenant: "a", ip: "198.51.100.7", want: http.StatusTooManyRequests},
+		{tenant: "b", ip: "198.51.100.7", want: http.StatusOK},
+		{tenant: "b", ip: "192.0.2.1", want: http.StatusTooManyRequests},
+	} {
+		if got := request(tt.tenant, tt.ip); got != tt.want {
+			t.Errorf("request %d (tenant %s from %s): status = %d, want %d", i+1, tt.tenant, tt.ip, got, tt.want)
+		}
+	}
+}
+
+// TestObserveModeCountsRejections checks the dry-run mode serves every
+// request while still counting the ones it would have rejected.
+func TestObserveModeCountsRejections(t *testing.T) {
+	stats := newLimiterStats()
+	h := rateLimiterMiddleware(func(w http.ResponseWriter, r *http.Request) {}, newIPLimiters(rate.Every(time.Minute), 2, time.Minute), WithStats(stats), WithObserve(true))
+	for i := 0; i < 5; i++ {
+		var rec *httptest.ResponseRecorder
+		captureStdout(t, func() { rec = serveGet(h, "/weather") })
+		if rec.Code != http.StatusOK {
+			t.Errorf("request %d: status = %d, want 200 in observe mode", i+1, rec.Code)
+		}
+		if wouldReject := rec.Header().Get("X-RateLimit-Would-Reject") == "true"; wouldReject != (i >= 2) {
+			t.Errorf("request %d: marked as rejected = %v, want %v", i+1, wouldReject, i >= 2)
+		}
+	}
+	snap := stats.snapshot(10)
+	if snap.Allowed != 2 || snap.Rejected != 3 {
+		t.Errorf("allowed, rejected = %d, %d, want 2, 3", snap.Allowed, snap.Rejected)
+	}
+	if len(snap.TopRejected) != 1 || snap.TopRejected[0].Rejected != 3 {
+		t.Errorf("top rejected = %+v, want the client with 3", snap.TopRejected)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisModeStandalone = "standalone"
+	redisModeSentinel   = "sentinel"
+	redisModeCluster    = "cluster"
+)
+
+// redisOptions validates the Redis settings in cfg and turns them into client
+// options for the configured deployment mode.
+func redisOptions(cfg Config) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:        cfg.RedisAddrs,
+		Username:     cfg.RedisUsername,
+		Password:     cfg.RedisPassword,
+		DB:           cfg.RedisDB,
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+		DialTimeout:  cfg.RedisDialTimeout,
+		ReadTimeout:  cfg.RedisReadTimeout,
+		WriteTimeout: cfg.RedisWriteTimeout,
+	}
+
+	switch cfg.RedisMode {
+	case redisModeStandalone:
+		if len(cfg.RedisAddrs) != 1 {
+			return nil, fmt.Errorf("standalone mode takes exactly one address in REDIS_ADDRS, got %d", len(cfg.RedisAddrs))
+		}
+	case redisModeSentinel:
+		if cfg.RedisMasterName == "" {
+			return nil, fmt.Errorf("REDIS_MASTER_NAME is required in sentinel mode")
+		}
+		opts.MasterName = cfg.RedisMasterName
+	case redisModeCluster:
+		if cfg.RedisDB != 0 {
+			return nil, fmt.Errorf("REDIS_DB must be 0 in cluster mode")
+		}
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE %q", cfg.RedisMode)
+	}
+
+	if cfg.RedisUsername != "" && cfg.RedisPassword == "" {
+		return nil, fmt.Errorf("REDIS_USERNAME is set but REDIS_PASSWORD is empty")
+	}
+	if cfg.RedisPoolSize > 0 && cfg.RedisMinIdleConns > cfg.RedisPoolSize {
+		return nil, fmt.Errorf("REDIS_MIN_IDLE_CONNS (%d) cannot exceed REDIS_POOL_SIZE (%d)", cfg.RedisMinIdleConns, cfg.RedisPoolSize)
+	}
+
+	if cfg.RedisTLSCAFile != "" && !cfg.RedisTLS {
+		return nil, fmt.Errorf("REDIS_TLS_CA_FILE is set but REDIS_TLS is not enabled")
+	}
+	if cfg.RedisTLS {
+		tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+		if cfg.RedisTLSCAFile != "" {
+			pem, err := os.ReadFile(cfg.RedisTLSCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read REDIS_TLS_CA_FILE: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("REDIS_TLS_CA_FILE %q contains no certificates", cfg.RedisTLSCAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return opts, nil
+}
+
+// newRedisClient builds the client for the configured deployment mode and
+// checks that it is reachable.
+func newRedisClient(cfg Config) (redis.UniversalClient, error) {
+	opts, err := redisOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var client redis.UniversalClient
+	switch cfg.RedisMode {
+	case redisModeSentinel:
+		client = redis.NewFailoverClient(opts.Failover())
+	case redisModeCluster:
+		client = redis.NewClusterClient(opts.Cluster())
+	default:
+		client = redis.NewClient(opts.Simple())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("could not reach redis (%s mode, %v): %v", cfg.RedisMode, cfg.RedisAddrs, err)
+	}
+	return client, nil
+}
+
+// redisBackend stores cache entries in Redis as hashes, see splitEntry, so
+// that single days can be read without fetching the rest.
+type redisBackend struct {
+	redisDB  redis.UniversalClient
+	codec    cacheCodec
+	compress bool
+}
+
+func (b *redisBackend) Close() error {
+	return b.redisDB.Close()
+}
+
+func newRedisBackend(redisDB redis.UniversalClient, codec cacheCodec, compress bool) *redisBackend {
+	return &redisBackend{redisDB: redisDB, codec: codec, compress: compress}
+}
+
+func (b *redisBackend) Get(ctx context.Context, key string) ([]byte, error) {
+	return b.read(ctx, key)
+}
+
+func (b *redisBackend) GetDays(ctx context.Context, key string, dates []string) ([]byte, error) {
+	return b.read(ctx, key, dates...)
+}
+
+// read reads the entry at key, limited to the given dates if any. Keys
+// written as plain strings before entries were stored as hashes are still
+// read, in full.
+func (b *redisBackend) read(ctx context.Context, key string, dates ...string) ([]byte, error) {
+	fields := []string(nil)
+	if len(dates) > 0 {
+		fields = append(fields, entryMetaField)
+		for _, date := range dates {
+			fields = append(fields, dayField(date))
+		}
+	}
+	hash, err := getRedisHash(ctx, b.redisDB, key, fields...)
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		val, err := getRedisValue(ctx, b.redisDB, key)
+		if err == redis.Nil {
+			return nil, errCacheMiss
+		}
+		if err != nil || len(dates) == 0 {
+			return []byte(val), err
+		}
+		if filtered, ok := filterEntryDays([]byte(val), dates); ok {
+			return filtered, nil
+		}
+		return nil, errCacheMiss
+	}
+	if err == redis.Nil {
+		return nil, errCacheMiss
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := hash[entryMetaField]; !ok {
+		return nil, errCacheMiss
+	}
+	return joinEntry(hash)
+}
+
+func (b *redisBackend) GetMany(ctx context.Context, keys []string) (map[string][]byte, []string, error) {
+	hashes, misses, legacy, err := getRedisHashes(ctx, b.redisDB, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	found := make(map[string][]byte, len(hashes))
+	for key, fields := range hashes {
+		val, err := joinEntry(fields)
+		if err != nil {
+			misses = append(misses, key)
+			continue
+		}
+		found[key] = val
+	}
+	if len(legacy) > 0 {
+		values, legacyMisses, err := getRedisValues(ctx, b.redisDB, legacy)
+		if err != nil {
+			return nil, nil, err
+		}
+		for key, val := range values {
+			found[key] = []byte(val)
+		}
+		misses = append(misses, legacyMisses...)
+	}
+	return found, misses, nil
+}
+
+func (b *redisBackend) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	fields, err := splitEntry(value)
+	if err != nil {
+		return err
+	}
+	for name, field := range fields {
+		if fields[name], err = b.codec.Encode(field); err != nil {
+			return err
+		}
+	}
+	return setRedisHash(ctx, b.redisDB, key, fields, ttl, b.compress)
+}
+
+func (b *redisBackend) Delete(ctx context.Context, key string) error {
+	return b.redisDB.Del(ctx, key).Err()
+}
+
+func (b *redisBackend) DeleteMatching(ctx context.Context, pattern string) (int64, error) {
+	return deleteRedisPattern(ctx, b.redisDB, pattern)
+}
+
+func (b *redisBackend) CountKeys(ctx context.Context, pattern string, limit int64) (int64, bool, error) {
+	return countRedisKeys(ctx, b.redisDB, pattern, limit)
+}
+
+// ListKeys reads the TTL, memory usage and fetch time of each key in one
+// pipeline. A cluster has one cursor per node, so listing is unsupported
+// there.
+func (b *redisBackend) ListKeys(ctx context.Context, pattern string, cursor uint64, count int64) ([]cachedKey, uint64, error) {
+	if _, ok := b.redisDB.(*redis.ClusterClient); ok {
+		return nil, 0, errKeyListUnsupported
+	}
+	keys, next, err := b.redisDB.Scan(ctx, cursor, pattern, count).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	ttls := make([]*redis.DurationCmd, len(keys))
+	sizes := make([]*redis.IntCmd, len(keys))
+	metas := make([]*redis.StringCmd, len(keys))
+	// Errors are per key: an entry that expired since the SCAN, a legacy
+	// string key or a server without MEMORY USAGE only loses those fields.
+	b.redisDB.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			ttls[i] = pipe.PTTL(ctx, key)
+			sizes[i] = pipe.MemoryUsage(ctx, key)
+			metas[i] = pipe.HGet(ctx, key, entryMetaField)
+		}
+		return nil
+	})
+	listed := make([]cachedKey, len(keys))
+	for i, key := range keys {
+		listed[i] = cachedKey{Key: key, TTL: max(ttls[i].Val(), 0), Size: sizes[i].Val()}
+		if meta, err := decodeValue(metas[i].Val()); err == nil {
+			if entry, ok := decodeCacheEntry([]byte(meta)); ok {
+				listed[i].FetchedAt = entry.FetchedAt
+			}
+		}
+	}
+	return listed, next, nil
+}
+
+func (b *redisBackend) MemoryInfo(ctx context.Context) (map[string]string, error) {
+	return redisMemoryInfo(ctx, b.redisDB)
+}
+
+// unlockScript deletes the lock only if it still holds the caller's token, so
+// an instance whose lock expired cannot release the next holder's.
+var unlockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// lockKey is kept outside cacheKeyPrefix so locks are never counted or
+// purged as cache entries.
+func lockKey(key string) string {
+	return "lock:" + key
+}
+
+func (b *redisBackend) Lock(ctx context.Context, key string, ttl time.Duration) (string, bool, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", false, err
+	}
+	token := hex.EncodeToString(buf)
+	ok, err := b.redisDB.SetNX(ctx, lockKey(key), token, ttl).Result()
+	return token, ok, err
+}
+
+func (b *redisBackend) Unlock(ctx context.Context, key, token string) error {
+	return unlockScript.Run(ctx, b.redisDB, []string{lockKey(key)}, token).Err()
+}
+
+// invalidationChannel carries the patterns purged by any instance.
+const invalidationChannel = "weather:invalidate"
+
+type invalidationMessage struct {
+	Pattern string `json:"pattern"`
+}
+
+func (b *redisBackend) PublishInvalidation(ctx context.Context, pattern string) error {
+	msg, err := json.Marshal(invalidationMessage{Pattern: pattern})
+	if err != nil {
+		return err
+	}
+	return b.redisDB.Publish(ctx, invalidationChannel, msg).Err()
+}
+
+// SubscribeInvalidations resubscribes with exponential backoff whenever the
+// subscription drops.
+func (b *redisBackend) SubscribeInvalidations(ctx context.Context, evict func(pattern string)) {
+	backoff := time.Second
+	for {
+		subscribed, err := b.readInvalidations(ctx, evict)
+		if ctx.Err() != nil {
+			return
+		}
+		if subscribed {
+			backoff = time.Second
+		}
+		fmt.Println("Cache invalidation subscription lost, retrying in", backoff, ":", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, time.Minute)
+	}
+}
+
+// readInvalidations subscribes once and handles messages until the
+// subscription fails, reporting whether it got as far as subscribing.
+func (b *redisBackend) readInvalidations(ctx context.Context, evict func(pattern string)) (bool, error) {
+	pubsub := b.redisDB.Subscribe(ctx, invalidationChannel)
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		return false, err
+	}
+	for {
+		msg, err := pubsub.ReceiveMessage(ctx)
+		if err != nil {
+			return true, err
+		}
+		var inv invalidationMessage
+		if err := json.Unmarshal([]byte(msg.Payload), &inv); err != nil || inv.Pattern == "" {
+			fmt.Println("Ignoring malformed cache invalidation :", msg.Payload)
+			continue
+		}
+		evict(inv.Pattern)
+	}
+}
+
+func (b *redisBackend) Ping(ctx context.Context) error {
+	return b.redisDB.Ping(ctx).Err()
+}
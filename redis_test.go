@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	backend := newRedisBackend(client, cacheCodecs["json"], true)
+	ctx := context.Background()
+
+	token, ok, err := backend.Lock(ctx, "k", time.Second)
+	if err != nil || !ok {
+		t.Fatalf("Lock() = %v, %v, want the lock", ok, err)
+	}
+	steps := []struct {
+		name   string
+		do     func()
+		wantOK bool
+	}{
+		{name: "held", do: func() {}, wantOK: false},
+		{name: "unlocked with another token", do: func() { backend.Unlock(ctx, "k", "other") }, wantOK: false},
+		{name: "unlocked with its token", do: func() { backend.Unlock(ctx, "k", token) }, wantOK: true},
+		{name: "held again", do: func() {}, wantOK: false},
+		{name: "expired", do: func() { mr.FastForward(time.Second) }, wantOK: true},
+	}
+	for _, step := range steps {
+		step.do()
+		next, ok, err := backend.Lock(ctx, "k", time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != step.wantOK {
+			t.Fatalf("%s: Lock() = %v, want %v", step.name, ok, step.wantOK)
+		}
+		if ok {
+			token = next
+		}
+	}
+	if mr.Exists(cacheKeyPrefix + "k") {
+		t.Error("the lock was stored under the cache prefix")
+	}
+}
+
+// TestFetchSharedAcrossInstances runs the miss path of two instances
+// sharing a Redis at once, with a singleflight group each.
+func TestFetchSharedAcrossInstances(t *testing.T) {
+	calls := stubProvider(t, 300*time.Millisecond, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.LocalCacheTTL = time.Nanosecond
+	a, mr := newTestCache(t, cfg)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+	b := newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), newCacheHealth(), cfg)
+	budget := newUpstreamBudget(0, 0, time.UTC, nil)
+	q := defaultQuery("istanbul")
+
+	var wg sync.WaitGroup
+	results := make([][]byte, 2)
+	for i, cache := range []*tieredCache{a, b} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data, err := fetchShared(context.Background(), cache, budget, cfg, q, "test", time.Minute)
+			if err != nil {
+				t.Errorf("instance %d: %v", i, err)
+			}
+			results[i] = data
+		}()
+	}
+	wg.Wait()
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+	if !bytes.Equal(results[0], results[1]) {
+		t.Error("the instances served different payloads")
+	}
+	if mr.Exists(lockKey(q.cacheKey())) {
+		t.Error("the lock was not released")
+	}
+}
+
+// TestFetchSharedLockHolderDies leaves a lock nobody releases, and checks
+// that the miss path stops waiting for it and fetches.
+func TestFetchSharedLockHolderDies(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	q := defaultQuery("istanbul")
+	if _, ok := cache.Lock(context.Background(), q.cacheKey(), time.Minute); !ok {
+		t.Fatal("Lock() failed")
+	}
+	start := time.Now()
+	if _, err := fetchShared(context.Background(), cache, newUpstreamBudget(0, 0, time.UTC, nil), cfg, q, "test", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < fetchLockWait || waited > fetchLockWait+500*time.Millisecond {
+		t.Errorf("waited %s for the lock, want about %s", waited, fetchLockWait)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+}
+
+// TestNewRedisClient connects a standalone client to miniredis, and checks
+// that an unreachable server fails at startup with the mode and addresses
+// in the error.
+func TestNewRedisClient(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := testConfig(t)
+	cfg.RedisMode = redisModeStandalone
+	cfg.RedisAddrs = []string{mr.Addr()}
+	client, err := newRedisClient(cfg)
+	if err != nil {
+		t.Fatalf("newRedisClient: %v", err)
+	}
+	defer client.Close()
+	if _, ok := client.(*redis.Client); !ok {
+		t.Errorf("standalone client is a %T, want *redis.Client", client)
+	}
+	if err := client.Set(context.Background(), "test:client", "ok", 0).Err(); err != nil {
+		t.Fatalf("Set: %v", err)
+	}
+	if got, _ := mr.Get("test:client"); got != "ok" {
+		t.Errorf("miniredis holds %q, want ok", got)
+	}
+
+	addr := mr.Addr()
+	mr.Close()
+	cfg.RedisAddrs = []string{addr}
+	cfg.RedisDialTimeout = 100 * time.Millisecond
+	if _, err := newRedisClient(cfg); err == nil {
+		t.Fatal("newRedisClient succeeded with nothing listening")
+	} else if want := "could not reach redis (standalone mode, [" + addr + "])"; !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error = %q, want it to start with %q", err, want)
+	}
+}
+
+func TestRedisOptions(t *testing.T) {
+	certFile, _, _ := writeSelfSignedCert(t, t.TempDir())
+	base := Config{RedisMode: redisModeStandalone, RedisAddrs: []string{"localhost:6379"}}
+	tests := []struct {
+		name    string
+		modify  func(cfg *Config)
+		check   func(t *testing.T, opts *redis.UniversalOptions)
+		wantErr string
+	}{
+		{
+			name: "standalone defaults",
+			check: func(t *testing.T, opts *redis.UniversalOptions) {
+				if opts.TLSConfig != nil || opts.DB != 0 || opts.Password != "" {
+					t.Errorf("options = %+v, want plain defaults", opts)
+				}
+			},
+		},
+		{
+			name: "auth, db and pool",
+			modify: func(cfg *Config) {
+				cfg.RedisUsername, cfg.RedisPassword = "app", "secret"
+				cfg.RedisDB, cfg.RedisPoolSize, cfg.RedisMinIdleConns = 2, 20, 5
+			},
+			check: func(t *testing.T, opts *redis.UniversalOptions) {
+				if opts.Username != "app" || opts.Password != "secret" || opts.DB != 2 || opts.PoolSize != 20 || opts.MinIdleConns != 5 {
+					t.Errorf("options = %+v", opts)
+				}
+			},
+		},
+		{
+			name:   "tls",
+			modify: func(cfg *Config) { cfg.RedisTLS = true },
+			check: func(t *testing.T, opts *redis.UniversalOptions) {
+				if opts.TLSConfig == nil || opts.TLSConfig.RootCAs != nil {
+					t.Errorf("TLSConfig = %+v, want system roots", opts.TLSConfig)
+				}
+			},
+		},
+		{
+			name:   "tls with a CA file",
+			modify: func(cfg *Config) { cfg.RedisTLS, cfg.RedisTLSCAFile = true, certFile },
+			check: func(t *testing.T, opts *redis.UniversalOptions) {
+				if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil {
+					t.Errorf("TLSConfig = %+v, want the CA file's pool", opts.TLSConfig)
+				}
+			},
+		},
+		{
+			name:   "sentinel",
+			modify: func(cfg *Config) { cfg.RedisMode, cfg.RedisMasterName = redisModeSentinel, "primary" },
+			check: func(t *testing.T, opts *redis.UniversalOptions) {
+				if opts.MasterName != "primary" {
+					t.Errorf("MasterName = %q, want primary", opts.MasterName)
+				}
+			},
+		},
+		{
+			name:    "standalone with two addresses",
+			modify:  func(cfg *Config) { cfg.RedisAddrs = []string{"a:6379", "b:6379"} },
+			wantErr: "standalone mode takes exactly one address in REDIS_ADDRS, got 2",
+		},
+		{
+			name:    "sentinel without a master name",
+			modify:  func(cfg *Config) { cfg.RedisMode = redisModeSentinel },
+			wantErr: "REDIS_MASTER_NAME is required in sentinel mode",
+		},
+		{
+			name:    "cluster with a db",
+			modify:  func(cfg *Config) { cfg.RedisMode, cfg.RedisDB = redisModeCluster, 1 },
+			wantErr: "REDIS_DB must be 0 in cluster mode",
+		},
+		{
+			name:    "unknown mode",
+			modify:  func(cfg *Config) { cfg.RedisMode = "ring" },
+			wantErr: `unknown REDIS_MODE "ring"`,
+		},
+		{
+			name:    "username without a password",
+			modify:  func(cfg *Config) { cfg.RedisUsername = "app" },
+			wantErr: "REDIS_USERNAME is set but REDIS_PASSWORD is empty",
+		},
+		{
+			name:    "more idle connections than the pool",
+			modify:  func(cfg *Config) { cfg.RedisPoolSize, cfg.RedisMinIdleConns = 5, 10 },
+			wantErr: "REDIS_MIN_IDLE_CONNS (10) cannot exceed REDIS_POOL_SIZE (5)",
+		},
+		{
+			name:    "CA file without tls",
+			modify:  func(cfg *Config) { cfg.RedisTLSCAFile = certFile },
+			wantErr: "REDIS_TLS_CA_FILE is set but REDIS_TLS is not enabled",
+		},
+		{
+			name:    "missing CA file",
+			modify:  func(cfg *Config) { cfg.RedisTLS, cfg.RedisTLSCAFile = true, "/nonexistent/ca.pem" },
+			wantErr: "could not read REDIS_TLS_CA_FILE",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			if tt.modify != nil {
+				tt.modify(&cfg)
+			}
+			opts, err := redisOptions(cfg)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("redisOptions() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("redisOptions() error = %v", err)
+			}
+			tt.check(t, opts)
+		})
+	}
+}
+
+// roundTripCounter is a go-redis hook counting single commands and
+// pipelines sent to the server.
+type roundTripCounter struct {
+	commands, pipelines atomic.Int64
+}
+
+func (h *roundTripCounter) DialHook(next redis.DialHook) redis.DialHook { return next }
+
+func (h *roundTripCounter) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		h.commands.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (h *roundTripCounter) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.pipelines.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// TestGetManyOneRoundTrip reads a batch mixing a local hit, a Redis hit and
+// two misses, and checks the keys not held locally are read in a single
+// pipeline, one HGETALL each.
+func TestGetManyOneRoundTrip(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	counter := &roundTripCounter{}
+	client.AddHook(counter)
+	cfg := testConfig(t)
+	cfg.LocalCacheSize = 10
+	cfg.LocalCacheTTL = time.Minute
+	cache := newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), newCacheHealth(), cfg)
+	ctx := context.Background()
+	local, remote := defaultQuery("istanbul").cacheKey(), defaultQuery("ankara").cacheKey()
+	cache.Set(ctx, local, testEntry(t, testWeather), time.Hour)
+	if err := cache.backend.Set(ctx, remote, testEntry(t, testWeather), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	missing := []string{defaultQuery("izmir").cacheKey(), defaultQuery("bursa").cacheKey()}
+
+	counter.commands.Store(0)
+	counter.pipelines.Store(0)
+	before := mr.CommandCount()
+	found, misses := cache.GetMany(ctx, append([]string{local, remote}, missing...))
+	if len(found) != 2 || found[local] == nil || found[remote] == nil {
+		t.Errorf("found %d entries, want %s and %s", len(found), local, remote)
+	}
+	if len(misses) != 2 {
+		t.Errorf("misses = %v, want %v", misses, missing)
+	}
+	if got := counter.pipelines.Load(); got != 1 {
+		t.Errorf("%d pipelines sent, want 1", got)
+	}
+	if got := counter.commands.Load(); got != 0 {
+		t.Errorf("%d commands sent outside the pipeline, want 0", got)
+	}
+	if got := mr.CommandCount() - before; got != 3 {
+		t.Errorf("Redis ran %d commands, want 3, one per key not held locally", got)
+	}
+}
+
+// TestInvalidationAcrossInstances runs two caches on one Redis and checks
+// a purge by the first evicts the second's local copy, while malformed
+// invalidations are ignored.
+func TestInvalidationAcrossInstances(t *testing.T) {
+	mr := miniredis.RunT(t)
+	cfg := testConfig(t)
+	cfg.LocalCacheSize = 10
+	cfg.LocalCacheTTL = time.Hour
+	newInstance := func() *tieredCache {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return newTieredCache(newRedisBackend(client, cacheCodecs["json"], true), newCacheHealth(), cfg)
+	}
+	first, second := newInstance(), newInstance()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	key, other := defaultQuery("istanbul").cacheKey(), defaultQuery("ankara").cacheKey()
+
+	evicted := func(key string) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			if _, ok := second.local.Get(key); !ok {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("the second instance still holds %s locally", key)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	out := captureStdout(t, func() {
+		go second.listenInvalidations(ctx)
+		for deadline := time.Now().Add(2 * time.Second); mr.PubSubNumSub(invalidationChannel)[invalidationChannel] == 0; {
+			if time.Now().After(deadline) {
+				t.Fatal("the second instance never subscribed")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		for _, k := range []string{key, other} {
+			first.Set(ctx, k, testEntry(t, testWeather), time.Hour)
+			if _, ok := second.Get(ctx, k); !ok {
+				t.Fatalf("the second instance cannot read %s", k)
+			}
+		}
+
+		mr.Publish(invalidationChannel, "not json")
+		mr.Publish(invalidationChannel, `{"pattern":""}`)
+		// Messages arrive in order, so once this one is handled the
+		// malformed ones have been too.
+		first.Invalidate(ctx, escapeGlob(other))
+		evicted(other)
+		if _, ok := second.local.Get(key); !ok {
+			t.Fatal("a malformed invalidation evicted a local entry")
+		}
+
+		if _, err := first.DeleteMatching(ctx, escapeGlob(key)); err != nil {
+			t.Fatalf("DeleteMatching: %v", err)
+		}
+		evicted(key)
+		if _, ok := second.Get(ctx, key); ok {
+			t.Error("the second instance still serves the purged entry")
+		}
+		cancel()
+	})
+	if got := strings.Count(out, "Ignoring malformed cache invalidation"); got != 2 {
+		t.Errorf("logged %d malformed invalidations, want 2:\n%s", got, out)
+	}
+}
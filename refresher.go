@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotKeys counts requests per cache key so that the most requested locations
+// can be refreshed before they expire.
+type hotKeys struct {
+	mu     sync.Mutex
+	counts map[string]*hotKey
+}
+
+type hotKey struct {
+	query weatherQuery
+	count int
+}
+
+func newHotKeys() *hotKeys {
+	return &hotKeys{counts: make(map[string]*hotKey)}
+}
+
+func (h *hotKeys) Record(q weatherQuery) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := q.cacheKey()
+	if k, ok := h.counts[key]; ok {
+		k.count++
+		return
+	}
+	h.counts[key] = &hotKey{query: q, count: 1}
+}
+
+// top returns the n most requested queries. Every count is halved afterwards
+// so that locations which stop being requested fall out of the set.
+func (h *hotKeys) top(n int) []weatherQuery {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]*hotKey, 0, len(h.counts))
+	for _, k := range h.counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].count > keys[j].count })
+	if len(keys) > n {
+		keys = keys[:n]
+	}
+	queries := make([]weatherQuery, len(keys))
+	for i, k := range keys {
+		queries[i] = k.query
+	}
+	for key, k := range h.counts {
+		if k.count /= 2; k.count == 0 {
+			delete(h.counts, key)
+		}
+	}
+	return queries
+}
+
+// runRefresher re-fetches the hottest locations shortly before their cache
+// entries stop being fresh, so users requesting them never pay for a miss.
+// Each cycle makes at most cfg.HotRefreshMaxCalls upstream requests. It
+// returns when ctx is cancelled.
+func runRefresher(ctx context.Context, cache *tieredCache, budget *upstreamBudget, hot *hotKeys, cfg Config) {
+	ticker := time.NewTicker(cfg.HotRefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Refreshing ahead is the first call to give up when short on budget.
+		key := os.Getenv("API_KEY")
+		if key == "" || budget.saving() {
+			continue
+		}
+		queries := hot.top(cfg.HotRefreshTop)
+		keys := make([]string, len(queries))
+		for i, q := range queries {
+			keys[i] = q.cacheKey()
+		}
+		found, _ := cache.GetMany(ctx, keys)
+		calls := 0
+		for _, q := range queries {
+			if calls >= cfg.HotRefreshMaxCalls || ctx.Err() != nil {
+				break
+			}
+			if val, ok := found[q.cacheKey()]; ok {
+				entry, ok := decodeCacheEntry(val)
+				if ok && (entry.Status != 0 || time.Until(entry.FreshUntil) > cfg.HotRefreshAhead) {
+					continue
+				}
+			}
+			calls++
+			if _, err := fetchAndCache(ctx, cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q)); err != nil {
+				fmt.Printf("Error refreshing hot key %q : %v\n", q.cacheKey(), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// TestRefresherRefetchesHotKeys runs the refresher over two hot locations,
+// one about to go stale and one fresh for another hour, and checks only the
+// first is fetched again, with no request made for it.
+func TestRefresherRefetchesHotKeys(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.HotRefreshInterval = 10 * time.Millisecond
+	cfg.HotRefreshAhead = time.Minute
+	cache, _ := newTestCache(t, cfg)
+	expiring, fresh := defaultQuery("istanbul"), defaultQuery("ankara")
+	cache.Set(context.Background(), expiring.cacheKey(), entryFreshUntil(t, time.Now().Add(10*time.Second)), time.Hour)
+	cache.Set(context.Background(), fresh.cacheKey(), entryFreshUntil(t, time.Now().Add(time.Hour)), time.Hour)
+	hot := newHotKeys()
+	for i := 0; i < 8; i++ {
+		hot.Record(expiring)
+		hot.Record(fresh)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runRefresher(ctx, cache, newUpstreamBudget(0, 0, time.UTC, nil), hot, cfg)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for calls.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// Leave the refresher a few more cycles to fetch what it should not.
+	time.Sleep(5 * cfg.HotRefreshInterval)
+	cancel()
+	<-done
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("provider called %d times, want 1", got)
+	}
+	val, ok := cache.Get(context.Background(), expiring.cacheKey())
+	if !ok {
+		t.Fatal("the refreshed entry is not cached")
+	}
+	if entry, _ := decodeCacheEntry(val); time.Until(entry.FreshUntil) <= cfg.HotRefreshAhead {
+		t.Errorf("the entry is fresh until %v, want it refreshed", entry.FreshUntil)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// requestIDHeader carries the ID of a request, both ways, and on to the
+// provider.
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the IDs taken from clients.
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// requestIDMiddleware gives every request an ID, the client's X-Request-ID
+// when it is a sane token and a new UUID otherwise, and sends it back in
+// the response's X-Request-ID.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// validRequestID reports whether id is a token that is safe to log and
+// echo: letters, digits and -_.: only.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range []byte(id) {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random version 4 UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// requestID returns the ID of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// logf logs a line about the request ctx belongs to, prefixed with its ID.
+func logf(ctx context.Context, format string, args ...any) {
+	if id := requestID(ctx); id != "" {
+		format = "request_id=" + id + " " + format
+	}
+	fmt.Printf(format+"\n", args...)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{name: "client ID", header: "abc-123_x.y:z", want: "abc-123_x.y:z"},
+		{name: "no ID", header: ""},
+		{name: "unsafe characters", header: "abc\"<script>"},
+		{name: "too long", header: strings.Repeat("a", maxRequestIDLength+1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var seen string
+			h := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = requestID(r.Context())
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/weather", nil)
+			if tt.header != "" {
+				r.Header.Set(requestIDHeader, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			got := rec.Header().Get(requestIDHeader)
+			if got != seen {
+				t.Errorf("response ID %q differs from the request's %q", got, seen)
+			}
+			if tt.want != "" && got != tt.want {
+				t.Errorf("ID = %q, want %q", got, tt.want)
+			}
+			if tt.want == "" && !uuidPattern.MatchString(got) {
+				t.Errorf("ID = %q, want a new UUID", got)
+			}
+		})
+	}
+}
+
+// captureStdout returns what f prints.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	f()
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestLogf(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "id-1")
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "request", ctx: ctx, want: "request_id=id-1 Error X : boom\n"},
+		{name: "no request", ctx: context.Background(), want: "Error X : boom\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := captureStdout(t, func() { logf(tt.ctx, "Error X : %v", "boom") }); got != tt.want {
+				t.Errorf("logf() printed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBudgetLogsRequestID(t *testing.T) {
+	ctx := context.WithValue(context.Background(), requestIDKey{}, "id-2")
+	budget := newUpstreamBudget(1, 1, time.UTC, nil)
+	out := captureStdout(t, func() { budget.take(ctx) })
+	if !strings.HasPrefix(out, "request_id=id-2 Upstream budget") {
+		t.Errorf("budget threshold logged %q, want it tagged with the request ID", out)
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import "net/http"
+
+// routeLimitMiddleware applies the limiter of each request's route on top of
+// the route's own limits, so that costly endpoints can be held tighter than
+// the rest. limiters is keyed by the mux's route patterns, such as
+// /weather/batch, and a request's route is the pattern mux would serve it
+// with, whatever its query string. Routes not listed keep their default
+// limits alone.
+func routeLimitMiddleware(next http.Handler, mux *http.ServeMux, limiters map[string]rateLimiter, opts ...Option) http.Handler {
+	if len(limiters) == 0 {
+		return next
+	}
+	limited := make(map[string]http.Handler, len(limiters))
+	for pattern, limiter := range limiters {
+		limited[pattern] = RateLimit(next, append([]Option{WithLimiter(limiter)}, opts...)...)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := mux.Handler(r); limited[pattern] != nil {
+			limited[pattern].ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
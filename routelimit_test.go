@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// TestRouteLimits gives two routes different limits and checks one client
+// exhausting either leaves the other, and routes without a limit, alone.
+func TestRouteLimits(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	for _, pattern := range []string{"/weather", "/weather/batch", "/status"} {
+		mux.Handle(pattern, ok)
+	}
+	h := routeLimitMiddleware(mux, mux, map[string]rateLimiter{
+		"/weather":       newIPLimiters(rate.Every(time.Minute), 3, time.Minute),
+		"/weather/batch": newIPLimiters(rate.Every(time.Minute), 1, time.Minute),
+	})
+
+	for i, tt := range []struct {
+		target string
+		want   int
+	}{
+		{target: "/weather/batch?country=a,b", want: http.StatusOK},
+		{target: "/weather/batch?country=c,d", want: http.StatusTooManyRequests},
+		{target: "/weather?country=istanbul", want: http.StatusOK},
+		{target: "/weather?country=ankara", want: http.StatusOK},
+		{target: "/weather?country=izmir", want: http.StatusOK},
+		{target: "/weather?country=bursa", want: http.StatusTooManyRequests},
+		{target: "/weather/batch?country=a,b", want: http.StatusTooManyRequests},
+		{target: "/status", want: http.StatusOK},
+		{target: "/status", want: http.StatusOK},
+	} {
+		if rec := serveGet(h, tt.target); rec.Code != tt.want {
+			t.Errorf("request %d, %s: status = %d, want %d", i+1, tt.target, rec.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+const (
+	rateLimitAlgorithmTokenBucket   = "token-bucket"
+	rateLimitAlgorithmSlidingWindow = "sliding-window"
+)
+
+// slidingWindowLimiters admits at most burst requests per client in any
+// window of burst/limit seconds, which is the long-run rate of the token
+// bucket without its burst at window boundaries. Each client keeps the
+// times of its requests in the window, so at most burst of them.
+type slidingWindowLimiters struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	window    time.Duration
+	idle      time.Duration
+	now       func() time.Time
+	lastSweep time.Time
+	logs      map[string]*requestLog
+}
+
+// requestLog is a ring of the times of a client's latest requests, oldest
+// first from start.
+type requestLog struct {
+	times []time.Time
+	start int
+	n     int
+}
+
+func newSlidingWindowLimiters(limit rate.Limit, burst int, idle time.Duration) *slidingWindowLimiters {
+	window := time.Duration(float64(burst) / float64(limit) * float64(time.Second))
+	return &slidingWindowLimiters{
+		limit:     limit,
+		burst:     burst,
+		window:    window,
+		idle:      max(idle, window),
+		now:       time.Now,
+		lastSweep: time.Now(),
+		logs:      make(map[string]*requestLog),
+	}
+}
+
+func (l *slidingWindowLimiters) allow(ctx context.Context, key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastSweep) >= l.idle {
+		l.sweep(now)
+	}
+	log, ok := l.logs[key]
+	if !ok {
+		log = &requestLog{times: make([]time.Time, l.burst)}
+		l.logs[key] = log
+	}
+	log.prune(now.Add(-l.window))
+
+	d := rateDecision{Allowed: log.n < l.burst, Limit: l.burst, Rate: l.limit}
+	if d.Allowed {
+		log.times[(log.start+log.n)%l.burst] = now
+		log.n++
+	} else {
+		d.RetryAfter = log.times[log.start].Add(l.window).Sub(now)
+	}
+	d.Remaining = l.burst - log.n
+	d.Reset = log.times[(log.start+log.n-1)%l.burst].Add(l.window).Sub(now)
+	return d
+}
+
+// peek counts key's requests in the window without recording one, or
+// forgetting those that left it.
+func (l *slidingWindowLimiters) peek(ctx context.Context, key string) rateDecision {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	d := rateDecision{Allowed: true, Limit: l.burst, Rate: l.limit, Remaining: l.burst}
+	log, ok := l.logs[key]
+	if !ok {
+		return d
+	}
+	since, left := now.Add(-l.window), 0
+	for left < log.n && !log.times[(log.start+left)%l.burst].After(since) {
+		left++
+	}
+	n := log.n - left
+	if n == 0 {
+		return d
+	}
+	d.Allowed = n < l.burst
+	d.Remaining = l.burst - n
+	d.Reset = log.times[(log.start+log.n-1)%l.burst].Add(l.window).Sub(now)
+	if !d.Allowed {
+		d.RetryAfter = log.times[(log.start+left)%l.burst].Add(l.window).Sub(now)
+	}
+	return d
+}
+
+// prune forgets the requests made at or before since.
+func (log *requestLog) prune(since time.Time) {
+	for log.n > 0 && !log.times[log.start].After(since) {
+		log.start = (log.start + 1) % len(log.times)
+		log.n--
+	}
+}
+
+// sweep drops the logs of clients idle since now minus idle, which is never
+// shorter than the window, so only empty logs are dropped. l.mu must be held.
+func (l *slidingWindowLimiters) sweep(now time.Time) {
+	for key, log := range l.logs {
+		if log.n == 0 || now.Sub(log.times[(log.start+log.n-1)%l.burst]) >= l.idle {
+			delete(l.logs, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// redisSlidingWindowScript is the Redis counterpart of slidingWindowLimiters.
+// KEYS[1] is a sorted set of request times in microseconds, by the Redis
+// clock so that instances agree. It prunes the times older than ARGV[1]
+// microseconds, adds the request as member ARGV[3] if fewer than ARGV[2]
+// remain, and returns whether it did, how many requests are in the window
+// and the milliseconds until the oldest and the newest leave it. The set
+// expires a second after its newest request leaves the window.
+var redisSlidingWindowScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[1])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local n = redis.call("ZCARD", KEYS[1])
+local allowed = 0
+if n < tonumber(ARGV[2]) then
+	redis.call("ZADD", KEYS[1], now, ARGV[3])
+	n = n + 1
+	allowed = 1
+end
+redis.call("PEXPIRE", KEYS[1], math.ceil(window / 1000) + 1000)
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")
+local newest = redis.call("ZRANGE", KEYS[1], -1, -1, "WITHSCORES")
+return {allowed, n, math.ceil((oldest[2] + window - now) / 1000), math.ceil((newest[2] + window - now) / 1000)}`)
+
+// slidingWindowAllow runs redisSlidingWindowScript for key.
+func (l *redisLimiter) slidingWindowAllow(ctx context.Context, key string) (rateDecision, error) {
+	member := strconv.FormatUint(rand.Uint64(), 36)
+	res, err := redisSlidingWindowScript.Run(ctx, l.redisDB, []string{l.prefix + key}, l.window.Microseconds(), l.burst, member).Int64Slice()
+	if err == nil && len(res) != 4 {
+		err = fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	if err != nil {
+		return rateDecision{}, err
+	}
+	d := rateDecision{
+		Allowed:   res[0] == 1,
+		Limit:     int(l.burst),
+		Rate:      l.limit,
+		Remaining: int(max(l.burst-res[1], 0)),
+		Reset:     time.Duration(max(res[3], 0)) * time.Millisecond,
+	}
+	if !d.Allowed {
+		d.RetryAfter = time.Duration(max(res[2], 0)) * time.Millisecond
+	}
+	return d, nil
+}
+
+// redisSlidingWindowPeekScript counts the requests in the window of
+// ARGV[1] microseconds at KEYS[1] without adding one or pruning the set,
+// and returns the count with the milliseconds until the oldest and the
+// newest of them leave the window.
+var redisSlidingWindowPeekScript = redis.NewScript(`
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local window = tonumber(ARGV[1])
+local times = redis.call("ZRANGE", KEYS[1], 0, -1, "WITHSCORES")
+local n, oldest, newest = 0, 0, 0
+for i = 2, #times, 2 do
+	local score = tonumber(times[i])
+	if score > now - window then
+		if n == 0 then
+			oldest = score
+		end
+		n = n + 1
+		newest = score
+	end
+end
+if n == 0 then
+	return {0, 0, 0}
+end
+return {n, math.ceil((oldest + window - now) / 1000), math.ceil((newest + window - now) / 1000)}`)
+
+// slidingWindowPeek runs redisSlidingWindowPeekScript for key.
+func (l *redisLimiter) slidingWindowPeek(ctx context.Context, key string) (rateDecision, error) {
+	res, err := redisSlidingWindowPeekScript.Run(ctx, l.redisDB, []string{l.prefix + key}, l.window.Microseconds()).Int64Slice()
+	if err == nil && len(res) != 3 {
+		err = fmt.Errorf("unexpected rate limit script result %v", res)
+	}
+	if err != nil {
+		return rateDecision{}, err
+	}
+	d := rateDecision{
+		Allowed:   res[0] < l.burst,
+		Limit:     int(l.burst),
+		Rate:      l.limit,
+		Remaining: int(max(l.burst-res[0], 0)),
+		Reset:     time.Duration(max(res[2], 0)) * time.Millisecond,
+	}
+	if !d.Allowed {
+		d.RetryAfter = time.Duration(max(res[1], 0)) * time.Millisecond
+	}
+	return d, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultStreamInterval is how often an event stream gets the weather
+	// when it does not ask.
+	defaultStreamInterval = time.Minute
+	// streamWriteWait bounds every write to an event stream.
+	streamWriteWait = 10 * time.Second
+)
+
+// streamInterval reads the interval, in seconds, at which the weather is
+// sent from the request. Intervals under shortest are raised to it.
+func streamInterval(r *http.Request, shortest time.Duration) (time.Duration, error) {
+	v := r.URL.Query().Get("interval")
+	if v == "" {
+		return max(defaultStreamInterval, shortest), nil
+	}
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || seconds <= 0 {
+		return 0, fmt.Errorf("interval must be a positive number of seconds")
+	}
+	return max(time.Duration(seconds)*time.Second, shortest), nil
+}
+
+// weatherStreamHandler answers with an event stream of the weather for the
+// location, sent at once and then every interval, from the cache like any
+// other request, so that streams cost no more upstream calls than polling.
+// Comments are sent every cfg.StreamHeartbeat in between.
+func weatherStreamHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config, streams *openStreams) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseWeatherQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		interval, err := streamInterval(r, cfg.StreamMinInterval)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		payload, err := latestPayload(r.Context(), cache, group, budget, cfg, q)
+		if err != nil {
+			writeStreamError(w, r, err, budget)
+			return
+		}
+		streams.open.Add(1)
+		defer streams.open.Done()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		// Keeps nginx from buffering the events.
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		rc := http.NewResponseController(w)
+		send := func(event string) bool {
+			// The server's WriteTimeout would cut the stream off, so each
+			// write gets a deadline of its own.
+			rc.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if _, err := io.WriteString(w, event); err != nil {
+				return false
+			}
+			return rc.Flush() == nil
+		}
+		if !send(weatherEvent(payload)) {
+			return
+		}
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		heartbeat := time.NewTicker(cfg.StreamHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-tick.C:
+				payload, err := latestPayload(r.Context(), cache, group, budget, cfg, q)
+				if err != nil {
+					logf(r.Context(), "Error getting the weather to stream : %v", err)
+					continue
+				}
+				if !send(weatherEvent(payload)) {
+					return
+				}
+			case <-heartbeat.C:
+				if !send(": heartbeat\n\n") {
+					return
+				}
+			case <-r.Context().Done():
+				return
+			case <-streams.closing:
+				return
+			}
+		}
+	}
+}
+
+// weatherEvent formats payload as a weather event.
+func weatherEvent(payload []byte) string {
+	var b strings.Builder
+	b.WriteString("event: weather\n")
+	for _, line := range strings.Split(string(payload), "\n") {
+		b.WriteString("data: ")
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
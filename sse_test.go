@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestStreamInterval(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{query: "", want: time.Minute},
+		{query: "interval=120", want: 2 * time.Minute},
+		{query: "interval=30", want: 30 * time.Second},
+		{query: "interval=5", want: 30 * time.Second},
+		{query: "interval=0", wantErr: true},
+		{query: "interval=soon", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := streamInterval(httptest.NewRequest(http.MethodGet, "/weather/stream?"+tt.query, nil), 30*time.Second)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("streamInterval() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("streamInterval() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestWeatherStream reads events off a stream for longer than the server's
+// write timeout, then hangs up.
+func TestWeatherStream(t *testing.T) {
+	cfg := testConfig(t)
+	cfg.StreamMinInterval = time.Second
+	cfg.StreamHeartbeat = 300 * time.Millisecond
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	var group singleflight.Group
+	streams := newOpenStreams()
+	mux := http.NewServeMux()
+	mux.Handle("/weather/stream", weatherStreamHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), cfg, streams))
+	server := httptest.NewUnstartedServer(metricsMiddleware(gzipMiddleware(mux), mux, newHTTPMetrics()))
+	server.Config.WriteTimeout = 500 * time.Millisecond
+	server.Start()
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/weather/stream?country=istanbul&interval=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got := res.Header.Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	events, heartbeats := 0, 0
+	scanner := bufio.NewScanner(res.Body)
+	for events < 2 && scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "event: weather":
+			events++
+		case strings.HasPrefix(line, "data: "):
+			var weather Weather
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &weather); err != nil {
+				t.Fatalf("event data %q: %v", line, err)
+			}
+			if weather.ResolvedAddress != testWeather.ResolvedAddress {
+				t.Errorf("event is for %q, want %q", weather.ResolvedAddress, testWeather.ResolvedAddress)
+			}
+		case strings.HasPrefix(line, ":"):
+			heartbeats++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if events < 2 {
+		t.Fatalf("the stream ended after %d events", events)
+	}
+	if heartbeats == 0 {
+		t.Error("no heartbeat between the events")
+	}
+
+	cancel()
+	done := make(chan struct{})
+	go func() {
+		streams.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the stream kept going after the client left")
+	}
+}
+
+func TestWeatherStreamEndsOnShutdown(t *testing.T) {
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	var group singleflight.Group
+	streams := newOpenStreams()
+	h := weatherStreamHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), cfg, streams)
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		h(rec, httptest.NewRequest(http.MethodGet, "/weather/stream?country=istanbul", nil))
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	streams.close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the stream kept going after shutdown")
+	}
+	if !strings.HasPrefix(rec.Body.String(), "event: weather\ndata: {") {
+		t.Errorf("body = %q, want a weather event", rec.Body.String())
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// statsKeyScanCap bounds how many keys /admin/cache/stats will count.
+const statsKeyScanCap = 100000
+
+// cacheStats counts cache lookups made by redisMiddleware. Negative hits are
+// also counted as hits.
+type cacheStats struct {
+	hits         atomic.Int64
+	misses       atomic.Int64
+	negativeHits atomic.Int64
+}
+
+type cacheStatsSnapshot struct {
+	Hits           int64             `json:"hits"`
+	Misses         int64             `json:"misses"`
+	HitRatio       float64           `json:"hitRatio"`
+	NegativeHits   int64             `json:"negativeHits"`
+	Keys           *int64            `json:"keys,omitempty"`
+	KeysTruncated  bool              `json:"keysTruncated,omitempty"`
+	OversizedSkips int64             `json:"oversizedSkips"`
+	Memory         map[string]string `json:"memory,omitempty"`
+}
+
+func (s *cacheStats) snapshot() cacheStatsSnapshot {
+	snap := cacheStatsSnapshot{
+		Hits:         s.hits.Load(),
+		Misses:       s.misses.Load(),
+		NegativeHits: s.negativeHits.Load(),
+	}
+	if total := snap.Hits + snap.Misses; total > 0 {
+		snap.HitRatio = float64(snap.Hits) / float64(total)
+	}
+	return snap
+}
+
+func (s *cacheStats) reset() {
+	s.hits.Store(0)
+	s.misses.Store(0)
+	s.negativeHits.Store(0)
+}
+
+// cacheStatsHandler serves GET /admin/cache/stats. With ?reset=true the counters
+// are reset after the snapshot is taken.
+func cacheStatsHandler(cache *tieredCache, stats *cacheStats) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		snap := stats.snapshot()
+		snap.OversizedSkips = cache.oversized.Load()
+		if r.URL.Query().Get("reset") == "true" {
+			stats.reset()
+			cache.oversized.Store(0)
+		}
+
+		if counter, ok := cache.backend.(keyCounter); ok {
+			keys, truncated, err := counter.CountKeys(r.Context(), cacheKeyPrefix+"*", statsKeyScanCap)
+			if err != nil {
+				logf(r.Context(), "Error counting keys in cache : %v", err)
+			}
+			snap.Keys, snap.KeysTruncated = &keys, truncated
+		}
+		if reporter, ok := cache.backend.(memoryReporter); ok {
+			if memory, err := reporter.MemoryInfo(r.Context()); err == nil {
+				snap.Memory = memory
+			}
+		}
+		writeJSON(w, http.StatusOK, snap)
+	}
+}
+
+// countRedisKeys counts the keys matching pattern, giving up once limit keys
+// have been seen.
+func countRedisKeys(ctx context.Context, redisDB redis.UniversalClient, pattern string, limit int64) (int64, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	count := func(ctx context.Context, node redis.Cmdable) (int64, error) {
+		var n int64
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, pattern, 1000).Result()
+			if err != nil {
+				return n, err
+			}
+			n += int64(len(keys))
+			cursor = next
+			if cursor == 0 || n >= limit {
+				return n, nil
+			}
+		}
+	}
+
+	var total int64
+	var err error
+	if cluster, ok := redisDB.(*redis.ClusterClient); ok {
+		var mu sync.Mutex
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			n, err := count(ctx, node)
+			mu.Lock()
+			total += n
+			mu.Unlock()
+			return err
+		})
+	} else {
+		total, err = count(ctx, redisDB)
+	}
+	if total >= limit {
+		return limit, true, err
+	}
+	return total, false, err
+}
+
+// redisMemoryInfo returns the used_memory fields of INFO memory.
+func redisMemoryInfo(ctx context.Context, redisDB redis.UniversalClient) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	info, err := redisDB.Info(ctx, "memory").Result()
+	if err != nil {
+		return nil, err
+	}
+	memory := make(map[string]string)
+	scanner := bufio.NewScanner(strings.NewReader(info))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if ok && strings.HasPrefix(name, "used_memory") {
+			memory[name] = value
+		}
+	}
+	return memory, nil
+}
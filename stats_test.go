@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// TestCacheStatsUnderLoad counts hits and misses from many goroutines while
+// the stats are read, and checks that the totals add up. Run it with -race.
+func TestCacheStatsUnderLoad(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	stats := &cacheStats{}
+	var group singleflight.Group
+	next := func(w http.ResponseWriter, r *http.Request) {}
+	h := redisMiddleware(next, parseWeatherQuery, cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), newHotKeys(), stats, cfg)
+	statsHandler := cacheStatsHandler(cache, stats)
+
+	const hits, misses, reads = 200, 100, 20
+	var wg sync.WaitGroup
+	send := func(n int, target string, h http.HandlerFunc) {
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, target, nil))
+			}()
+		}
+	}
+	send(hits, "/weather?country=istanbul", h)
+	send(misses, "/weather?country=ankara", h)
+	send(reads, "/cache/stats", statsHandler)
+	wg.Wait()
+
+	rec := httptest.NewRecorder()
+	statsHandler(rec, httptest.NewRequest(http.MethodGet, "/cache/stats?reset=true", nil))
+	var snap cacheStatsSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Hits != hits || snap.Misses != misses {
+		t.Errorf("hits, misses = %d, %d, want %d, %d", snap.Hits, snap.Misses, hits, misses)
+	}
+	if want := float64(hits) / float64(hits+misses); snap.HitRatio != want {
+		t.Errorf("hitRatio = %v, want %v", snap.HitRatio, want)
+	}
+	if after := stats.snapshot(); after.Hits != 0 || after.Misses != 0 {
+		t.Errorf("?reset=true left hits, misses = %d, %d", after.Hits, after.Misses)
+	}
+}
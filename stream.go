@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// errUnconfigured is returned by latestPayload for a miss without API_KEY.
+var errUnconfigured = errors.New("API_KEY is not set")
+
+// openStreams tracks the WebSockets and event streams, which are open for
+// as long as their clients stay, so that shutdown can end them. Shutdown
+// waits for the event streams but not for hijacked WebSockets.
+type openStreams struct {
+	closing chan struct{}
+	once    sync.Once
+	open    sync.WaitGroup
+}
+
+func newOpenStreams() *openStreams {
+	return &openStreams{closing: make(chan struct{})}
+}
+
+// close tells every stream to end. It is safe to call more than once.
+func (s *openStreams) close() {
+	s.once.Do(func() { close(s.closing) })
+}
+
+// wait blocks until every stream has ended.
+func (s *openStreams) wait() {
+	s.open.Wait()
+}
+
+// latestPayload returns the weather for q a stream sends: the cached one,
+// refreshed in the background when stale, or a new fetch on a miss, shared
+// with every other request for it.
+func latestPayload(ctx context.Context, cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config, q weatherQuery) ([]byte, error) {
+	cacheKey := q.cacheKey()
+	key := os.Getenv("API_KEY")
+	if val, ok := cache.Get(ctx, cacheKey); ok {
+		if entry, ok := decodeCacheEntry(val); ok && entry.Status != 0 {
+			return nil, &upstreamError{StatusCode: entry.Status, Message: entry.Error}
+		} else if ok {
+			// The refresh reaches the streams through the cache.
+			if time.Now().After(entry.FreshUntil) && key != "" && !budget.saving() {
+				go group.Do(cacheKey, func() (interface{}, error) {
+					return fetchAndCache(context.WithoutCancel(ctx), cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q))
+				})
+			}
+			return entry.Payload, nil
+		}
+	}
+	if key == "" {
+		return nil, errUnconfigured
+	}
+	v, err, _ := group.Do(cacheKey, func() (interface{}, error) {
+		return fetchShared(context.WithoutCancel(ctx), cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// writeStreamError answers a stream request latestPayload failed for.
+func writeStreamError(w http.ResponseWriter, r *http.Request, err error, budget *upstreamBudget) {
+	var upErr *upstreamError
+	switch {
+	case errors.Is(err, errUnconfigured):
+		writeUnconfigured(w)
+	case errors.As(err, &upErr) && upErr.rejectsLocation():
+		writeError(w, upErr.StatusCode, apiError{Code: "location_rejected"})
+	case errors.Is(err, errBudgetExhausted):
+		retry := retryAfterSeconds(budget.resetIn())
+		w.Header().Set("Retry-After", strconv.FormatInt(retry, 10))
+		writeError(w, http.StatusServiceUnavailable, apiError{Code: "upstream_quota_exhausted", RetryAfterSeconds: retry, Limit: budget.dailyLimit(), Scope: scopeGlobalQuota})
+	default:
+		logf(r.Context(), "Error fetching the weather to stream : %v", err)
+		writeError(w, http.StatusBadGateway, apiError{Code: "upstream_error"})
+	}
+}
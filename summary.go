@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// weatherSummary is the body of GET /weather/summary, aggregates of the
+// daily data of a range. Days counts the days the provider sent, DaysMissing
+// those of the range it left out. Without any days the aggregates are left
+// out too.
+type weatherSummary struct {
+	ResolvedAddress string       `json:"resolvedAddress" xml:"resolvedAddress"`
+	Start           string       `json:"start" xml:"start"`
+	End             string       `json:"end" xml:"end"`
+	Days            int          `json:"days" xml:"days"`
+	DaysMissing     int          `json:"daysMissing" xml:"daysMissing"`
+	MinTemp         *float64     `json:"minTemp,omitempty" xml:"minTemp,omitempty"`
+	MaxTemp         *float64     `json:"maxTemp,omitempty" xml:"maxTemp,omitempty"`
+	MeanTemp        *float64     `json:"meanTemp,omitempty" xml:"meanTemp,omitempty"`
+	MeanFeelsLike   *float64     `json:"meanFeelsLike,omitempty" xml:"meanFeelsLike,omitempty"`
+	MaxWindSpeed    *float64     `json:"maxWindSpeed,omitempty" xml:"maxWindSpeed,omitempty"`
+	MaxUVIndex      *float64     `json:"maxUvIndex,omitempty" xml:"maxUvIndex,omitempty"`
+	WarmestDate     string       `json:"warmestDate,omitempty" xml:"warmestDate,omitempty"`
+	ColdestDate     string       `json:"coldestDate,omitempty" xml:"coldestDate,omitempty"`
+	Meta            *weatherMeta `json:"meta,omitempty" xml:"meta,omitempty"`
+}
+
+// summarize aggregates the days of weather from start to end. Days outside
+// the range, repeated or without a date are not counted. Means are rounded
+// to two decimals.
+func summarize(weather Weather, start, end time.Time) weatherSummary {
+	s := weatherSummary{
+		ResolvedAddress: weather.ResolvedAddress,
+		Start:           start.Format(time.DateOnly),
+		End:             end.Format(time.DateOnly),
+	}
+	if weather.Meta != nil {
+		s.Meta = &weatherMeta{Units: weather.Meta.Units, weatherUnits: weather.Meta.weatherUnits}
+	}
+	seen := make(map[string]bool)
+	var warmest, coldest Day
+	var temps, feelsLike, wind, uv float64
+	for _, day := range weather.Days {
+		date, err := time.Parse(time.DateOnly, day.Datetime)
+		if err != nil || date.Before(start) || date.After(end) || seen[day.Datetime] {
+			continue
+		}
+		seen[day.Datetime] = true
+		if s.Days == 0 || day.Temp > warmest.Temp {
+			warmest = day
+		}
+		if s.Days == 0 || day.Temp < coldest.Temp {
+			coldest = day
+		}
+		if s.Days == 0 || day.WindSpeed > wind {
+			wind = day.WindSpeed
+		}
+		if s.Days == 0 || day.UVIndex > uv {
+			uv = day.UVIndex
+		}
+		temps += day.Temp
+		feelsLike += day.FeelsLike
+		s.Days++
+	}
+	s.DaysMissing = int(end.Sub(start).Hours()/24) + 1 - s.Days
+	if s.Days == 0 {
+		return s
+	}
+	round := func(v float64) *float64 {
+		v = math.Round(v*100) / 100
+		return &v
+	}
+	s.MinTemp, s.MaxTemp = &coldest.Temp, &warmest.Temp
+	s.MeanTemp, s.MeanFeelsLike = round(temps/float64(s.Days)), round(feelsLike/float64(s.Days))
+	s.MaxWindSpeed, s.MaxUVIndex = &wind, &uv
+	s.WarmestDate, s.ColdestDate = warmest.Datetime, coldest.Datetime
+	return s
+}
+
+// summaryMiddleware turns the Weather responses of next, for the range of
+// the start and end parameters, into their summary.
+func summaryMiddleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		buf := &bufferedResponse{header: w.Header()}
+		next(buf, r)
+		if buf.status == 0 {
+			return
+		}
+		start, end, err := dayRange(r)
+		var weather Weather
+		if err != nil || buf.status >= 300 || json.Unmarshal(buf.body.Bytes(), &weather) != nil {
+			w.WriteHeader(buf.status)
+			w.Write(buf.body.Bytes())
+			return
+		}
+		data, _ := json.Marshal(summarize(weather, start, end))
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(buf.status)
+		w.Write(data)
+	}
+}
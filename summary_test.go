@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// summaryWeather has known values over 2024-01-01 to 2024-01-04, with the
+// 3rd missing, the 2nd repeated and days outside the range or undated.
+var summaryWeather = Weather{
+	ResolvedAddress: "Istanbul, Türkiye",
+	Days: []Day{
+		{Datetime: "2023-12-31", Temp: 40, FeelsLike: 40, WindSpeed: 90, UVIndex: 9},
+		{Datetime: "2024-01-01", Temp: 10, FeelsLike: 8, WindSpeed: 20, UVIndex: 2},
+		{Datetime: "2024-01-02", Temp: 14, FeelsLike: 13, WindSpeed: 35, UVIndex: 4},
+		{Datetime: "2024-01-02", Temp: -20, FeelsLike: -20, WindSpeed: 0, UVIndex: 0},
+		{Datetime: "2024-01-04", Temp: -5, FeelsLike: -9, WindSpeed: 10, UVIndex: 1},
+		{Datetime: "", Temp: -30},
+	},
+	Meta: &weatherMeta{Units: "metric", weatherUnits: unitGroups["metric"]},
+}
+
+func TestSummarize(t *testing.T) {
+	ptr := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name       string
+		start, end string
+		want       weatherSummary
+	}{
+		{
+			name:  "range with a missing day",
+			start: "2024-01-01", end: "2024-01-04",
+			want: weatherSummary{
+				Days: 3, DaysMissing: 1,
+				MinTemp: ptr(-5), MaxTemp: ptr(14), MeanTemp: ptr(6.33), MeanFeelsLike: ptr(4),
+				MaxWindSpeed: ptr(35), MaxUVIndex: ptr(4),
+				WarmestDate: "2024-01-02", ColdestDate: "2024-01-04",
+			},
+		},
+		{
+			name:  "single day",
+			start: "2024-01-02", end: "2024-01-02",
+			want: weatherSummary{
+				Days:    1,
+				MinTemp: ptr(14), MaxTemp: ptr(14), MeanTemp: ptr(14), MeanFeelsLike: ptr(13),
+				MaxWindSpeed: ptr(35), MaxUVIndex: ptr(4),
+				WarmestDate: "2024-01-02", ColdestDate: "2024-01-02",
+			},
+		},
+		{
+			name:  "every day missing",
+			start: "2024-02-01", end: "2024-02-03",
+			want: weatherSummary{DaysMissing: 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start, _ := time.Parse(time.DateOnly, tt.start)
+			end, _ := time.Parse(time.DateOnly, tt.end)
+			got := summarize(summaryWeather, start, end)
+			tt.want.ResolvedAddress, tt.want.Start, tt.want.End = summaryWeather.ResolvedAddress, tt.start, tt.end
+			tt.want.Meta = summaryWeather.Meta
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Errorf("summarize() = %s, want %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestSummaryMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		body       any
+		wantStatus int
+		wantDays   int
+	}{
+		{name: "weather", status: http.StatusOK, body: summaryWeather, wantStatus: http.StatusOK, wantDays: 3},
+		{name: "error", status: http.StatusBadGateway, body: errorBody(apiError{Code: "upstream_error"}), wantStatus: http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := summaryMiddleware(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, tt.status, tt.body)
+			})
+			rec := httptest.NewRecorder()
+			h(rec, httptest.NewRequest(http.MethodGet, "/weather/summary?country=istanbul&start=2024-01-01&end=2024-01-04", nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			var got map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantDays == 0 {
+				if got["error"] == nil {
+					t.Errorf("body = %v, want the error passed on", got)
+				}
+				return
+			}
+			if got["days"] != float64(tt.wantDays) || got["daysMissing"] != float64(1) {
+				t.Errorf("body = %v, want %d days and 1 missing", got, tt.wantDays)
+			}
+		})
+	}
+}
+
+func TestParseSummaryQuery(t *testing.T) {
+	future := time.Now().AddDate(0, 0, 5).Format(time.DateOnly)
+	tests := []struct {
+		query     string
+		wantRange string
+		wantErr   bool
+	}{
+		{query: "country=istanbul&start=2024-01-01&end=2024-01-07", wantRange: "2024-01-01/2024-01-07"},
+		{query: "country=istanbul&start=2024-01-01&end=2024-01-01", wantRange: "2024-01-01/2024-01-01"},
+		{query: "country=istanbul&start=" + future + "&end=" + future, wantRange: future + "/" + future},
+		{query: "country=istanbul&start=2024-01-01", wantErr: true},
+		{query: "country=istanbul&start=2024-01-07&end=2024-01-01", wantErr: true},
+		{query: "country=istanbul&start=2024-01-01&end=2024-12-31", wantErr: true},
+		{query: "start=2024-01-01&end=2024-01-07", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, err := parseSummaryQuery(httptest.NewRequest(http.MethodGet, "/weather/summary?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseSummaryQuery() error = %v, want error %v", err, tt.wantErr)
+			}
+			if q.Range != tt.wantRange || (!tt.wantErr && q.Include != "days") {
+				t.Errorf("range = %q and include = %q, want %q of days", q.Range, q.Include, tt.wantRange)
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/time/rate"
+)
+
+// anonymousTier is the tier of requests without a known API key. They are
+// limited per client IP, the others per key.
+const anonymousTier = "anonymous"
+
+// apiKeyTiersHash is the Redis hash mapping API keys to tier names, for keys
+// issued without restarting the service.
+const apiKeyTiersHash = "ratelimit:apikeys"
+
+// parseRateTiers parses a comma separated list of name=rps:burst tiers, as
+// in "free=2:10,pro=20:40".
+func parseRateTiers(v string) (map[string]rateSpec, error) {
+	tiers, err := parseRateSpecs(v)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := tiers[anonymousTier]; ok {
+		return nil, fmt.Errorf("%s is the tier of requests without a key", anonymousTier)
+	}
+	return tiers, nil
+}
+
+// parseAPIKeyTiers parses a comma separated list of key=tier pairs and checks
+// that every tier is one of tiers.
+func parseAPIKeyTiers(v string, tiers map[string]rateSpec) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, entry := range splitList(v) {
+		key, tier, ok := strings.Cut(entry, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("API key entry must be key=tier")
+		}
+		if _, ok := tiers[tier]; !ok {
+			return nil, fmt.Errorf("unknown tier %q", tier)
+		}
+		keys[key] = tier
+	}
+	return keys, nil
+}
+
+// apiKeyTiers finds the tier of an API key, first in the configured keys and
+// then, when redisDB is set, in the apiKeyTiersHash hash.
+type apiKeyTiers struct {
+	keys    map[string]string
+	redisDB redis.UniversalClient
+}
+
+func (t *apiKeyTiers) tier(ctx context.Context, key string) (string, bool) {
+	if tier, ok := t.keys[key]; ok {
+		return tier, true
+	}
+	if t.redisDB == nil {
+		return "", false
+	}
+	ctx, cancel := context.WithTimeout(ctx, 500*time.Millisecond)
+	defer cancel()
+	tier, err := t.redisDB.HGet(ctx, apiKeyTiersHash, key).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logf(ctx, "Error looking up API key tier : %v", err)
+		}
+		return "", false
+	}
+	return tier, true
+}
+
+type consumerKey struct{}
+
+// consumer is the API key a request was made with and the key's tier. Keys
+// checked by authMiddleware also carry the name they were issued to.
+type consumer struct {
+	key  string
+	tier string
+	name string
+}
+
+// apiKey returns the consumer API key r carries, in the X-API-Key header or
+// as a bearer token.
+func apiKey(r *http.Request) string {
+	key, _ := credentials(r)
+	return key
+}
+
+// consumerMiddleware resolves the API key of each request to its tier for
+// tieredLimiter to read, unless authMiddleware already has.
+func consumerMiddleware(next http.HandlerFunc, keys *apiKeyTiers) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(consumerKey{}).(consumer); ok {
+			next(w, r)
+			return
+		}
+		if key := apiKey(r); key != "" {
+			if tier, ok := keys.tier(r.Context(), key); ok {
+				r = r.WithContext(context.WithValue(r.Context(), consumerKey{}, consumer{key: key, tier: tier}))
+			}
+		}
+		next(w, r)
+	}
+}
+
+// tieredLimiter applies the limiter of the request's consumer tier, keyed on
+// its API key, and the anonymous limiter keyed on the client IP to requests
+// without a known key. Unknown keys are anonymous, so that making them up
+// does not buy a fresh budget.
+type tieredLimiter struct {
+	anonymous rateLimiter
+	tiers     map[string]rateLimiter
+}
+
+func (l *tieredLimiter) allow(ctx context.Context, ip string) rateDecision {
+	if c, ok := ctx.Value(consumerKey{}).(consumer); ok && c.tier != "" {
+		if limiter, ok := l.tiers[c.tier]; ok {
+			d := limiter.allow(ctx, c.key)
+			d.Tier = c.tier
+			return d
+		}
+		logf(ctx, "Unknown rate limit tier %s for an API key, limiting it as anonymous", c.tier)
+	}
+	d := l.anonymous.allow(ctx, ip)
+	d.Tier = anonymousTier
+	return d
+}
+
+func (l *tieredLimiter) peek(ctx context.Context, ip string) rateDecision {
+	if c, ok := ctx.Value(consumerKey{}).(consumer); ok && c.tier != "" {
+		if limiter, ok := l.tiers[c.tier]; ok {
+			d := limiter.peek(ctx, c.key)
+			d.Tier = c.tier
+			return d
+		}
+	}
+	d := l.anonymous.peek(ctx, ip)
+	d.Tier = anonymousTier
+	return d
+}
+
+// newTieredLimiter builds the limiters of every tier with newLimiter. It
+// returns anonymous alone when there are no tiers or rate limiting is off.
+func newTieredLimiter(anonymous rateLimiter, tiers map[string]rateSpec, newLimiter func(name string, limit rate.Limit, burst int) rateLimiter) rateLimiter {
+	if anonymous == nil || len(tiers) == 0 {
+		return anonymous
+	}
+	l := &tieredLimiter{anonymous: anonymous, tiers: make(map[string]rateLimiter, len(tiers))}
+	for name, tier := range tiers {
+		l.tiers[name] = newLimiter("tier:"+name, rate.Limit(tier.RPS), tier.Burst)
+	}
+	return l
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	tlsModeOff      = "off"
+	tlsModeFiles    = "files"
+	tlsModeAutocert = "autocert"
+)
+
+// tlsModeOf picks the TLS mode from the certificate settings of cfg,
+// refusing incomplete or conflicting ones.
+func tlsModeOf(cfg Config) (string, error) {
+	files := cfg.TLSCertFile != "" || cfg.TLSKeyFile != ""
+	autocert := len(cfg.TLSAutocertHosts) > 0 || cfg.TLSAutocertCacheDir != ""
+	switch {
+	case files && autocert:
+		return "", fmt.Errorf("TLS_CERT_FILE and TLS_AUTOCERT_HOSTS cannot both be set")
+	case files:
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return "", fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		return tlsModeFiles, nil
+	case autocert:
+		if len(cfg.TLSAutocertHosts) == 0 || cfg.TLSAutocertCacheDir == "" {
+			return "", fmt.Errorf("TLS_AUTOCERT_HOSTS and TLS_AUTOCERT_CACHE_DIR must be set together")
+		}
+		return tlsModeAutocert, nil
+	}
+	return tlsModeOff, nil
+}
+
+// serverTLSConfig returns the TLS configuration of the server in cfg.TLSMode,
+// along with the handler of its plain HTTP listener, or nil when TLS is off.
+func serverTLSConfig(cfg Config, httpsAddr string) (*tls.Config, http.Handler, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:       tls.VersionTLS12,
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+		// Only forward secret AEAD suites. TLS 1.3 suites are not
+		// configurable and are all of that kind.
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+	if cfg.AdminClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.AdminClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not read ADMIN_CLIENT_CA_FILE: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("ADMIN_CLIENT_CA_FILE %q contains no certificates", cfg.AdminClientCAFile)
+		}
+		// Only the admin routes require a certificate, the others are
+		// served to clients without one.
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	redirect := httpsRedirectHandler(httpsAddr)
+	switch cfg.TLSMode {
+	case tlsModeFiles:
+		cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not load TLS_CERT_FILE and TLS_KEY_FILE: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+		return tlsConfig, redirect, nil
+	case tlsModeAutocert:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.TLSAutocertHosts...),
+			Cache:      autocert.DirCache(cfg.TLSAutocertCacheDir),
+		}
+		tlsConfig.GetCertificate = manager.GetCertificate
+		tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+		// The plain listener also answers the HTTP-01 challenges.
+		return tlsConfig, manager.HTTPHandler(redirect), nil
+	}
+	return nil, nil, nil
+}
+
+// httpsRedirectHandler redirects every request to the same URL over HTTPS
+// on the port of httpsAddr.
+func httpsRedirectHandler(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := strings.Trim(r.Host, "[]")
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
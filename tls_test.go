@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTLSMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr bool
+	}{
+		{name: "off", want: tlsModeOff},
+		{name: "files", env: map[string]string{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem"}, want: tlsModeFiles},
+		{name: "cert without key", env: map[string]string{"TLS_CERT_FILE": "cert.pem"}, wantErr: true},
+		{name: "autocert", env: map[string]string{"TLS_AUTOCERT_HOSTS": "weather.example.com", "TLS_AUTOCERT_CACHE_DIR": "certs"}, want: tlsModeAutocert},
+		{name: "autocert without cache", env: map[string]string{"TLS_AUTOCERT_HOSTS": "weather.example.com"}, wantErr: true},
+		{name: "both", env: map[string]string{"TLS_CERT_FILE": "cert.pem", "TLS_KEY_FILE": "key.pem", "TLS_AUTOCERT_HOSTS": "weather.example.com", "TLS_AUTOCERT_CACHE_DIR": "certs"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"TLS_CERT_FILE", "TLS_KEY_FILE", "TLS_AUTOCERT_HOSTS", "TLS_AUTOCERT_CACHE_DIR"} {
+				t.Setenv(name, tt.env[name])
+			}
+			cfg, err := loadConfig()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, want error %v", err, tt.wantErr)
+			}
+			if cfg.TLSMode != tt.want {
+				t.Errorf("TLSMode = %q, want %q", cfg.TLSMode, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSRedirectAddr(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string
+	}{
+		{env: "", want: ":80"},
+		{env: ":8080", want: ":8080"},
+		{env: "off", want: ""},
+	}
+	for _, tt := range tests {
+		t.Setenv("TLS_REDIRECT_ADDR", tt.env)
+		cfg := testConfig(t)
+		if cfg.TLSRedirectAddr != tt.want {
+			t.Errorf("TLS_REDIRECT_ADDR=%q gave %q, want %q", tt.env, cfg.TLSRedirectAddr, tt.want)
+		}
+	}
+}
+
+// writeSelfSignedCert writes a certificate for 127.0.0.1 and its key to dir,
+// returning their paths and the certificate.
+func writeSelfSignedCert(t *testing.T, dir string) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "weather-api test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestServerTLSRoundTrip(t *testing.T) {
+	cfg := testConfig(t)
+	var cert *x509.Certificate
+	cfg.TLSCertFile, cfg.TLSKeyFile, cert = writeSelfSignedCert(t, t.TempDir())
+	cfg.TLSMode = tlsModeFiles
+	tlsConfig, redirect, err := serverTLSConfig(cfg, ":7878")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if redirect == nil {
+		t.Error("no redirect handler with TLS on")
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tests := []struct {
+		name       string
+		maxVersion uint16
+		wantErr    bool
+	}{
+		{name: "TLS 1.3", maxVersion: tls.VersionTLS13},
+		{name: "TLS 1.2", maxVersion: tls.VersionTLS12},
+		{name: "TLS 1.1", maxVersion: tls.VersionTLS11, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+				RootCAs:    roots,
+				MinVersion: tls.VersionTLS10,
+				MaxVersion: tt.maxVersion,
+			}}}
+			res, err := client.Get(server.URL)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("GET error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != "ok" {
+				t.Errorf("body = %q, want ok", body)
+			}
+			if res.TLS.Version != tt.maxVersion {
+				t.Errorf("negotiated version %x, want %x", res.TLS.Version, tt.maxVersion)
+			}
+		})
+	}
+}
+
+// TestAdminClientCert serves the admin routes over TLS with a client CA, to
+// clients with and without a certificate it issued.
+func TestAdminClientCert(t *testing.T) {
+	cfg := testConfig(t)
+	var cert *x509.Certificate
+	cfg.TLSCertFile, cfg.TLSKeyFile, cert = writeSelfSignedCert(t, t.TempDir())
+	cfg.TLSMode = tlsModeFiles
+	cfg.AdminClientCAFile = cfg.TLSCertFile
+	tlsConfig, _, err := serverTLSConfig(cfg, ":7878")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(adminRoutes(adminAuth{token: "secret", requireCert: true}))
+	server.TLS = tlsConfig
+	server.StartTLS()
+	defer server.Close()
+
+	clientCert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		want  int
+	}{
+		{name: "with certificate", certs: []tls.Certificate{clientCert}, want: http.StatusOK},
+		{name: "without certificate", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: tt.certs}}}
+			r, _ := http.NewRequest(http.MethodGet, server.URL+"/admin/cache/stats", nil)
+			r.Header.Set("X-Admin-Token", "secret")
+			res, err := client.Do(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status = %d, want %d", res.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestServerTLSConfigOff(t *testing.T) {
+	tlsConfig, redirect, err := serverTLSConfig(testConfig(t), ":7878")
+	if err != nil || tlsConfig != nil || redirect != nil {
+		t.Errorf("serverTLSConfig() = %v, %v, %v with TLS off, want nothing", tlsConfig, redirect, err)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name      string
+		httpsAddr string
+		url       string
+		want      string
+	}{
+		{name: "default port", httpsAddr: ":443", url: "http://weather.example.com/weather?country=istanbul", want: "https://weather.example.com/weather?country=istanbul"},
+		{name: "own port", httpsAddr: ":7878", url: "http://weather.example.com/weather", want: "https://weather.example.com:7878/weather"},
+		{name: "port in host", httpsAddr: ":7878", url: "http://weather.example.com:80/", want: "https://weather.example.com:7878/"},
+		{name: "IPv6", httpsAddr: ":7878", url: "http://[::1]/status", want: "https://[::1]:7878/status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			httpsRedirectHandler(tt.httpsAddr).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.url, nil))
+			if rec.Code != http.StatusPermanentRedirect {
+				t.Errorf("status = %d, want 308", rec.Code)
+			}
+			if got := rec.Header().Get("Location"); got != tt.want {
+				t.Errorf("Location = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
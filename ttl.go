@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// dataType groups queries whose data goes stale at the same rate.
+type dataType string
+
+const (
+	dataCurrent    dataType = "current"
+	dataToday      dataType = "today"
+	dataMultiDay   dataType = "multi-day"
+	dataHourly     dataType = "hourly"
+	dataAlerts     dataType = "alerts"
+	dataHistorical dataType = "historical"
+)
+
+// ttlPolicy maps each data type to how long its entries stay fresh.
+type ttlPolicy map[dataType]time.Duration
+
+// dataType classifies q by its range. Explicit dates that have passed
+// everywhere are historical, since the provider never revises them. Rolling
+// ranges such as yesterday or last7days shift every day and are not. Hourly
+// breakdowns of days still to come change faster than the days themselves.
+func (q weatherQuery) dataType(now time.Time) dataType {
+	if q.Include == "alerts" {
+		return dataAlerts
+	}
+	t := q.rangeType(now)
+	if q.Include == "hours" && t != dataHistorical {
+		return dataHourly
+	}
+	return t
+}
+
+func (q weatherQuery) rangeType(now time.Time) dataType {
+	switch q.Range {
+	case "current":
+		return dataCurrent
+	case "today":
+		return dataToday
+	}
+	dates := strings.Split(q.Range, "/")
+	end, err := time.Parse("2006-01-02", dates[len(dates)-1])
+	if err != nil {
+		return dataMultiDay
+	}
+	// A day is over in every timezone once UTC is a full day past its end.
+	if now.UTC().After(end.AddDate(0, 0, 2)) {
+		return dataHistorical
+	}
+	return dataMultiDay
+}
+
+// ttl returns how long the entry for q stays fresh.
+func (p ttlPolicy) ttl(q weatherQuery) time.Duration {
+	return p[q.dataType(time.Now())]
+}
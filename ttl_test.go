@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQueryDataType(t *testing.T) {
+	now := time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		rng     string
+		include string
+		want    dataType
+	}{
+		{name: "current", rng: "current", include: "current", want: dataCurrent},
+		{name: "today", rng: "today", include: "days", want: dataToday},
+		{name: "forecast", rng: "next7days", include: "days", want: dataMultiDay},
+		{name: "rolling past range", rng: "last7days", include: "days", want: dataMultiDay},
+		{name: "hourly today", rng: "today", include: "hours", want: dataHourly},
+		{name: "alerts", rng: "today", include: "alerts", want: dataAlerts},
+		{name: "past range", rng: "2024-06-01/2024-06-10", include: "days", want: dataHistorical},
+		{name: "past hours", rng: "2024-06-01", include: "hours", want: dataHistorical},
+		{name: "yesterday somewhere", rng: "2024-06-14", include: "days", want: dataMultiDay},
+		{name: "range ending today", rng: "2024-06-01/2024-06-15", include: "days", want: dataMultiDay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := weatherQuery{Location: "istanbul", Range: tt.rng, Include: tt.include}
+			if got := q.dataType(now); got != tt.want {
+				t.Errorf("dataType() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiVersion is the version of the API served under apiVersionPrefix.
+const (
+	apiVersion       = "v1"
+	apiVersionPrefix = "/" + apiVersion
+)
+
+// legacyDeprecatedAt is when the unversioned paths of the API were
+// deprecated in favour of those under apiVersionPrefix.
+var legacyDeprecatedAt = time.Date(2026, time.October, 14, 0, 0, 0, 0, time.UTC)
+
+// unversionedRoutes are the routes that are not part of the API, such as
+// the probes and the admin routes, and are served at their own paths for
+// good. / is one too.
+var unversionedRoutes = []string{"/healthz", "/livez", "/readyz", metricsPath, "/status", "/openapi.json", "/docs", "/admin/"}
+
+// versionedRoute reports whether pattern, a route of the mux, belongs to the
+// versioned API.
+func versionedRoute(pattern string) bool {
+	pattern = strings.TrimSuffix(pattern, "{$}")
+	return pattern != "/" && !slices.Contains(unversionedRoutes, pattern)
+}
+
+type apiPrefixKey struct{}
+
+// apiPrefix returns the version prefix r was made under, "" for a legacy
+// path.
+func apiPrefix(r *http.Request) string {
+	prefix, _ := r.Context().Value(apiPrefixKey{}).(string)
+	return prefix
+}
+
+// versionMiddleware serves every route of mux under apiVersionPrefix, the
+// canonical paths, by stripping the prefix before next sees the request, so
+// that a route registered once is served at both paths. At their legacy
+// unversioned paths the routes of the API answer the same, with Deprecation
+// and Sunset headers and a link to the versioned path. Every response names
+// the version in X-API-Version.
+func versionMiddleware(next http.Handler, mux *http.ServeMux, sunset time.Time) http.Handler {
+	deprecation := "@" + strconv.FormatInt(legacyDeprecatedAt.Unix(), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-API-Version", apiVersion)
+		if rest, ok := strings.CutPrefix(r.URL.Path, apiVersionPrefix); ok && (rest == "" || rest[0] == '/') {
+			if rest == "" {
+				rest = "/"
+			}
+			r = r.WithContext(context.WithValue(r.Context(), apiPrefixKey{}, apiVersionPrefix))
+			u := *r.URL
+			u.Path = rest
+			u.RawPath = strings.TrimPrefix(u.RawPath, apiVersionPrefix)
+			r.URL = &u
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := mux.Handler(r); versionedRoute(pattern) {
+			h := w.Header()
+			h.Set("Deprecation", deprecation)
+			h.Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+			h.Add("Link", fmt.Sprintf(`<%s>; rel="successor-version"`, apiVersionPrefix+r.URL.EscapedPath()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestVersionMiddleware(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/weather", allowMethods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"path": r.URL.Path, "country": r.URL.Query().Get("country")})
+	}), http.MethodGet))
+	mux.Handle("/healthz", allowMethods(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	}), http.MethodGet))
+	mux.HandleFunc("/", http.NotFound)
+	sunset := time.Date(2027, time.April, 14, 0, 0, 0, 0, time.UTC)
+	h := versionMiddleware(mux, mux, sunset)
+
+	tests := []struct {
+		target         string
+		wantStatus     int
+		wantDeprecated bool
+	}{
+		{target: "/v1/weather?country=istanbul", wantStatus: http.StatusOK},
+		{target: "/weather?country=istanbul", wantStatus: http.StatusOK, wantDeprecated: true},
+		{target: "/healthz", wantStatus: http.StatusOK},
+		{target: "/v1weather", wantStatus: http.StatusNotFound},
+		{target: "/nowhere", wantStatus: http.StatusNotFound},
+	}
+	bodies := make(map[string]string)
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			bodies[tt.target] = rec.Body.String()
+			if got := rec.Header().Get("X-API-Version"); got != "v1" {
+				t.Errorf("X-API-Version = %q, want v1", got)
+			}
+			deprecation, sunsetHeader, link := rec.Header().Get("Deprecation"), rec.Header().Get("Sunset"), rec.Header().Get("Link")
+			if !tt.wantDeprecated {
+				if deprecation != "" || sunsetHeader != "" || link != "" {
+					t.Errorf("Deprecation = %q, Sunset = %q and Link = %q, want none", deprecation, sunsetHeader, link)
+				}
+				return
+			}
+			if deprecation != "@1791936000" {
+				t.Errorf("Deprecation = %q, want @1791936000", deprecation)
+			}
+			if sunsetHeader != "Wed, 14 Apr 2027 00:00:00 GMT" {
+				t.Errorf("Sunset = %q, want Wed, 14 Apr 2027 00:00:00 GMT", sunsetHeader)
+			}
+			if link != `</v1/weather>; rel="successor-version"` {
+				t.Errorf("Link = %q, want the /v1 path as successor", link)
+			}
+		})
+	}
+	if v1, legacy := bodies["/v1/weather?country=istanbul"], bodies["/weather?country=istanbul"]; v1 != legacy {
+		t.Errorf("/v1/weather served %s, /weather %s", v1, legacy)
+	}
+}
+
+// TestOpenAPIServers checks that the spec puts the paths of unversionedRoutes
+// at the root and the others under /v1.
+func TestOpenAPIServers(t *testing.T) {
+	type server struct {
+		URL string `json:"url"`
+	}
+	var spec struct {
+		Servers []server `json:"servers"`
+		Paths   map[string]struct {
+			Servers []server `json:"servers"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	if len(spec.Servers) == 0 || spec.Servers[0].URL != apiVersionPrefix {
+		t.Errorf("servers = %v, want %s first", spec.Servers, apiVersionPrefix)
+	}
+	for path, item := range spec.Paths {
+		atRoot := slices.Contains(item.Servers, server{URL: "/"})
+		if atRoot == versionedRoute(path) {
+			t.Errorf("%s is served at the root: %v, want %v", path, atRoot, !versionedRoute(path))
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// warmCache fetches every location in cfg.WarmLocations and seeds the cache
+// with it, running at most cfg.WarmWorkers upstream requests at a time. A
+// failing location is logged and does not stop the others. It stops early
+// when ctx is cancelled.
+func warmCache(ctx context.Context, cache *tieredCache, budget *upstreamBudget, cfg Config) {
+	if len(cfg.WarmLocations) == 0 {
+		return
+	}
+	key := os.Getenv("API_KEY")
+	if key == "" {
+		fmt.Println("Skipping cache warm up : Api key could not found")
+		return
+	}
+
+	// Skip locations another instance has already cached and that are still
+	// fresh.
+	queries := make(map[string]weatherQuery, len(cfg.WarmLocations))
+	keys := make([]string, 0, len(cfg.WarmLocations))
+	for _, location := range cfg.WarmLocations {
+		q := defaultQuery(location)
+		queries[q.cacheKey()] = q
+		keys = append(keys, q.cacheKey())
+	}
+	found, _ := cache.GetMany(ctx, keys)
+	for key, val := range found {
+		if entry, ok := decodeCacheEntry(val); ok && time.Now().Before(entry.FreshUntil) {
+			fmt.Printf("Cache already warm for %q\n", queries[key].Location)
+			delete(queries, key)
+		}
+	}
+
+	locations := make(chan weatherQuery)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.WarmWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for q := range locations {
+				if _, err := fetchAndCache(ctx, cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q)); err != nil {
+					fmt.Printf("Cache warm up failed for %q : %v\n", q.Location, err)
+					continue
+				}
+				fmt.Printf("Cache warmed for %q\n", q.Location)
+			}
+		}()
+	}
+send:
+	for _, q := range queries {
+		select {
+		case locations <- q:
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(locations)
+	wg.Wait()
+}
+
+// sweepOldCacheVersions deletes the keys written under every schema version
+// older than cacheSchemaVersion.
+func sweepOldCacheVersions(ctx context.Context, cache *tieredCache) {
+	for version := 1; version < cacheSchemaVersion && ctx.Err() == nil; version++ {
+		deleted, err := cache.DeleteMatching(ctx, versionPrefix(version)+"*")
+		if err != nil {
+			fmt.Printf("Error sweeping cache version %d : %v\n", version, err)
+			continue
+		}
+		fmt.Printf("Swept %d keys of cache version %d\n", deleted, version)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWarmCache warms four locations, one of them already cached and fresh,
+// and checks every key ends up in Redis with only the others fetched.
+func TestWarmCache(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	cfg := testConfig(t)
+	cfg.WarmLocations = []string{"istanbul", "ankara", "izmir", "bursa"}
+	cfg.WarmWorkers = 2
+	cache, mr := newTestCache(t, cfg)
+	cache.Set(context.Background(), defaultQuery("bursa").cacheKey(), entryFreshUntil(t, time.Now().Add(time.Hour)), time.Hour)
+
+	out := captureStdout(t, func() {
+		warmCache(context.Background(), cache, newUpstreamBudget(0, 0, time.UTC, nil), cfg)
+	})
+	for _, location := range cfg.WarmLocations {
+		if key := defaultQuery(location).cacheKey(); !mr.Exists(key) {
+			t.Errorf("%s: %s is not cached", location, key)
+		}
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("provider called %d times, want 3", got)
+	}
+	if !strings.Contains(out, `Cache already warm for "bursa"`) {
+		t.Errorf("output does not report bursa as warm:\n%s", out)
+	}
+}
+
+// TestWarmCacheFailure checks a failing provider leaves the cache empty
+// and logs every location.
+func TestWarmCacheFailure(t *testing.T) {
+	stubProvider(t, 0, http.StatusInternalServerError)
+	cfg := testConfig(t)
+	cfg.WarmLocations = []string{"istanbul", "ankara"}
+	cache, mr := newTestCache(t, cfg)
+
+	out := captureStdout(t, func() {
+		warmCache(context.Background(), cache, newUpstreamBudget(0, 0, time.UTC, nil), cfg)
+	})
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("cached %v after failed fetches", keys)
+	}
+	for _, location := range cfg.WarmLocations {
+		if !strings.Contains(out, `Cache warm up failed for "`+location+`"`) {
+			t.Errorf("output does not report %s as failed:\n%s", location, out)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"path"
+	"sync"
+)
+
+// cacheWatchers wakes the watchers of a key whenever its entry is written.
+type cacheWatchers struct {
+	mu   sync.Mutex
+	keys map[string]map[chan struct{}]struct{}
+}
+
+func newCacheWatchers() *cacheWatchers {
+	return &cacheWatchers{keys: make(map[string]map[chan struct{}]struct{})}
+}
+
+// watch returns a channel that receives after every write of key, and the
+// function that stops watching it. Writes made while the watcher has not read
+// the last wake yet are folded into that wake.
+func (w *cacheWatchers) watch(key string) (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys[key] == nil {
+		w.keys[key] = make(map[chan struct{}]struct{})
+	}
+	w.keys[key][ch] = struct{}{}
+	return ch, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		delete(w.keys[key], ch)
+		if len(w.keys[key]) == 0 {
+			delete(w.keys, key)
+		}
+	}
+}
+
+// notify wakes the watchers of key.
+func (w *cacheWatchers) notify(key string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for ch := range w.keys[key] {
+		wake(ch)
+	}
+}
+
+// notifyMatching wakes the watchers of every key matching the glob pattern.
+func (w *cacheWatchers) notifyMatching(pattern string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for key, watchers := range w.keys {
+		if ok, _ := path.Match(pattern, key); !ok {
+			continue
+		}
+		for ch := range watchers {
+			wake(ch)
+		}
+	}
+}
+
+func wake(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
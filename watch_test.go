@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestCacheWatchers(t *testing.T) {
+	tests := []struct {
+		name   string
+		notify func(w *cacheWatchers)
+		want   bool
+	}{
+		{name: "the key", notify: func(w *cacheWatchers) { w.notify("weather:v4:istanbul") }, want: true},
+		{name: "another key", notify: func(w *cacheWatchers) { w.notify("weather:v4:ankara") }, want: false},
+		{name: "matching pattern", notify: func(w *cacheWatchers) { w.notifyMatching("weather:v4:ist*") }, want: true},
+		{name: "other pattern", notify: func(w *cacheWatchers) { w.notifyMatching("weather:v4:ank*") }, want: false},
+		{name: "many writes", notify: func(w *cacheWatchers) {
+			for range 3 {
+				w.notify("weather:v4:istanbul")
+			}
+		}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := newCacheWatchers()
+			ch, stop := w.watch("weather:v4:istanbul")
+			defer stop()
+			tt.notify(w)
+			select {
+			case <-ch:
+				if !tt.want {
+					t.Error("the watcher was woken")
+				}
+			default:
+				if tt.want {
+					t.Error("the watcher was not woken")
+				}
+			}
+			select {
+			case <-ch:
+				t.Error("the watcher was woken twice")
+			default:
+			}
+		})
+	}
+}
+
+func TestCacheWatchersStop(t *testing.T) {
+	w := newCacheWatchers()
+	_, stop := w.watch("weather:v4:istanbul")
+	stop()
+	w.notify("weather:v4:istanbul")
+	if len(w.keys) != 0 {
+		t.Errorf("%d keys still watched after stop", len(w.keys))
+	}
+}
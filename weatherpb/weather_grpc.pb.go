@@ -0,0 +1,206 @@
+// The gRPC face of the weather API. Its requests carry the parameters of the
+// matching HTTP endpoints and are answered from the same cache.
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: weather.proto
+
+package weatherpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	WeatherService_GetWeather_FullMethodName  = "/weather.v1.WeatherService/GetWeather"
+	WeatherService_GetForecast_FullMethodName = "/weather.v1.WeatherService/GetForecast"
+	WeatherService_GetCurrent_FullMethodName  = "/weather.v1.WeatherService/GetCurrent"
+)
+
+// WeatherServiceClient is the client API for WeatherService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type WeatherServiceClient interface {
+	// GetWeather is GET /weather, today's weather.
+	GetWeather(ctx context.Context, in *WeatherRequest, opts ...grpc.CallOption) (*Weather, error)
+	// GetForecast is GET /weather/forecast, the coming days.
+	GetForecast(ctx context.Context, in *ForecastRequest, opts ...grpc.CallOption) (*Weather, error)
+	// GetCurrent is GET /weather/current, the latest observation.
+	GetCurrent(ctx context.Context, in *WeatherRequest, opts ...grpc.CallOption) (*Current, error)
+}
+
+type weatherServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWeatherServiceClient(cc grpc.ClientConnInterface) WeatherServiceClient {
+	return &weatherServiceClient{cc}
+}
+
+func (c *weatherServiceClient) GetWeather(ctx context.Context, in *WeatherRequest, opts ...grpc.CallOption) (*Weather, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Weather)
+	err := c.cc.Invoke(ctx, WeatherService_GetWeather_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weatherServiceClient) GetForecast(ctx context.Context, in *ForecastRequest, opts ...grpc.CallOption) (*Weather, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Weather)
+	err := c.cc.Invoke(ctx, WeatherService_GetForecast_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weatherServiceClient) GetCurrent(ctx context.Context, in *WeatherRequest, opts ...grpc.CallOption) (*Current, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(Current)
+	err := c.cc.Invoke(ctx, WeatherService_GetCurrent_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// WeatherServiceServer is the server API for WeatherService service.
+// All implementations must embed UnimplementedWeatherServiceServer
+// for forward compatibility.
+type WeatherServiceServer interface {
+	// GetWeather is GET /weather, today's weather.
+	GetWeather(context.Context, *WeatherRequest) (*Weather, error)
+	// GetForecast is GET /weather/forecast, the coming days.
+	GetForecast(context.Context, *ForecastRequest) (*Weather, error)
+	// GetCurrent is GET /weather/current, the latest observation.
+	GetCurrent(context.Context, *WeatherRequest) (*Current, error)
+	mustEmbedUnimplementedWeatherServiceServer()
+}
+
+// UnimplementedWeatherServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedWeatherServiceServer struct{}
+
+func (UnimplementedWeatherServiceServer) GetWeather(context.Context, *WeatherRequest) (*Weather, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetWeather not implemented")
+}
+func (UnimplementedWeatherServiceServer) GetForecast(context.Context, *ForecastRequest) (*Weather, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetForecast not implemented")
+}
+func (UnimplementedWeatherServiceServer) GetCurrent(context.Context, *WeatherRequest) (*Current, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetCurrent not implemented")
+}
+func (UnimplementedWeatherServiceServer) mustEmbedUnimplementedWeatherServiceServer() {}
+func (UnimplementedWeatherServiceServer) testEmbeddedByValue()                        {}
+
+// UnsafeWeatherServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WeatherServiceServer will
+// result in compilation errors.
+type UnsafeWeatherServiceServer interface {
+	mustEmbedUnimplementedWeatherServiceServer()
+}
+
+func RegisterWeatherServiceServer(s grpc.ServiceRegistrar, srv WeatherServiceServer) {
+	// If the following call pancis, it indicates UnimplementedWeatherServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&WeatherService_ServiceDesc, srv)
+}
+
+func _WeatherService_GetWeather_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WeatherRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeatherServiceServer).GetWeather(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WeatherService_GetWeather_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeatherServiceServer).GetWeather(ctx, req.(*WeatherRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WeatherService_GetForecast_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ForecastRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeatherServiceServer).GetForecast(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WeatherService_GetForecast_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeatherServiceServer).GetForecast(ctx, req.(*ForecastRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _WeatherService_GetCurrent_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(WeatherRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeatherServiceServer).GetCurrent(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: WeatherService_GetCurrent_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeatherServiceServer).GetCurrent(ctx, req.(*WeatherRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// WeatherService_ServiceDesc is the grpc.ServiceDesc for WeatherService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var WeatherService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "weather.v1.WeatherService",
+	HandlerType: (*WeatherServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetWeather",
+			Handler:    _WeatherService_GetWeather_Handler,
+		},
+		{
+			MethodName: "GetForecast",
+			Handler:    _WeatherService_GetForecast_Handler,
+		},
+		{
+			MethodName: "GetCurrent",
+			Handler:    _WeatherService_GetCurrent_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "weather.proto",
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// webhooksHash is the Redis hash holding the webhook subscriptions, each
+// mapped from its ID.
+const webhooksHash = "webhooks"
+
+const (
+	// webhookAttempts is how many times an event is sent before it is given
+	// up on, webhookTimeout how long each attempt may take.
+	webhookAttempts = 4
+	webhookTimeout  = 5 * time.Second
+	// webhookQueueSize bounds the fetched entries waiting to be evaluated.
+	webhookQueueSize = 100
+)
+
+// webhookFields are the measurements of a day conditions can test.
+var webhookFields = map[string]func(Day) float64{
+	"temp":       func(d Day) float64 { return d.Temp },
+	"feelslike":  func(d Day) float64 { return d.FeelsLike },
+	"windspeed":  func(d Day) float64 { return d.WindSpeed },
+	"visibility": func(d Day) float64 { return d.Visibility },
+	"uvindex":    func(d Day) float64 { return d.UVIndex },
+}
+
+// webhookOps are the comparisons conditions can make.
+var webhookOps = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	">":  func(a, b float64) bool { return a > b },
+	">=": func(a, b float64) bool { return a >= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+}
+
+// webhookCondition compares a measurement of today's weather, in metric
+// units, to Value.
+type webhookCondition struct {
+	Field string  `json:"field"`
+	Op    string  `json:"op"`
+	Value float64 `json:"value"`
+}
+
+func (c webhookCondition) validate() error {
+	if _, ok := webhookFields[c.Field]; !ok {
+		return fmt.Errorf("condition field must be one of %s", strings.Join(sortedKeys(webhookFields), ", "))
+	}
+	if _, ok := webhookOps[c.Op]; !ok {
+		return fmt.Errorf("condition op must be one of %s", strings.Join(sortedKeys(webhookOps), ", "))
+	}
+	return nil
+}
+
+// holds reports whether the condition holds on d, and the measurement it
+// tested.
+func (c webhookCondition) holds(d Day) (bool, float64) {
+	v := webhookFields[c.Field](d)
+	return webhookOps[c.Op](v, c.Value), v
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// webhook is a subscription to the weather of Country, sending an event to
+// URL each time Condition starts to hold. Met is whether it held when last
+// evaluated. Owner is a hash of the API key it was made with.
+type webhook struct {
+	ID        string           `json:"id"`
+	URL       string           `json:"url"`
+	Country   string           `json:"country"`
+	Condition webhookCondition `json:"condition"`
+	Met       bool             `json:"met"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Owner     string           `json:"owner,omitempty"`
+}
+
+// cacheKey is the key of the entry the webhook is evaluated on.
+func (wh webhook) cacheKey() string {
+	return defaultQuery(wh.Country).cacheKey()
+}
+
+// public returns the webhook as its owner sees it.
+func (wh webhook) public() webhook {
+	wh.Owner = ""
+	return wh
+}
+
+// webhookOwner is the owner recorded for subscriptions made with key.
+func webhookOwner(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// webhookEvent is the body sent to a webhook as its condition starts to
+// hold.
+type webhookEvent struct {
+	Webhook         string           `json:"webhook"`
+	Country         string           `json:"country"`
+	ResolvedAddress string           `json:"resolvedAddress"`
+	Date            string           `json:"date"`
+	Condition       webhookCondition `json:"condition"`
+	Value           float64          `json:"value"`
+	FetchedAt       time.Time        `json:"fetchedAt"`
+}
+
+// webhookStore keeps the subscriptions in Redis, so that they are evaluated
+// by whichever instance fetches their location.
+type webhookStore struct {
+	redisDB redis.UniversalClient
+}
+
+// list returns every subscription, oldest first.
+func (s *webhookStore) list(ctx context.Context) ([]webhook, error) {
+	entries, err := s.redisDB.HGetAll(ctx, webhooksHash).Result()
+	if err != nil {
+		return nil, err
+	}
+	hooks := make([]webhook, 0, len(entries))
+	for _, data := range entries {
+		var wh webhook
+		if err := json.Unmarshal([]byte(data), &wh); err != nil {
+			continue
+		}
+		hooks = append(hooks, wh)
+	}
+	sort.Slice(hooks, func(i, j int) bool { return hooks[i].CreatedAt.Before(hooks[j].CreatedAt) })
+	return hooks, nil
+}
+
+func (s *webhookStore) put(ctx context.Context, wh webhook) error {
+	data, err := json.Marshal(wh)
+	if err != nil {
+		return err
+	}
+	return s.redisDB.HSet(ctx, webhooksHash, wh.ID, data).Err()
+}
+
+// update rewrites a subscription unless it has been deleted meanwhile.
+func (s *webhookStore) update(ctx context.Context, wh webhook) error {
+	data, err := json.Marshal(wh)
+	if err != nil {
+		return err
+	}
+	exists, err := s.redisDB.HExists(ctx, webhooksHash, wh.ID).Result()
+	if err != nil || !exists {
+		return err
+	}
+	return s.redisDB.HSet(ctx, webhooksHash, wh.ID, data).Err()
+}
+
+func (s *webhookStore) delete(ctx context.Context, id string) error {
+	return s.redisDB.HDel(ctx, webhooksHash, id).Err()
+}
+
+// webhooksHandler serves the subscriptions of the consumer making the
+// request. GET /webhooks lists them, POST /webhooks subscribes from a
+// {"url", "country", "condition": {"field", "op", "value"}} body and DELETE
+// /webhooks/{id} unsubscribes. It must run behind authMiddleware.
+func webhooksHandler(store *webhookStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, ok := r.Context().Value(consumerKey{}).(consumer)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, apiError{Code: "api_key_required"})
+			return
+		}
+		owner := webhookOwner(c.key)
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			hooks, err := store.list(r.Context())
+			if err != nil {
+				logf(r.Context(), "Error listing webhooks : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error listing webhooks"})
+				return
+			}
+			own := []webhook{}
+			for _, wh := range hooks {
+				if wh.Owner == owner {
+					own = append(own, wh.public())
+				}
+			}
+			writeJSON(w, http.StatusOK, own)
+		case http.MethodPost:
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+			if err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			var wh webhook
+			if err := json.Unmarshal(body, &wh); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: `body must be {"url": "...", "country": "...", "condition": {"field": "...", "op": "...", "value": 0}}`})
+				return
+			}
+			if err := validateWebhook(r.Context(), wh); err != nil {
+				writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+				return
+			}
+			id := make([]byte, 12)
+			if _, err := rand.Read(id); err != nil {
+				logf(r.Context(), "Error generating webhook ID : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error storing webhook"})
+				return
+			}
+			wh = webhook{ID: hex.EncodeToString(id), URL: wh.URL, Country: wh.Country, Condition: wh.Condition, CreatedAt: time.Now().UTC(), Owner: owner}
+			if err := store.put(r.Context(), wh); err != nil {
+				logf(r.Context(), "Error storing webhook : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error storing webhook"})
+				return
+			}
+			writeJSON(w, http.StatusCreated, wh.public())
+		case http.MethodDelete:
+			hooks, err := store.list(r.Context())
+			if err != nil {
+				logf(r.Context(), "Error listing webhooks : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error listing webhooks"})
+				return
+			}
+			// Other consumers' webhooks are not found rather than forbidden,
+			// so that their IDs cannot be probed.
+			i := slices.IndexFunc(hooks, func(wh webhook) bool { return wh.ID == r.PathValue("id") && wh.Owner == owner })
+			if i < 0 {
+				writeError(w, http.StatusNotFound, apiError{Code: "not_found", Message: "Unknown webhook"})
+				return
+			}
+			if err := store.delete(r.Context(), hooks[i].ID); err != nil {
+				logf(r.Context(), "Error deleting webhook : %v", err)
+				writeError(w, http.StatusInternalServerError, apiError{Code: "internal_error", Message: "Error deleting webhook"})
+				return
+			}
+			writeJSON(w, http.StatusOK, hooks[i].public())
+		}
+	}
+}
+
+// lookupWebhookHost resolves the hosts of webhook URLs.
+var lookupWebhookHost = net.DefaultResolver.LookupNetIP
+
+// blockedWebhookAddr reports whether ip is one webhooks must not be sent
+// to, an address of the server itself or of its private network, so that
+// subscriptions cannot reach the services behind it.
+func blockedWebhookAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return !ip.IsValid() || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified()
+}
+
+// webhookDialControl refuses connections to the addresses blockedWebhookAddr
+// blocks. It runs once the host is resolved, for every connection, so that
+// a host resolving to another address after validateWebhook checked it is
+// still refused.
+func webhookDialControl(network, address string, _ syscall.RawConn) error {
+	addr, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if blockedWebhookAddr(addr.Addr()) {
+		return fmt.Errorf("webhooks must not be sent to %s", addr.Addr())
+	}
+	return nil
+}
+
+// validateWebhook checks the fields a subscription is made with. The host
+// of its URL must resolve, and only to addresses webhooks can be sent to.
+func validateWebhook(ctx context.Context, wh webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	ips, err := lookupWebhookHost(ctx, "ip", u.Hostname())
+	if err != nil || len(ips) == 0 {
+		return fmt.Errorf("url host %q does not resolve", u.Hostname())
+	}
+	for _, ip := range ips {
+		if blockedWebhookAddr(ip) {
+			return fmt.Errorf("url must not point at a loopback, private or link-local address")
+		}
+	}
+	if wh.Country == "" {
+		return fmt.Errorf("country is required")
+	}
+	if err := validateLocation("country", wh.Country); err != nil {
+		return err
+	}
+	return wh.Condition.validate()
+}
+
+// fetchedEntry is an entry written to the cache, waiting to be evaluated.
+type fetchedEntry struct {
+	key   string
+	value []byte
+}
+
+// webhookDispatcher evaluates the subscriptions of every location fetched
+// into the cache, and sends the events of those whose conditions start to
+// hold. Failed deliveries are retried on network errors and 5xx responses,
+// waiting retryBackoff and then twice as long after each attempt.
+type webhookDispatcher struct {
+	store        *webhookStore
+	client       *http.Client
+	retryBackoff time.Duration
+	fetched      chan fetchedEntry
+	deliveries   sync.WaitGroup
+}
+
+func newWebhookDispatcher(store *webhookStore, retryBackoff time.Duration) *webhookDispatcher {
+	// Deliveries go straight to the receiver rather than through a proxy,
+	// which would dial the blocked addresses in their place.
+	transport := &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: webhookTimeout, Control: webhookDialControl}).DialContext,
+		TLSHandshakeTimeout: webhookTimeout,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &webhookDispatcher{
+		store:        store,
+		client:       &http.Client{Timeout: webhookTimeout, Transport: transport},
+		retryBackoff: retryBackoff,
+		fetched:      make(chan fetchedEntry, webhookQueueSize),
+	}
+}
+
+// observe is the cache write hook queueing entries for evaluation. Entries
+// written while the queue is full are only evaluated on their next fetch.
+func (d *webhookDispatcher) observe(ctx context.Context, key string, value []byte) {
+	select {
+	case d.fetched <- fetchedEntry{key: key, value: value}:
+	default:
+		logf(ctx, "Not evaluating webhooks for %s : the queue is full", key)
+	}
+}
+
+// run evaluates the queued entries until ctx is done, then waits for the
+// deliveries under way.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	defer d.deliveries.Wait()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-d.fetched:
+			d.evaluate(ctx, e.key, e.value)
+		}
+	}
+}
+
+// evaluate tests the conditions of the subscriptions for key on its entry,
+// recording the ones that changed and sending events for those now met.
+func (d *webhookDispatcher) evaluate(ctx context.Context, key string, value []byte) {
+	entry, ok := decodeCacheEntry(value)
+	if !ok || entry.Status != 0 {
+		return
+	}
+	var weather Weather
+	if err := json.Unmarshal(entry.Payload, &weather); err != nil || len(weather.Days) == 0 {
+		return
+	}
+	hooks, err := d.store.list(ctx)
+	if err != nil {
+		fmt.Println("Error listing webhooks :", err)
+		return
+	}
+	today := weather.Days[0]
+	for _, wh := range hooks {
+		if wh.cacheKey() != key {
+			continue
+		}
+		met, v := wh.Condition.holds(today)
+		if met == wh.Met {
+			continue
+		}
+		wh.Met = met
+		if err := d.store.update(ctx, wh); err != nil {
+			fmt.Printf("Error updating webhook %s : %v\n", wh.ID, err)
+			continue
+		}
+		if !met {
+			continue
+		}
+		event := webhookEvent{Webhook: wh.ID, Country: wh.Country, ResolvedAddress: weather.ResolvedAddress, Date: today.Datetime, Condition: wh.Condition, Value: v, FetchedAt: entry.FetchedAt}
+		d.deliveries.Add(1)
+		go func() {
+			defer d.deliveries.Done()
+			if err := d.deliver(ctx, wh, event); err != nil {
+				fmt.Printf("Error delivering webhook %s : %v\n", wh.ID, err)
+			}
+		}()
+	}
+}
+
+// deliver posts event to the webhook's URL, retrying failures that may be
+// transient.
+func (d *webhookDispatcher) deliver(ctx context.Context, wh webhook, event webhookEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	backoff := d.retryBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := d.post(ctx, wh, body)
+		if err == nil && status < 500 {
+			if status >= 300 {
+				return fmt.Errorf("the receiver answered %d", status)
+			}
+			return nil
+		}
+		if err == nil {
+			err = fmt.Errorf("the receiver answered %d", status)
+		}
+		if attempt == webhookAttempts {
+			return fmt.Errorf("giving up after %d attempts : %v", attempt, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, wh webhook, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "weather-api-webhooks")
+	req.Header.Set("X-Webhook-ID", wh.ID)
+	res, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+	return res.StatusCode, nil
+}
+
+// runWebhookSweep fetches, every cfg.WebhookSweepInterval, the subscribed
+// locations whose entries are not fresh, so that the conditions of places
+// nobody requests are still evaluated. It returns when ctx is cancelled.
+func runWebhookSweep(ctx context.Context, cache *tieredCache, budget *upstreamBudget, store *webhookStore, cfg Config) {
+	ticker := time.NewTicker(cfg.WebhookSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sweepWebhooks(ctx, cache, budget, store, cfg)
+	}
+}
+
+// sweepWebhooks runs one pass of runWebhookSweep.
+func sweepWebhooks(ctx context.Context, cache *tieredCache, budget *upstreamBudget, store *webhookStore, cfg Config) {
+	key := os.Getenv("API_KEY")
+	if key == "" || budget.saving() {
+		return
+	}
+	hooks, err := store.list(ctx)
+	if err != nil {
+		fmt.Println("Error listing webhooks :", err)
+		return
+	}
+	queries := make(map[string]weatherQuery)
+	for _, wh := range hooks {
+		queries[wh.cacheKey()] = defaultQuery(wh.Country)
+	}
+	keys := make([]string, 0, len(queries))
+	for k := range queries {
+		keys = append(keys, k)
+	}
+	found, _ := cache.GetMany(ctx, keys)
+	for k, q := range queries {
+		if ctx.Err() != nil {
+			return
+		}
+		if entry, ok := decodeCacheEntry(found[k]); ok && time.Now().Before(entry.FreshUntil) {
+			continue
+		}
+		// Writing the entry has it evaluated.
+		if _, err := fetchAndCache(ctx, cache, budget, cfg, q, key, cfg.TTLPolicy.ttl(q)); err != nil {
+			fmt.Printf("Error fetching webhook location %q : %v\n", q.Location, err)
+		}
+	}
+}
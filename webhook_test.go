@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func testWebhookStore(t *testing.T) *webhookStore {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return &webhookStore{redisDB: client}
+}
+
+func TestWebhookCondition(t *testing.T) {
+	day := Day{Temp: -2, WindSpeed: 40}
+	tests := []struct {
+		condition webhookCondition
+		want      bool
+	}{
+		{condition: webhookCondition{Field: "temp", Op: "<", Value: 0}, want: true},
+		{condition: webhookCondition{Field: "temp", Op: ">=", Value: 0}, want: false},
+		{condition: webhookCondition{Field: "temp", Op: "==", Value: -2}, want: true},
+		{condition: webhookCondition{Field: "windspeed", Op: ">", Value: 50}, want: false},
+		{condition: webhookCondition{Field: "windspeed", Op: "!=", Value: 50}, want: true},
+	}
+	for _, tt := range tests {
+		if got, _ := tt.condition.holds(day); got != tt.want {
+			t.Errorf("%+v holds = %v, want %v", tt.condition, got, tt.want)
+		}
+	}
+}
+
+// webhookRequest makes a request to the webhook routes with key as its
+// consumer.
+func webhookRequest(t *testing.T, store *webhookStore, method, target, key, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.Handle("/webhooks", webhooksHandler(store))
+	mux.Handle("/webhooks/{id}", webhooksHandler(store))
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r = r.WithContext(context.WithValue(r.Context(), consumerKey{}, consumer{key: key}))
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, r)
+	return rec
+}
+
+// stubWebhookHosts has the hosts of webhook URLs resolve to the addresses
+// of hosts, and the others not at all.
+func stubWebhookHosts(t *testing.T, hosts map[string]string) {
+	t.Helper()
+	lookup := lookupWebhookHost
+	t.Cleanup(func() { lookupWebhookHost = lookup })
+	lookupWebhookHost = func(ctx context.Context, network, host string) ([]netip.Addr, error) {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			return []netip.Addr{ip}, nil
+		}
+		addr, ok := hosts[host]
+		if !ok {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return []netip.Addr{netip.MustParseAddr(addr)}, nil
+	}
+}
+
+func TestWebhooksHandler(t *testing.T) {
+	store := testWebhookStore(t)
+	stubWebhookHosts(t, map[string]string{"example.com": "93.184.215.14", "rebind.example.com": "10.0.0.7"})
+	tests := []struct {
+		name string
+		body string
+		want int
+	}{
+		{name: "valid", body: `{"url": "https://example.com/hook", "country": "Ankara", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusCreated},
+		{name: "not JSON", body: `url=https://example.com`, want: http.StatusBadRequest},
+		{name: "relative url", body: `{"url": "/hook", "country": "Ankara", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "other scheme", body: `{"url": "ftp://example.com/hook", "country": "Ankara", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "unknown host", body: `{"url": "https://nowhere.example.com/hook", "country": "Ankara", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "host resolving to a private address", body: `{"url": "https://rebind.example.com/hook", "country": "Ankara", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "no country", body: `{"url": "https://example.com/hook", "condition": {"field": "temp", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "unknown field", body: `{"url": "https://example.com/hook", "country": "Ankara", "condition": {"field": "mood", "op": "<", "value": 0}}`, want: http.StatusBadRequest},
+		{name: "unknown op", body: `{"url": "https://example.com/hook", "country": "Ankara", "condition": {"field": "temp", "op": "~", "value": 0}}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := webhookRequest(t, store, http.MethodPost, "/webhooks", "alice", tt.body); rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body)
+			}
+		})
+	}
+
+	list := func(key string) []webhook {
+		t.Helper()
+		rec := webhookRequest(t, store, http.MethodGet, "/webhooks", key, "")
+		var hooks []webhook
+		if err := json.Unmarshal(rec.Body.Bytes(), &hooks); err != nil {
+			t.Fatal(err)
+		}
+		return hooks
+	}
+	hooks := list("alice")
+	if len(hooks) != 1 {
+		t.Fatalf("alice has %d webhooks, want 1", len(hooks))
+	}
+	if hooks[0].Owner != "" {
+		t.Error("the owner is shown")
+	}
+	if got := list("bob"); len(got) != 0 {
+		t.Errorf("bob sees %d webhooks of alice", len(got))
+	}
+	if rec := webhookRequest(t, store, http.MethodDelete, "/webhooks/"+hooks[0].ID, "bob", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("bob deleting it got %d, want 404", rec.Code)
+	}
+	if rec := webhookRequest(t, store, http.MethodDelete, "/webhooks/"+hooks[0].ID, "alice", ""); rec.Code != http.StatusOK {
+		t.Errorf("alice deleting it got %d, want 200", rec.Code)
+	}
+	if got := list("alice"); len(got) != 0 {
+		t.Errorf("alice has %d webhooks after deleting hers", len(got))
+	}
+}
+
+// webhookReceiver answers deliveries with the statuses in order, the last
+// one from then on, and records the events.
+type webhookReceiver struct {
+	*httptest.Server
+	calls  atomic.Int64
+	events chan webhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, statuses ...int) *webhookReceiver {
+	t.Helper()
+	recv := &webhookReceiver{events: make(chan webhookEvent, 10)}
+	recv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(recv.calls.Add(1))
+		status := statuses[min(n, len(statuses))-1]
+		w.WriteHeader(status)
+		if status != http.StatusOK {
+			return
+		}
+		var event webhookEvent
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("event %q: %v", body, err)
+		}
+		recv.events <- event
+	}))
+	t.Cleanup(recv.Close)
+	return recv
+}
+
+// ankaraEntry is the cache entry of Ankara's weather at temp degrees.
+func ankaraEntry(t *testing.T, temp float64) []byte {
+	return testEntry(t, Weather{ResolvedAddress: "Ankara, Türkiye", Days: []Day{{Datetime: "2024-01-01", Temp: temp}}})
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	store := testWebhookStore(t)
+	recv := newWebhookReceiver(t, http.StatusOK)
+	wh := webhook{ID: "freeze", URL: recv.URL, Country: "Ankara", Condition: webhookCondition{Field: "temp", Op: "<", Value: 0}, CreatedAt: time.Now()}
+	if err := store.put(context.Background(), wh); err != nil {
+		t.Fatal(err)
+	}
+	cache, _ := newTestCache(t, testConfig(t))
+	d := newWebhookDispatcher(store, time.Millisecond)
+	// The receiver listens on loopback, which the dispatcher's own client
+	// refuses.
+	d.client = recv.Client()
+	cache.OnWrite(d.observe)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.run(ctx)
+		close(done)
+	}()
+
+	steps := []struct {
+		name      string
+		key       string
+		temp      float64
+		wantEvent bool
+	}{
+		{name: "condition not met", key: wh.cacheKey(), temp: 3},
+		{name: "condition starts to hold", key: wh.cacheKey(), temp: -4, wantEvent: true},
+		{name: "condition still holds", key: wh.cacheKey(), temp: -5},
+		{name: "other location", key: defaultQuery("Istanbul").cacheKey(), temp: -6},
+		{name: "condition stops holding", key: wh.cacheKey(), temp: 1},
+		{name: "condition holds again", key: wh.cacheKey(), temp: -1, wantEvent: true},
+	}
+	for _, step := range steps {
+		cache.Set(context.Background(), step.key, ankaraEntry(t, step.temp), time.Hour)
+		select {
+		case event := <-recv.events:
+			if !step.wantEvent {
+				t.Errorf("%s: got an event", step.name)
+			} else if event.Webhook != wh.ID || event.Value != step.temp || event.ResolvedAddress != "Ankara, Türkiye" {
+				t.Errorf("%s: event = %+v", step.name, event)
+			}
+		case <-time.After(200 * time.Millisecond):
+			if step.wantEvent {
+				t.Errorf("%s: no event", step.name)
+			}
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestWebhookRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantCalls int64
+		wantErr   bool
+	}{
+		{name: "delivered", statuses: []int{http.StatusOK}, wantCalls: 1},
+		{name: "recovers", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, wantCalls: 3},
+		{name: "keeps failing", statuses: []int{http.StatusInternalServerError}, wantCalls: webhookAttempts, wantErr: true},
+		{name: "refused", statuses: []int{http.StatusGone}, wantCalls: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv := newWebhookReceiver(t, tt.statuses...)
+			d := newWebhookDispatcher(nil, time.Millisecond)
+			d.client = recv.Client()
+			err := d.deliver(context.Background(), webhook{ID: "freeze", URL: recv.URL}, webhookEvent{Webhook: "freeze"})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("deliver() error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := recv.calls.Load(); got != tt.wantCalls {
+				t.Errorf("receiver called %d times, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestValidateWebhookAddresses(t *testing.T) {
+	stubWebhookHosts(t, map[string]string{"public.example.com": "8.8.8.8"})
+	tests := []struct {
+		url     string
+		wantErr bool
+	}{
+		{url: "https://public.example.com/hook"},
+		{url: "https://8.8.8.8/hook"},
+		{url: "http://127.0.0.1:6379/", wantErr: true},
+		{url: "http://[::1]:8080/admin/cache", wantErr: true},
+		{url: "http://169.254.169.254/latest/meta-data/", wantErr: true},
+		{url: "http://[fe80::1]/", wantErr: true},
+		{url: "http://10.1.2.3/", wantErr: true},
+		{url: "http://172.16.0.1/", wantErr: true},
+		{url: "http://192.168.1.1/", wantErr: true},
+		{url: "http://[fd00::1]/", wantErr: true},
+		{url: "http://0.0.0.0:8080/", wantErr: true},
+		{url: "http://[::]/", wantErr: true},
+		{url: "http://[::ffff:127.0.0.1]/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			wh := webhook{URL: tt.url, Country: "Ankara", Condition: webhookCondition{Field: "temp", Op: "<", Value: 0}}
+			if err := validateWebhook(context.Background(), wh); (err != nil) != tt.wantErr {
+				t.Errorf("validateWebhook() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// TestWebhookDialRefused sends an event to a receiver on loopback, as a
+// subscription whose host was rebound there after validation would, and
+// checks the dispatcher refuses to connect.
+func TestWebhookDialRefused(t *testing.T) {
+	recv := newWebhookReceiver(t, http.StatusOK)
+	d := newWebhookDispatcher(nil, time.Millisecond)
+	err := d.deliver(context.Background(), webhook{ID: "freeze", URL: recv.URL}, webhookEvent{Webhook: "freeze"})
+	if err == nil || !strings.Contains(err.Error(), "must not be sent") {
+		t.Errorf("deliver() error = %v, want the connection refused", err)
+	}
+	if got := recv.calls.Load(); got != 0 {
+		t.Errorf("receiver called %d times, want 0", got)
+	}
+}
+
+func TestWebhookSweep(t *testing.T) {
+	calls := stubProvider(t, 0, http.StatusOK)
+	store := testWebhookStore(t)
+	for _, country := range []string{"Ankara", "Istanbul"} {
+		wh := webhook{ID: country, URL: "https://example.com/hook", Country: country, Condition: webhookCondition{Field: "temp", Op: "<", Value: 0}}
+		store.put(context.Background(), wh)
+	}
+	cfg := testConfig(t)
+	cache, _ := newTestCache(t, cfg)
+	// Istanbul is fresh, so only Ankara needs a fetch.
+	now := time.Now()
+	data, _ := json.Marshal(testWeather)
+	entry, _ := json.Marshal(cacheEntry{FetchedAt: now, FreshUntil: now.Add(time.Hour), Payload: data})
+	cache.Set(context.Background(), defaultQuery("Istanbul").cacheKey(), entry, time.Hour)
+
+	sweepWebhooks(context.Background(), cache, newUpstreamBudget(0, 0, time.UTC, nil), store, cfg)
+	if got := calls.Load(); got != 1 {
+		t.Errorf("provider called %d times, want 1", got)
+	}
+	if _, ok := cache.Get(context.Background(), defaultQuery("Ankara").cacheKey()); !ok {
+		t.Error("Ankara was not fetched into the cache")
+	}
+}
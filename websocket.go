@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// wsWriteWait bounds every write to a socket. A socket is dropped when
+	// no pong comes back within wsPongWait, pings going out every
+	// wsPingInterval.
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = time.Minute
+	wsPingInterval = wsPongWait * 9 / 10
+	// wsReadLimit caps the messages clients send, which are only read to
+	// notice them leave.
+	wsReadLimit = 512
+)
+
+// weatherSocketHandler upgrades requests to a WebSocket that receives the
+// weather for the location at once, and again every time its cache entry is
+// refreshed, by this instance or a forced refresh on another one. Nothing
+// but refreshes triggers a fetch, so a socket costs no more upstream calls
+// than a cache hit.
+func weatherSocketHandler(cache *tieredCache, group *singleflight.Group, budget *upstreamBudget, cfg Config, streams *openStreams) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" || originAllowed(origin, cfg.CORSAllowedOrigins) {
+				return true
+			}
+			u, err := url.Parse(origin)
+			return err == nil && strings.EqualFold(u.Host, r.Host)
+		},
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		q, err := parseWeatherQuery(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, apiError{Code: "invalid_request", Message: err.Error()})
+			return
+		}
+		cacheKey := q.cacheKey()
+		// Watching starts before the first read so no refresh goes unseen.
+		updates, stop := cache.Watch(cacheKey)
+		defer stop()
+		payload, err := latestPayload(r.Context(), cache, group, budget, cfg, q)
+		if err != nil {
+			writeStreamError(w, r, err, budget)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has answered the request already.
+			logf(r.Context(), "Error upgrading to WebSocket : %v", err)
+			return
+		}
+		streams.open.Add(1)
+		defer streams.open.Done()
+		defer conn.Close()
+
+		// Reading handles the pongs and close frames, and notices the client
+		// leave.
+		gone := make(chan struct{})
+		conn.SetReadLimit(wsReadLimit)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		go func() {
+			defer close(gone)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		send := func(payload []byte) bool {
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				logf(r.Context(), "Error writing to WebSocket : %v", err)
+				return false
+			}
+			return true
+		}
+		if !send(payload) {
+			return
+		}
+		sent := payloadETag(payload)
+		ping := time.NewTicker(wsPingInterval)
+		defer ping.Stop()
+		for {
+			select {
+			case <-updates:
+				val, ok := cache.Get(r.Context(), cacheKey)
+				if !ok {
+					continue
+				}
+				entry, ok := decodeCacheEntry(val)
+				if !ok || entry.Status != 0 {
+					continue
+				}
+				etag := entry.ETag
+				if etag == "" {
+					etag = payloadETag(entry.Payload)
+				}
+				if etag == sent {
+					continue
+				}
+				if !send(entry.Payload) {
+					return
+				}
+				sent = etag
+			case <-ping.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+					return
+				}
+			case <-gone:
+				return
+			case <-streams.closing:
+				msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+				conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/sync/singleflight"
+)
+
+// dialWeatherSocket serves the socket handler, behind the middleware that
+// wraps every response, and connects to it for query.
+func dialWeatherSocket(t *testing.T, cache *tieredCache, streams *openStreams, query string) *websocket.Conn {
+	t.Helper()
+	var group singleflight.Group
+	h := weatherSocketHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), testConfig(t), streams)
+	mux := http.NewServeMux()
+	mux.Handle("/weather/ws", h)
+	server := httptest.NewServer(requestIDMiddleware(metricsMiddleware(gzipMiddleware(mux), mux, newHTTPMetrics())))
+	t.Cleanup(server.Close)
+	conn, res, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/weather/ws?"+query, http.Header{"Accept-Encoding": {"gzip"}})
+	if err != nil {
+		t.Fatalf("Dial() error = %v, response %+v", err, res)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// readWeather reads the next message off conn as weather.
+func readWeather(t *testing.T, conn *websocket.Conn) Weather {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	kind, data, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kind != websocket.TextMessage {
+		t.Errorf("message type = %d, want text", kind)
+	}
+	var weather Weather
+	if err := json.Unmarshal(data, &weather); err != nil {
+		t.Fatal(err)
+	}
+	return weather
+}
+
+func TestWeatherSocketPushesRefreshes(t *testing.T) {
+	cache, _ := newTestCache(t, testConfig(t))
+	key := defaultQuery("istanbul").cacheKey()
+	cache.Set(context.Background(), key, testEntry(t, testWeather), time.Hour)
+	conn := dialWeatherSocket(t, cache, newOpenStreams(), "country=istanbul")
+
+	if got := readWeather(t, conn); got.ResolvedAddress != testWeather.ResolvedAddress {
+		t.Errorf("first message is for %q, want %q", got.ResolvedAddress, testWeather.ResolvedAddress)
+	}
+	// Rewriting the same payload is not worth a message, changing it is.
+	cache.Set(context.Background(), key, testEntry(t, testWeather), time.Hour)
+	refreshed := testWeather
+	refreshed.Days = []Day{{Datetime: "2024-01-04", Temp: 12}}
+	cache.Set(context.Background(), key, testEntry(t, refreshed), time.Hour)
+	got := readWeather(t, conn)
+	if len(got.Days) != 1 || got.Days[0].Datetime != "2024-01-04" {
+		t.Errorf("update holds days %+v, want only 2024-01-04", got.Days)
+	}
+}
+
+func TestWeatherSocketClosesOnShutdown(t *testing.T) {
+	cache, _ := newTestCache(t, testConfig(t))
+	cache.Set(context.Background(), defaultQuery("istanbul").cacheKey(), testEntry(t, testWeather), time.Hour)
+	streams := newOpenStreams()
+	conn := dialWeatherSocket(t, cache, streams, "country=istanbul")
+	readWeather(t, conn)
+
+	streams.close()
+	streams.close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("ReadMessage() error = %v, want a going away close", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		streams.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the socket was still open after shutdown")
+	}
+}
+
+func TestWeatherSocketRefusals(t *testing.T) {
+	t.Setenv("API_KEY", "")
+	cache, _ := newTestCache(t, testConfig(t))
+	var group singleflight.Group
+	cache.Set(context.Background(), defaultQuery("ankara").cacheKey(), testEntry(t, testWeather), time.Hour)
+	h := weatherSocketHandler(cache, &group, newUpstreamBudget(0, 0, time.UTC, nil), testConfig(t), newOpenStreams())
+	tests := []struct {
+		name   string
+		url    string
+		origin string
+		want   int
+	}{
+		{name: "no location", url: "/weather/ws", want: http.StatusBadRequest},
+		{name: "not cached without API_KEY", url: "/weather/ws?country=istanbul", want: http.StatusServiceUnavailable},
+		{name: "other origin", url: "/weather/ws?country=ankara", origin: "https://elsewhere.example", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			r.Header.Set("Connection", "Upgrade")
+			r.Header.Set("Upgrade", "websocket")
+			r.Header.Set("Sec-WebSocket-Version", "13")
+			r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			h(rec, r)
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}